@@ -4,16 +4,27 @@
 package dbstat
 
 import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/measure/metrics"
 	"github.com/measure/mysql/tools"
@@ -25,60 +36,270 @@ type MysqlStat struct {
 	Metrics *MysqlStatMetrics //collection of metrics
 	m       *metrics.MetricContext
 	db      tools.MysqlDB //mysql connection
+	dbLock  sync.RWMutex  //held by Ping while it uses db, and by SetDB to replace it
 	wg      sync.WaitGroup
+	errLock sync.Mutex
+	errs    tools.GetterErrors //errors hit by each getter during the last Collect
+
+	formatLock   sync.Mutex //guards precision and units, which a reload changes while output is formatted
+	precision    int        //digits after the decimal point in formatted output
+	precisionSet bool
+	units        tools.Units //units of metrics tagged with one in formatted output
+
+	queryTimeout time.Duration //how long a query may run, see SetQueryTimeout
+	maxConns     int           //connections db may open, see SetMaxConnections
+
+	latencyLock sync.Mutex
+	latencies   map[string]time.Duration //how long each getter of the last Collect took
+	poolWaited  time.Duration            //time queries had waited for a connection at the last Collect
+
+	infoLock        sync.Mutex
+	replFilters     map[string]string //replication filters set on this slave, by SHOW SLAVE STATUS column
+	identity        ServerIdentity
+	source          ReplicationSource
+	replicas        []string          //hosts of the replicas connected at the last collection
+	role            string            //rolePrimary or roleReplica at the last collection, "" when unclear
+	binlogOff       bool              //log_bin was off at the last collection
+	closed          bool              //Close was called, see SetDB
+	lastUptime      uint64            //server uptime at the last collection, to notice restarts
+	lastApply       *applyPosition    //SQL thread position at the last collection, nil before the first
+	perfSchemaSlave bool              //SHOW SLAVE STATUS was refused, replication state comes from performance_schema
+	prevHistogram   map[int64]float64 //statements in each latency histogram bucket at the last collection
+
+	roleAware bool   //skip getters that don't apply to role
+	roleSet   string //role given with SetRole, "" to find it
+
+	tuner   *tools.ConcurrencyTuner //sets the connections used after each Collect, nil unless SetAutoConcurrency was called
+	sqlMode string                  //global sql_mode at the last collection
+
+	namespace string //set when several collectors share a metric context
+	target    string //user@host, for String
+
+	queryLock sync.Mutex
+	queries   map[string]string //queries set with SetQuery, by the query they replace
+
+	sampleInterval time.Duration //time between Threads_running samples
+	sampleWindow   time.Duration //how long to sample Threads_running for, 0 to turn off
+
+	timestamps     bool             //end graphite lines with the collection time
+	graphitePrefix string           //put before every graphite name, see SetGraphitePrefix
+	collectedAt    time.Time        //start of the last Collect
+	now            func() time.Time //clock for times relative to now, time.Now if nil
+
+	errorLogTail  bool   //report new entries from performance_schema.error_log
+	localBinlogs  bool   //read the oldest binary log's header, see SetLocalBinlogs
+	errorLogSince string //LOGGED time of the newest error log entry seen
+
+	corruptLogOff  bool            //performance_schema.error_log is missing
+	checkSchemas   []string        //schemas checked with CHECK TABLE, see SetCheckTables
+	backupTable    string          //table backups record their completion in, see SetBackupMarker
+	backupColumn   string          //timestamp column of backupTable
+	checkEvery     time.Duration   //time between CHECK TABLE runs
+	lastCheck      time.Time       //when CHECK TABLE last ran
+	checkedCorrupt map[string]bool //tables CHECK TABLE last found corrupt
+
+	rates *tools.CounterRates //per second counter rates, nil unless turned on
+
+	lagWindow *tools.Window //recent replication lag samples, nil unless turned on
+
+	master tools.MysqlDB //this replica's master, nil unless SetMaster was called
+
+	replicaConnect func(host string) (tools.MysqlDB, error) //connects to a replica, nil unless SetReplicaLag was called
+	replicaHosts   []string                                 //replicas to check, found from binlog dump threads when empty
+	replicaLimit   int                                      //replicas checked at once
+	replicaDBs     map[string]tools.MysqlDB                 //open replica connections, by host
+	replicaLag     map[string]*MysqlStatPerReplica          //replicas checked, by host
+
+	skipGetters map[string]bool //getters Collect doesn't run, see SetSkipGetters
+
+	workers  map[string]*MysqlStatPerWorker  //replication applier workers, by worker id
+	channels map[string]*MysqlStatPerChannel //named replication channels, by channel name
+	hosts    map[string]*MysqlStatPerHost    //client hosts with sessions open, by host
+	engines  map[string]*MysqlStatPerEngine  //storage engines that have tables, by engine
+	accounts map[string]*MysqlStatPerAccount //users with resource limits, by user
+
+	statements map[string]*MysqlStatPerStatement //statement summaries, by statement type
+
+	fingerprintTop int                                 //long running query fingerprints tracked, 0 to turn off
+	fingerprints   map[string]*MysqlStatPerFingerprint //long running queries, by fingerprint id
+
+	extraStatus     map[string]*metrics.Gauge //status variables set with SetExtraStatus, by name. replaced, never changed, under infoLock
+	extraStatusKeys []string                  //names in extraStatus, sorted
+	extraWarned     map[string]bool           //extra status variables already logged as unusable
+
+	namesLock sync.Mutex
+	names     *tools.NameSanitizer //builds metric name components from hosts, users and channels
+	promNames *tools.NameSanitizer //builds metric names in Prometheus output
 }
 
-// metrics being collected about the server/database
-type MysqlStatMetrics struct {
-	//GetSlave Stats
+// MysqlStatPerWorker - metrics for each multi-threaded replication worker
+type MysqlStatPerWorker struct {
+	AppliedTransactions *metrics.Counter
+	ServiceOn           *metrics.Gauge
+	Busy                *metrics.Gauge
+}
+
+// MysqlStatPerChannel - replication lag and position of one named
+// channel of multi-source replication
+type MysqlStatPerChannel struct {
 	SlaveSecondsBehindMaster *metrics.Gauge
 	SlaveSeqFile             *metrics.Gauge
 	SlavePosition            *metrics.Counter
-	ReplicationRunning       *metrics.Gauge
+}
+
+// MysqlStatPerFingerprint - long running queries of one shape, as
+// grouped by tools.Fingerprint
+type MysqlStatPerFingerprint struct {
+	Count   *metrics.Gauge
+	MaxTime *metrics.Gauge //seconds the longest of them has been running
+}
+
+// MysqlStatPerHost - metrics for each client host connected to the server
+type MysqlStatPerHost struct {
+	Sessions *metrics.Gauge
+}
+
+// MysqlStatPerEngine - tables using one storage engine
+type MysqlStatPerEngine struct {
+	TableCount *metrics.Gauge
+}
+
+// MysqlStatPerReplica - replication lag of a replica checked by SetReplicaLag
+type MysqlStatPerReplica struct {
+	SecondsBehindMaster *metrics.Gauge `unit:"s"` //-1 when not replicating or unreachable
+	Reachable           *metrics.Gauge
+}
+
+// MysqlStatPerAccount - resource limits of a user and how much of them is used
+type MysqlStatPerAccount struct {
+	MaxUserConnections *metrics.Gauge
+	MaxQuestions       *metrics.Gauge
+	Connections        *metrics.Gauge
+	ConnectionsPct     *metrics.Gauge //of MaxUserConnections
+}
+
+// MysqlStatPerStatement - totals for each type of SQL statement, e.g. select
+type MysqlStatPerStatement struct {
+	Count       *metrics.Counter
+	TimerWaitUs *metrics.Counter //total time spent running these statements
+}
+
+// ReplicationSource identifies the master a replica replicates from.
+// It is empty on a server that isn't a replica
+type ReplicationSource struct {
+	Host     string
+	Port     string
+	ServerID string
+}
+
+//a group of metrics and the prefix of their names in formatted output
+type metricSet struct {
+	name    string
+	metrics interface{} //pointer to a struct of metrics
+}
+
+// ServerIdentity identifies the server being monitored
+type ServerIdentity struct {
+	Hostname   string
+	Version    string
+	ServerID   string
+	ServerUUID string
+}
+
+// metrics being collected about the server/database
+type MysqlStatMetrics struct {
+	//GetSlave Stats
+	SlaveSecondsBehindMaster   *metrics.Gauge `unit:"s"`
+	SlaveSeqFile               *metrics.Gauge
+	SlavePosition              *metrics.Counter
+	ReplicationRunning         *metrics.Gauge
+	SlaveHasReplicationFilters *metrics.Gauge
+	SlaveSSLAllowed            *metrics.Gauge
+	SlaveAutoPosition          *metrics.Gauge
+	ReplicationChannelsTotal   *metrics.Gauge
+	ReplicationChannelsHealthy *metrics.Gauge
+	IsReplica                  *metrics.Gauge //unset while the role isn't clear, see SetRoleAware
+	SlaveLagP95                *metrics.Gauge `unit:"s"`
+	SlaveLagMax                *metrics.Gauge `unit:"s"`
+	SlaveIOLagBytes            *metrics.Gauge `unit:"bytes"` //master's binlog not yet read, needs SetMaster
+	SlaveSQLLagBytes           *metrics.Gauge `unit:"bytes"` //read from the master but not yet applied
+	RelayLogApplyQueueBytes    *metrics.Gauge `unit:"bytes"` //relay log written but not yet applied
+	SlaveApplyStalled          *metrics.Gauge //1 if the relay log grew but nothing was applied since the last collection
 
 	//GetGlobalStatus
-	BinlogCacheDiskUse        *metrics.Counter
-	BinlogCacheUse            *metrics.Counter
-	ComAlterTable             *metrics.Counter
-	ComBegin                  *metrics.Counter
-	ComCommit                 *metrics.Counter
-	ComCreateTable            *metrics.Counter
-	ComDelete                 *metrics.Counter
-	ComDeleteMulti            *metrics.Counter
-	ComDropTable              *metrics.Counter
-	ComInsert                 *metrics.Counter
-	ComInsertSelect           *metrics.Counter
-	ComReplace                *metrics.Counter
-	ComReplaceSelect          *metrics.Counter
-	ComRollback               *metrics.Counter
-	ComSelect                 *metrics.Counter
-	ComUpdate                 *metrics.Counter
-	ComUpdateMulti            *metrics.Counter
-	CreatedTmpDiskTables      *metrics.Counter
-	CreatedTmpFiles           *metrics.Counter
-	CreatedTmpTables          *metrics.Counter
-	InnodbCurrentRowLocks     *metrics.Gauge
-	InnodbLogOsWaits          *metrics.Gauge
-	InnodbRowLockCurrentWaits *metrics.Gauge
-	InnodbRowLockTimeAvg      *metrics.Gauge
-	InnodbRowLockTimeMax      *metrics.Counter
-	PreparedStmtCount         *metrics.Gauge
-	PreparedStmtPct           *metrics.Gauge
-	Queries                   *metrics.Counter
-	SortMergePasses           *metrics.Counter
-	ThreadsConnected          *metrics.Gauge
-	Uptime                    *metrics.Counter
-	ThreadsRunning            *metrics.Gauge
+	AbortedClients                 *metrics.Counter //includes connections closed by wait_timeout
+	BinlogCacheDiskUse             *metrics.Counter
+	BinlogCacheUse                 *metrics.Counter
+	ComAdminCommands               *metrics.Counter
+	ComAlterTable                  *metrics.Counter
+	ComBegin                       *metrics.Counter
+	ComChangeDb                    *metrics.Counter
+	ComCommit                      *metrics.Counter
+	ComCreateTable                 *metrics.Counter
+	ComDelete                      *metrics.Counter
+	ComDeleteMulti                 *metrics.Counter
+	ComDropTable                   *metrics.Counter
+	ComInsert                      *metrics.Counter
+	ComInsertSelect                *metrics.Counter
+	ComKill                        *metrics.Counter
+	ComReplace                     *metrics.Counter
+	ComReplaceSelect               *metrics.Counter
+	ComRollback                    *metrics.Counter
+	ComSelect                      *metrics.Counter
+	ComSetOption                   *metrics.Counter
+	ComStmtFetch                   *metrics.Counter //rows fetched with server side cursors
+	ComUpdate                      *metrics.Counter
+	ComUpdateMulti                 *metrics.Counter
+	ConnectionErrorsAccept         *metrics.Counter
+	ConnectionErrorsInternal       *metrics.Counter
+	ConnectionErrorsMaxConnections *metrics.Counter
+	ConnectionErrorsPeerAddress    *metrics.Counter
+	ConnectionErrorsSelect         *metrics.Counter
+	ConnectionErrorsTcpwrap        *metrics.Counter
+	CreatedTmpDiskTables           *metrics.Counter
+	CreatedTmpFiles                *metrics.Counter
+	CreatedTmpTables               *metrics.Counter
+	CreatedTmpDiskTablesRatio      *metrics.Gauge //share of internal temporary tables since startup created on disk
+	HandlerCommit                  *metrics.Counter
+	HandlerRollback                *metrics.Counter
+	InnodbAvailableUndoLogs        *metrics.Gauge //5.7 and earlier
+	InnodbBufferPoolPagesLatched   *metrics.Gauge //debug builds only
+	InnodbBufpoolLoadInProgress    *metrics.Gauge //1 while the buffer pool is loaded from a dump, as after a restart
+	InnodbBufpoolLoadPct           *metrics.Gauge //pages of the dump loaded so far
+	InnodbCurrentRowLocks          *metrics.Gauge
+	InnodbDataFsyncs               *metrics.Counter
+	InnodbDataPendingFsyncs        *metrics.Gauge
+	InnodbDblwrWrites              *metrics.Counter
+	InnodbDblwrPagesWritten        *metrics.Counter
+	InnodbLogOsWaits               *metrics.Gauge
+	InnodbRowLockCurrentWaits      *metrics.Gauge
+	InnodbRowLockTimeAvg           *metrics.Gauge `unit:"ms"`
+	InnodbRowLockTimeMax           *metrics.Counter
+	PreparedStmtCount              *metrics.Gauge
+	PreparedStmtPct                *metrics.Gauge
+	Queries                        *metrics.Counter
+	RollbackRatio                  *metrics.Gauge //share of storage engine transactions since startup rolled back
+	SelectRange                    *metrics.Counter
+	SortMergePasses                *metrics.Counter
+	SslServerCertExpirySeconds     *metrics.Gauge `unit:"s"` //negative once the certificate has expired
+	TableLocksImmediate            *metrics.Counter
+	TableLocksWaited               *metrics.Counter
+	TableLockContentionRatio       *metrics.Gauge
+	ThreadsConnected               *metrics.Gauge
+	Uptime                         *metrics.Counter
+	UptimeSinceFlushStatus         *metrics.Gauge `unit:"s"`
+	ThreadsRunning                 *metrics.Gauge
 
 	//GetOldestQueryS
-	OldestQueryS *metrics.Gauge
+	OldestQueryS *metrics.Gauge `unit:"s"`
 
 	//GetOldestTrxS
-	OldestTrxS *metrics.Gauge
+	OldestTrxS *metrics.Gauge `unit:"s"`
 
 	//BinlogFiles
-	BinlogFiles *metrics.Gauge
-	BinlogSize  *metrics.Gauge
+	BinlogFiles            *metrics.Gauge
+	BinlogSize             *metrics.Gauge `unit:"bytes"`
+	OldestBinlogAgeSeconds *metrics.Gauge `unit:"s"`
 
 	//GetNumLongRunQueries
 	ActiveLongRunQueries *metrics.Gauge
@@ -92,7 +313,7 @@ type MysqlStatMetrics struct {
 
 	//GetStackedQueries
 	IdenticalQueriesStacked *metrics.Gauge
-	IdenticalQueriesMaxAge  *metrics.Gauge
+	IdenticalQueriesMaxAge  *metrics.Gauge `unit:"s"`
 
 	//GetSessions
 	ActiveSessions          *metrics.Gauge
@@ -103,35 +324,44 @@ type MysqlStatMetrics struct {
 	MaxConnections          *metrics.Gauge
 	SessionTablesLocks      *metrics.Gauge
 	SessionGlobalReadLocks  *metrics.Gauge
+	SessionBackupLockWaits  *metrics.Gauge
 	SessionsCopyingToTable  *metrics.Gauge
 	SessionsStatistics      *metrics.Gauge
+	ConnectedReplicas       *metrics.Gauge
 	UnauthenticatedSessions *metrics.Gauge
 
 	//GetInnodbStats
 	OSFileReads                   *metrics.Gauge
 	OSFileWrites                  *metrics.Gauge
 	AdaptiveHash                  *metrics.Gauge
-	AvgBytesPerRead               *metrics.Gauge
+	AvgBytesPerRead               *metrics.Gauge `unit:"bytes"`
 	BufferPoolHitRate             *metrics.Gauge
 	BufferPoolSize                *metrics.Gauge
 	CacheHitPct                   *metrics.Gauge
-	InnodbCheckpointAge           *metrics.Gauge
-	InnodbCheckpointAgeTarget     *metrics.Gauge
+	InnodbCheckpointAge           *metrics.Gauge `unit:"bytes"`
+	InnodbCheckpointAgeTarget     *metrics.Gauge `unit:"bytes"`
+	InnodbCheckpointAgePct        *metrics.Gauge
 	DatabasePages                 *metrics.Gauge
 	DictionaryCache               *metrics.Gauge
 	DictionaryMemoryAllocated     *metrics.Gauge
 	FileSystem                    *metrics.Gauge
 	FreeBuffers                   *metrics.Gauge
 	FsyncsPerSec                  *metrics.Gauge
+	PendingFsyncsLog              *metrics.Gauge
+	PendingFsyncsBufferPool       *metrics.Gauge
 	InnodbHistoryLinkList         *metrics.Gauge
 	InnodbLastCheckpointAt        *metrics.Gauge
 	LockSystem                    *metrics.Gauge
 	InnodbLogFlushedUpTo          *metrics.Gauge
 	LogIOPerSec                   *metrics.Gauge
 	InnodbLogSequenceNumber       *metrics.Gauge
-	InnodbMaxCheckpointAge        *metrics.Gauge
-	InnodbModifiedAge             *metrics.Gauge
+	InnodbMaxCheckpointAge        *metrics.Gauge `unit:"bytes"`
+	InnodbModifiedAge             *metrics.Gauge `unit:"bytes"`
+	InnodbModifiedAgePct          *metrics.Gauge
 	ModifiedDBPages               *metrics.Gauge
+	InnodbLRUListLength           *metrics.Gauge
+	InnodbFlushListLength         *metrics.Gauge
+	InnodbOldestModifiedPageAge   *metrics.Gauge `unit:"bytes"`
 	OldDatabasePages              *metrics.Gauge
 	PageHash                      *metrics.Gauge
 	PagesFlushedUpTo              *metrics.Gauge
@@ -171,16 +401,208 @@ type MysqlStatMetrics struct {
 	QueryResponseSec10000_   *metrics.Counter
 	QueryResponseSec100000_  *metrics.Counter
 	QueryResponseSec1000000_ *metrics.Counter
+
+	//GetSchemaObjects
+	Routines      *metrics.Gauge
+	Triggers      *metrics.Gauge
+	Events        *metrics.Gauge
+	EventsEnabled *metrics.Gauge
+
+	//GetServerIdentity
+	ServerID *metrics.Gauge
+
+	//GetAccounts
+	UserAccounts    *metrics.Gauge
+	LockedAccounts  *metrics.Gauge
+	ExpiredAccounts *metrics.Gauge
+
+	//GetGlobalReadLock
+	GlobalReadLockHeld *metrics.Gauge
+
+	//GetDDLOperations
+	ActiveDDLOperations *metrics.Gauge
+	OldestDDLAgeSec     *metrics.Gauge `unit:"s"`
+
+	//GetThreadsRunningSamples
+	ThreadsRunningMax *metrics.Gauge
+	ThreadsRunningAvg *metrics.Gauge
+	ThreadsRunningP95 *metrics.Gauge
+
+	//GetRecentErrorLog
+	RecentErrorLogEntries *metrics.Gauge
+
+	//GetReplicationWorkers
+	SlaveWorkersBusy *metrics.Gauge
+	SlaveWorkersIdle *metrics.Gauge
+
+	//GetTempTables
+	SlaveOpenTempTables  *metrics.Gauge
+	InnodbTempTables     *metrics.Gauge
+	TempTableMemoryBytes *metrics.Gauge `unit:"bytes"` //internal temporary tables in memory right now, 8.0 and later
+	TempTableDiskBytes   *metrics.Gauge `unit:"bytes"` //internal temporary tables spilled to disk right now, 8.0.23 and later
+
+	//GetUndoTablespaces
+	UndoTablespaces           *metrics.Gauge
+	UndoTablespaceBytes       *metrics.Gauge `unit:"bytes"`
+	UndoTablespacesTruncating *metrics.Gauge
+
+	//GetUndoLogs, from innodb_metrics counters that are enabled
+	UndoRsegCurrentPages *metrics.Gauge   //pages in use by rollback segments
+	UndoTruncations      *metrics.Counter //undo tablespace truncations since startup
+	UndoTruncationActive *metrics.Gauge
+
+	//GetBufferPoolLRU
+	InnodbPagesMadeYoung          *metrics.Counter
+	InnodbPagesMadeNotYoung       *metrics.Counter
+	InnodbYoungPerThousandGets    *metrics.Gauge
+	InnodbNotYoungPerThousandGets *metrics.Gauge
+
+	//GetTLSConnections
+	TlsConnectionsPct *metrics.Gauge
+
+	//GetThreadPool
+	ThreadpoolThreads        *metrics.Gauge
+	ThreadpoolIdleThreads    *metrics.Gauge
+	ThreadpoolActiveThreads  *metrics.Gauge
+	ThreadpoolQueuedRequests *metrics.Gauge
+
+	//GetOldestTrxOwner
+	OldestTrxRowsModified *metrics.Gauge
+
+	//GetSemiSync
+	SemiSyncMasterStatus *metrics.Gauge
+	SemiSyncSlaveStatus  *metrics.Gauge
+	SemiSyncMasterYesTx  *metrics.Counter
+	SemiSyncMasterNoTx   *metrics.Counter
+
+	//GetRedoLog
+	InnodbRedoLogCapacityBytes *metrics.Gauge `unit:"bytes"`
+	InnodbRedoLogUsedBytes     *metrics.Gauge `unit:"bytes"`
+	InnodbRedoLogUsedPct       *metrics.Gauge
+
+	//GetAccountLimits
+	AccountsNearConnectionLimit *metrics.Gauge
+
+	//GetSqlMode
+	StrictSqlMode *metrics.Gauge
+
+	//connection pool of the collector itself, read at the end of Collect.
+	// waits mean getters queued for one of the pool's connections
+	CollectorPoolInUse        *metrics.Gauge
+	CollectorPoolIdle         *metrics.Gauge
+	CollectorPoolWaitCount    *metrics.Counter
+	CollectorPoolWaitDuration *metrics.Counter //milliseconds
+
+	//the collector process itself, read at the end of Collect, so a
+	// goroutine or memory leak shows up in long running server mode
+	CollectorGoroutines *metrics.Gauge
+	CollectorHeapBytes  *metrics.Gauge `unit:"bytes"`
+
+	//set at the end of every Collect, even one where every query failed:
+	// how long it took, and the getters that failed in all collections
+	// so far, one per getter per collection however many of its queries
+	// failed. errors a getter tolerates, e.g. a table the server
+	// version doesn't have, aren't counted
+	CollectDurationMs   *metrics.Gauge
+	CollectGetterErrors *metrics.Counter
+	//set by the caller sending graphite output with a tools.GraphiteSink:
+	// lines dropped because carbon couldn't be reached for too long
+	GraphiteDroppedLines *metrics.Counter
+
+	//GetSkipCounter
+	SlaveSkipCounterActive *metrics.Gauge
+
+	//GetDataDirUsage
+	DataDirFreeBytes  *metrics.Gauge `unit:"bytes"`
+	DataDirTotalBytes *metrics.Gauge `unit:"bytes"`
+
+	//GetCorruptTables
+	CorruptTablesCount *metrics.Gauge
+
+	//GetBinlogSettings
+	BinlogFormat              *metrics.Gauge //1 STATEMENT, 2 MIXED, 3 ROW
+	BinlogRowImage            *metrics.Gauge //1 FULL, 2 MINIMAL, 3 NOBLOB
+	LogSlaveUpdates           *metrics.Gauge
+	SyncBinlog                *metrics.Gauge //commits between binlog syncs, 0 leaves it to the OS
+	InnodbFlushLogAtTrxCommit *metrics.Gauge //1 flushes the redo log at every commit, 0 and 2 about once a second
+
+	//GetStatementSummary, over every statement type
+	StatementsNoIndexUsed     *metrics.Counter //statements that scanned a table without using an index
+	StatementsNoGoodIndexUsed *metrics.Counter //statements that found no good index to use
+	StatementsRowsExamined    *metrics.Counter //rows read by statements, including ones filtered out
+	StatementsRowsSent        *metrics.Counter //rows statements returned to clients
+	RowsExaminedPerSent       *metrics.Gauge   //rows examined for each row sent since startup
+
+	//GetCloneStatus, for the last clone this server received
+	CloneInProgress  *metrics.Gauge
+	CloneState       *metrics.Gauge //0 Not Started, 1 In Progress, 2 Completed, 3 Failed
+	CloneProgressPct *metrics.Gauge //share of the estimated data copied so far
+
+	//GetClusterStatus, for Group Replication or Galera
+	ClusterType          *metrics.Gauge //0 standalone, 1 Group Replication, 2 Galera
+	ClusterMembers       *metrics.Gauge
+	ClusterMembersOnline *metrics.Gauge
+	ClusterMemberState   *metrics.Gauge //this node's state: 1 ONLINE, 2 RECOVERING, 3 OFFLINE, 4 ERROR, 5 UNREACHABLE
+	ClusterMemberOnline  *metrics.Gauge //1 if this node is ONLINE, or Synced for Galera
+	ClusterQuorum        *metrics.Gauge //1 if the node is in the primary component, which has a majority of members
+
+	//GetPerfSchemaMemory
+	PerfSchemaMemoryBytes *metrics.Gauge `unit:"bytes"` //memory performance_schema itself is using
+
+	//GetBackupAge
+	LastBackupAgeSeconds *metrics.Gauge `unit:"s"`
+
+	//GetDataLocks, InnoDB row and table locks by mode, from 8.0
+	DataLocksGrantedS  *metrics.Gauge
+	DataLocksGrantedX  *metrics.Gauge
+	DataLocksGrantedIS *metrics.Gauge
+	DataLocksGrantedIX *metrics.Gauge
+	DataLocksWaitingS  *metrics.Gauge
+	DataLocksWaitingX  *metrics.Gauge
+	DataLocksWaitingIS *metrics.Gauge
+	DataLocksWaitingIX *metrics.Gauge
+	DataLockWaits      *metrics.Gauge //lock requests waiting on a lock another transaction holds
+
+	//GetStatementLatency, over statements completed since the last
+	// collection, from 8.0
+	StatementLatencyP95Ms *metrics.Gauge `unit:"ms"`
+	StatementLatencyP99Ms *metrics.Gauge `unit:"ms"`
+
+	//GetActiveTrxAges, transactions open longer than each age
+	ActiveTrxOver1s   *metrics.Gauge
+	ActiveTrxOver10s  *metrics.Gauge
+	ActiveTrxOver60s  *metrics.Gauge
+	ActiveTrxOver300s *metrics.Gauge
 }
 
 const (
-	slaveQuery  = "SHOW SLAVE STATUS;"
+	slaveQuery = "SHOW SLAVE STATUS;"
+	roleQuery  = "SELECT @@global.read_only AS read_only, @@global.log_bin AS log_bin;"
+	//8.0.22+, with Replica_ and Source_ in place of Slave_ and Master_
+	replicaQuery = "SHOW REPLICA STATUS;"
+	//the replication state SHOW SLAVE STATUS reports, from tables SELECT
+	// on performance_schema can read without REPLICATION CLIENT. lag is
+	// how long ago the oldest transaction being applied was committed on
+	// the master, 0 when nothing is being applied. 8.0 only
+	perfSchemaSlaveQuery = `
+  SELECT c.channel_name, cc.host, cc.port,
+         c.service_state AS io_state, a.service_state AS sql_state,
+         (SELECT COALESCE(MAX(TIMESTAMPDIFF(SECOND, w.applying_transaction_original_commit_timestamp, NOW(6))), 0)
+            FROM performance_schema.replication_applier_status_by_worker w
+           WHERE w.channel_name = c.channel_name AND w.applying_transaction <> '') AS lag
+    FROM performance_schema.replication_connection_status c
+    JOIN performance_schema.replication_applier_status a ON a.channel_name = c.channel_name
+    LEFT JOIN performance_schema.replication_connection_configuration cc ON cc.channel_name = c.channel_name
+   ORDER BY c.channel_name;`
 	oldestQuery = `
  SELECT time FROM information_schema.processlist
   WHERE command NOT IN ('Sleep','Connect','Binlog Dump')
   ORDER BY time DESC LIMIT 1;`
 	oldestTrx = `
   SELECT UNIX_TIMESTAMP(NOW()) - UNIX_TIMESTAMP(MIN(trx_started)) AS time 
+    FROM information_schema.innodb_trx;`
+	trxAgesQuery = `
+  SELECT TIMESTAMPDIFF(SECOND, trx_started, NOW()) AS age
     FROM information_schema.innodb_trx;`
 	responseTimeQuery         = "SELECT time, count FROM INFORMATION_SCHEMA.QUERY_RESPONSE_TIME;"
 	binlogQuery               = "SHOW MASTER LOGS;"
@@ -212,635 +634,4599 @@ const (
            processlist.*
       FROM information_schema.processlist
      ORDER BY 1, time DESC;`
-	innodbQuery      = "SHOW GLOBAL VARIABLES LIKE 'innodb_log_file_size';"
+	innodbQuery       = "SHOW GLOBAL VARIABLES LIKE 'innodb_log_file_size';"
+	redoCapacityQuery = `
+SHOW GLOBAL VARIABLES
+ WHERE Variable_name IN ('innodb_log_file_size', 'innodb_log_files_in_group', 'innodb_redo_log_capacity');`
+	//8.0.30+, the capacity in effect while a resize is still under way
+	redoResizedQuery = "SHOW GLOBAL STATUS LIKE 'Innodb_redo_log_capacity_resized';"
+	redoFilesQuery   = `
+  SELECT COALESCE(SUM(end_lsn - start_lsn), 0) AS used
+    FROM performance_schema.innodb_redo_log_files;`
 	securityQuery    = "SELECT user FROM mysql.user WHERE password = '' AND ssl_type = '';"
 	slaveBackupQuery = `
 SELECT COUNT(*) as count
   FROM information_schema.processlist 
  WHERE user LIKE '%backup%';`
-	defaultMaxConns = 5
+	routinesQuery = `
+  SELECT COUNT(*) AS count
+    FROM information_schema.routines
+   WHERE routine_schema NOT IN ('mysql', 'sys', 'information_schema', 'performance_schema');`
+	triggersQuery = `
+  SELECT COUNT(*) AS count
+    FROM information_schema.triggers
+   WHERE trigger_schema NOT IN ('mysql', 'sys', 'information_schema', 'performance_schema');`
+	eventsQuery = `
+  SELECT COUNT(*) AS count,
+         COALESCE(SUM(status = 'ENABLED'), 0) AS enabled
+    FROM information_schema.events;`
+	identityQuery = `
+  SELECT @@hostname AS hostname, @@version AS version,
+         @@server_id AS server_id, @@server_uuid AS server_uuid;`
+	accountsQuery       = "SELECT COUNT(*) AS count FROM mysql.user;"
+	lockedAccountsQuery = `
+  SELECT COALESCE(SUM(account_locked = 'Y'), 0) AS locked,
+         COALESCE(SUM(password_expired = 'Y'), 0) AS expired
+    FROM mysql.user;`
+	//FLUSH TABLES WITH READ LOCK holds a shared global lock,
+	// LOCK INSTANCE FOR BACKUP holds the backup lock
+	globalReadLockQuery = `
+  SELECT COUNT(*) AS locks
+    FROM performance_schema.metadata_locks
+   WHERE lock_status = 'GRANTED'
+     AND ((object_type = 'GLOBAL' AND lock_type = 'SHARED')
+          OR object_type = 'BACKUP LOCK');`
+	ddlStagesQuery = `
+  SELECT COUNT(*) AS ddl, COALESCE(MAX(t.processlist_time), 0) AS oldest
+    FROM performance_schema.events_stages_current s
+    JOIN performance_schema.threads t ON t.thread_id = s.thread_id
+   WHERE s.event_name LIKE 'stage/innodb/alter%'
+      OR s.event_name IN ('stage/sql/altering table', 'stage/sql/copy to tmp table');`
+	ddlProcesslistQuery = `
+  SELECT COUNT(*) AS ddl, COALESCE(MAX(time), 0) AS oldest
+    FROM information_schema.processlist
+   WHERE command = 'Query'
+     AND (state LIKE '%alter%' OR state = 'copy to tmp table');`
+	threadsRunningQuery = "SHOW GLOBAL STATUS LIKE 'Threads_running';"
+	errorLogMarkQuery   = "SELECT MAX(logged) AS logged FROM performance_schema.error_log;"
+	//workers waiting on the coordinator have nothing to apply
+	replicationWorkersQuery = `
+  SELECT w.worker_id AS worker, w.service_state AS state,
+         t.processlist_state AS thread_state, tx.count_star AS transactions
+    FROM performance_schema.replication_applier_status_by_worker w
+    LEFT JOIN performance_schema.threads t ON t.thread_id = w.thread_id
+    LEFT JOIN performance_schema.events_transactions_summary_by_thread_by_event_name tx
+           ON tx.thread_id = w.thread_id AND tx.event_name = 'transaction';`
+	workerIdleState = "Waiting for an event from Coordinator"
+	//slave_parallel_workers can't be set higher
+	maxReplicationWorkers = 1024
+	//client hosts beyond this are not tracked, to bound the number of metrics
+	maxSessionHosts    = 256
+	replicaHostsQuery  = "SELECT host FROM information_schema.processlist WHERE command IN ('Binlog Dump', 'Binlog Dump GTID');"
+	maxReplicaHosts    = 64
+	accountLimitsQuery = `
+  SELECT user, max_user_connections, max_questions
+    FROM mysql.user
+   WHERE max_user_connections > 0 OR max_questions > 0;`
+	userConnectionsQuery = `
+  SELECT user, COUNT(*) AS connections
+    FROM information_schema.processlist
+   GROUP BY user;`
+	//users with limits beyond this are not tracked
+	maxLimitedAccounts = 256
+	//accounts using this share of their connection limit are near it
+	accountLimitNearPct   = 90
+	slaveTempTablesQuery  = "SHOW GLOBAL STATUS LIKE 'Slave_open_temp_tables';"
+	innodbTempTablesQuery = "SELECT COUNT(*) AS tables FROM information_schema.innodb_temp_table_info;"
+	//memory the TempTable engine holds for internal temporary tables, in
+	// RAM and in files once they outgrow temptable_max_ram
+	tempTableMemoryQuery = `
+  SELECT event_name, current_number_of_bytes_used AS bytes
+    FROM performance_schema.memory_summary_global_by_event_name
+   WHERE event_name IN ('memory/temptable/physical_ram', 'memory/temptable/physical_disk');`
+	//bucket_timer_high is in picoseconds
+	statementHistogramQuery = `
+  SELECT bucket_number, bucket_timer_high, count_bucket
+    FROM performance_schema.events_statements_histogram_global
+   WHERE count_bucket > 0
+   ORDER BY bucket_number;`
+	//lock_mode is the mode followed by its flags, e.g. X,REC_NOT_GAP
+	dataLocksQuery = `
+  SELECT lock_mode, lock_status, COUNT(*) AS locks
+    FROM performance_schema.data_locks
+   GROUP BY lock_mode, lock_status;`
+	dataLockWaitsQuery = "SELECT COUNT(*) AS waits FROM performance_schema.data_lock_waits;"
+	//tables of the system schemas are left out, they use their own engines
+	tableEnginesQuery = `
+  SELECT engine, COUNT(*) AS tables
+    FROM information_schema.tables
+   WHERE table_schema NOT IN ('performance_schema', 'information_schema', 'mysql', 'sys')
+     AND table_type = 'BASE TABLE' AND engine IS NOT NULL
+   GROUP BY engine;`
+	//undo tablespaces are listed from 8.0, earlier servers don't have space_type
+	undoTablespacesQuery = `
+  SELECT name, file_size, state
+    FROM information_schema.innodb_tablespaces
+   WHERE space_type = 'Undo';`
+	//most of these counters are disabled unless innodb_monitor_enable
+	// turns them on
+	undoMetricsQuery = `
+  SELECT name, count
+    FROM information_schema.innodb_metrics
+   WHERE status = 'enabled'
+     AND name IN ('trx_rseg_current_size', 'undo_truncate_count',
+                  'undo_truncate_start_logging_count', 'undo_truncate_done_logging_count');`
+	binlogBasenameQuery = "SELECT @@log_bin_basename AS basename;"
+	binlogMagic         = "\xfebin"
+	//one row per buffer pool instance
+	bufferPoolLRUQuery = `
+  SELECT pages_made_young, pages_not_made_young,
+         young_make_per_thousand_gets, not_young_make_per_thousand_gets
+    FROM information_schema.innodb_buffer_pool_stats;`
+	bufferPoolLRUStatusQuery = "SHOW GLOBAL STATUS LIKE 'Innodb_buffer_pool_pages_made%';"
+	//only SQL statements, which have a fixed set of types, that have run
+	statementSummaryQuery = `
+  SELECT event_name, count_star, sum_timer_wait, sum_no_index_used, sum_no_good_index_used,
+         sum_rows_examined, sum_rows_sent
+    FROM performance_schema.events_statements_summary_global_by_event_name
+   WHERE event_name LIKE 'statement/sql/%' AND count_star > 0;`
+	//there are fewer statement types than this
+	maxStatementTypes = 512
+	//threads of connections using TLS have an Ssl_version
+	tlsConnectionsQuery = `
+  SELECT COUNT(*) AS connections, COALESCE(SUM(variable_value <> ''), 0) AS tls
+    FROM performance_schema.status_by_thread
+   WHERE variable_name = 'Ssl_version';`
+	tlsAcceptsQuery       = "SHOW GLOBAL STATUS WHERE variable_name IN ('Ssl_accepts', 'Connections');"
+	threadPoolStatusQuery = "SHOW GLOBAL STATUS LIKE 'Threadpool%';"
+	semiSyncQuery         = "SHOW GLOBAL STATUS LIKE 'Rpl_semi_sync%';"
+	threadPoolQueueQuery  = "SELECT SUM(queue_length) AS queued FROM information_schema.THREAD_POOL_GROUPS;"
+	sqlModeQuery          = "SELECT @@global.sql_mode AS sql_mode;"
+	skipCounterQuery      = "SELECT @@global.sql_slave_skip_counter AS skip_counter;"
+	dataDirQuery          = "SELECT @@datadir AS datadir;"
+	binlogSettingsQuery   = `
+  SELECT @@global.binlog_format AS binlog_format, @@global.binlog_row_image AS binlog_row_image,
+         @@global.log_slave_updates AS log_slave_updates, @@global.sync_binlog AS sync_binlog,
+         @@global.innodb_flush_log_at_trx_commit AS innodb_flush_log_at_trx_commit;`
+	//clone_status has a row for the last clone this server received, and
+	// clone_progress a row per stage of it
+	cloneStatusQuery = `
+  SELECT s.state AS state, COALESCE(SUM(p.data), 0) AS data, COALESCE(SUM(p.estimate), 0) AS estimate
+    FROM performance_schema.clone_status s
+    LEFT JOIN performance_schema.clone_progress p ON p.id = s.id
+   GROUP BY s.id, s.state;`
+	//8.0 has a row with an empty member_id when Group Replication isn't
+	// configured
+	groupMembersQuery = `
+  SELECT member_id, member_state, member_id = @@global.server_uuid AS self
+    FROM performance_schema.replication_group_members;`
+	//the memory/performance_schema/ instruments count what
+	// performance_schema allocates for its own tables and buffers
+	perfSchemaMemoryQuery = `
+  SELECT event_name, current_number_of_bytes_used AS bytes
+    FROM performance_schema.memory_summary_global_by_event_name
+   WHERE event_name LIKE 'memory/performance_schema/%';`
+	wsrepStatusQuery = "SHOW GLOBAL STATUS LIKE 'wsrep_%';"
+	corruptLogQuery  = `
+  SELECT data FROM performance_schema.error_log
+   WHERE data LIKE '%corrupt%' OR data LIKE '%crashed%';`
+	oldestTrxOwnerQuery = `
+  SELECT t.trx_id, TIMESTAMPDIFF(SECOND, t.trx_started, NOW()) AS age,
+         t.trx_state, t.trx_rows_modified, t.trx_mysql_thread_id AS thread_id,
+         th.processlist_user AS user, th.processlist_host AS host, t.trx_query AS query
+    FROM information_schema.innodb_trx t
+    LEFT JOIN performance_schema.threads th ON th.processlist_id = t.trx_mysql_thread_id
+   ORDER BY t.trx_started
+   LIMIT 10;`
+	//transactions open longer than this are logged with their owner
+	oldestTrxLogSec = 60
+	//longest query text logged for the oldest transaction
+	maxLoggedQueryLen = 256
+	defaultMaxConns   = 5
+	//collections measured before SetAutoConcurrency changes the connections used
+	autoConcurrencyWindow = 3
+
+	//digits after the decimal point used when formatting non-integer values
+	defaultFormatPrecision = 5
+
+	rolePrimary = "primary"
+	roleReplica = "replica"
+
+	//how OpenSSL prints certificate dates, as in Ssl_server_not_after
+	sslTimeLayout = "Jan _2 15:04:05 2006 MST"
 )
 
+//main query run by each getter, which SetQuery can replace
+var getterQueries = map[string]string{
+	"GetAccountLimits":     accountLimitsQuery,
+	"GetAccounts":          accountsQuery,
+	"GetActiveTrxAges":     trxAgesQuery,
+	"GetBinlogFiles":       binlogQuery,
+	"GetBinlogSettings":    binlogSettingsQuery,
+	"GetBinlogStats":       binlogStatsQuery,
+	"GetBufferPoolLRU":     bufferPoolLRUQuery,
+	"GetCloneStatus":       cloneStatusQuery,
+	"GetClusterStatus":     groupMembersQuery,
+	"GetCorruptTables":     corruptLogQuery,
+	"GetDataDirUsage":      dataDirQuery,
+	"GetDataLocks":         dataLocksQuery,
+	"GetGlobalReadLock":    globalReadLockQuery,
+	"GetGlobalStatus":      globalStatsQuery,
+	"GetNumLongRunQueries": longQuery,
+	"GetOldestQuery":       oldestQuery,
+	"GetOldestTrx":         oldestTrx,
+	"GetOldestTrxOwner":    oldestTrxOwnerQuery,
+	"GetPerfSchemaMemory":  perfSchemaMemoryQuery,
+	"GetQueryResponseTime": responseTimeQuery,
+	"GetRedoLog":           redoCapacityQuery,
+	"GetReplicaLag":        replicaHostsQuery,
+	"GetSecurity":          securityQuery,
+	"GetSemiSync":          semiSyncQuery,
+	"GetServerIdentity":    identityQuery,
+	"GetSessions":          sessionQuery2,
+	"GetSkipCounter":       skipCounterQuery,
+	"GetSlaveStats":        slaveQuery,
+	"GetSqlMode":           sqlModeQuery,
+	"GetStackedQueries":    stackedQuery,
+	"GetStatementLatency":  statementHistogramQuery,
+	"GetStatementSummary":  statementSummaryQuery,
+	"GetTLSConnections":    tlsConnectionsQuery,
+	"GetTableEngines":      tableEnginesQuery,
+	"GetThreadPool":        threadPoolStatusQuery,
+	"GetTempTables":        slaveTempTablesQuery,
+	"GetUndoLogs":          undoMetricsQuery,
+	"GetUndoTablespaces":   undoTablespacesQuery,
+	"GetVersion":           versionQuery,
+}
+
+//what each getter parses out of its main query, checked by CheckQueries
+var getterColumns = map[string]tools.Expected{
+	"GetAccountLimits":     {Columns: []string{"user", "max_user_connections", "max_questions"}},
+	"GetAccounts":          {Columns: []string{"count"}},
+	"GetActiveTrxAges":     {Columns: []string{"age"}},
+	"GetBinlogFiles":       {Columns: []string{"Log_name", "File_size"}},
+	"GetBinlogSettings":    {Columns: []string{"binlog_format", "binlog_row_image", "log_slave_updates", "sync_binlog", "innodb_flush_log_at_trx_commit"}},
+	"GetBinlogStats":       {Columns: []string{"File", "Position"}},
+	"GetBufferPoolLRU":     {Columns: []string{"pages_made_young", "pages_not_made_young", "young_make_per_thousand_gets", "not_young_make_per_thousand_gets"}},
+	"GetCloneStatus":       {Columns: []string{"state", "data", "estimate"}, Optional: true},
+	"GetClusterStatus":     {Columns: []string{"member_id", "member_state", "self"}, Optional: true},
+	"GetCorruptTables":     {Columns: []string{"data"}, Optional: true},
+	"GetDataDirUsage":      {Columns: []string{"datadir"}},
+	"GetDataLocks":         {Columns: []string{"lock_mode", "lock_status", "locks"}},
+	"GetGlobalReadLock":    {Columns: []string{"locks"}},
+	"GetGlobalStatus":      {Columns: []string{"Variable_name", "Value"}, Names: []string{"Queries", "Threads_connected", "Threads_running", "Uptime"}},
+	"GetNumLongRunQueries": {Columns: []string{"ID"}},
+	"GetOldestQuery":       {Columns: []string{"time"}},
+	"GetOldestTrx":         {Columns: []string{"time"}},
+	"GetOldestTrxOwner":    {Columns: []string{"trx_id", "age", "trx_state", "trx_rows_modified", "thread_id", "user", "host", "query"}},
+	"GetPerfSchemaMemory":  {Columns: []string{"event_name", "bytes"}, Optional: true},
+	"GetQueryResponseTime": {Columns: []string{"time", "count"}, Optional: true},
+	"GetRedoLog":           {Columns: []string{"Variable_name", "Value"}},
+	"GetReplicaLag":        {Columns: []string{"host"}},
+	"GetSecurity":          {Columns: []string{"user"}},
+	"GetSemiSync":          {Columns: []string{"Variable_name", "Value"}},
+	"GetServerIdentity":    {Columns: []string{"hostname", "version", "server_id", "server_uuid"}},
+	"GetSessions":          {Columns: []string{"COMMAND", "USER", "STATE", "HOST"}},
+	"GetSkipCounter":       {Columns: []string{"skip_counter"}},
+	"GetSlaveStats":        {Columns: []string{"Seconds_Behind_Master", "Relay_Master_Log_File", "Exec_Master_Log_Pos", "Master_SSL_Allowed"}},
+	"GetSqlMode":           {Columns: []string{"sql_mode"}},
+	"GetStackedQueries":    {Columns: []string{"identical_queries_stacked", "max_age"}},
+	"GetStatementLatency":  {Columns: []string{"bucket_number", "bucket_timer_high", "count_bucket"}},
+	"GetStatementSummary":  {Columns: []string{"event_name", "count_star", "sum_timer_wait", "sum_no_index_used", "sum_no_good_index_used", "sum_rows_examined", "sum_rows_sent"}},
+	"GetTLSConnections":    {Columns: []string{"connections", "tls"}},
+	"GetTableEngines":      {Columns: []string{"engine", "tables"}},
+	"GetThreadPool":        {Columns: []string{"Variable_name", "Value"}, Optional: true},
+	"GetTempTables":        {Columns: []string{"Variable_name", "Value"}},
+	"GetUndoLogs":          {Columns: []string{"name", "count"}, Optional: true},
+	"GetUndoTablespaces":   {Columns: []string{"name", "file_size", "state"}, Optional: true},
+	"GetVersion":           {Columns: []string{"VERSION()"}},
+}
+
 //initializes mysqlstat.
 //takes as input: metrics context, username, password, path to config file for
 // mysql. username and password can be left as "" if a config file is specified.
 func New(m *metrics.MetricContext, user, password, host, config string) (*MysqlStat, error) {
+	return NewWithNamespace(m, "", user, password, host, config)
+}
+
+//initializes mysqlstat with its metrics registered under
+// "mysqlstat.<namespace>" instead of "mysqlstat", so several collectors
+// can share a metric context without overwriting each other's metrics.
+// Formatted output is prefixed with the namespace as well.
+func NewWithNamespace(m *metrics.MetricContext, namespace, user, password, host,
+	config string) (*MysqlStat, error) {
+	return newMysqlStat(m, namespace, user, password, host, config, tools.Options{})
+}
+
+//initializes mysqlstat with connection options such as the charset
+func NewWithOptions(m *metrics.MetricContext, user, password, host, config string,
+	opts tools.Options) (*MysqlStat, error) {
+	return newMysqlStat(m, "", user, password, host, config, opts)
+}
+
+//initializes mysqlstat on a connection pool the caller already has open,
+// such as an application's own. Close leaves db open, and the pool's
+// connection limits are left as the caller set them
+func NewFromDB(m *metrics.MetricContext, db *sql.DB) *MysqlStat {
 	s := new(MysqlStat)
+	s.m = m
+	s.target = "existing connection"
+	s.db = tools.NewFromDB(db)
+	s.Metrics = MysqlStatMetricsNewNamespace(m, "")
+	return s
+}
+
+//initializes mysqlstat from a dsn, see tools.NewDSN, instead of a config
+// file, e.g. to collect from a server on another host. a malformed dsn
+// fails with an error wrapping tools.ErrInvalidDSN
+func NewDSN(m *metrics.MetricContext, dsn string) (*MysqlStat, error) {
+	s := new(MysqlStat)
+	s.m = m
+	s.target = tools.DSNTargetName(dsn)
 
-	// connect to database
 	var err error
-	s.db, err = tools.New(user, password, host, config)
+	s.db, err = tools.NewDSN(dsn)
+	if err != nil {
+		s.db.Log(err)
+		return nil, err
+	}
 	s.SetMaxConnections(defaultMaxConns)
+	s.Metrics = MysqlStatMetricsNewNamespace(m, "")
+
+	return s, nil
+}
+
+func newMysqlStat(m *metrics.MetricContext, namespace, user, password, host, config string,
+	opts tools.Options) (*MysqlStat, error) {
+	s := new(MysqlStat)
+	s.m = m
+	s.namespace = namespace
+	s.target = tools.TargetName(user, host)
+
+	// connect to database
+	var err error
+	s.db, err = tools.NewWithOptions(user, password, host, config, opts)
 	if err != nil {
 		s.db.Log(err)
 		return nil, err
 	}
-	s.Metrics = MysqlStatMetricsNew(m)
+	s.SetMaxConnections(defaultMaxConns)
+	s.Metrics = MysqlStatMetricsNewNamespace(m, namespace)
 
 	return s, nil
 }
 
-// Set the max number of concurrent connections that the mysql client can use
+// Set the max number of concurrent connections that the mysql client can use.
+// Kept across SetDB
 func (s *MysqlStat) SetMaxConnections(maxConns int) {
+	s.maxConns = maxConns
 	s.db.SetMaxConnections(maxConns)
 }
 
-//initializes metrics
-func MysqlStatMetricsNew(m *metrics.MetricContext) *MysqlStatMetrics {
-	c := new(MysqlStatMetrics)
-	misc.InitializeMetrics(c, m, "mysqlstat", true)
-	return c
+// Pick the connections Collect runs its queries on, between 1 and max,
+// from how long the getters of the last few collections took, so that
+// a collection takes about target or less. A target of 0 turns it off
+// and goes back to max connections
+func (s *MysqlStat) SetAutoConcurrency(target time.Duration, max int) {
+	s.infoLock.Lock()
+	s.tuner = nil
+	if target > 0 {
+		s.tuner = tools.NewConcurrencyTuner(1, max, target, autoConcurrencyWindow)
+	}
+	s.infoLock.Unlock()
+	s.SetMaxConnections(max)
 }
 
-//launches metrics collectors.
-// sql.DB is safe for concurrent use by multiple goroutines
-// so launching each metric collector as its own goroutine is safe
-func (s *MysqlStat) Collect() {
-	s.wg.Add(14)
-	go s.GetVersion()
-	go s.GetSlaveStats()
-	go s.GetGlobalStatus()
-	go s.GetBinlogStats()
-	go s.GetStackedQueries()
-	go s.GetSessions()
-	go s.GetNumLongRunQueries()
-	go s.GetQueryResponseTime()
-	go s.GetBackups()
-	go s.GetOldestQuery()
-	go s.GetOldestTrx()
-	go s.GetBinlogFiles()
-	go s.GetInnodbStats()
-	go s.GetSecurity()
-	s.wg.Wait()
+// Give up on a query that runs longer than timeout, and kill it on the
+// server, so one stuck query can't hold up Collect. The getter that ran
+// it records the error and its metrics keep their last values. 0 lets
+// queries run as long as they take. Kept across SetDB
+func (s *MysqlStat) SetQueryTimeout(timeout time.Duration) {
+	s.queryTimeout = timeout
+	s.db.SetQueryTimeout(timeout)
 }
 
-// get_slave_stats gets slave statistics
-func (s *MysqlStat) GetSlaveStats() {
-	s.Metrics.ReplicationRunning.Set(float64(-1))
-	numBackups := float64(0)
+// Set the number of digits written after the decimal point for
+// non-integer values in formatted output. Whole numbers are always
+// written without a decimal point.
+func (s *MysqlStat) SetFormatPrecision(precision int) {
+	s.formatLock.Lock()
+	s.precision = precision
+	s.precisionSet = true
+	s.formatLock.Unlock()
+}
 
-	res, err := s.db.QueryReturnColumnDict(slaveBackupQuery)
-	if err != nil {
-		s.db.Log(err)
-	} else if len(res["count"]) > 0 {
-		numBackups, err = strconv.ParseFloat(string(res["count"][0]), 64)
-		if err != nil {
-			s.db.Log(err)
-		} else {
-			if numBackups > 0 {
-				s.Metrics.SlaveSecondsBehindMaster.Set(float64(-1))
-				s.Metrics.ReplicationRunning.Set(float64(1))
-			}
-		}
+// Output metrics tagged with a unit, such as `unit:"bytes"`, in the units
+// of u rather than the ones they are collected in. Counters, which are
+// whole numbers, are left as they are
+func (s *MysqlStat) SetUnits(u tools.Units) {
+	s.formatLock.Lock()
+	s.units = u
+	s.formatLock.Unlock()
+}
+
+// Replace the main query of the getter named method, for example
+// "GetGlobalStatus". The getter parses the result as before, so the
+// query must return the same column names.
+func (s *MysqlStat) SetQuery(method, query string) error {
+	def, ok := getterQueries[method]
+	if !ok {
+		return errors.New("no query to override for " + method)
 	}
-	res, err = s.db.QueryReturnColumnDict(slaveQuery)
-	if err != nil {
-		s.db.Log(err)
-		s.wg.Done()
-		return
+	s.queryLock.Lock()
+	if s.queries == nil {
+		s.queries = make(map[string]string)
 	}
+	s.queries[def] = query
+	s.queryLock.Unlock()
+	return nil
+}
 
-	if (len(res["Seconds_Behind_Master"]) > 0) && (string(res["Seconds_Behind_Master"][0]) != "") {
-		seconds_behind_master, err := strconv.ParseFloat(string(res["Seconds_Behind_Master"][0]), 64)
-		if err != nil {
-			s.db.Log(err)
-			s.Metrics.SlaveSecondsBehindMaster.Set(float64(-1))
-			if numBackups == 0 {
-				s.Metrics.ReplicationRunning.Set(float64(-1))
-			}
-		} else {
-			s.Metrics.SlaveSecondsBehindMaster.Set(float64(seconds_behind_master))
-			s.Metrics.ReplicationRunning.Set(float64(1))
-		}
+//returns the query set to replace def, or def itself
+func (s *MysqlStat) query(def string) string {
+	s.queryLock.Lock()
+	defer s.queryLock.Unlock()
+	if q, ok := s.queries[def]; ok {
+		return q
 	}
+	return def
+}
 
-	relay_master_log_file, _ := res["Relay_Master_Log_File"]
-	if len(relay_master_log_file) > 0 {
-		tmp := strings.Split(string(relay_master_log_file[0]), ".")
-		slave_seqfile, err := strconv.ParseInt(tmp[len(tmp)-1], 10, 64)
-		s.Metrics.SlaveSeqFile.Set(float64(slave_seqfile))
-		if err != nil {
-			s.db.Log(err)
-		}
+//runs the query of every getter, including queries set with SetQuery,
+// and returns the results without parsing them into metrics
+func (s *MysqlStat) DumpRaw() map[string]tools.RawResult {
+	queries := make(map[string]string)
+	for method, def := range getterQueries {
+		queries[method] = s.query(def)
 	}
+	return tools.QueryRaw(s.db, queries)
+}
 
-	if len(res["Exec_Master_Log_Pos"]) > 0 {
-		slave_position, err := strconv.ParseFloat(string(res["Exec_Master_Log_Pos"][0]), 64)
-		if err != nil {
-			s.db.Log(err)
-			s.wg.Done()
-			return
-		}
-		s.Metrics.SlavePosition.Set(uint64(slave_position))
-	}
-	s.wg.Done()
-	return
+// Run the query of every getter once and check it returned the columns
+// the getter parses, to catch queries a server version no longer
+// supports before the metrics quietly go missing
+func (s *MysqlStat) CheckQueries() []tools.GetterCheck {
+	return tools.CheckColumns(s.DumpRaw(), getterColumns)
 }
 
-//gets global statuses
-func (s *MysqlStat) GetGlobalStatus() {
-	res, err := s.db.QueryReturnColumnDict(maxPreparedStmtCountQuery)
-	if err != nil {
-		s.db.Log(err)
-		s.wg.Done()
-		return
+// Sample Threads_running every interval for window during each
+// collection, to catch spikes shorter than the collection step.
+// A window of 0 turns sampling off, which is the default.
+func (s *MysqlStat) SetThreadsRunningSampling(interval, window time.Duration) {
+	s.sampleInterval = interval
+	s.sampleWindow = window
+}
+
+// End each line of graphite output with the Unix time of the last
+// collection, as the plaintext protocol expects
+func (s *MysqlStat) SetGraphiteTimestamp(on bool) {
+	s.timestamps = on
+}
+
+// Put prefix, e.g. "mysql.<hostname>", and a dot before every name in
+// graphite output, ahead of any namespace. An empty prefix adds nothing
+func (s *MysqlStat) SetGraphitePrefix(prefix string) {
+	s.graphitePrefix = tools.GraphiteName(prefix)
+}
+
+//returns the start of every graphite name, the graphite prefix and the
+// namespace, each followed by a dot
+func (s *MysqlStat) graphiteNamePrefix() string {
+	prefix := ""
+	if s.graphitePrefix != "" {
+		prefix = s.graphitePrefix + "."
 	}
-	var max_prepared_stmt_count int64
-	if err == nil && len(res["Value"]) > 0 {
-		max_prepared_stmt_count, err = strconv.ParseInt(res["Value"][0], 10, 64)
-		if err != nil {
-			s.db.Log(err)
-		}
+	if s.namespace != "" {
+		prefix += s.namespace + "."
 	}
+	return prefix
+}
 
-	res, err = s.db.QueryMapFirstColumnToRow(globalStatsQuery)
-	if err != nil {
-		s.db.Log(err)
-		s.wg.Done()
-		return
+// Returns when the last Collect started, or the zero time if
+// Collect hasn't run
+func (s *MysqlStat) CollectedAt() time.Time {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.collectedAt
+}
+
+//returns " <unix time>" of the last collection when timestamps are on,
+// or the current time if nothing has been collected with Collect
+func (s *MysqlStat) graphiteTimestamp() string {
+	if !s.timestamps {
+		return ""
 	}
-	vars := map[string]interface{}{
-		"Binlog_cache_disk_use":         s.Metrics.BinlogCacheDiskUse,
-		"Binlog_cache_use":              s.Metrics.BinlogCacheUse,
-		"Com_alter_table":               s.Metrics.ComAlterTable,
-		"Com_begin":                     s.Metrics.ComBegin,
-		"Com_commit":                    s.Metrics.ComCommit,
-		"Com_create_table":              s.Metrics.ComCreateTable,
-		"Com_delete":                    s.Metrics.ComDelete,
-		"Com_delete_multi":              s.Metrics.ComDeleteMulti,
-		"Com_drop_table":                s.Metrics.ComDropTable,
-		"Com_insert":                    s.Metrics.ComInsert,
-		"Com_insert_select":             s.Metrics.ComInsertSelect,
-		"Com_replace":                   s.Metrics.ComReplace,
-		"Com_replace_select":            s.Metrics.ComReplaceSelect,
-		"Com_rollback":                  s.Metrics.ComRollback,
-		"Com_select":                    s.Metrics.ComSelect,
-		"Com_update":                    s.Metrics.ComUpdate,
-		"Com_update_multi":              s.Metrics.ComUpdateMulti,
-		"Created_tmp_disk_tables":       s.Metrics.CreatedTmpDiskTables,
-		"Created_tmp_files":             s.Metrics.CreatedTmpFiles,
-		"Created_tmp_tables":            s.Metrics.CreatedTmpTables,
-		"Innodb_current_row_locks":      s.Metrics.InnodbCurrentRowLocks,
-		"Innodb_log_os_waits":           s.Metrics.InnodbLogOsWaits,
-		"Innodb_row_lock_current_waits": s.Metrics.InnodbRowLockCurrentWaits,
-		"Innodb_row_lock_time_avg":      s.Metrics.InnodbRowLockTimeAvg,
-		"Innodb_row_lock_time_max":      s.Metrics.InnodbRowLockTimeMax,
-		"Prepared_stmt_count":           s.Metrics.PreparedStmtCount,
-		"Queries":                       s.Metrics.Queries,
-		"Sort_merge_passes":             s.Metrics.SortMergePasses,
-		"Threads_connected":             s.Metrics.ThreadsConnected,
-		"Uptime":                        s.Metrics.Uptime,
-		"Threads_running":               s.Metrics.ThreadsRunning,
+	t := s.CollectedAt()
+	if t.IsZero() {
+		t = time.Now()
 	}
+	return " " + strconv.FormatInt(t.Unix(), 10)
+}
 
-	//range through expected metrics and grab from data
-	for name, metric := range vars {
-		v, ok := res[name]
-		if ok && len(v) > 0 {
-			val, err := strconv.ParseFloat(string(v[0]), 64)
-			if err != nil {
-				s.db.Log(err)
-			}
-			switch met := metric.(type) {
-			case *metrics.Counter:
-				met.Set(uint64(val))
-			case *metrics.Gauge:
-				met.Set(float64(val))
-			}
-		}
-	}
+// Report entries at ERROR priority that were added to
+// performance_schema.error_log since the last collection. Each entry is
+// written to the log and RecentErrorLogEntries counts them.
+// Only MySQL 8.0.22+ has the table; on older servers this is skipped.
+func (s *MysqlStat) SetErrorLogTail(on bool) {
+	s.errorLogTail = on
+}
 
-	if max_prepared_stmt_count != 0 {
-		pct := (s.Metrics.PreparedStmtCount.Get() / float64(max_prepared_stmt_count)) * 100
-		s.Metrics.PreparedStmtPct.Set(pct)
+// Read the header of the oldest binary log, from the directory of
+// @@log_bin_basename, to set OldestBinlogAgeSeconds. This only works when
+// the collector runs on the database host; a binary log that isn't
+// there is skipped without logging.
+func (s *MysqlStat) SetLocalBinlogs(on bool) {
+	s.localBinlogs = on
+}
+
+// Also output a <name>_per_sec gauge for each counter, the change in the
+// counter per second between the last two collections. A counter that
+// was reset, e.g. by a restart, has a rate of 0
+func (s *MysqlStat) SetCounterRates(on bool) {
+	if on {
+		s.rates = new(tools.CounterRates)
+	} else {
+		s.rates = nil
 	}
+}
 
-	s.wg.Done()
-	return
+//what SaveState keeps of the last collection
+type collectorState struct {
+	Uptime   uint64                         `json:"uptime"`
+	Counters map[string]tools.CounterSample `json:"counters,omitempty"`
 }
 
-//get time of oldest query in seconds
-func (s *MysqlStat) GetOldestQuery() {
-	res, err := s.db.QueryReturnColumnDict(oldestQuery)
+// SaveState writes what the next run needs to pick up where this one
+// left off to path: the server's uptime, to notice a restart while the
+// collector was down, and the counters' last values when counter rates
+// are on, so the first collection after a restart has rates. The file
+// is replaced in one step, so a crash leaves the previous state
+func (s *MysqlStat) SaveState(path string) error {
+	s.infoLock.Lock()
+	state := collectorState{Uptime: s.lastUptime}
+	s.infoLock.Unlock()
+	if s.rates != nil {
+		state.Counters = s.rates.Samples()
+	}
+	data, err := json.Marshal(state)
 	if err != nil {
-		s.db.Log(err)
-		s.wg.Done()
-		return
+		return err
 	}
-	t := int64(0)
-	if time, ok := res["time"]; ok && len(time) > 0 {
-		t, err = strconv.ParseInt(time[0], 10, 64)
-		if err != nil {
-			s.db.Log(err)
-		}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
 	}
-	s.Metrics.OldestQueryS.Set(float64(t))
-	s.wg.Done()
-	return
+	return os.Rename(tmp, path)
 }
 
-func (s *MysqlStat) GetOldestTrx() {
-	res, err := s.db.QueryReturnColumnDict(oldestTrx)
+// LoadState reads the state written by SaveState from path, before the
+// first collection. A missing file is a first run and isn't an error
+func (s *MysqlStat) LoadState(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		s.db.Log(err)
-		s.wg.Done()
-		return
+		return err
 	}
-	t := int64(0)
-	if time, ok := res["time"]; ok && len(time) > 0 {
-		t, _ = strconv.ParseInt(time[0], 10, 64)
+	var state collectorState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return errors.New(path + ": " + err.Error())
+	}
+	s.infoLock.Lock()
+	if s.lastUptime == 0 {
+		s.lastUptime = state.Uptime
+	}
+	s.infoLock.Unlock()
+	if s.rates != nil {
+		s.rates.Restore(state.Counters)
+	}
+	return nil
+}
+
+// Also output SlaveLagP95 and SlaveLagMax, the 95th percentile and
+// maximum replication lag over the last size collections, so alerts can
+// follow sustained lag rather than brief spikes. Samples older than age
+// are left out when age is set. A size of 0 turns this off
+func (s *MysqlStat) SetLagWindow(size int, age time.Duration) {
+	if size > 0 {
+		s.lagWindow = tools.NewWindow(size, age)
+	} else {
+		s.lagWindow = nil
+	}
+}
+
+// Group long running queries by their fingerprint, the query with its
+// values left out, and output the count and longest running time of the
+// top fingerprints with the most queries as LongQueries.<id>. Each
+// fingerprint is logged with its id when it first shows up, and the
+// oldest transaction's query is logged as a fingerprint too, so no query
+// data is logged. A top of 0 turns this off.
+func (s *MysqlStat) SetQueryFingerprints(top int) {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	s.fingerprintTop = top
+	if top <= 0 {
+		s.fingerprints = nil
+	}
+}
+
+// Read the binlog position of this replica's master over master, so
+// SlaveIOLagBytes can say how far the IO thread is behind it. Close
+// closes master too.
+func (s *MysqlStat) SetMaster(master tools.MysqlDB) {
+	if s.master != nil {
+		s.master.Close()
+	}
+	s.master = master
+}
+
+// Also collect the replication lag of this server's replicas, in
+// replica.<host>.SecondsBehindMaster, connecting to each with connect.
+// hosts lists the replicas to check. when it is empty the replicas with
+// a binlog dump thread on this server are checked, found again each
+// collection. at most concurrency replicas are checked at once. a nil
+// connect turns it off. Close closes the replica connections too
+func (s *MysqlStat) SetReplicaLag(hosts []string, concurrency int, connect func(host string) (tools.MysqlDB, error)) {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	for _, db := range s.replicaDBs {
+		db.Close()
+	}
+	s.replicaDBs = nil
+	s.replicaHosts = nil
+	for _, host := range hosts {
+		if host = strings.TrimSpace(host); host != "" {
+			s.replicaHosts = append(s.replicaHosts, host)
+		}
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	s.replicaLimit = concurrency
+	s.replicaConnect = connect
+}
+
+// Don't run the getters named in names, e.g. GetSessions, in Collect.
+// Their metrics keep the last value collected. Replaces the names set by
+// an earlier call
+func (s *MysqlStat) SetSkipGetters(names []string) {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	s.skipGetters = make(map[string]bool)
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			s.skipGetters[name] = true
+		}
+	}
+}
+
+// Collect over db from now on, e.g. after connection settings changed,
+// and close the connection used before once pings in progress are done.
+// Metrics, counter state and other settings, such as the query timeout
+// and max connections, are kept. Call it between collections
+func (s *MysqlStat) SetDB(db tools.MysqlDB) {
+	db.SetQueryTimeout(s.queryTimeout)
+	if s.maxConns > 0 {
+		db.SetMaxConnections(s.maxConns)
+	}
+	s.dbLock.Lock()
+	old := s.db
+	s.db = db
+	s.dbLock.Unlock()
+	s.infoLock.Lock()
+	s.closed = false
+	s.perfSchemaSlave = false //the new connection may be allowed SHOW SLAVE STATUS
+	s.infoLock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// Also run CHECK TABLE ... QUICK on every table in schemas, at most once
+// every interval, and count the tables it reports as corrupt in
+// CorruptTablesCount. Checking reads every table and can take a while,
+// so this is off unless schemas are given.
+func (s *MysqlStat) SetCheckTables(schemas []string, every time.Duration) {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	s.checkSchemas = nil
+	for _, schema := range schemas {
+		if schema = strings.TrimSpace(schema); schema != "" {
+			s.checkSchemas = append(s.checkSchemas, schema)
+		}
+	}
+	s.checkEvery = every
+	s.lastCheck = time.Time{}
+	s.checkedCorrupt = nil
+}
+
+// Read the time of the last successful backup from the latest value of
+// column, a TIMESTAMP or DATETIME, in table, which may be given as
+// db.table, for LastBackupAgeSeconds. An empty table, or an empty
+// table name, which is the default, leaves the age unknown.
+func (s *MysqlStat) SetBackupMarker(table, column string) {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	s.backupTable = strings.TrimSpace(table)
+	s.backupColumn = strings.TrimSpace(column)
+}
+
+// Also collect each of the global status variables named in keys as a
+// gauge named "status.<key>", for variables without a metric of their
+// own. Names match regardless of case. Values that aren't numbers are
+// skipped, and logged the first time. It can be called again, e.g. on
+// a reload, and variables named both times keep their gauge.
+func (s *MysqlStat) SetExtraStatus(keys []string) {
+	_, current := s.extraStatusGauges()
+	gauges := make(map[string]*metrics.Gauge)
+	var names []string
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if _, ok := gauges[key]; ok {
+			continue
+		}
+		if g, ok := current[key]; ok {
+			gauges[key] = g
+		} else {
+			gauges[key] = s.m.NewGauge(metricPrefix(s.namespace) + ".status." + key)
+		}
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	s.infoLock.Lock()
+	s.extraStatus = gauges
+	s.extraStatusKeys = names
+	s.infoLock.Unlock()
+}
+
+//returns the names of the extra status variables, sorted, and their
+// gauges. SetExtraStatus replaces both rather than changing them, so
+// they can be read without the lock
+func (s *MysqlStat) extraStatusGauges() ([]string, map[string]*metrics.Gauge) {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	return s.extraStatusKeys, s.extraStatus
+}
+
+//sets the gauges of the extra status variables from the result of
+// globalStatsQuery
+func (s *MysqlStat) setExtraStatus(res map[string][]string) {
+	keys, gauges := s.extraStatusGauges()
+	if len(keys) == 0 {
+		return
+	}
+	byName := make(map[string][]string, len(res))
+	for name, v := range res {
+		byName[strings.ToLower(name)] = v
+	}
+	for _, key := range keys {
+		v := byName[strings.ToLower(key)]
+		if len(v) == 0 {
+			s.warnExtraStatus(key, "extra status "+key+": no such status variable")
+			continue
+		}
+		val, err := strconv.ParseFloat(v[0], 64)
+		if err != nil {
+			s.warnExtraStatus(key, "extra status "+key+": skipping value that isn't a number: "+v[0])
+			continue
+		}
+		gauges[key].Set(val)
+	}
+}
+
+//logs msg the first time key can't be collected
+func (s *MysqlStat) warnExtraStatus(key, msg string) {
+	s.infoLock.Lock()
+	if s.extraWarned == nil {
+		s.extraWarned = make(map[string]bool)
+	}
+	warned := s.extraWarned[key]
+	s.extraWarned[key] = true
+	s.infoLock.Unlock()
+	if !warned {
+		s.db.Log(msg)
+	}
+}
+
+//returns the rate of the counter named name in formatted output,
+// false if rates are off or not known yet
+func (s *MysqlStat) counterRate(name string) (float64, bool) {
+	if s.rates == nil {
+		return 0, false
+	}
+	return s.rates.Rate(name)
+}
+
+//records how busy the collector's own connection pool was
+func (s *MysqlStat) updatePoolStats() {
+	stats := s.db.Stats()
+	s.Metrics.CollectorPoolInUse.Set(float64(stats.InUse))
+	s.Metrics.CollectorPoolIdle.Set(float64(stats.Idle))
+	s.Metrics.CollectorPoolWaitCount.Set(uint64(stats.WaitCount))
+	s.Metrics.CollectorPoolWaitDuration.Set(uint64(stats.WaitDuration / time.Millisecond))
+}
+
+//records the collector's goroutines and heap in use
+func (s *MysqlStat) updateRuntimeStats() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	s.Metrics.CollectorGoroutines.Set(float64(runtime.NumGoroutine()))
+	s.Metrics.CollectorHeapBytes.Set(float64(mem.HeapAlloc))
+}
+
+//records every counter's value at the start of the collection
+func (s *MysqlStat) updateRates() {
+	if s.rates == nil {
+		return
+	}
+	s.errLock.Lock()
+	at := s.collectedAt
+	s.errLock.Unlock()
+	for _, set := range s.metricSets() {
+		metricvalue := reflect.ValueOf(set.metrics).Elem()
+		metricstype := metricvalue.Type()
+		for i := 0; i < metricvalue.NumField(); i++ {
+			if metric, ok := metricvalue.Field(i).Interface().(*metrics.Counter); ok {
+				s.rates.Update(set.name+metricstype.Field(i).Name, metric.Get(), at)
+			}
+		}
+	}
+}
+
+// Describes the collector's target and settings for log lines. It never
+// includes the password
+func (s *MysqlStat) String() string {
+	parts := []string{"target " + s.target}
+	if s.namespace != "" {
+		parts = append(parts, "namespace "+s.namespace)
+	}
+	if s.sampleWindow > 0 {
+		parts = append(parts, "threads running sampled every "+s.sampleInterval.String()+
+			" for "+s.sampleWindow.String())
+	}
+	if s.errorLogTail {
+		parts = append(parts, "error log tailed")
+	}
+	if s.rates != nil {
+		parts = append(parts, "counter rates on")
+	}
+	if s.timestamps {
+		parts = append(parts, "graphite timestamps on")
+	}
+	if s.graphitePrefix != "" {
+		parts = append(parts, "graphite prefix "+s.graphitePrefix)
+	}
+	if overridden := s.overriddenGetters(); len(overridden) > 0 {
+		parts = append(parts, "queries set for "+strings.Join(overridden, " "))
+	}
+	return "mysqlstat " + strings.Join(parts, ", ")
+}
+
+//returns the getters whose query was replaced with SetQuery, sorted
+func (s *MysqlStat) overriddenGetters() []string {
+	s.queryLock.Lock()
+	defer s.queryLock.Unlock()
+	var names []string
+	for method, def := range getterQueries {
+		if _, ok := s.queries[def]; ok {
+			names = append(names, method)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+//returns the configured output precision, or the default if unset
+func (s *MysqlStat) formatPrecision() int {
+	s.formatLock.Lock()
+	defer s.formatLock.Unlock()
+	if !s.precisionSet {
+		return defaultFormatPrecision
+	}
+	return s.precision
+}
+
+//returns the units set with SetUnits
+func (s *MysqlStat) formatUnits() tools.Units {
+	s.formatLock.Lock()
+	defer s.formatLock.Unlock()
+	return s.units
+}
+
+//initializes metrics
+func MysqlStatMetricsNew(m *metrics.MetricContext) *MysqlStatMetrics {
+	return MysqlStatMetricsNewNamespace(m, "")
+}
+
+//initializes metrics under "mysqlstat.<namespace>",
+// or "mysqlstat" if namespace is empty
+func MysqlStatMetricsNewNamespace(m *metrics.MetricContext, namespace string) *MysqlStatMetrics {
+	c := new(MysqlStatMetrics)
+	misc.InitializeMetrics(c, m, metricPrefix(namespace), true)
+	return c
+}
+
+//starts the counters over when the server restarted since the last
+// collection, which shows as its uptime going down. the counters of a
+// server that kept running continue across reconnects, such as SetDB,
+// since only the connection changed and the server's counters didn't
+// reset. the counters keep the values collected after the restart and
+// have no rate until the next collection. they are reset in place, so
+// output being served and callers holding s.Metrics see the same ones
+func (s *MysqlStat) checkRestart() {
+	uptime := s.Metrics.Uptime.Get()
+	if uptime == 0 {
+		return //not collected yet
+	}
+	s.infoLock.Lock()
+	last := s.lastUptime
+	s.lastUptime = uptime
+	s.infoLock.Unlock()
+	if uptime >= last {
+		return
+	}
+	s.db.Log("server restarted, uptime went from " + strconv.FormatUint(last, 10) + " to " +
+		strconv.FormatUint(uptime, 10) + " seconds, starting counters over")
+	for _, set := range s.metricSets() {
+		metricvalue := reflect.ValueOf(set.metrics).Elem()
+		for i := 0; i < metricvalue.NumField(); i++ {
+			if metric, ok := metricvalue.Field(i).Interface().(*metrics.Counter); ok {
+				value := metric.Get()
+				metric.Reset()
+				metric.Set(value)
+			}
+		}
+	}
+}
+
+//checks relationships that collected metrics should always satisfy,
+// returning an error for each one that doesn't. A failed check points at
+// a parsing bug or a query returning something unexpected.
+// Metrics that were not collected are not checked.
+func (c *MysqlStatMetrics) Validate() []error {
+	var errs []error
+	atMost := func(name string, a *metrics.Gauge, limitName string, limit *metrics.Gauge) {
+		x, y := a.Get(), limit.Get()
+		if !math.IsNaN(x) && !math.IsNaN(y) && x > y {
+			errs = append(errs, errors.New(name+" ("+strconv.FormatFloat(x, 'f', -1, 64)+
+				") is greater than "+limitName+" ("+strconv.FormatFloat(y, 'f', -1, 64)+")"))
+		}
+	}
+	percent := func(name string, a *metrics.Gauge) {
+		x := a.Get()
+		if !math.IsNaN(x) && (x < 0 || x > 100) {
+			errs = append(errs, errors.New(name+" ("+strconv.FormatFloat(x, 'f', -1, 64)+
+				") is not between 0 and 100"))
+		}
+	}
+	atMost("ActiveSessions", c.ActiveSessions, "CurrentSessions", c.CurrentSessions)
+	atMost("ModifiedDBPages", c.ModifiedDBPages, "DatabasePages", c.DatabasePages)
+	atMost("OldDatabasePages", c.OldDatabasePages, "DatabasePages", c.DatabasePages)
+	atMost("DatabasePages", c.DatabasePages, "BufferPoolSize", c.BufferPoolSize)
+	atMost("FreeBuffers", c.FreeBuffers, "BufferPoolSize", c.BufferPoolSize)
+	atMost("EventsEnabled", c.EventsEnabled, "Events", c.Events)
+	atMost("LockedAccounts", c.LockedAccounts, "UserAccounts", c.UserAccounts)
+	atMost("ExpiredAccounts", c.ExpiredAccounts, "UserAccounts", c.UserAccounts)
+	atMost("SlaveLagP95", c.SlaveLagP95, "SlaveLagMax", c.SlaveLagMax)
+	percent("BusySessionPct", c.BusySessionPct)
+	percent("CurrentConnectionsPct", c.CurrentConnectionsPct)
+	percent("PreparedStmtPct", c.PreparedStmtPct)
+	percent("CacheHitPct", c.CacheHitPct)
+	percent("TlsConnectionsPct", c.TlsConnectionsPct)
+	percent("InnodbCheckpointAgePct", c.InnodbCheckpointAgePct)
+	percent("InnodbModifiedAgePct", c.InnodbModifiedAgePct)
+	percent("InnodbRedoLogUsedPct", c.InnodbRedoLogUsedPct)
+	return errs
+}
+
+func metricPrefix(namespace string) string {
+	if namespace == "" {
+		return "mysqlstat"
+	}
+	return "mysqlstat." + namespace
+}
+
+//launches metrics collectors.
+// sql.DB is safe for concurrent use by multiple goroutines
+// so launching each metric collector as its own goroutine is safe.
+// Collection is best effort: a failing getter does not stop the others,
+// but the returned error names every getter that failed.
+func (s *MysqlStat) Collect() error {
+	start := time.Now()
+	s.resetErrors()
+	skip := s.skippedGetters()
+	s.wg.Add(47)
+	s.runGetter(skip, "GetVersion", s.GetVersion)
+	s.runGetter(skip, "GetSlaveStats", s.GetSlaveStats)
+	s.runGetter(skip, "GetGlobalStatus", s.GetGlobalStatus)
+	s.runGetter(skip, "GetBinlogStats", s.GetBinlogStats)
+	s.runGetter(skip, "GetStackedQueries", s.GetStackedQueries)
+	s.runGetter(skip, "GetSessions", s.GetSessions)
+	s.runGetter(skip, "GetNumLongRunQueries", s.GetNumLongRunQueries)
+	s.runGetter(skip, "GetQueryResponseTime", s.GetQueryResponseTime)
+	s.runGetter(skip, "GetBackups", s.GetBackups)
+	s.runGetter(skip, "GetOldestQuery", s.GetOldestQuery)
+	s.runGetter(skip, "GetOldestTrx", s.GetOldestTrx)
+	s.runGetter(skip, "GetBinlogFiles", s.GetBinlogFiles)
+	s.runGetter(skip, "GetInnodbStats", s.GetInnodbStats)
+	s.runGetter(skip, "GetSecurity", s.GetSecurity)
+	s.runGetter(skip, "GetSchemaObjects", s.GetSchemaObjects)
+	s.runGetter(skip, "GetServerIdentity", s.GetServerIdentity)
+	s.runGetter(skip, "GetAccounts", s.GetAccounts)
+	s.runGetter(skip, "GetGlobalReadLock", s.GetGlobalReadLock)
+	s.runGetter(skip, "GetDDLOperations", s.GetDDLOperations)
+	s.runGetter(skip, "GetThreadsRunningSamples", s.GetThreadsRunningSamples)
+	s.runGetter(skip, "GetRecentErrorLog", s.GetRecentErrorLog)
+	s.runGetter(skip, "GetReplicationWorkers", s.GetReplicationWorkers)
+	s.runGetter(skip, "GetTempTables", s.GetTempTables)
+	s.runGetter(skip, "GetUndoTablespaces", s.GetUndoTablespaces)
+	s.runGetter(skip, "GetBufferPoolLRU", s.GetBufferPoolLRU)
+	s.runGetter(skip, "GetStatementSummary", s.GetStatementSummary)
+	s.runGetter(skip, "GetTLSConnections", s.GetTLSConnections)
+	s.runGetter(skip, "GetThreadPool", s.GetThreadPool)
+	s.runGetter(skip, "GetOldestTrxOwner", s.GetOldestTrxOwner)
+	s.runGetter(skip, "GetSemiSync", s.GetSemiSync)
+	s.runGetter(skip, "GetRedoLog", s.GetRedoLog)
+	s.runGetter(skip, "GetAccountLimits", s.GetAccountLimits)
+	s.runGetter(skip, "GetSqlMode", s.GetSqlMode)
+	s.runGetter(skip, "GetSkipCounter", s.GetSkipCounter)
+	s.runGetter(skip, "GetDataDirUsage", s.GetDataDirUsage)
+	s.runGetter(skip, "GetCorruptTables", s.GetCorruptTables)
+	s.runGetter(skip, "GetBinlogSettings", s.GetBinlogSettings)
+	s.runGetter(skip, "GetUndoLogs", s.GetUndoLogs)
+	s.runGetter(skip, "GetCloneStatus", s.GetCloneStatus)
+	s.runGetter(skip, "GetClusterStatus", s.GetClusterStatus)
+	s.runGetter(skip, "GetReplicaLag", s.GetReplicaLag)
+	s.runGetter(skip, "GetPerfSchemaMemory", s.GetPerfSchemaMemory)
+	s.runGetter(skip, "GetBackupAge", s.GetBackupAge)
+	s.runGetter(skip, "GetTableEngines", s.GetTableEngines)
+	s.runGetter(skip, "GetDataLocks", s.GetDataLocks)
+	s.runGetter(skip, "GetStatementLatency", s.GetStatementLatency)
+	s.runGetter(skip, "GetActiveTrxAges", s.GetActiveTrxAges)
+	s.wg.Wait()
+	s.checkRestart()
+	s.updateRates()
+	s.updatePoolStats()
+	s.updateRuntimeStats()
+	s.tune()
+	s.Metrics.CollectGetterErrors.Set(s.errs.Total())
+	s.Metrics.CollectDurationMs.Set(float64(time.Since(start)) / float64(time.Millisecond))
+	return s.errs.Err()
+}
+
+//starts getter unless it is in skip, recording how long it takes
+func (s *MysqlStat) runGetter(skip map[string]bool, name string, getter func()) {
+	if skip[name] {
+		s.wg.Done()
+		return
+	}
+	go func() {
+		start := time.Now()
+		getter()
+		s.latencyLock.Lock()
+		if s.latencies == nil {
+			s.latencies = make(map[string]time.Duration)
+		}
+		s.latencies[name] = time.Since(start)
+		s.latencyLock.Unlock()
+	}()
+}
+
+//sets the connections the next Collect uses from how long the getters
+// took, when SetAutoConcurrency is on. a getter can finish recording
+// just after Collect is done waiting for it, and then counts towards
+// the next collection
+func (s *MysqlStat) tune() {
+	s.infoLock.Lock()
+	tuner := s.tuner
+	s.infoLock.Unlock()
+	if tuner == nil {
+		return
+	}
+	waited := s.db.Stats().WaitDuration
+	s.latencyLock.Lock()
+	latencies := make([]time.Duration, 0, len(s.latencies))
+	for _, latency := range s.latencies {
+		latencies = append(latencies, latency)
+	}
+	s.latencies = nil
+	waited, s.poolWaited = waited-s.poolWaited, waited
+	s.latencyLock.Unlock()
+	if conns, changed := tuner.Observe(latencies, waited); changed {
+		s.SetMaxConnections(conns)
+		s.db.Log("collecting on " + strconv.Itoa(conns) + " connections")
+	}
+}
+
+//getters turned off with SetSkipGetters, and those that don't apply to
+// the server as the last collection found it, when SetRoleAware is on.
+// slave getters are skipped on a primary and binlog getters when log_bin
+// is off. GetSlaveStats always runs, since it finds the role
+func (s *MysqlStat) skippedGetters() map[string]bool {
+	skip := make(map[string]bool)
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	for name := range s.skipGetters {
+		skip[name] = true
+	}
+	if !s.roleAware {
+		return skip
+	}
+	if s.role == rolePrimary {
+		skip["GetReplicationWorkers"] = true
+		skip["GetSkipCounter"] = true
+	}
+	if s.binlogOff {
+		skip["GetBinlogFiles"] = true
+		skip["GetBinlogStats"] = true
+	}
+	return skip
+}
+
+//clears the errors recorded by the previous collection
+func (s *MysqlStat) resetErrors() {
+	s.errLock.Lock()
+	s.errs.Reset()
+	s.collectedAt = time.Now()
+	s.errLock.Unlock()
+}
+
+//records an error returned by a query against the getter that made it
+// and logs it
+func (s *MysqlStat) logError(err error) {
+	name := s.errs.Record(err)
+	s.db.Log(name + ": " + err.Error())
+}
+
+// Returns the error each getter that failed during the last collection
+// hit, by getter name, e.g. GetSlaveStats
+func (s *MysqlStat) LastErrors() map[string]error {
+	return s.errs.Last()
+}
+
+//columns of SHOW SLAVE STATUS that configure replication filters
+var replicationFilterColumns = []string{
+	"Replicate_Do_DB",
+	"Replicate_Ignore_DB",
+	"Replicate_Do_Table",
+	"Replicate_Ignore_Table",
+	"Replicate_Wild_Do_Table",
+	"Replicate_Wild_Ignore_Table",
+}
+
+// get_slave_stats gets slave statistics
+func (s *MysqlStat) GetSlaveStats() {
+	s.Metrics.ReplicationRunning.Set(float64(-1))
+	numBackups := float64(0)
+
+	res, err := s.db.QueryReturnColumnDict(slaveBackupQuery)
+	if err != nil {
+		s.logError(err)
+	} else if len(res["count"]) > 0 {
+		numBackups, err = strconv.ParseFloat(string(res["count"][0]), 64)
+		if err != nil {
+			s.db.Log(err)
+		} else {
+			if numBackups > 0 {
+				s.Metrics.SlaveSecondsBehindMaster.Set(float64(-1))
+				s.Metrics.ReplicationRunning.Set(float64(1))
+			}
+		}
+	}
+	res, err = s.slaveStatus()
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+
+	if (len(res["Seconds_Behind_Master"]) > 0) && (string(res["Seconds_Behind_Master"][0]) != "") {
+		seconds_behind_master, err := strconv.ParseFloat(string(res["Seconds_Behind_Master"][0]), 64)
+		if err != nil {
+			s.db.Log(err)
+			s.Metrics.SlaveSecondsBehindMaster.Set(float64(-1))
+			if numBackups == 0 {
+				s.Metrics.ReplicationRunning.Set(float64(-1))
+			}
+		} else {
+			s.Metrics.SlaveSecondsBehindMaster.Set(float64(seconds_behind_master))
+			s.Metrics.ReplicationRunning.Set(float64(1))
+			if s.lagWindow != nil {
+				s.lagWindow.Add(time.Now(), seconds_behind_master)
+				s.Metrics.SlaveLagP95.Set(s.lagWindow.Percentile(95))
+				s.Metrics.SlaveLagMax.Set(s.lagWindow.Max())
+			}
+		}
+	}
+
+	s.setReplicationFilters(res)
+	s.setReplicationChannels(res)
+	s.setReplicationSource(res)
+	s.setRole(res)
+
+	//"Ignored" means SSL was asked for but this server can't use it
+	if len(res["Master_SSL_Allowed"]) > 0 {
+		if res["Master_SSL_Allowed"][0] == "Yes" {
+			s.Metrics.SlaveSSLAllowed.Set(float64(1))
+		} else {
+			s.Metrics.SlaveSSLAllowed.Set(float64(0))
+		}
+	}
+
+	//1 when GTID auto-positioning picks where replication resumes
+	if len(res["Auto_Position"]) > 0 {
+		autoPosition, err := strconv.ParseFloat(res["Auto_Position"][0], 64)
+		if err != nil {
+			s.db.Log(err)
+		} else {
+			s.Metrics.SlaveAutoPosition.Set(autoPosition)
+		}
+	}
+
+	relay_master_log_file, _ := res["Relay_Master_Log_File"]
+	if len(relay_master_log_file) > 0 {
+		slave_seqfile, err := binlogSeq(relay_master_log_file[0])
+		s.Metrics.SlaveSeqFile.Set(float64(slave_seqfile))
+		if err != nil {
+			s.db.Log(err)
+		}
+	}
+
+	if len(res["Exec_Master_Log_Pos"]) > 0 {
+		slave_position, err := strconv.ParseFloat(string(res["Exec_Master_Log_Pos"][0]), 64)
+		if err != nil {
+			s.db.Log(err)
+			s.wg.Done()
+			return
+		}
+		s.Metrics.SlavePosition.Set(uint64(slave_position))
+	}
+	s.setLagBytes(res)
+	s.setRelayLogQueue(res)
+	s.setApplyStalled(res)
+	s.setSlaveChannels(res)
+	s.wg.Done()
+	return
+}
+
+//returns the sequence number of a binlog file name, the part after its
+// last dot
+func binlogSeq(file string) (int64, error) {
+	tmp := strings.Split(file, ".")
+	return strconv.ParseInt(tmp[len(tmp)-1], 10, 64)
+}
+
+//sets lag and position for each named channel of multi-source
+// replication. the unnamed default channel, and servers without
+// channels, only get the unsuffixed metrics, which come from the first
+// row. a channel that never connected has no lag, which is left unset
+// rather than reading as 0. channels no longer listed are dropped
+func (s *MysqlStat) setSlaveChannels(res map[string][]string) {
+	seen := make(map[string]bool)
+	for i, name := range res["Channel_Name"] {
+		if name == "" {
+			continue
+		}
+		seen[name] = true
+		channel := s.checkChannel(name)
+		row := tools.NewResultRow(res, i, s.db.Log)
+		if lag, ok := row.Float("Seconds_Behind_Master"); ok {
+			channel.SlaveSecondsBehindMaster.Set(lag)
+		} else {
+			channel.SlaveSecondsBehindMaster.Set(math.NaN())
+		}
+		if file, ok := row.String("Relay_Master_Log_File"); ok {
+			if seq, err := binlogSeq(file); err != nil {
+				s.db.Log(err)
+			} else {
+				channel.SlaveSeqFile.Set(float64(seq))
+			}
+		}
+		if position, ok := row.Uint("Exec_Master_Log_Pos"); ok {
+			channel.SlavePosition.Set(position)
+		}
+	}
+	s.infoLock.Lock()
+	for name := range s.channels {
+		if !seen[name] {
+			delete(s.channels, name)
+		}
+	}
+	s.infoLock.Unlock()
+}
+
+//returns the metrics for replication channel name, initializing them
+// if needed
+func (s *MysqlStat) checkChannel(name string) *MysqlStatPerChannel {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	if s.channels == nil {
+		s.channels = make(map[string]*MysqlStatPerChannel)
+	}
+	if channel, ok := s.channels[name]; ok {
+		return channel
+	}
+	channel := new(MysqlStatPerChannel)
+	misc.InitializeMetrics(channel, s.m, metricPrefix(s.namespace)+".SlaveChannels."+s.nameComponent("SlaveChannels", name), true)
+	s.channels[name] = channel
+	return channel
+}
+
+//sets how far the IO thread is behind the master's binlog, and the SQL
+// thread behind the IO thread, in bytes. positions are only comparable
+// within one binlog file, so a gap that spans files is left unset. the
+// master's position is only known with SetMaster
+func (s *MysqlStat) setLagBytes(res map[string][]string) {
+	row := tools.NewResultRow(res, 0, s.db.Log)
+	readFile, ok := row.String("Master_Log_File")
+	if !ok {
+		return
+	}
+	read, ok := row.Float("Read_Master_Log_Pos")
+	if !ok {
+		return
+	}
+	execFile, fileOk := row.String("Relay_Master_Log_File")
+	exec, ok := row.Float("Exec_Master_Log_Pos")
+	if ok && fileOk && execFile == readFile {
+		s.Metrics.SlaveSQLLagBytes.Set(read - exec)
+	}
+	if s.master == nil {
+		return
+	}
+	master, err := s.master.QueryReturnColumnDict(binlogStatsQuery)
+	if err != nil {
+		s.db.Log("master position: " + err.Error())
+		return
+	}
+	masterRow := tools.NewResultRow(master, 0, s.db.Log)
+	masterFile, fileOk := masterRow.String("File")
+	position, ok := masterRow.Float("Position")
+	if ok && fileOk && masterFile == readFile {
+		s.Metrics.SlaveIOLagBytes.Set(position - read)
+	}
+}
+
+//sets how much of the relay log the IO thread has written but the SQL
+// coordinator hasn't applied yet. Relay_Log_Space totals the relay log
+// files not yet purged, and relay logs are purged as soon as they are
+// applied, so what is left past Relay_Log_Pos in the relay log being
+// read is the queue. with relay_log_purge off the applied files still
+// count, and the queue reads too large
+func (s *MysqlStat) setRelayLogQueue(res map[string][]string) {
+	row := tools.NewResultRow(res, 0, s.db.Log)
+	space, ok := row.Float("Relay_Log_Space")
+	if !ok {
+		return
+	}
+	position, ok := row.Float("Relay_Log_Pos")
+	if !ok || position > space {
+		return
+	}
+	s.Metrics.RelayLogApplyQueueBytes.Set(space - position)
+}
+
+//where the SQL thread was, and how much relay log there was
+type applyPosition struct {
+	file     string  //Relay_Master_Log_File
+	position float64 //Exec_Master_Log_Pos
+	space    float64 //Relay_Log_Space
+}
+
+//sets whether the SQL thread is stalled: the IO thread added to the
+// relay log since the last collection but the SQL thread's position
+// didn't move. Slave_SQL_Running still says Yes and lag can stay flat
+// when the applier hangs, e.g. on a lock, so this catches stalls lag
+// alone misses. unset until there are two collections to compare
+func (s *MysqlStat) setApplyStalled(res map[string][]string) {
+	row := tools.NewResultRow(res, 0, s.db.Log)
+	file, fileOk := row.String("Relay_Master_Log_File")
+	position, posOk := row.Float("Exec_Master_Log_Pos")
+	space, spaceOk := row.Float("Relay_Log_Space")
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	if !fileOk || !posOk || !spaceOk {
+		s.lastApply = nil
+		return
+	}
+	last := s.lastApply
+	s.lastApply = &applyPosition{file: file, position: position, space: space}
+	if last == nil {
+		return
+	}
+	if file == last.file && position == last.position && space > last.space {
+		s.Metrics.SlaveApplyStalled.Set(1)
+	} else {
+		s.Metrics.SlaveApplyStalled.Set(0)
+	}
+}
+
+//runs SHOW REPLICA STATUS on 8.0.22+ and SHOW SLAVE STATUS before,
+// going by the version found by an earlier collection, and falls back
+// to the other one if that fails. columns come back with their
+// Slave_ and Master_ names either way. a query set with SetQuery is run
+// as it is. when the user lacks REPLICATION CLIENT, replication state is
+// read from performance_schema from then on, see perfSchemaSlaveStatus
+func (s *MysqlStat) slaveStatus() (map[string][]string, error) {
+	if q := s.query(slaveQuery); q != slaveQuery {
+		return s.db.QueryReturnColumnDict(q)
+	}
+	s.infoLock.Lock()
+	perfSchema := s.perfSchemaSlave
+	s.infoLock.Unlock()
+	if perfSchema {
+		return s.perfSchemaSlaveStatus()
+	}
+	first, second := slaveQuery, replicaQuery
+	if versionAtLeast(s.Identity().Version, 8, 0, 22) {
+		first, second = replicaQuery, slaveQuery
+	}
+	res, err := replicaStatus(s.db, first, second)
+	if err == nil || tools.ClassifyError(err) != tools.ErrorPrivilege {
+		return res, err
+	}
+	res, perr := s.perfSchemaSlaveStatus()
+	if perr != nil {
+		return nil, err
+	}
+	s.db.Log("SHOW SLAVE STATUS needs REPLICATION CLIENT, reading replication state from performance_schema")
+	s.infoLock.Lock()
+	s.perfSchemaSlave = true
+	s.infoLock.Unlock()
+	return res, nil
+}
+
+//returns the replication state of every channel from performance_schema,
+// in the SHOW SLAVE STATUS columns. only the channel, master, thread
+// states and lag are known this way, so the metrics from the other
+// columns are left unset
+func (s *MysqlStat) perfSchemaSlaveStatus() (map[string][]string, error) {
+	res, err := s.db.QueryReturnColumnDict(perfSchemaSlaveQuery)
+	if err != nil {
+		return nil, err
+	}
+	states := map[string]string{"ON": "Yes", "CONNECTING": "Connecting"}
+	status := make(map[string][]string)
+	for i := range res["channel_name"] {
+		row := tools.NewResultRow(res, i, s.db.Log)
+		name, _ := row.String("channel_name")
+		host, _ := row.String("host")
+		port, _ := row.String("port")
+		ioState, _ := row.String("io_state")
+		sqlState, _ := row.String("sql_state")
+		ioRunning, sqlRunning := "No", "No"
+		if state, ok := states[strings.ToUpper(ioState)]; ok {
+			ioRunning = state
+		}
+		if strings.ToUpper(sqlState) == "ON" {
+			sqlRunning = "Yes"
+		}
+		//no lag while the SQL thread is stopped, as SHOW SLAVE STATUS
+		lag := ""
+		if sqlRunning == "Yes" {
+			lag, _ = row.String("lag")
+		}
+		status["Channel_Name"] = append(status["Channel_Name"], name)
+		status["Master_Host"] = append(status["Master_Host"], host)
+		status["Master_Port"] = append(status["Master_Port"], port)
+		status["Slave_IO_Running"] = append(status["Slave_IO_Running"], ioRunning)
+		status["Slave_SQL_Running"] = append(status["Slave_SQL_Running"], sqlRunning)
+		status["Seconds_Behind_Master"] = append(status["Seconds_Behind_Master"], lag)
+	}
+	return status, nil
+}
+
+//runs first over db, and second if it fails, returning the columns
+// named as SHOW SLAVE STATUS names them
+func replicaStatus(db tools.MysqlDB, first, second string) (map[string][]string, error) {
+	res, err := db.QueryReturnColumnDict(first)
+	if err != nil {
+		var ferr error
+		res, ferr = db.QueryReturnColumnDict(second)
+		if ferr != nil {
+			return nil, err
+		}
+	}
+	return slaveColumns(res), nil
+}
+
+//finds whether this server is a replica, because SHOW SLAVE STATUS
+// returned rows, or a primary, because it returned none and read_only is
+// off. a read only server that doesn't replicate could be either
+func (s *MysqlStat) setRole(slaveStatus map[string][]string) {
+	res, err := s.db.QueryReturnColumnDict(roleQuery)
+	if err != nil {
+		s.db.Log(err)
+	}
+	row := tools.NewResultRow(res, 0, s.db.Log)
+	role := ""
+	readOnly, ok := row.Int("read_only")
+	for _, values := range slaveStatus {
+		if len(values) > 0 {
+			role = roleReplica
+			break
+		}
+	}
+	if role == "" && ok && readOnly == 0 {
+		role = rolePrimary
+	}
+	s.infoLock.Lock()
+	if s.roleSet != "" {
+		role = s.roleSet
+	}
+	s.infoLock.Unlock()
+	switch role {
+	case roleReplica:
+		s.Metrics.IsReplica.Set(float64(1))
+	case rolePrimary:
+		s.Metrics.IsReplica.Set(float64(0))
+	}
+	logBin, binlogKnown := row.Int("log_bin")
+	s.infoLock.Lock()
+	if s.roleAware && role != s.role && role != "" {
+		s.db.Log("server role is now " + role)
+	}
+	s.role = role
+	s.binlogOff = binlogKnown && logBin == 0
+	s.infoLock.Unlock()
+}
+
+//renames SHOW REPLICA STATUS columns to their SHOW SLAVE STATUS names,
+// Seconds_Behind_Source to Seconds_Behind_Master and so on. columns
+// such as Replicate_Do_DB are left as they are
+func slaveColumns(res map[string][]string) map[string][]string {
+	renamed := make(map[string][]string, len(res))
+	for col, values := range res {
+		words := strings.Split(col, "_")
+		for i, word := range words {
+			switch word {
+			case "Replica":
+				words[i] = "Slave"
+			case "Source":
+				words[i] = "Master"
+			}
+		}
+		renamed[strings.Join(words, "_")] = values
+	}
+	return renamed
+}
+
+//splits version, as returned by VERSION(), into its numbers, leaving
+// out any suffix such as -log or -MariaDB
+func versionParts(version string) []string {
+	if i := strings.IndexAny(version, "-+~ "); i >= 0 {
+		version = version[:i]
+	}
+	return strings.Split(version, ".")
+}
+
+//encodes version, as returned by VERSION(), as
+// major*10000 + minor*100 + patch, so 5.7.31-log is 50731 and
+// 10.4.13-MariaDB is 100413. a missing patch counts as 0, and
+// letters after a number, as in 9.8.76a, are left out
+func parseVersion(version string) (float64, error) {
+	parts := versionParts(version)
+	if len(parts) < 2 {
+		return 0, errors.New("can't parse version " + version)
+	}
+	ver := 0
+	for i, scale := range []int{10000, 100, 1} {
+		if i >= len(parts) {
+			break
+		}
+		digits := strings.TrimRightFunc(parts[i], func(r rune) bool { return r < '0' || r > '9' })
+		n, err := strconv.Atoi(digits)
+		if err != nil || n < 0 {
+			return 0, errors.New("can't parse version " + version)
+		}
+		ver += n * scale
+	}
+	return float64(ver), nil
+}
+
+//reports whether version, as returned by VERSION(), is at least
+// major.minor.patch. false if it can't be parsed
+func versionAtLeast(version string, major, minor, patch int) bool {
+	parts := versionParts(version)
+	if len(parts) < 2 {
+		return false
+	}
+	want := []int{major, minor, patch}
+	for i, w := range want {
+		n := 0
+		if i < len(parts) {
+			var err error
+			n, err = strconv.Atoi(parts[i])
+			if err != nil {
+				return false
+			}
+		}
+		if n != w {
+			return n > w
+		}
+	}
+	return true
+}
+
+//gets global statuses
+func (s *MysqlStat) GetGlobalStatus() {
+	res, err := s.db.QueryReturnColumnDict(maxPreparedStmtCountQuery)
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	var max_prepared_stmt_count int64
+	if err == nil && len(res["Value"]) > 0 {
+		max_prepared_stmt_count, err = strconv.ParseInt(res["Value"][0], 10, 64)
+		if err != nil {
+			s.db.Log(err)
+		}
+	}
+
+	res, err = s.db.QueryMapFirstColumnToRow(s.query(globalStatsQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	vars := map[string]interface{}{
+		"Aborted_clients":                   s.Metrics.AbortedClients,
+		"Binlog_cache_disk_use":             s.Metrics.BinlogCacheDiskUse,
+		"Binlog_cache_use":                  s.Metrics.BinlogCacheUse,
+		"Com_admin_commands":                s.Metrics.ComAdminCommands,
+		"Com_alter_table":                   s.Metrics.ComAlterTable,
+		"Com_begin":                         s.Metrics.ComBegin,
+		"Com_change_db":                     s.Metrics.ComChangeDb,
+		"Com_commit":                        s.Metrics.ComCommit,
+		"Com_create_table":                  s.Metrics.ComCreateTable,
+		"Com_delete":                        s.Metrics.ComDelete,
+		"Com_delete_multi":                  s.Metrics.ComDeleteMulti,
+		"Com_drop_table":                    s.Metrics.ComDropTable,
+		"Com_insert":                        s.Metrics.ComInsert,
+		"Com_insert_select":                 s.Metrics.ComInsertSelect,
+		"Com_kill":                          s.Metrics.ComKill,
+		"Com_replace":                       s.Metrics.ComReplace,
+		"Com_replace_select":                s.Metrics.ComReplaceSelect,
+		"Com_rollback":                      s.Metrics.ComRollback,
+		"Com_select":                        s.Metrics.ComSelect,
+		"Com_set_option":                    s.Metrics.ComSetOption,
+		"Com_stmt_fetch":                    s.Metrics.ComStmtFetch,
+		"Com_update":                        s.Metrics.ComUpdate,
+		"Com_update_multi":                  s.Metrics.ComUpdateMulti,
+		"Connection_errors_accept":          s.Metrics.ConnectionErrorsAccept,
+		"Connection_errors_internal":        s.Metrics.ConnectionErrorsInternal,
+		"Connection_errors_max_connections": s.Metrics.ConnectionErrorsMaxConnections,
+		"Connection_errors_peer_address":    s.Metrics.ConnectionErrorsPeerAddress,
+		"Connection_errors_select":          s.Metrics.ConnectionErrorsSelect,
+		"Connection_errors_tcpwrap":         s.Metrics.ConnectionErrorsTcpwrap,
+		"Created_tmp_disk_tables":           s.Metrics.CreatedTmpDiskTables,
+		"Created_tmp_files":                 s.Metrics.CreatedTmpFiles,
+		"Created_tmp_tables":                s.Metrics.CreatedTmpTables,
+		"Handler_commit":                    s.Metrics.HandlerCommit,
+		"Handler_rollback":                  s.Metrics.HandlerRollback,
+		"Innodb_available_undo_logs":        s.Metrics.InnodbAvailableUndoLogs,
+		"Innodb_buffer_pool_pages_latched":  s.Metrics.InnodbBufferPoolPagesLatched,
+		"Innodb_current_row_locks":          s.Metrics.InnodbCurrentRowLocks,
+		"Innodb_data_fsyncs":                s.Metrics.InnodbDataFsyncs,
+		"Innodb_data_pending_fsyncs":        s.Metrics.InnodbDataPendingFsyncs,
+		"Innodb_dblwr_writes":               s.Metrics.InnodbDblwrWrites,
+		"Innodb_dblwr_pages_written":        s.Metrics.InnodbDblwrPagesWritten,
+		"Innodb_log_os_waits":               s.Metrics.InnodbLogOsWaits,
+		"Innodb_row_lock_current_waits":     s.Metrics.InnodbRowLockCurrentWaits,
+		"Innodb_row_lock_time_avg":          s.Metrics.InnodbRowLockTimeAvg,
+		"Innodb_row_lock_time_max":          s.Metrics.InnodbRowLockTimeMax,
+		"Prepared_stmt_count":               s.Metrics.PreparedStmtCount,
+		"Queries":                           s.Metrics.Queries,
+		"Select_range":                      s.Metrics.SelectRange,
+		"Sort_merge_passes":                 s.Metrics.SortMergePasses,
+		"Table_locks_immediate":             s.Metrics.TableLocksImmediate,
+		"Table_locks_waited":                s.Metrics.TableLocksWaited,
+		"Threads_connected":                 s.Metrics.ThreadsConnected,
+		"Uptime":                            s.Metrics.Uptime,
+		"Uptime_since_flush_status":         s.Metrics.UptimeSinceFlushStatus,
+		"Threads_running":                   s.Metrics.ThreadsRunning,
+	}
+
+	//range through expected metrics and grab from data
+	for name, metric := range vars {
+		v, ok := res[name]
+		if ok && len(v) > 0 {
+			val, err := strconv.ParseFloat(string(v[0]), 64)
+			if err != nil {
+				s.db.Log(err)
+			}
+			switch met := metric.(type) {
+			case *metrics.Counter:
+				met.Set(uint64(val))
+			case *metrics.Gauge:
+				met.Set(float64(val))
+			}
+		}
+	}
+
+	if max_prepared_stmt_count != 0 {
+		pct := (s.Metrics.PreparedStmtCount.Get() / float64(max_prepared_stmt_count)) * 100
+		s.Metrics.PreparedStmtPct.Set(pct)
+	}
+	s.setExtraStatus(res)
+
+	//share of table lock requests since startup that had to wait
+	locks := s.Metrics.TableLocksImmediate.Get() + s.Metrics.TableLocksWaited.Get()
+	if locks != 0 {
+		s.Metrics.TableLockContentionRatio.Set(float64(s.Metrics.TableLocksWaited.Get()) / float64(locks))
+	}
+	//queries that keep spilling temporary tables to disk
+	tmpTables := s.Metrics.CreatedTmpTables.Get()
+	if tmpTables != 0 {
+		s.Metrics.CreatedTmpDiskTablesRatio.Set(float64(s.Metrics.CreatedTmpDiskTables.Get()) / float64(tmpTables))
+	}
+	//a high share points at application errors or deadlock retries
+	trxs := s.Metrics.HandlerCommit.Get() + s.Metrics.HandlerRollback.Get()
+	if trxs != 0 {
+		s.Metrics.RollbackRatio.Set(float64(s.Metrics.HandlerRollback.Get()) / float64(trxs))
+	}
+	s.setCertExpiry(res)
+	s.setBufferPoolLoad(res)
+
+	s.wg.Done()
+	return
+}
+
+//sets the seconds until the server's TLS certificate expires, from
+// Ssl_server_not_after. it is empty on servers without TLS
+func (s *MysqlStat) setCertExpiry(res map[string][]string) {
+	v, ok := tools.NewResultRow(res, 0, s.db.Log).String("Ssl_server_not_after")
+	if !ok {
+		return
+	}
+	notAfter, err := time.Parse(sslTimeLayout, v)
+	if err != nil {
+		s.db.Log("can't parse Ssl_server_not_after: " + err.Error())
+		return
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	s.Metrics.SslServerCertExpirySeconds.Set(notAfter.Sub(now()).Seconds())
+}
+
+//sets whether the buffer pool is being warmed from the dump
+// innodb_buffer_pool_dump_at_shutdown wrote, and how far along, from
+// Innodb_buffer_pool_load_status. it reads e.g.
+// "Loaded 5121/6441 pages" while loading and
+// "Buffer pool(s) load completed at 170601 12:34:56" once done, and the
+// hit ratio is low until then. progress is left unset when nothing was
+// loaded, or the load was aborted
+func (s *MysqlStat) setBufferPoolLoad(res map[string][]string) {
+	status, ok := tools.NewResultRow(res, 0, s.db.Log).String("Innodb_buffer_pool_load_status")
+	if !ok {
+		return
+	}
+	var loaded, total float64
+	switch {
+	case strings.Contains(status, "load completed"):
+		s.Metrics.InnodbBufpoolLoadInProgress.Set(0)
+		s.Metrics.InnodbBufpoolLoadPct.Set(100)
+	case strings.HasPrefix(status, "Loaded "):
+		s.Metrics.InnodbBufpoolLoadInProgress.Set(1)
+		if _, err := fmt.Sscanf(status, "Loaded %g/%g pages", &loaded, &total); err != nil {
+			s.db.Log("can't parse Innodb_buffer_pool_load_status: " + status)
+		} else if total > 0 {
+			s.Metrics.InnodbBufpoolLoadPct.Set(loaded / total * 100)
+		}
+	case strings.HasPrefix(status, "Loading "), strings.Contains(status, "load starting"):
+		s.Metrics.InnodbBufpoolLoadInProgress.Set(1)
+		s.Metrics.InnodbBufpoolLoadPct.Set(0)
+	default:
+		s.Metrics.InnodbBufpoolLoadInProgress.Set(0)
+	}
+}
+
+//get time of oldest query in seconds
+func (s *MysqlStat) GetOldestQuery() {
+	res, err := s.db.QueryReturnColumnDict(s.query(oldestQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	t := int64(0)
+	if time, ok := res["time"]; ok && len(time) > 0 {
+		t, err = strconv.ParseInt(time[0], 10, 64)
+		if err != nil {
+			s.db.Log(err)
+		}
+	}
+	s.Metrics.OldestQueryS.Set(float64(t))
+	s.wg.Done()
+	return
+}
+
+func (s *MysqlStat) GetOldestTrx() {
+	res, err := s.db.QueryReturnColumnDict(s.query(oldestTrx))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	t := int64(0)
+	if time, ok := res["time"]; ok && len(time) > 0 {
+		t, _ = strconv.ParseInt(time[0], 10, 64)
 		//only error expecting is when "NULL" is encountered
 	}
-	s.Metrics.OldestTrxS.Set(float64(t))
+	s.Metrics.OldestTrxS.Set(float64(t))
+	s.wg.Done()
+	return
+}
+
+//counts the open transactions by how long they have been open, so a
+// pile of long transactions shows and not only the oldest one
+func (s *MysqlStat) GetActiveTrxAges() {
+	res, err := s.db.QueryReturnColumnDict(s.query(trxAgesQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	buckets := []struct {
+		age   float64
+		gauge *metrics.Gauge
+	}{
+		{1, s.Metrics.ActiveTrxOver1s},
+		{10, s.Metrics.ActiveTrxOver10s},
+		{60, s.Metrics.ActiveTrxOver60s},
+		{300, s.Metrics.ActiveTrxOver300s},
+	}
+	counts := make([]float64, len(buckets))
+	for i := range res["age"] {
+		age, ok := tools.NewResultRow(res, i, s.db.Log).Float("age")
+		if !ok {
+			continue
+		}
+		for j, b := range buckets {
+			if age > b.age {
+				counts[j]++
+			}
+		}
+	}
+	for i, b := range buckets {
+		b.gauge.Set(counts[i])
+	}
+	s.wg.Done()
+}
+
+//calculate query response times
+func (s *MysqlStat) GetQueryResponseTime() {
+	timers := map[string]*metrics.Counter{
+		".000001":  s.Metrics.QueryResponseSec_000001,
+		".00001":   s.Metrics.QueryResponseSec_00001,
+		".0001":    s.Metrics.QueryResponseSec_0001,
+		".001":     s.Metrics.QueryResponseSec_001,
+		".01":      s.Metrics.QueryResponseSec_01,
+		".1":       s.Metrics.QueryResponseSec_1,
+		"1.":       s.Metrics.QueryResponseSec1_,
+		"10.":      s.Metrics.QueryResponseSec10_,
+		"100.":     s.Metrics.QueryResponseSec100_,
+		"1000.":    s.Metrics.QueryResponseSec1000_,
+		"10000.":   s.Metrics.QueryResponseSec10000_,
+		"100000.":  s.Metrics.QueryResponseSec100000_,
+		"1000000.": s.Metrics.QueryResponseSec100000_,
+	}
+
+	res, err := s.db.QueryReturnColumnDict(s.query(responseTimeQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+
+	for i, time := range res["time"] {
+		count, err := strconv.ParseInt(res["count"][i], 10, 64)
+		if err != nil {
+			s.db.Log(err)
+		}
+		if count < 1 {
+			continue
+		}
+		key := strings.Trim(time, " 0")
+		if timer, ok := timers[key]; ok {
+			timer.Set(uint64(count))
+		}
+	}
+	s.wg.Done()
+	return
+}
+
+//gets status on binary logs
+func (s *MysqlStat) GetBinlogFiles() {
+	res, err := s.db.QueryReturnColumnDict(s.query(binlogQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	s.Metrics.BinlogFiles.Set(float64(len(res["File_size"])))
+	binlog_total_size := int64(0)
+	for _, size := range res["File_size"] {
+		si, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			s.db.Log(err) //don't return err so we can continue with more values
+		}
+		binlog_total_size += si
+	}
+	s.Metrics.BinlogSize.Set(float64(binlog_total_size))
+	if len(res["Log_name"]) > 0 {
+		s.setOldestBinlogAge(res["Log_name"][0])
+	}
+	s.wg.Done()
+	return
+}
+
+//get the age of the first event in the oldest binary log, how far back
+// point in time recovery can go. no query has the time, so it is read
+// from the file's header, only with SetLocalBinlogs
+func (s *MysqlStat) setOldestBinlogAge(oldest string) {
+	if !s.localBinlogs {
+		return
+	}
+	res, err := s.db.QueryReturnColumnDict(binlogBasenameQuery)
+	if err != nil {
+		s.db.Log(err)
+		return
+	}
+	if len(res["basename"]) == 0 || res["basename"][0] == "" {
+		return
+	}
+	path := filepath.Join(filepath.Dir(res["basename"][0]), filepath.Base(oldest))
+	started, err := binlogStart(path)
+	if os.IsNotExist(err) {
+		return //the server is on another host
+	}
+	if err != nil {
+		s.db.Log(err)
+		return
+	}
+	s.Metrics.OldestBinlogAgeSeconds.Set(time.Since(started).Seconds())
+}
+
+//returns the time of the first event in the binary log at path. the
+// file starts with a 4 byte magic number, followed by the first event
+// whose header starts with its unix time
+func binlogStart(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return time.Time{}, errors.New(path + ": " + err.Error())
+	}
+	if string(header[:4]) != binlogMagic {
+		return time.Time{}, errors.New(path + " is not a binary log")
+	}
+	return time.Unix(int64(binary.LittleEndian.Uint32(header[4:])), 0), nil
+}
+
+//get number of long running queries
+func (s *MysqlStat) GetNumLongRunQueries() {
+	res, err := s.db.QueryReturnColumnDict(s.query(longQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	found_sql := len(res["ID"])
+	s.Metrics.ActiveLongRunQueries.Set(float64(found_sql))
+	s.setFingerprints(res)
+	s.wg.Done()
+	return
+}
+
+//long running queries of one fingerprint in a collection
+type fingerprintCount struct {
+	id, fingerprint string
+	count           int
+	maxTime         float64
+}
+
+//groups long running queries by fingerprint and keeps the
+// fingerprintTop with the most queries. fingerprints that drop out are
+// no longer output. each fingerprint is logged when it is first tracked,
+// so its id can be looked up without logging any query's data
+func (s *MysqlStat) setFingerprints(res map[string][]string) {
+	s.infoLock.Lock()
+	top := s.fingerprintTop
+	s.infoLock.Unlock()
+	if top <= 0 {
+		return
+	}
+	counts := make(map[string]*fingerprintCount)
+	for i, info := range res["INFO"] {
+		if info == "" {
+			continue
+		}
+		fingerprint := tools.Fingerprint(info)
+		id := tools.FingerprintID(fingerprint)
+		c, ok := counts[id]
+		if !ok {
+			c = &fingerprintCount{id: id, fingerprint: fingerprint}
+			counts[id] = c
+		}
+		c.count++
+		if t, ok := tools.NewResultRow(res, i, nil).Float("TIME"); ok && t > c.maxTime {
+			c.maxTime = t
+		}
+	}
+	sorted := make([]*fingerprintCount, 0, len(counts))
+	for _, c := range counts {
+		sorted = append(sorted, c)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		return sorted[i].id < sorted[j].id
+	})
+	if len(sorted) > top {
+		sorted = sorted[:top]
+	}
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	tracked := make(map[string]*MysqlStatPerFingerprint)
+	for _, c := range sorted {
+		f, ok := s.fingerprints[c.id]
+		if !ok {
+			f = new(MysqlStatPerFingerprint)
+			misc.InitializeMetrics(f, s.m, metricPrefix(s.namespace)+".LongQueries."+c.id, true)
+			s.db.Log("long running query fingerprint " + c.id + ": " + c.fingerprint)
+		}
+		f.Count.Set(float64(c.count))
+		f.MaxTime.Set(c.maxTime)
+		tracked[c.id] = f
+	}
+	s.fingerprints = tracked
+}
+
+//get version
+//version is of the form '5.7.31-log' or '10.4.13-MariaDB'
+// and is kept as a number that compares like versions do, see parseVersion
+func (s *MysqlStat) GetVersion() {
+	res, err := s.db.QueryReturnColumnDict(s.query(versionQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if len(res["VERSION()"]) == 0 {
+		s.wg.Done()
+		return
+	}
+	ver, err := parseVersion(res["VERSION()"][0])
+	if err != nil {
+		s.db.Log(err)
+	} else {
+		s.Metrics.Version.Set(ver)
+	}
+	s.wg.Done()
+	return
+}
+
+// get binlog statistics
+func (s *MysqlStat) GetBinlogStats() {
+	res, err := s.db.QueryReturnColumnDict(s.query(binlogStatsQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if len(res["File"]) == 0 || len(res["Position"]) == 0 {
+		s.wg.Done()
+		return
+	}
+
+	v, err := strconv.ParseFloat(strings.Split(string(res["File"][0]), ".")[1], 64)
+	if err != nil {
+		s.db.Log(err)
+	}
+	s.Metrics.BinlogSeqFile.Set(float64(v))
+	v, err = strconv.ParseFloat(string(res["Position"][0]), 64)
+	if err != nil {
+		s.db.Log(err)
+	}
+	s.Metrics.BinlogPosition.Set(uint64(v))
+	s.wg.Done()
+	return
+}
+
+//detect application bugs which result in multiple instance of the same query "stacking up"/ executing at the same time
+func (s *MysqlStat) GetStackedQueries() {
+	cmd := s.query(stackedQuery)
+	res, err := s.db.QueryReturnColumnDict(cmd)
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if len(res["identical_queries_stacked"]) > 0 {
+		count, err := strconv.ParseFloat(string(res["identical_queries_stacked"][0]), 64)
+		if err != nil {
+			s.db.Log(err)
+		}
+		s.Metrics.IdenticalQueriesStacked.Set(float64(count))
+		age, err := strconv.ParseFloat(string(res["max_age"][0]), 64)
+		if err != nil {
+			s.db.Log(err)
+		}
+		s.Metrics.IdenticalQueriesMaxAge.Set(float64(age))
+	}
+	s.wg.Done()
+	return
+}
+
+//get session stats
+func (s *MysqlStat) GetSessions() {
+	res, err := s.db.QueryReturnColumnDict(sessionQuery1)
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	var max_sessions int64
+	for _, val := range res {
+		max_sessions, err = strconv.ParseInt(val[0], 10, 64)
+		if err != nil {
+			s.db.Log(err)
+		}
+		s.Metrics.MaxConnections.Set(float64(max_sessions))
+	}
+	res, err = s.db.QueryReturnColumnDict(s.query(sessionQuery2))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if len(res["COMMAND"]) == 0 {
+		s.wg.Done()
+		return
+	}
+	current_total := len(res["COMMAND"])
+	s.Metrics.CurrentSessions.Set(float64(current_total))
+	pct := (float64(current_total) / float64(max_sessions)) * 100
+	s.Metrics.CurrentConnectionsPct.Set(pct)
+
+	active := 0.0
+	unauthenticated := 0
+	locked := 0
+	table_lock_wait := 0
+	global_read_lock_wait := 0
+	backup_lock_wait := 0
+	copy_to_table := 0
+	statistics := 0
+	var replicas []string
+	for i, val := range res["COMMAND"] {
+		if val != "Sleep" && val != "Connect" && val != "Binlog Dump" {
+			active += 1
+		}
+		//each connected replica has a dump thread reading the binlog
+		if val == "Binlog Dump" || val == "Binlog Dump GTID" {
+			replicas = append(replicas, replicaHost(res["HOST"], i))
+		}
+		if matched, err := regexp.MatchString("unauthenticated", res["USER"][i]); err == nil && matched {
+			unauthenticated += 1
+		}
+		if matched, err := regexp.MatchString("Locked", res["STATE"][i]); err == nil && matched {
+			locked += 1
+		} else if matched, err := regexp.MatchString("Table Lock", res["STATE"][i]); err == nil && matched {
+			table_lock_wait += 1
+		} else if matched, err := regexp.MatchString("Waiting for global read lock", res["STATE"][i]); err == nil && matched {
+			global_read_lock_wait += 1
+		} else if matched, err := regexp.MatchString("Waiting for backup lock", res["STATE"][i]); err == nil && matched {
+			backup_lock_wait += 1
+		} else if matched, err := regexp.MatchString("opy.*table", res["STATE"][i]); err == nil && matched {
+			copy_to_table += 1
+		} else if matched, err := regexp.MatchString("statistics", res["STATE"][i]); err == nil && matched {
+			statistics += 1
+		}
+	}
+	s.Metrics.ActiveSessions.Set(active)
+	s.Metrics.BusySessionPct.Set((active / float64(current_total)) * float64(100))
+	s.Metrics.UnauthenticatedSessions.Set(float64(unauthenticated))
+	s.Metrics.LockedSessions.Set(float64(locked))
+	s.Metrics.SessionTablesLocks.Set(float64(table_lock_wait))
+	s.Metrics.SessionGlobalReadLocks.Set(float64(global_read_lock_wait))
+	s.Metrics.SessionBackupLockWaits.Set(float64(backup_lock_wait))
+	s.Metrics.SessionsCopyingToTable.Set(float64(copy_to_table))
+	s.Metrics.SessionsStatistics.Set(float64(statistics))
+	s.Metrics.ConnectedReplicas.Set(float64(len(replicas)))
+	sort.Strings(replicas)
+	s.infoLock.Lock()
+	s.replicas = replicas
+	s.infoLock.Unlock()
+	s.setHostSessions(res["HOST"])
+
+	s.wg.Done()
+	return
+}
+
+//returns the host of the i-th processlist HOST value, without the port
+func replicaHost(hosts []string, i int) string {
+	if i >= len(hosts) {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(hosts[i])
+	if err != nil {
+		return hosts[i]
+	}
+	return host
+}
+
+//metrics from innodb
+func (s *MysqlStat) GetInnodbStats() {
+	res, err := s.db.QueryReturnColumnDict(innodbQuery)
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	var innodb_log_file_size int64
+	if err == nil && len(res["Value"]) > 0 {
+		innodb_log_file_size, err = strconv.ParseInt(res["Value"][0], 10, 64)
+		if err != nil {
+			s.db.Log(err)
+		}
+	}
+
+	res, err = s.db.QueryReturnColumnDict("SHOW ENGINE INNODB STATUS")
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+
+	//parse the result
+	var idb *tools.InnodbStats
+	idb, _ = tools.ParseInnodbStats(res["Status"][0])
+	vars := map[string]interface{}{
+		"OS_file_reads":               s.Metrics.OSFileReads,
+		"OS_file_writes":              s.Metrics.OSFileWrites,
+		"adaptive_hash":               s.Metrics.AdaptiveHash,
+		"avg_bytes_per_read":          s.Metrics.AvgBytesPerRead,
+		"buffer_pool_hit_rate":        s.Metrics.BufferPoolHitRate,
+		"buffer_pool_size":            s.Metrics.BufferPoolSize,
+		"cache_hit_pct":               s.Metrics.CacheHitPct,
+		"checkpoint_age":              s.Metrics.InnodbCheckpointAge,
+		"checkpoint_age_target":       s.Metrics.InnodbCheckpointAgeTarget,
+		"database_pages":              s.Metrics.DatabasePages,
+		"dictionary_cache":            s.Metrics.DictionaryCache,
+		"dictionary_memory_allocated": s.Metrics.DictionaryMemoryAllocated,
+		"file_system":                 s.Metrics.FileSystem,
+		"flush_list_len":              s.Metrics.InnodbFlushListLength,
+		"free_buffers":                s.Metrics.FreeBuffers,
+		"fsyncs_per_s":                s.Metrics.FsyncsPerSec,
+		"pending_fsyncs_buffer_pool":  s.Metrics.PendingFsyncsBufferPool,
+		"pending_fsyncs_log":          s.Metrics.PendingFsyncsLog,
+		"history_list":                s.Metrics.InnodbHistoryLinkList,
+		"last_checkpoint_at":          s.Metrics.InnodbLastCheckpointAt,
+		"lock_system":                 s.Metrics.LockSystem,
+		"lru_len":                     s.Metrics.InnodbLRUListLength,
+		"log_flushed_up_to":           s.Metrics.InnodbLogFlushedUpTo,
+		"log_io_per_sec":              s.Metrics.LogIOPerSec,
+		"log_sequence_number":         s.Metrics.InnodbLogSequenceNumber,
+		"max_checkpoint_age":          s.Metrics.InnodbMaxCheckpointAge,
+		"modified_age":                s.Metrics.InnodbModifiedAge,
+		"modified_db_pages":           s.Metrics.ModifiedDBPages,
+		"old_database_pages":          s.Metrics.OldDatabasePages,
+		"page_hash":                   s.Metrics.PageHash,
+		"pages_flushed_up_to":         s.Metrics.PagesFlushedUpTo,
+		"pages_made_young":            s.Metrics.PagesMadeYoung,
+		"pages_read":                  s.Metrics.PagesRead,
+		"pending_chkp_writes":         s.Metrics.InnodbPendingCheckpointWrites,
+		"pending_log_writes":          s.Metrics.InnodbPendingLogWrites,
+		"pending_reads":               s.Metrics.PendingReads,
+		"pending_writes_lru":          s.Metrics.PendingWritesLRU,
+		"reads_per_s":                 s.Metrics.ReadsPerSec,
+		"recovery_system":             s.Metrics.RecoverySystem,
+		"total_mem":                   s.Metrics.TotalMem,
+		"total_mem_by_read_views":     s.Metrics.TotalMemByReadViews,
+		"trx_id":                      s.Metrics.TransactionID,
+		"trxes_not_started":           s.Metrics.InnodbTransactionsNotStarted,
+		"undo":                        s.Metrics.InnodbUndo,
+		"writes_per_s":                s.Metrics.WritesPerSec,
+	}
+	//store the result in the appropriate metrics
+	for name, metric := range vars {
+		v, ok := idb.Metrics[name]
+		if ok {
+			val, err := strconv.ParseFloat(string(v), 64)
+			if err != nil {
+				s.db.Log(err)
+			}
+			//case based on type so can switch between Gauge and Counter easily
+			switch met := metric.(type) {
+			case *metrics.Counter:
+				met.Set(uint64(val))
+			case *metrics.Gauge:
+				met.Set(float64(val))
+			}
+		}
+	}
+	if lsn, ok := idb.Metrics["log_sequence_number"]; ok && innodb_log_file_size != 0 {
+		lsn_s, _ := strconv.ParseFloat(lsn, 64)
+		s.Metrics.InnodbLogWriteRatio.Set((lsn_s * 3600.0) / float64(innodb_log_file_size))
+	}
+	//the lsn age of the oldest modified page. percona reports it directly,
+	// otherwise it's how far the log is ahead of the flushed pages
+	if age, ok := lsnAge(idb.Metrics, "modified_age", "pages_flushed_up_to"); ok {
+		s.Metrics.InnodbOldestModifiedPageAge.Set(age)
+	}
+	s.setRedoAges(idb.Metrics)
+	s.wg.Done()
+	return
+}
+
+//sets how much of the redo log the checkpoint age and the age of the
+// oldest modified page take up. InnoDB flushes asynchronously from
+// about 75% and stalls writes to flush from about 90%
+func (s *MysqlStat) setRedoAges(idb map[string]string) {
+	res, err := s.db.QueryMapFirstColumnToRow(redoCapacityQuery)
+	if err != nil {
+		s.db.Log(err)
+		return
+	}
+	capacity := redoCapacity(res)
+	if capacity == 0 {
+		return
+	}
+	if age, ok := lsnAge(idb, "checkpoint_age", "last_checkpoint_at"); ok {
+		s.Metrics.InnodbCheckpointAgePct.Set(age / capacity * 100)
+	}
+	if age, ok := lsnAge(idb, "modified_age", "pages_flushed_up_to"); ok {
+		s.Metrics.InnodbModifiedAgePct.Set(age / capacity * 100)
+	}
+}
+
+//returns the size of the redo log in bytes from the variables read by
+// redoCapacityQuery, or 0 if it can't be found. innodb_redo_log_capacity
+// replaces the other two from 8.0.30
+func redoCapacity(vars map[string][]string) float64 {
+	value := func(name string) float64 {
+		if len(vars[name]) == 0 {
+			return 0
+		}
+		v, _ := strconv.ParseFloat(vars[name][0], 64)
+		return v
+	}
+	if c := value("innodb_redo_log_capacity"); c > 0 {
+		return c
+	}
+	return value("innodb_log_file_size") * value("innodb_log_files_in_group")
+}
+
+//get the size of the redo log and, from 8.0.30, how much of it the redo
+// log files hold. earlier servers size the redo log with
+// innodb_log_file_size and innodb_log_files_in_group and don't list the
+// files, so only the capacity is collected there
+func (s *MysqlStat) GetRedoLog() {
+	res, err := s.db.QueryMapFirstColumnToRow(s.query(redoCapacityQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	capacity := redoCapacity(res)
+	if len(res["innodb_redo_log_capacity"]) == 0 {
+		if capacity > 0 {
+			s.Metrics.InnodbRedoLogCapacityBytes.Set(capacity)
+		}
+		s.wg.Done()
+		return
+	}
+
+	resized, err := s.db.QueryMapFirstColumnToRow(redoResizedQuery)
+	if err != nil {
+		s.db.Log(err)
+	} else if v := resized["Innodb_redo_log_capacity_resized"]; len(v) > 0 {
+		if c, err := strconv.ParseFloat(v[0], 64); err == nil && c > 0 {
+			capacity = c
+		}
+	}
+	if capacity == 0 {
+		s.wg.Done()
+		return
+	}
+	s.Metrics.InnodbRedoLogCapacityBytes.Set(capacity)
+
+	files, err := s.db.QueryReturnColumnDict(redoFilesQuery)
+	if err != nil {
+		if tools.ClassifyError(err) == tools.ErrorUnsupported {
+			s.db.Log(err)
+		} else {
+			s.logError(err)
+		}
+		s.wg.Done()
+		return
+	}
+	if len(files["used"]) > 0 {
+		used, err := strconv.ParseFloat(files["used"][0], 64)
+		if err != nil {
+			s.db.Log(err)
+		} else {
+			s.Metrics.InnodbRedoLogUsedBytes.Set(used)
+			s.Metrics.InnodbRedoLogUsedPct.Set(used / capacity * 100)
+		}
+	}
+	s.wg.Done()
+	return
+}
+
+//returns the age named key in the LOG section of innodb status. servers
+// that don't print it get the log sequence number less the LSN named by
+// since instead
+func lsnAge(idb map[string]string, key, since string) (float64, bool) {
+	if v, ok := idb[key]; ok {
+		age, err := strconv.ParseFloat(v, 64)
+		return age, err == nil
+	}
+	lsn, err := strconv.ParseFloat(idb["log_sequence_number"], 64)
+	if err != nil {
+		return 0, false
+	}
+	at, err := strconv.ParseFloat(idb[since], 64)
+	if err != nil {
+		return 0, false
+	}
+	return lsn - at, true
+}
+
+//get backups count
+func (s *MysqlStat) GetBackups() {
+	out, err := exec.Command("ps", "aux").Output()
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	blob := string(out)
+	lines := strings.Split(blob, "\n")
+	backupProcs := 0
+	for _, line := range lines {
+		words := strings.Split(line, " ")
+		if len(words) < 10 {
+			continue
+		}
+		command := strings.Join(words[10:], " ")
+		if strings.Contains(command, "innobackupex") ||
+			strings.Contains(command, "mysqldump") ||
+			strings.Contains(command, "mydumper") {
+			backupProcs += 1
+		}
+	}
+	s.Metrics.BackupsRunning.Set(float64(backupProcs))
+	s.wg.Done()
+	return
+}
+
+//get count unsecure users
+func (s *MysqlStat) GetSecurity() {
+	res, err := s.db.QueryReturnColumnDict(s.query(securityQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	s.Metrics.UnsecureUsers.Set(float64(len(res["user"])))
+	s.wg.Done()
+	return
+}
+
+//get counts of stored routines, triggers and scheduled events,
+// as an inventory for spotting drift after migrations
+func (s *MysqlStat) GetSchemaObjects() {
+	counts := map[string]*metrics.Gauge{
+		routinesQuery: s.Metrics.Routines,
+		triggersQuery: s.Metrics.Triggers,
+		eventsQuery:   s.Metrics.Events,
+	}
+	for query, metric := range counts {
+		res, err := s.db.QueryReturnColumnDict(query)
+		if err != nil {
+			s.logError(err)
+			continue
+		}
+		if len(res["count"]) > 0 {
+			v, err := strconv.ParseFloat(res["count"][0], 64)
+			if err != nil {
+				s.db.Log(err)
+				continue
+			}
+			metric.Set(v)
+		}
+		if query == eventsQuery && len(res["enabled"]) > 0 {
+			v, err := strconv.ParseFloat(res["enabled"][0], 64)
+			if err != nil {
+				s.db.Log(err)
+				continue
+			}
+			s.Metrics.EventsEnabled.Set(v)
+		}
+	}
+	s.wg.Done()
+	return
+}
+
+//records which replication filters are set from a SHOW SLAVE STATUS result.
+// filters silently cause data divergence, so any filter being set is flagged
+//counts replication channels, one per row of SHOW SLAVE STATUS, and
+// how many of them have both the IO and SQL threads running
+func (s *MysqlStat) setReplicationChannels(res map[string][]string) {
+	healthy := 0
+	for i, ioRunning := range res["Slave_IO_Running"] {
+		if ioRunning == "Yes" && i < len(res["Slave_SQL_Running"]) && res["Slave_SQL_Running"][i] == "Yes" {
+			healthy++
+		}
+	}
+	s.Metrics.ReplicationChannelsTotal.Set(float64(len(res["Slave_IO_Running"])))
+	s.Metrics.ReplicationChannelsHealthy.Set(float64(healthy))
+}
+
+func (s *MysqlStat) setReplicationFilters(res map[string][]string) {
+	filters := make(map[string]string)
+	found := false
+	for _, col := range replicationFilterColumns {
+		v, ok := res[col]
+		if !ok || len(v) == 0 {
+			continue
+		}
+		found = true
+		if v[0] != "" {
+			filters[col] = v[0]
+		}
+	}
+	if !found {
+		return
+	}
+	if len(filters) > 0 {
+		s.Metrics.SlaveHasReplicationFilters.Set(float64(1))
+	} else {
+		s.Metrics.SlaveHasReplicationFilters.Set(float64(0))
+	}
+	s.infoLock.Lock()
+	s.replFilters = filters
+	s.infoLock.Unlock()
+}
+
+// ReplicationFilters returns the replication filters set on this slave
+// as of the last collection, keyed by SHOW SLAVE STATUS column name.
+func (s *MysqlStat) ReplicationFilters() map[string]string {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	filters := make(map[string]string, len(s.replFilters))
+	for col, filter := range s.replFilters {
+		filters[col] = filter
+	}
+	return filters
+}
+
+//get the hostname, version, server_id and server_uuid of the server
+func (s *MysqlStat) GetServerIdentity() {
+	res, err := s.db.QueryReturnColumnDict(s.query(identityQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	var id ServerIdentity
+	if len(res["hostname"]) > 0 {
+		id.Hostname = res["hostname"][0]
+	}
+	if len(res["version"]) > 0 {
+		id.Version = res["version"][0]
+	}
+	if len(res["server_uuid"]) > 0 {
+		id.ServerUUID = res["server_uuid"][0]
+	}
+	if len(res["server_id"]) > 0 {
+		id.ServerID = res["server_id"][0]
+		server_id, err := strconv.ParseFloat(id.ServerID, 64)
+		if err != nil {
+			s.db.Log(err)
+		} else {
+			s.Metrics.ServerID.Set(server_id)
+		}
+	}
+	s.infoLock.Lock()
+	s.identity = id
+	s.infoLock.Unlock()
+	s.wg.Done()
+	return
+}
+
+//records the master named by SHOW SLAVE STATUS. with several channels
+// the first one is used
+func (s *MysqlStat) setReplicationSource(res map[string][]string) {
+	var src ReplicationSource
+	if len(res["Master_Host"]) > 0 {
+		src.Host = res["Master_Host"][0]
+	}
+	if len(res["Master_Port"]) > 0 {
+		src.Port = res["Master_Port"][0]
+	}
+	if len(res["Master_Server_Id"]) > 0 {
+		src.ServerID = res["Master_Server_Id"][0]
+	}
+	s.infoLock.Lock()
+	s.source = src
+	s.infoLock.Unlock()
+}
+
+// Source returns the master this server replicated from at the last
+// collection, so a collector run across a fleet can rebuild the
+// replication topology
+func (s *MysqlStat) Source() ReplicationSource {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	return s.source
+}
+
+// ConnectedReplicas returns the hosts of the replicas reading the binlog
+// at the last collection, sorted. a host with several replicas is listed
+// once for each
+func (s *MysqlStat) ConnectedReplicas() []string {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	return append([]string(nil), s.replicas...)
+}
+
+// SqlMode returns the global sql_mode read by the last collection, so
+// changes to it can be tracked
+func (s *MysqlStat) SqlMode() string {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	return s.sqlMode
+}
+
+// Role returns "primary" or "replica" as found by the last collection,
+// or "" if it wasn't clear. A role given with SetRole is returned as is
+func (s *MysqlStat) Role() string {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	return s.role
+}
+
+// Use role, "primary" or "replica", instead of finding it from read_only
+// and SHOW SLAVE STATUS, for Role, IsReplica and SetRoleAware. "auto" or
+// "" finds it again. Returns an error for any other role
+func (s *MysqlStat) SetRole(role string) error {
+	switch role {
+	case "auto":
+		role = ""
+	case "", rolePrimary, roleReplica:
+	default:
+		return errors.New("unknown role " + strconv.Quote(role) + ", want primary, replica or auto")
+	}
+	s.infoLock.Lock()
+	s.roleSet = role
+	if role != "" {
+		s.role = role
+	}
+	s.infoLock.Unlock()
+	return nil
+}
+
+// Skip getters that don't apply to the server's role, as found by the
+// previous collection: the slave getters on a primary, and the binlog
+// getters when log_bin is off. The first collection runs every getter.
+func (s *MysqlStat) SetRoleAware(on bool) {
+	s.infoLock.Lock()
+	s.roleAware = on
+	s.infoLock.Unlock()
+}
+
+// Identity returns the server identity found by the last collection
+func (s *MysqlStat) Identity() ServerIdentity {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	return s.identity
+}
+
+// Probe looks up only the server identity, to confirm the server can be
+// reached and queried with the configured credentials.
+func (s *MysqlStat) Probe() (ServerIdentity, error) {
+	s.resetErrors()
+	s.wg.Add(1)
+	s.GetServerIdentity()
+	return s.Identity(), s.errs.Err()
+}
+
+//get the number of user accounts, and how many are locked or expired.
+// requires SELECT on mysql.user; without it the metrics are left unset.
+// account_locked only exists on 5.7.6+, so older servers only get a total.
+func (s *MysqlStat) GetAccounts() {
+	res, err := s.db.QueryReturnColumnDict(s.query(accountsQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if count, ok := tools.NewResultRow(res, 0, s.db.Log).Float("count"); ok {
+		s.Metrics.UserAccounts.Set(count)
+	}
+	res, err = s.db.QueryReturnColumnDict(lockedAccountsQuery)
+	if err != nil {
+		s.db.Log(err)
+		s.wg.Done()
+		return
+	}
+	row := tools.NewResultRow(res, 0, s.db.Log)
+	if locked, ok := row.Float("locked"); ok {
+		s.Metrics.LockedAccounts.Set(locked)
+	}
+	if expired, ok := row.Float("expired"); ok {
+		s.Metrics.ExpiredAccounts.Set(expired)
+	}
+	s.wg.Done()
+	return
+}
+
+//checks whether a global read lock or backup lock is currently held.
+// needs the wait/lock/metadata/sql/mdl instrument, which is only on by
+// default from 5.7 onwards
+func (s *MysqlStat) GetGlobalReadLock() {
+	res, err := s.db.QueryReturnColumnDict(s.query(globalReadLockQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if locks, ok := tools.NewResultRow(res, 0, s.db.Log).Int("locks"); ok {
+		if locks > 0 {
+			s.Metrics.GlobalReadLockHeld.Set(1)
+		} else {
+			s.Metrics.GlobalReadLockHeld.Set(0)
+		}
+	}
+	s.wg.Done()
+	return
+}
+
+//get the number of DDL operations running and the age of the oldest.
+// stages in performance_schema are used when available, the processlist
+// otherwise. stage events are only recorded with the events_stages_current
+// consumer enabled, so finding none there also falls back to the processlist
+func (s *MysqlStat) GetDDLOperations() {
+	res, err := s.db.QueryReturnColumnDict(ddlStagesQuery)
+	if err != nil {
+		s.db.Log(err)
+	}
+	if err != nil || len(res["ddl"]) == 0 || res["ddl"][0] == "0" {
+		res, err = s.db.QueryReturnColumnDict(ddlProcesslistQuery)
+		if err != nil {
+			s.logError(err)
+			s.wg.Done()
+			return
+		}
+	}
+	if len(res["ddl"]) > 0 {
+		ddl, err := strconv.ParseFloat(res["ddl"][0], 64)
+		if err != nil {
+			s.db.Log(err)
+		} else {
+			s.Metrics.ActiveDDLOperations.Set(ddl)
+		}
+	}
+	if len(res["oldest"]) > 0 {
+		oldest, err := strconv.ParseFloat(res["oldest"][0], 64)
+		if err != nil {
+			s.db.Log(err)
+		} else {
+			s.Metrics.OldestDDLAgeSec.Set(oldest)
+		}
+	}
+	s.wg.Done()
+	return
+}
+
+//samples Threads_running over a short window and keeps the
+// max, average and 95th percentile of the samples
+func (s *MysqlStat) GetThreadsRunningSamples() {
+	if s.sampleWindow <= 0 || s.sampleInterval <= 0 {
+		s.wg.Done()
+		return
+	}
+	samples := []float64{}
+	for elapsed := time.Duration(0); elapsed < s.sampleWindow; elapsed += s.sampleInterval {
+		if elapsed > 0 {
+			time.Sleep(s.sampleInterval)
+		}
+		res, err := s.db.QueryReturnColumnDict(threadsRunningQuery)
+		if err != nil {
+			s.logError(err)
+			s.wg.Done()
+			return
+		}
+		if len(res["Value"]) == 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(res["Value"][0], 64)
+		if err != nil {
+			s.db.Log(err)
+			continue
+		}
+		samples = append(samples, v)
+	}
+	if len(samples) == 0 {
+		s.wg.Done()
+		return
+	}
+	sort.Float64s(samples)
+	sum := 0.0
+	for _, v := range samples {
+		sum += v
+	}
+	//nearest rank
+	p95 := samples[int(math.Ceil(0.95*float64(len(samples))))-1]
+	s.Metrics.ThreadsRunningMax.Set(samples[len(samples)-1])
+	s.Metrics.ThreadsRunningAvg.Set(sum / float64(len(samples)))
+	s.Metrics.ThreadsRunningP95.Set(p95)
+	s.wg.Done()
+	return
+}
+
+//query for error log entries newer than since
+func errorLogQuery(since string) string {
+	return `
+  SELECT logged, error_code, subsystem, data
+    FROM performance_schema.error_log
+   WHERE prio = 'Error' AND logged > '` + since + `'
+   ORDER BY logged;`
+}
+
+//logs error log entries added since the last collection.
+// the first collection only notes where the log ends
+func (s *MysqlStat) GetRecentErrorLog() {
+	if !s.errorLogTail {
+		s.wg.Done()
+		return
+	}
+	s.infoLock.Lock()
+	since := s.errorLogSince
+	s.infoLock.Unlock()
+	if since == "" {
+		res, err := s.db.QueryReturnColumnDict(errorLogMarkQuery)
+		if err != nil {
+			s.skipErrorLog(err)
+			s.wg.Done()
+			return
+		}
+		if len(res["logged"]) > 0 && res["logged"][0] != "" {
+			since = res["logged"][0]
+		} else {
+			since = "1970-01-01 00:00:00"
+		}
+		s.infoLock.Lock()
+		s.errorLogSince = since
+		s.infoLock.Unlock()
+		s.Metrics.RecentErrorLogEntries.Set(0)
+		s.wg.Done()
+		return
+	}
+	res, err := s.db.QueryReturnColumnDict(errorLogQuery(since))
+	if err != nil {
+		s.skipErrorLog(err)
+		s.wg.Done()
+		return
+	}
+	count := 0
+	newest := since
+	for i, logged := range res["logged"] {
+		//timestamps share one format, so they sort as strings
+		if logged <= since {
+			continue
+		}
+		entry := "error log " + logged
+		if i < len(res["error_code"]) {
+			entry += " " + res["error_code"][i]
+		}
+		if i < len(res["subsystem"]) {
+			entry += " [" + res["subsystem"][i] + "]"
+		}
+		if i < len(res["data"]) {
+			entry += " " + res["data"][i]
+		}
+		s.db.Log(entry)
+		count++
+		if logged > newest {
+			newest = logged
+		}
+	}
+	s.infoLock.Lock()
+	s.errorLogSince = newest
+	s.infoLock.Unlock()
+	s.Metrics.RecentErrorLogEntries.Set(float64(count))
 	s.wg.Done()
 	return
 }
 
-//calculate query response times
-func (s *MysqlStat) GetQueryResponseTime() {
-	timers := map[string]*metrics.Counter{
-		".000001":  s.Metrics.QueryResponseSec_000001,
-		".00001":   s.Metrics.QueryResponseSec_00001,
-		".0001":    s.Metrics.QueryResponseSec_0001,
-		".001":     s.Metrics.QueryResponseSec_001,
-		".01":      s.Metrics.QueryResponseSec_01,
-		".1":       s.Metrics.QueryResponseSec_1,
-		"1.":       s.Metrics.QueryResponseSec1_,
-		"10.":      s.Metrics.QueryResponseSec10_,
-		"100.":     s.Metrics.QueryResponseSec100_,
-		"1000.":    s.Metrics.QueryResponseSec1000_,
-		"10000.":   s.Metrics.QueryResponseSec10000_,
-		"100000.":  s.Metrics.QueryResponseSec100000_,
-		"1000000.": s.Metrics.QueryResponseSec100000_,
+//stops reading the error log on servers without the table,
+// other errors are recorded as usual
+func (s *MysqlStat) skipErrorLog(err error) {
+	if tools.ClassifyError(err) == tools.ErrorUnsupported {
+		s.db.Log("performance_schema.error_log not available, not reading the error log")
+		s.errorLogTail = false
+		return
+	}
+	s.logError(err)
+}
+
+//get per worker state for multi-threaded replication: whether each
+// worker is running and busy, and how many transactions it has applied.
+// applied transactions need the transaction instrument and consumer
+// enabled in performance_schema. workers are tracked by id, which
+// slave_parallel_workers bounds
+func (s *MysqlStat) GetReplicationWorkers() {
+	res, err := s.db.QueryReturnColumnDict(replicationWorkersQuery)
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	busy, idle := 0, 0
+	for i, id := range res["worker"] {
+		worker := s.checkWorker(id)
+		if worker == nil {
+			continue
+		}
+		if i >= len(res["state"]) || res["state"][i] != "ON" {
+			worker.ServiceOn.Set(0)
+			worker.Busy.Set(0)
+		} else {
+			worker.ServiceOn.Set(1)
+			if i < len(res["thread_state"]) && res["thread_state"][i] == workerIdleState {
+				worker.Busy.Set(0)
+				idle++
+			} else {
+				worker.Busy.Set(1)
+				busy++
+			}
+		}
+		if i < len(res["transactions"]) && res["transactions"][i] != "" {
+			applied, err := strconv.ParseUint(res["transactions"][i], 10, 64)
+			if err != nil {
+				s.db.Log(err)
+			} else {
+				worker.AppliedTransactions.Set(applied)
+			}
+		}
+	}
+	if len(res["worker"]) > 0 {
+		s.Metrics.SlaveWorkersBusy.Set(float64(busy))
+		s.Metrics.SlaveWorkersIdle.Set(float64(idle))
+	}
+	s.wg.Done()
+	return
+}
+
+//returns the metrics for worker id, initializing them if needed.
+// returns nil once maxReplicationWorkers workers are tracked
+func (s *MysqlStat) checkWorker(id string) *MysqlStatPerWorker {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	if s.workers == nil {
+		s.workers = make(map[string]*MysqlStatPerWorker)
+	}
+	if worker, ok := s.workers[id]; ok {
+		return worker
+	}
+	if len(s.workers) >= maxReplicationWorkers {
+		return nil
+	}
+	worker := new(MysqlStatPerWorker)
+	misc.InitializeMetrics(worker, s.m, metricPrefix(s.namespace)+".SlaveWorkers."+id, true)
+	s.workers[id] = worker
+	return worker
+}
+
+//counts sessions by client host. hosts seen in earlier collections
+// that have no sessions now are set to 0
+func (s *MysqlStat) setHostSessions(clients []string) {
+	counts := make(map[string]int)
+	for _, client := range clients {
+		host := clientHost(client)
+		if host != "" {
+			counts[host]++
+		}
+	}
+	//in order, so hosts whose names clean the same are always told apart
+	// by the same suffixes
+	hosts := make([]string, 0, len(counts))
+	for host := range counts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		if h := s.checkHost(host); h != nil {
+			h.Sessions.Set(float64(counts[host]))
+		}
+	}
+	s.infoLock.Lock()
+	for host, h := range s.hosts {
+		if _, ok := counts[host]; !ok {
+			h.Sessions.Set(0)
+		}
+	}
+	s.infoLock.Unlock()
+}
+
+//returns the host part of a processlist HOST value, without the port
+func clientHost(client string) string {
+	host, _, err := net.SplitHostPort(client)
+	if err != nil {
+		host = client //no port, e.g. localhost
+	}
+	return host
+}
+
+//returns the metrics for a client host, initializing them if needed.
+// returns nil once maxSessionHosts hosts are tracked
+func (s *MysqlStat) checkHost(host string) *MysqlStatPerHost {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	if s.hosts == nil {
+		s.hosts = make(map[string]*MysqlStatPerHost)
+	}
+	if h, ok := s.hosts[host]; ok {
+		return h
+	}
+	if len(s.hosts) >= maxSessionHosts {
+		return nil
+	}
+	h := new(MysqlStatPerHost)
+	misc.InitializeMetrics(h, s.m, metricPrefix(s.namespace)+".sessions.host."+s.nameComponent("sessions.host", host), true)
+	s.hosts[host] = h
+	return h
+}
+
+//get the max_user_connections and max_questions limits of users that
+// have them, and how many connections each user has open. a user
+// reaching its connection limit can't connect until one closes.
+// processlist doesn't say which host an account was matched by, so
+// connections are counted by user and checked against the smallest
+// limit of its accounts. reading mysql.user needs SELECT on it, without
+// which nothing is collected
+func (s *MysqlStat) GetAccountLimits() {
+	res, err := s.db.QueryReturnColumnDict(s.query(accountLimitsQuery))
+	if err != nil {
+		if tools.ClassifyError(err) == tools.ErrorPrivilege {
+			s.db.Log(err)
+		} else {
+			s.logError(err)
+		}
+		s.wg.Done()
+		return
+	}
+	type limits struct{ connections, questions float64 }
+	byUser := make(map[string]limits)
+	for i, user := range res["user"] {
+		if user == "" || i >= len(res["max_user_connections"]) || i >= len(res["max_questions"]) {
+			continue
+		}
+		conns, err := strconv.ParseFloat(res["max_user_connections"][i], 64)
+		if err != nil {
+			s.db.Log(err)
+			continue
+		}
+		questions, err := strconv.ParseFloat(res["max_questions"][i], 64)
+		if err != nil {
+			s.db.Log(err)
+			continue
+		}
+		l, seen := byUser[user]
+		if !seen || (conns > 0 && (l.connections == 0 || conns < l.connections)) {
+			l.connections = conns
+		}
+		if !seen || (questions > 0 && (l.questions == 0 || questions < l.questions)) {
+			l.questions = questions
+		}
+		byUser[user] = l
+	}
+
+	open := make(map[string]float64)
+	sessions, connErr := s.db.QueryReturnColumnDict(userConnectionsQuery)
+	if connErr != nil {
+		s.logError(connErr)
+	}
+	for i, user := range sessions["user"] {
+		if i < len(sessions["connections"]) {
+			n, err := strconv.ParseFloat(sessions["connections"][i], 64)
+			if err != nil {
+				s.db.Log(err)
+				continue
+			}
+			open[user] = n
+		}
+	}
+
+	//in order, so users whose names clean the same are always told apart
+	// by the same suffixes
+	users := make([]string, 0, len(byUser))
+	for user := range byUser {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	var near []string
+	for _, user := range users {
+		l := byUser[user]
+		account := s.checkAccount(user)
+		if account == nil {
+			continue
+		}
+		account.MaxUserConnections.Set(l.connections)
+		account.MaxQuestions.Set(l.questions)
+		if connErr != nil {
+			continue
+		}
+		account.Connections.Set(open[user])
+		if l.connections > 0 {
+			pct := open[user] / l.connections * 100
+			account.ConnectionsPct.Set(pct)
+			if pct >= accountLimitNearPct {
+				near = append(near, user+" ("+strconv.FormatFloat(open[user], 'f', -1, 64)+
+					" of "+strconv.FormatFloat(l.connections, 'f', -1, 64)+")")
+			}
+		}
+	}
+	if connErr == nil {
+		s.Metrics.AccountsNearConnectionLimit.Set(float64(len(near)))
+	}
+	if len(near) > 0 {
+		sort.Strings(near)
+		s.db.Log("accounts near max_user_connections: " + strings.Join(near, ", "))
+	}
+	s.wg.Done()
+	return
+}
+
+//returns the metrics for a user with resource limits, initializing them
+// if needed. returns nil once maxLimitedAccounts users are tracked
+func (s *MysqlStat) checkAccount(user string) *MysqlStatPerAccount {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	if s.accounts == nil {
+		s.accounts = make(map[string]*MysqlStatPerAccount)
+	}
+	if account, ok := s.accounts[user]; ok {
+		return account
+	}
+	if len(s.accounts) >= maxLimitedAccounts {
+		return nil
+	}
+	account := new(MysqlStatPerAccount)
+	misc.InitializeMetrics(account, s.m, metricPrefix(s.namespace)+".accounts."+s.nameComponent("accounts", user), true)
+	s.accounts[user] = account
+	return account
+}
+
+//returns every group of metrics this collector owns
+func (s *MysqlStat) metricSets() []metricSet {
+	sets := []metricSet{{"", s.Metrics}}
+	s.infoLock.Lock()
+	ids := make([]string, 0, len(s.workers))
+	for id := range s.workers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		sets = append(sets, metricSet{"SlaveWorkers." + id + ".", s.workers[id]})
+	}
+	channels := make([]string, 0, len(s.channels))
+	for name := range s.channels {
+		channels = append(channels, name)
+	}
+	sort.Strings(channels)
+	for _, name := range channels {
+		sets = append(sets, metricSet{"SlaveChannels." + s.nameComponent("SlaveChannels", name) + ".", s.channels[name]})
+	}
+	names := make([]string, 0, len(s.statements))
+	for name := range s.statements {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sets = append(sets, metricSet{"Statements." + name + ".", s.statements[name]})
+	}
+	fingerprints := make([]string, 0, len(s.fingerprints))
+	for id := range s.fingerprints {
+		fingerprints = append(fingerprints, id)
+	}
+	sort.Strings(fingerprints)
+	for _, id := range fingerprints {
+		sets = append(sets, metricSet{"LongQueries." + id + ".", s.fingerprints[id]})
+	}
+	hosts := make([]string, 0, len(s.hosts))
+	for host := range s.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		sets = append(sets, metricSet{"sessions.host." + s.nameComponent("sessions.host", host) + ".", s.hosts[host]})
+	}
+	engines := make([]string, 0, len(s.engines))
+	for engine := range s.engines {
+		engines = append(engines, engine)
+	}
+	sort.Strings(engines)
+	for _, engine := range engines {
+		sets = append(sets, metricSet{"engine." + engine + ".", s.engines[engine]})
+	}
+	users := make([]string, 0, len(s.accounts))
+	for user := range s.accounts {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		sets = append(sets, metricSet{"accounts." + s.nameComponent("accounts", user) + ".", s.accounts[user]})
+	}
+	replicas := make([]string, 0, len(s.replicaLag))
+	for host := range s.replicaLag {
+		replicas = append(replicas, host)
+	}
+	sort.Strings(replicas)
+	for _, host := range replicas {
+		sets = append(sets, metricSet{"replica." + s.nameComponent("replica", clientHost(host)) + ".", s.replicaLag[host]})
+	}
+	s.infoLock.Unlock()
+	return sets
+}
+
+//get the number of temporary tables open right now. replicas keep
+// temporary tables created by replicated statements open until the
+// session that made them ends, which blocks switching to row based
+// replication and makes a restart lose them.
+// the innodb count, of temporary tables in the innodb engine, needs 5.7 or later.
+// the memory internal temporary tables hold right now, in RAM and on
+// disk, catches a query building a huge one, which the since startup
+// CreatedTmpDiskTablesRatio is slow to show
+func (s *MysqlStat) GetTempTables() {
+	res, err := s.db.QueryReturnColumnDict(s.query(slaveTempTablesQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if v, ok := tools.NewResultRow(res, 0, s.db.Log).Float("Value"); ok {
+		s.Metrics.SlaveOpenTempTables.Set(v)
+	}
+	res, err = s.db.QueryReturnColumnDict(innodbTempTablesQuery)
+	if err != nil {
+		s.db.Log(err)
+		s.wg.Done()
+		return
+	}
+	if v, ok := tools.NewResultRow(res, 0, s.db.Log).Float("tables"); ok {
+		s.Metrics.InnodbTempTables.Set(v)
+	}
+	res, err = s.db.QueryReturnColumnDict(tempTableMemoryQuery)
+	if err != nil {
+		s.db.Log(err)
+		s.wg.Done()
+		return
+	}
+	for i, event := range res["event_name"] {
+		bytes, ok := tools.NewResultRow(res, i, s.db.Log).Float("bytes")
+		if !ok {
+			continue
+		}
+		switch event {
+		case "memory/temptable/physical_ram":
+			s.Metrics.TempTableMemoryBytes.Set(bytes)
+		case "memory/temptable/physical_disk":
+			s.Metrics.TempTableDiskBytes.Set(bytes)
+		}
+	}
+	s.wg.Done()
+	return
+}
+
+//get the number and total size of undo tablespaces, and how many are
+// being truncated. undo that keeps growing means long running
+// transactions are holding back purge
+func (s *MysqlStat) GetUndoTablespaces() {
+	res, err := s.db.QueryReturnColumnDict(s.query(undoTablespacesQuery))
+	if err != nil {
+		//servers too old to list undo tablespaces
+		if tools.ClassifyError(err) == tools.ErrorUnsupported {
+			s.db.Log(err)
+		} else {
+			s.logError(err)
+		}
+		s.wg.Done()
+		return
+	}
+	size := 0.0
+	truncating := 0
+	for i, name := range res["name"] {
+		if i < len(res["file_size"]) {
+			fileSize, err := strconv.ParseFloat(res["file_size"][i], 64)
+			if err != nil {
+				s.db.Log("undo tablespace " + name + ": " + err.Error())
+			} else {
+				size += fileSize
+			}
+		}
+		//truncation marks the tablespace inactive until it is done
+		if i < len(res["state"]) && res["state"][i] == "inactive" {
+			truncating++
+		}
+	}
+	s.Metrics.UndoTablespaces.Set(float64(len(res["name"])))
+	s.Metrics.UndoTablespaceBytes.Set(size)
+	s.Metrics.UndoTablespacesTruncating.Set(float64(truncating))
+	s.wg.Done()
+	return
+}
+
+//get the size of the rollback segments and undo truncation activity
+// from innodb_metrics. counters that aren't enabled are left unset.
+// a truncation has started and not finished while the start count is
+// ahead of the done count. undo that grows with no truncation points at
+// a long transaction holding back purge
+func (s *MysqlStat) GetUndoLogs() {
+	res, err := s.db.QueryMapFirstColumnToRow(s.query(undoMetricsQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	count := func(name string) (float64, bool) {
+		v, ok := res[name]
+		if !ok || len(v) == 0 {
+			return 0, false
+		}
+		f, err := strconv.ParseFloat(v[0], 64)
+		if err != nil {
+			s.db.Log("can't parse " + name + ": " + strconv.Quote(v[0]))
+			return 0, false
+		}
+		return f, true
+	}
+	if pages, ok := count("trx_rseg_current_size"); ok {
+		s.Metrics.UndoRsegCurrentPages.Set(pages)
+	}
+	if truncations, ok := count("undo_truncate_count"); ok {
+		s.Metrics.UndoTruncations.Set(uint64(truncations))
+	}
+	started, startOk := count("undo_truncate_start_logging_count")
+	done, doneOk := count("undo_truncate_done_logging_count")
+	if startOk && doneOk {
+		active := 0.0
+		if started > done {
+			active = 1
+		}
+		s.Metrics.UndoTruncationActive.Set(active)
+	}
+	s.wg.Done()
+	return
+}
+
+//get how often pages are moved to the young end of the buffer pool LRU
+// list, and how often they are kept old, for tuning innodb_old_blocks_pct
+// and innodb_old_blocks_time. innodb_buffer_pool_stats has the per
+// thousand page gets breakdown, the status variables that some servers
+// have are used when it can't be read
+func (s *MysqlStat) GetBufferPoolLRU() {
+	res, err := s.db.QueryReturnColumnDict(s.query(bufferPoolLRUQuery))
+	if err != nil || len(res["pages_made_young"]) == 0 {
+		if err != nil {
+			s.db.Log(err)
+		}
+		s.getBufferPoolLRUStatus()
+		s.wg.Done()
+		return
+	}
+	var young, notYoung uint64
+	youngRate, notYoungRate := 0.0, 0.0
+	instances := len(res["pages_made_young"])
+	for i := 0; i < instances; i++ {
+		young += uint64(s.lruValue(res["pages_made_young"], i))
+		notYoung += uint64(s.lruValue(res["pages_not_made_young"], i))
+		youngRate += s.lruValue(res["young_make_per_thousand_gets"], i)
+		notYoungRate += s.lruValue(res["not_young_make_per_thousand_gets"], i)
+	}
+	s.Metrics.InnodbPagesMadeYoung.Set(young)
+	s.Metrics.InnodbPagesMadeNotYoung.Set(notYoung)
+	//instances are sized alike, so their rates are averaged
+	s.Metrics.InnodbYoungPerThousandGets.Set(youngRate / float64(instances))
+	s.Metrics.InnodbNotYoungPerThousandGets.Set(notYoungRate / float64(instances))
+	s.wg.Done()
+	return
+}
+
+//returns row i of a column from innodb_buffer_pool_stats, 0 if missing
+func (s *MysqlStat) lruValue(col []string, i int) float64 {
+	if i >= len(col) {
+		return 0
+	}
+	v, err := strconv.ParseFloat(col[i], 64)
+	if err != nil {
+		s.db.Log(err)
+		return 0
+	}
+	return v
+}
+
+//falls back to the Innodb_buffer_pool_pages_made_young and
+// Innodb_buffer_pool_pages_made_not_young status variables
+func (s *MysqlStat) getBufferPoolLRUStatus() {
+	res, err := s.db.QueryMapFirstColumnToRow(bufferPoolLRUStatusQuery)
+	if err != nil {
+		s.logError(err)
+		return
+	}
+	vars := map[string]*metrics.Counter{
+		"Innodb_buffer_pool_pages_made_young":     s.Metrics.InnodbPagesMadeYoung,
+		"Innodb_buffer_pool_pages_made_not_young": s.Metrics.InnodbPagesMadeNotYoung,
+	}
+	for name, metric := range vars {
+		if v, ok := res[name]; ok && len(v) > 0 {
+			val, err := strconv.ParseUint(v[0], 10, 64)
+			if err != nil {
+				s.db.Log(err)
+				continue
+			}
+			metric.Set(val)
+		}
+	}
+}
+
+// Checks the database can be reached, without collecting anything
+func (s *MysqlStat) Ping(ctx context.Context) error {
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+	return s.db.Ping(ctx)
+}
+
+//get how many of each type of SQL statement have run, and the total time
+// spent running them, from performance_schema. types are named after
+// the statement, e.g. select or insert, along with how many statements
+// of any type used no index or no good index, and the rows they examined
+// and sent. nothing is reported when performance_schema is off
+func (s *MysqlStat) GetStatementSummary() {
+	res, err := s.db.QueryReturnColumnDict(s.query(statementSummaryQuery))
+	if err != nil {
+		if tools.ClassifyError(err) == tools.ErrorUnsupported {
+			s.db.Log(err)
+		} else {
+			s.logError(err)
+		}
+		s.wg.Done()
+		return
+	}
+	var noIndex, noGoodIndex, examined, sent uint64
+	noIndexOK, noGoodIndexOK, rowsOK := false, false, false
+	for i, event := range res["event_name"] {
+		if i >= len(res["count_star"]) || i >= len(res["sum_timer_wait"]) {
+			break
+		}
+		//every statement type counts towards the totals, even untracked ones
+		row := tools.NewResultRow(res, i, s.db.Log)
+		if n, ok := row.Uint("sum_no_index_used"); ok {
+			noIndex += n
+			noIndexOK = true
+		}
+		if n, ok := row.Uint("sum_no_good_index_used"); ok {
+			noGoodIndex += n
+			noGoodIndexOK = true
+		}
+		if n, ok := row.Uint("sum_rows_examined"); ok {
+			examined += n
+			rowsOK = true
+		}
+		if n, ok := row.Uint("sum_rows_sent"); ok {
+			sent += n
+		}
+		stmt := s.checkStatement(strings.TrimPrefix(event, "statement/sql/"))
+		if stmt == nil {
+			continue
+		}
+		count, err := strconv.ParseUint(res["count_star"][i], 10, 64)
+		if err != nil {
+			s.db.Log(err)
+		} else {
+			stmt.Count.Set(count)
+		}
+		//timers are in picoseconds
+		wait, err := strconv.ParseUint(res["sum_timer_wait"][i], 10, 64)
+		if err != nil {
+			s.db.Log(err)
+		} else {
+			stmt.TimerWaitUs.Set(wait / 1000000)
+		}
+	}
+	if noIndexOK {
+		s.Metrics.StatementsNoIndexUsed.Set(noIndex)
+	}
+	if noGoodIndexOK {
+		s.Metrics.StatementsNoGoodIndexUsed.Set(noGoodIndex)
+	}
+	//a high ratio means queries scan far more rows than they return
+	if rowsOK {
+		s.Metrics.StatementsRowsExamined.Set(examined)
+		s.Metrics.StatementsRowsSent.Set(sent)
+		if sent != 0 {
+			s.Metrics.RowsExaminedPerSent.Set(float64(examined) / float64(sent))
+		}
+	}
+	s.wg.Done()
+	return
+}
+
+//returns the metrics for a statement type, initializing them if needed.
+// returns nil once maxStatementTypes types are tracked
+func (s *MysqlStat) checkStatement(name string) *MysqlStatPerStatement {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	if s.statements == nil {
+		s.statements = make(map[string]*MysqlStatPerStatement)
+	}
+	if stmt, ok := s.statements[name]; ok {
+		return stmt
+	}
+	if len(s.statements) >= maxStatementTypes {
+		return nil
+	}
+	stmt := new(MysqlStatPerStatement)
+	misc.InitializeMetrics(stmt, s.m, metricPrefix(s.namespace)+".Statements."+name, true)
+	s.statements[name] = stmt
+	return stmt
+}
+
+//get the percentage of current connections using TLS, from each
+// connection's Ssl_version in performance_schema. without
+// performance_schema, the percentage of all connections made since
+// startup that used TLS is reported instead
+func (s *MysqlStat) GetTLSConnections() {
+	res, err := s.db.QueryReturnColumnDict(s.query(tlsConnectionsQuery))
+	if err == nil && len(res["connections"]) > 0 && len(res["tls"]) > 0 {
+		total, terr := strconv.ParseFloat(res["connections"][0], 64)
+		tls, lerr := strconv.ParseFloat(res["tls"][0], 64)
+		if terr == nil && lerr == nil && total > 0 {
+			s.Metrics.TlsConnectionsPct.Set(tls / total * 100)
+			s.wg.Done()
+			return
+		}
 	}
-
-	res, err := s.db.QueryReturnColumnDict(responseTimeQuery)
 	if err != nil {
 		s.db.Log(err)
+	}
+	stats, err := s.db.QueryMapFirstColumnToRow(tlsAcceptsQuery)
+	if err != nil {
+		s.logError(err)
 		s.wg.Done()
 		return
 	}
+	if len(stats["Ssl_accepts"]) > 0 && len(stats["Connections"]) > 0 {
+		accepts, aerr := strconv.ParseFloat(stats["Ssl_accepts"][0], 64)
+		connections, cerr := strconv.ParseFloat(stats["Connections"][0], 64)
+		if aerr != nil || cerr != nil {
+			s.db.Log("can't parse Ssl_accepts or Connections")
+		} else if connections > 0 {
+			s.Metrics.TlsConnectionsPct.Set(accepts / connections * 100)
+		}
+	}
+	s.wg.Done()
+	return
+}
 
-	for i, time := range res["time"] {
-		count, err := strconv.ParseInt(res["count"][i], 10, 64)
+//get the thread pool's threads and how many are busy, on Percona
+// Server and MariaDB with thread_handling=pool-of-threads. servers without
+// a thread pool don't have the status variables and are skipped. the
+// queued requests come from THREAD_POOL_GROUPS, which only MariaDB 10.5+ has
+func (s *MysqlStat) GetThreadPool() {
+	res, err := s.db.QueryMapFirstColumnToRow(s.query(threadPoolStatusQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if len(res["Threadpool_threads"]) == 0 {
+		s.wg.Done()
+		return
+	}
+	threads, err := strconv.ParseFloat(res["Threadpool_threads"][0], 64)
+	if err != nil {
+		s.db.Log(err)
+		s.wg.Done()
+		return
+	}
+	s.Metrics.ThreadpoolThreads.Set(threads)
+	if len(res["Threadpool_idle_threads"]) > 0 {
+		idle, err := strconv.ParseFloat(res["Threadpool_idle_threads"][0], 64)
 		if err != nil {
 			s.db.Log(err)
+		} else {
+			s.Metrics.ThreadpoolIdleThreads.Set(idle)
+			s.Metrics.ThreadpoolActiveThreads.Set(threads - idle)
 		}
-		if count < 1 {
-			continue
-		}
-		key := strings.Trim(time, " 0")
-		if timer, ok := timers[key]; ok {
-			timer.Set(uint64(count))
+	}
+
+	queue, err := s.db.QueryReturnColumnDict(threadPoolQueueQuery)
+	if err != nil {
+		s.db.Log(err)
+	} else if len(queue["queued"]) > 0 && queue["queued"][0] != "" {
+		queued, err := strconv.ParseFloat(queue["queued"][0], 64)
+		if err != nil {
+			s.db.Log(err)
+		} else {
+			s.Metrics.ThreadpoolQueuedRequests.Set(queued)
 		}
 	}
 	s.wg.Done()
 	return
 }
 
-//gets status on binary logs
-func (s *MysqlStat) GetBinlogFiles() {
-	res, err := s.db.QueryReturnColumnDict(binlogQuery)
+//finds who owns the oldest open InnoDB transaction. on a primary it holds
+// back purge, so undo grows, and its binlog events wait for the commit.
+// OldestTrxS has its age; the rows it has changed are kept as a
+// metric and, once it is older than oldestTrxLogSec, the thread, account
+// and query running are logged
+func (s *MysqlStat) GetOldestTrxOwner() {
+	res, err := s.db.QueryReturnColumnDict(s.query(oldestTrxOwnerQuery))
 	if err != nil {
-		s.db.Log(err)
+		s.logError(err)
 		s.wg.Done()
 		return
 	}
-	s.Metrics.BinlogFiles.Set(float64(len(res["File_size"])))
-	binlog_total_size := int64(0)
-	for _, size := range res["File_size"] {
-		si, err := strconv.ParseInt(size, 10, 64)
+	oldest, age := -1, float64(-1)
+	for i := range res["trx_id"] {
+		if i >= len(res["age"]) {
+			break
+		}
+		a, err := strconv.ParseFloat(res["age"][i], 64)
 		if err != nil {
-			s.db.Log(err) //don't return err so we can continue with more values
+			continue
+		}
+		if a > age {
+			oldest, age = i, a
 		}
-		binlog_total_size += si
 	}
-	s.Metrics.BinlogSize.Set(float64(binlog_total_size))
+	if oldest < 0 {
+		s.Metrics.OldestTrxRowsModified.Set(0)
+		s.wg.Done()
+		return
+	}
+	col := func(name string) string {
+		if oldest < len(res[name]) {
+			return res[name][oldest]
+		}
+		return ""
+	}
+	rows, err := strconv.ParseFloat(col("trx_rows_modified"), 64)
+	if err != nil {
+		s.db.Log(err)
+	} else {
+		s.Metrics.OldestTrxRowsModified.Set(rows)
+	}
+	if age >= oldestTrxLogSec {
+		query := col("query")
+		s.infoLock.Lock()
+		fingerprinting := s.fingerprintTop > 0
+		s.infoLock.Unlock()
+		if fingerprinting {
+			query = tools.Fingerprint(query)
+		}
+		if len(query) > maxLoggedQueryLen {
+			query = query[:maxLoggedQueryLen] + "..."
+		}
+		if query == "" {
+			query = "none, idle in transaction"
+		}
+		s.db.Log("oldest transaction " + col("trx_id") + " open " + strconv.FormatFloat(age, 'f', 0, 64) +
+			"s, " + col("trx_state") + ", thread " + col("thread_id") + " " + col("user") + "@" +
+			col("host") + ", query: " + query)
+	}
 	s.wg.Done()
 	return
 }
 
-//get number of long running queries
-func (s *MysqlStat) GetNumLongRunQueries() {
-	res, err := s.db.QueryReturnColumnDict(longQuery)
+//get whether semi-sync replication is on, and how many commits were
+// acknowledged by a replica. Rpl_semi_sync_master_status turns OFF when
+// the source gives up waiting and falls back to async replication, and
+// the commits made then count in Rpl_semi_sync_master_no_tx.
+// servers without the semi-sync plugins are skipped
+func (s *MysqlStat) GetSemiSync() {
+	res, err := s.db.QueryMapFirstColumnToRow(s.query(semiSyncQuery))
 	if err != nil {
-		s.db.Log(err)
+		s.logError(err)
 		s.wg.Done()
 		return
 	}
-	found_sql := len(res["ID"])
-	s.Metrics.ActiveLongRunQueries.Set(float64(found_sql))
+	status := map[string]*metrics.Gauge{
+		"Rpl_semi_sync_master_status": s.Metrics.SemiSyncMasterStatus,
+		"Rpl_semi_sync_slave_status":  s.Metrics.SemiSyncSlaveStatus,
+	}
+	for name, metric := range status {
+		if v, ok := res[name]; ok && len(v) > 0 {
+			if v[0] == "ON" {
+				metric.Set(float64(1))
+			} else {
+				metric.Set(float64(0))
+			}
+		}
+	}
+	txs := map[string]*metrics.Counter{
+		"Rpl_semi_sync_master_yes_tx": s.Metrics.SemiSyncMasterYesTx,
+		"Rpl_semi_sync_master_no_tx":  s.Metrics.SemiSyncMasterNoTx,
+	}
+	for name, metric := range txs {
+		if v, ok := res[name]; ok && len(v) > 0 {
+			val, err := strconv.ParseUint(v[0], 10, 64)
+			if err != nil {
+				s.db.Log(err)
+				continue
+			}
+			metric.Set(val)
+		}
+	}
 	s.wg.Done()
 	return
 }
 
-//get version
-//version is of the form '1.2.34-56.7' or '9.8.76a-54.3-log'
-// want to represent version in form '1.234567' or '9.876543'
-func (s *MysqlStat) GetVersion() {
-	res, err := s.db.QueryReturnColumnDict(versionQuery)
+//get the global sql_mode. without STRICT_TRANS_TABLES or
+// STRICT_ALL_TABLES invalid values are truncated or coerced with a
+// warning instead of rejected
+func (s *MysqlStat) GetSqlMode() {
+	res, err := s.db.QueryReturnColumnDict(s.query(sqlModeQuery))
 	if err != nil {
-		s.db.Log(err)
+		s.logError(err)
 		s.wg.Done()
 		return
 	}
-	if len(res["VERSION()"]) == 0 {
+	if len(res["sql_mode"]) == 0 {
 		s.wg.Done()
 		return
 	}
-	version := res["VERSION()"][0]
-	//filter out letters
-	f := func(r rune) bool {
-		if (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') {
-			return true
+	mode := res["sql_mode"][0]
+	s.Metrics.StrictSqlMode.Set(float64(0))
+	for _, m := range strings.Split(mode, ",") {
+		if m == "STRICT_TRANS_TABLES" || m == "STRICT_ALL_TABLES" {
+			s.Metrics.StrictSqlMode.Set(float64(1))
 		}
-		return false
 	}
-	version = strings.Join(strings.FieldsFunc(version, f), "")                      //filters out letters from string
-	version = strings.Replace(strings.Replace(version, "-", ".", -1), "_", ".", -1) //replaces "_" and "-" with "."
-	leading := float64(len(strings.Split(version, ".")[0]))
-	version = strings.Replace(version, ".", "", -1)
-	ver, err := strconv.ParseFloat(version, 64)
-	ver /= math.Pow(10.0, (float64(len(version)) - leading))
-	s.Metrics.Version.Set(ver)
+	s.infoLock.Lock()
+	s.sqlMode = mode
+	s.infoLock.Unlock()
+	s.wg.Done()
+	return
+}
+
+//get whether sql_slave_skip_counter is set, meaning someone is skipping
+// replication events by hand and the slave may no longer match its master
+func (s *MysqlStat) GetSkipCounter() {
+	res, err := s.db.QueryReturnColumnDict(s.query(skipCounterQuery))
 	if err != nil {
-		s.db.Log(err)
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if skip, ok := tools.NewResultRow(res, 0, s.db.Log).Uint("skip_counter"); ok {
+		if skip > 0 {
+			s.Metrics.SlaveSkipCounterActive.Set(float64(1))
+		} else {
+			s.Metrics.SlaveSkipCounterActive.Set(float64(0))
+		}
 	}
 	s.wg.Done()
 	return
 }
 
-// get binlog statistics
-func (s *MysqlStat) GetBinlogStats() {
-	res, err := s.db.QueryReturnColumnDict(binlogStatsQuery)
+//get the free and total space of the filesystem holding the data
+// directory. this only works when the collector runs on the database
+// host, so a data directory that doesn't exist here is skipped
+func (s *MysqlStat) GetDataDirUsage() {
+	res, err := s.db.QueryReturnColumnDict(s.query(dataDirQuery))
 	if err != nil {
-		s.db.Log(err)
+		s.logError(err)
 		s.wg.Done()
 		return
 	}
-	if len(res["File"]) == 0 || len(res["Position"]) == 0 {
+	dir, ok := tools.NewResultRow(res, 0, s.db.Log).String("datadir")
+	if !ok {
 		s.wg.Done()
 		return
 	}
-
-	v, err := strconv.ParseFloat(strings.Split(string(res["File"][0]), ".")[1], 64)
+	if _, err := os.Stat(dir); err != nil {
+		s.wg.Done()
+		return
+	}
+	free, total, err := tools.DiskUsage(dir)
 	if err != nil {
 		s.db.Log(err)
+		s.wg.Done()
+		return
 	}
-	s.Metrics.BinlogSeqFile.Set(float64(v))
-	v, err = strconv.ParseFloat(string(res["Position"][0]), 64)
+	s.Metrics.DataDirFreeBytes.Set(float64(free))
+	s.Metrics.DataDirTotalBytes.Set(float64(total))
+	s.wg.Done()
+	return
+}
+
+//table names in error log messages, as `db`.`table` or './db/table'
+var corruptTableName = regexp.MustCompile("`([^`]+)`\\.`([^`]+)`|\\./([^/']+)/([^/']+)'")
+
+//names of the tables mentioned in error log messages about corruption
+func corruptLogTables(messages []string) map[string]bool {
+	tables := make(map[string]bool)
+	for _, message := range messages {
+		for _, m := range corruptTableName.FindAllStringSubmatch(message, -1) {
+			if m[1] != "" {
+				tables[m[1]+"."+m[2]] = true
+			} else {
+				tables[m[3]+"."+m[4]] = true
+			}
+		}
+	}
+	return tables
+}
+
+//quotes name as a MySQL identifier
+func quoteName(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+//query for the base tables in schemas
+func checkTablesQuery(schemas []string) string {
+	quoted := make([]string, len(schemas))
+	for i, schema := range schemas {
+		quoted[i] = "'" + strings.Replace(schema, "'", "''", -1) + "'"
+	}
+	return `
+  SELECT table_schema, table_name FROM information_schema.tables
+   WHERE table_type = 'BASE TABLE' AND table_schema IN (` + strings.Join(quoted, ", ") + `);`
+}
+
+//runs CHECK TABLE on the tables in the schemas given to SetCheckTables,
+// when the last check is older than the interval. returns the tables
+// found corrupt by the last check
+func (s *MysqlStat) checkTables() map[string]bool {
+	s.infoLock.Lock()
+	schemas, every, last := s.checkSchemas, s.checkEvery, s.lastCheck
+	corrupt := s.checkedCorrupt
+	s.infoLock.Unlock()
+	if len(schemas) == 0 || (!last.IsZero() && time.Since(last) < every) {
+		return corrupt
+	}
+	res, err := s.db.QueryReturnColumnDict(checkTablesQuery(schemas))
 	if err != nil {
-		s.db.Log(err)
+		s.logError(err)
+		return corrupt
+	}
+	corrupt = make(map[string]bool)
+	for i, schema := range res["table_schema"] {
+		if i >= len(res["table_name"]) {
+			break
+		}
+		name := schema + "." + res["table_name"][i]
+		check, err := s.db.QueryReturnColumnDict("CHECK TABLE " + quoteName(schema) + "." +
+			quoteName(res["table_name"][i]) + " QUICK;")
+		if err != nil {
+			s.db.Log(err)
+			continue
+		}
+		for j, msgType := range check["Msg_type"] {
+			text := ""
+			if j < len(check["Msg_text"]) {
+				text = check["Msg_text"][j]
+			}
+			if strings.EqualFold(msgType, "error") || strings.Contains(strings.ToLower(text), "corrupt") {
+				corrupt[name] = true
+			}
+		}
+	}
+	s.infoLock.Lock()
+	s.lastCheck = time.Now()
+	s.checkedCorrupt = corrupt
+	s.infoLock.Unlock()
+	return corrupt
+}
+
+//count tables flagged corrupt, from error log messages about corrupt or
+// crashed tables since the server started, and from CHECK TABLE when
+// SetCheckTables is on. performance_schema.error_log is MySQL 8.0.22+
+func (s *MysqlStat) GetCorruptTables() {
+	tables := make(map[string]bool)
+	known := false
+	s.infoLock.Lock()
+	logOff := s.corruptLogOff
+	s.infoLock.Unlock()
+	if !logOff {
+		res, err := s.db.QueryReturnColumnDict(s.query(corruptLogQuery))
+		if err == nil {
+			tables = corruptLogTables(res["data"])
+			known = true
+		} else if tools.ClassifyError(err) == tools.ErrorUnsupported {
+			s.db.Log("performance_schema.error_log not available, not reading it for corrupt tables")
+			s.infoLock.Lock()
+			s.corruptLogOff = true
+			s.infoLock.Unlock()
+		} else {
+			s.logError(err)
+		}
+	}
+	s.infoLock.Lock()
+	checking := len(s.checkSchemas) > 0
+	s.infoLock.Unlock()
+	if checking {
+		checked := s.checkTables()
+		if checked != nil {
+			known = true
+		}
+		for name := range checked {
+			tables[name] = true
+		}
+	}
+	if known {
+		s.Metrics.CorruptTablesCount.Set(float64(len(tables)))
 	}
-	s.Metrics.BinlogPosition.Set(uint64(v))
 	s.wg.Done()
 	return
 }
 
-//detect application bugs which result in multiple instance of the same query "stacking up"/ executing at the same time
-func (s *MysqlStat) GetStackedQueries() {
-	cmd := stackedQuery
-	res, err := s.db.QueryReturnColumnDict(cmd)
+//codes of the binlog_format and binlog_row_image values and of clone
+// states, for gauges
+var (
+	binlogFormats   = map[string]float64{"STATEMENT": 1, "MIXED": 2, "ROW": 3}
+	binlogRowImages = map[string]float64{"FULL": 1, "MINIMAL": 2, "NOBLOB": 3}
+	cloneStates     = map[string]float64{"NOT STARTED": 0, "IN PROGRESS": 1, "COMPLETED": 2, "FAILED": 3}
+)
+
+//kinds of cluster, for ClusterType
+const (
+	clusterStandalone       = 0
+	clusterGroupReplication = 1
+	clusterGalera           = 2
+)
+
+//codes of Group Replication member states, and the Galera node states
+// they correspond to, for ClusterMemberState
+var (
+	memberStates       = map[string]float64{"ONLINE": 1, "RECOVERING": 2, "OFFLINE": 3, "ERROR": 4, "UNREACHABLE": 5}
+	galeraMemberStates = map[string]float64{"SYNCED": 1, "JOINING": 2, "JOINED": 2, "DONOR/DESYNCED": 2, "INITIALIZED": 3}
+)
+
+//sets gauge to the code of the value of variable in row, or logs a
+// value without a code
+func (s *MysqlStat) setCoded(gauge *metrics.Gauge, row tools.ResultRow, variable string, codes map[string]float64) {
+	value, ok := row.String(variable)
+	if !ok {
+		return
+	}
+	code, ok := codes[strings.ToUpper(value)]
+	if !ok {
+		s.db.Log("unknown " + variable + ": " + value)
+		return
+	}
+	gauge.Set(code)
+}
+
+//get the binlog format, row image and whether a slave writes the events
+// it applies to its own binlog. these decide what replicates safely and
+// how big the binlog grows, so drift from the intended settings matters.
+// also gets sync_binlog and innodb_flush_log_at_trx_commit, which are
+// both 1 for commits to survive a crash, and are often left lower
+// after tuning
+func (s *MysqlStat) GetBinlogSettings() {
+	res, err := s.db.QueryReturnColumnDict(s.query(binlogSettingsQuery))
 	if err != nil {
-		s.db.Log(err)
+		s.logError(err)
 		s.wg.Done()
 		return
 	}
-	if len(res["identical_queries_stacked"]) > 0 {
-		count, err := strconv.ParseFloat(string(res["identical_queries_stacked"][0]), 64)
-		if err != nil {
+	row := tools.NewResultRow(res, 0, s.db.Log)
+	s.setCoded(s.Metrics.BinlogFormat, row, "binlog_format", binlogFormats)
+	s.setCoded(s.Metrics.BinlogRowImage, row, "binlog_row_image", binlogRowImages)
+	if updates, ok := row.Float("log_slave_updates"); ok {
+		s.Metrics.LogSlaveUpdates.Set(updates)
+	}
+	if syncs, ok := row.Float("sync_binlog"); ok {
+		s.Metrics.SyncBinlog.Set(syncs)
+	}
+	if flush, ok := row.Float("innodb_flush_log_at_trx_commit"); ok {
+		s.Metrics.InnodbFlushLogAtTrxCommit.Set(flush)
+	}
+	s.wg.Done()
+	return
+}
+
+//get the state and progress of a clone into this server with the CLONE
+// plugin (MySQL 8.0.17+). a clone copies the whole data directory, which
+// explains I/O and performance dips while it runs. servers without the
+// clone instrumentation are skipped
+func (s *MysqlStat) GetCloneStatus() {
+	res, err := s.db.QueryReturnColumnDict(s.query(cloneStatusQuery))
+	if err != nil {
+		if tools.ClassifyError(err) == tools.ErrorUnsupported {
 			s.db.Log(err)
+		} else {
+			s.logError(err)
 		}
-		s.Metrics.IdenticalQueriesStacked.Set(float64(count))
-		age, err := strconv.ParseFloat(string(res["max_age"][0]), 64)
+		s.wg.Done()
+		return
+	}
+	row := tools.NewResultRow(res, 0, s.db.Log)
+	state, ok := row.String("state")
+	//no clone has been run
+	if !ok {
+		s.Metrics.CloneInProgress.Set(float64(0))
+		s.wg.Done()
+		return
+	}
+	s.setCoded(s.Metrics.CloneState, row, "state", cloneStates)
+	inProgress := float64(0)
+	if strings.EqualFold(state, "In Progress") {
+		inProgress = 1
+	}
+	s.Metrics.CloneInProgress.Set(inProgress)
+	data, dok := row.Float("data")
+	estimate, eok := row.Float("estimate")
+	if dok && eok && estimate > 0 {
+		s.Metrics.CloneProgressPct.Set(data / estimate * 100)
+	}
+	s.wg.Done()
+	return
+}
+
+//get the health of the Group Replication or Galera cluster this server
+// is a member of: how many members there are and are online, this node's
+// state and whether it is in the primary component. a node outside of
+// it can't take writes. standalone servers only set ClusterType
+func (s *MysqlStat) GetClusterStatus() {
+	res, err := s.db.QueryReturnColumnDict(s.query(groupMembersQuery))
+	//before 5.7 there is no replication_group_members
+	if err != nil && tools.ClassifyError(err) != tools.ErrorUnsupported {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if err == nil && s.setGroupMembers(res) {
+		s.wg.Done()
+		return
+	}
+	wsrep, err := s.db.QueryMapFirstColumnToRow(wsrepStatusQuery)
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if !s.setGaleraStatus(wsrep) {
+		s.Metrics.ClusterType.Set(float64(clusterStandalone))
+	}
+	s.wg.Done()
+	return
+}
+
+//sets the cluster metrics from replication_group_members. returns false
+// if Group Replication isn't running
+func (s *MysqlStat) setGroupMembers(res map[string][]string) bool {
+	members, online := 0, 0
+	var self tools.ResultRow
+	found := false
+	for i, id := range res["member_id"] {
+		row := tools.NewResultRow(res, i, s.db.Log)
+		state, _ := row.String("member_state")
+		if id == "" {
+			continue
+		}
+		members++
+		if strings.EqualFold(state, "ONLINE") {
+			online++
+		}
+		if isSelf, ok := row.Int("self"); ok && isSelf == 1 {
+			self, found = row, true
+		}
+	}
+	if members == 0 {
+		return false
+	}
+	s.Metrics.ClusterType.Set(float64(clusterGroupReplication))
+	s.Metrics.ClusterMembers.Set(float64(members))
+	s.Metrics.ClusterMembersOnline.Set(float64(online))
+	if !found {
+		return true
+	}
+	s.setCoded(s.Metrics.ClusterMemberState, self, "member_state", memberStates)
+	state, _ := self.String("member_state")
+	selfOnline := float64(0)
+	if strings.EqualFold(state, "ONLINE") {
+		selfOnline = 1
+	}
+	s.Metrics.ClusterMemberOnline.Set(selfOnline)
+	//a node that can see a majority of members online is in the primary
+	// partition
+	quorum := float64(0)
+	if selfOnline == 1 && online*2 > members {
+		quorum = 1
+	}
+	s.Metrics.ClusterQuorum.Set(quorum)
+	return true
+}
+
+//sets the cluster metrics from Galera's wsrep_ status variables. returns
+// false if they aren't there
+func (s *MysqlStat) setGaleraStatus(res map[string][]string) bool {
+	row := tools.NewResultRow(res, 0, s.db.Log)
+	size, ok := row.Float("wsrep_cluster_size")
+	if !ok {
+		return false
+	}
+	s.Metrics.ClusterType.Set(float64(clusterGalera))
+	s.Metrics.ClusterMembers.Set(size)
+	s.setCoded(s.Metrics.ClusterMemberState, row, "wsrep_local_state_comment", galeraMemberStates)
+	state, _ := row.String("wsrep_local_state_comment")
+	online := float64(0)
+	if strings.EqualFold(state, "Synced") {
+		online = 1
+	}
+	s.Metrics.ClusterMemberOnline.Set(online)
+	status, _ := row.String("wsrep_cluster_status")
+	quorum := float64(0)
+	if strings.EqualFold(status, "Primary") {
+		quorum = 1
+	}
+	s.Metrics.ClusterQuorum.Set(quorum)
+	return true
+}
+
+//get the replication lag of the replicas given to SetReplicaLag, or of
+// those with a binlog dump thread on this server, over a connection to
+// each. a replica that can't be reached or queried is logged and
+// reported unreachable without failing the getter, and is connected to
+// again next collection. replicas no longer found are reported
+// unreachable too
+func (s *MysqlStat) GetReplicaLag() {
+	s.infoLock.Lock()
+	connect, hosts, limit := s.replicaConnect, s.replicaHosts, s.replicaLimit
+	s.infoLock.Unlock()
+	if connect == nil {
+		s.wg.Done()
+		return
+	}
+	if len(hosts) == 0 {
+		res, err := s.db.QueryReturnColumnDict(s.query(replicaHostsQuery))
+		if err != nil {
+			s.logError(err)
+			s.wg.Done()
+			return
+		}
+		seen := make(map[string]bool)
+		for i := range res["host"] {
+			//a host with several replicas is checked once
+			if host := replicaHost(res["host"], i); host != "" && !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+		sort.Strings(hosts)
+	}
+	if len(hosts) > maxReplicaHosts {
+		s.db.Log("checking the lag of " + strconv.Itoa(maxReplicaHosts) + " of " +
+			strconv.Itoa(len(hosts)) + " replicas")
+		hosts = hosts[:maxReplicaHosts]
+	}
+
+	checked := make(map[string]bool)
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		checked[host] = true
+		wg.Add(1)
+		go func(host string, r *MysqlStatPerReplica) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			s.checkReplicaLag(connect, host, r)
+		}(host, s.checkReplica(host))
+	}
+	wg.Wait()
+
+	s.infoLock.Lock()
+	for host, r := range s.replicaLag {
+		if !checked[host] {
+			r.Reachable.Set(0)
+			r.SecondsBehindMaster.Set(-1)
+			if db, ok := s.replicaDBs[host]; ok {
+				db.Close()
+				delete(s.replicaDBs, host)
+			}
+		}
+	}
+	s.infoLock.Unlock()
+	s.wg.Done()
+}
+
+//reads the lag of the replica at host into r, connecting to it first if
+// there is no connection open to it
+func (s *MysqlStat) checkReplicaLag(connect func(host string) (tools.MysqlDB, error), host string, r *MysqlStatPerReplica) {
+	s.infoLock.Lock()
+	db, ok := s.replicaDBs[host]
+	s.infoLock.Unlock()
+	var err error
+	if !ok {
+		db, err = connect(host)
 		if err != nil {
+			s.db.Log("replica " + host + ": " + err.Error())
+			r.Reachable.Set(0)
+			r.SecondsBehindMaster.Set(-1)
+			return
+		}
+		s.infoLock.Lock()
+		if s.replicaDBs == nil {
+			s.replicaDBs = make(map[string]tools.MysqlDB)
+		}
+		s.replicaDBs[host] = db
+		s.infoLock.Unlock()
+	}
+	res, err := replicaStatus(db, slaveQuery, replicaQuery)
+	if err != nil {
+		s.db.Log("replica " + host + ": " + err.Error())
+		s.infoLock.Lock()
+		delete(s.replicaDBs, host)
+		s.infoLock.Unlock()
+		db.Close()
+		r.Reachable.Set(0)
+		r.SecondsBehindMaster.Set(-1)
+		return
+	}
+	r.Reachable.Set(1)
+	lag, ok := tools.NewResultRow(res, 0, s.db.Log).Float("Seconds_Behind_Master")
+	if !ok {
+		lag = -1
+	}
+	r.SecondsBehindMaster.Set(lag)
+}
+
+//returns the lag metrics of the replica at host, initializing them if
+// needed
+func (s *MysqlStat) checkReplica(host string) *MysqlStatPerReplica {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	if s.replicaLag == nil {
+		s.replicaLag = make(map[string]*MysqlStatPerReplica)
+	}
+	if r, ok := s.replicaLag[host]; ok {
+		return r
+	}
+	r := new(MysqlStatPerReplica)
+	misc.InitializeMetrics(r, s.m, metricPrefix(s.namespace)+".replica."+s.nameComponent("replica", clientHost(host)), true)
+	s.replicaLag[host] = r
+	return r
+}
+
+//get how much memory performance_schema is using for its own
+// instrumentation, which grows with the instruments and consumers turned
+// on. nothing is collected when performance_schema is off, and servers
+// without memory instrumentation (before 5.7) are skipped
+func (s *MysqlStat) GetPerfSchemaMemory() {
+	res, err := s.db.QueryReturnColumnDict(s.query(perfSchemaMemoryQuery))
+	if err != nil {
+		if tools.ClassifyError(err) == tools.ErrorUnsupported {
 			s.db.Log(err)
+		} else {
+			s.logError(err)
+		}
+		s.wg.Done()
+		return
+	}
+	//the table is empty with performance_schema off
+	if len(res["event_name"]) == 0 {
+		s.wg.Done()
+		return
+	}
+	total := float64(0)
+	for i := range res["event_name"] {
+		if bytes, ok := tools.NewResultRow(res, i, s.db.Log).Float("bytes"); ok {
+			total += bytes
 		}
-		s.Metrics.IdenticalQueriesMaxAge.Set(float64(age))
 	}
+	s.Metrics.PerfSchemaMemoryBytes.Set(total)
 	s.wg.Done()
 	return
 }
 
-//get session stats
-func (s *MysqlStat) GetSessions() {
-	res, err := s.db.QueryReturnColumnDict(sessionQuery1)
-	if err != nil {
-		s.db.Log(err)
+//get the age of the last successful backup, from the marker table set
+// with SetBackupMarker
+func (s *MysqlStat) GetBackupAge() {
+	s.infoLock.Lock()
+	table, column := s.backupTable, s.backupColumn
+	s.infoLock.Unlock()
+	if table == "" {
 		s.wg.Done()
 		return
 	}
-	var max_sessions int64
-	for _, val := range res {
-		max_sessions, err = strconv.ParseInt(val[0], 10, 64)
-		if err != nil {
-			s.db.Log(err)
-		}
-		s.Metrics.MaxConnections.Set(float64(max_sessions))
-	}
-	res, err = s.db.QueryReturnColumnDict(sessionQuery2)
+	res, err := s.db.QueryReturnColumnDict(backupAgeQuery(table, column))
 	if err != nil {
-		s.db.Log(err)
+		s.logError(err)
 		s.wg.Done()
 		return
 	}
-	if len(res["COMMAND"]) == 0 {
+	//MAX is NULL for an empty table
+	at, ok := tools.NewResultRow(res, 0, s.db.Log).Float("ts")
+	if !ok {
+		s.Metrics.LastBackupAgeSeconds.Set(math.NaN())
 		s.wg.Done()
 		return
 	}
-	current_total := len(res["COMMAND"])
-	s.Metrics.CurrentSessions.Set(float64(current_total))
-	pct := (float64(current_total) / float64(max_sessions)) * 100
-	s.Metrics.CurrentConnectionsPct.Set(pct)
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	s.Metrics.LastBackupAgeSeconds.Set(float64(now().UnixNano())/float64(time.Second) - at)
+	s.wg.Done()
+	return
+}
 
-	active := 0.0
-	unauthenticated := 0
-	locked := 0
-	table_lock_wait := 0
-	global_read_lock_wait := 0
-	copy_to_table := 0
-	statistics := 0
-	for i, val := range res["COMMAND"] {
-		if val != "Sleep" && val != "Connect" && val != "Binlog Dump" {
-			active += 1
+//query for the latest time in column of table, given as table or
+// db.table, as a Unix time
+func backupAgeQuery(table, column string) string {
+	name := quoteName(table)
+	if i := strings.Index(table, "."); i >= 0 {
+		name = quoteName(table[:i]) + "." + quoteName(table[i+1:])
+	}
+	return "SELECT UNIX_TIMESTAMP(MAX(" + quoteName(column) + ")) AS ts FROM " + name + ";"
+}
+
+//counts tables by storage engine. tables that aren't InnoDB, such as
+// MyISAM, MEMORY and ARCHIVE ones, bypass the buffer pool and aren't
+// crash safe. engines seen in earlier collections that have no tables
+// now are set to 0
+func (s *MysqlStat) GetTableEngines() {
+	res, err := s.db.QueryReturnColumnDict(s.query(tableEnginesQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	counts := make(map[string]float64)
+	for i := range res["engine"] {
+		row := tools.NewResultRow(res, i, s.db.Log)
+		engine, ok := row.String("engine")
+		if !ok {
+			continue
 		}
-		if matched, err := regexp.MatchString("unauthenticated", res["USER"][i]); err == nil && matched {
-			unauthenticated += 1
+		if tables, ok := row.Float("tables"); ok {
+			counts[engine] += tables
 		}
-		if matched, err := regexp.MatchString("Locked", res["STATE"][i]); err == nil && matched {
-			locked += 1
-		} else if matched, err := regexp.MatchString("Table Lock", res["STATE"][i]); err == nil && matched {
-			table_lock_wait += 1
-		} else if matched, err := regexp.MatchString("Waiting for global read lock", res["STATE"][i]); err == nil && matched {
-			global_read_lock_wait += 1
-		} else if matched, err := regexp.MatchString("opy.*table", res["STATE"][i]); err == nil && matched {
-			copy_to_table += 1
-		} else if matched, err := regexp.MatchString("statistics", res["STATE"][i]); err == nil && matched {
-			statistics += 1
+	}
+	for engine, count := range counts {
+		s.checkEngine(engine).TableCount.Set(count)
+	}
+	s.infoLock.Lock()
+	for engine, e := range s.engines {
+		if _, ok := counts[engine]; !ok {
+			e.TableCount.Set(0)
 		}
 	}
-	s.Metrics.ActiveSessions.Set(active)
-	s.Metrics.BusySessionPct.Set((active / float64(current_total)) * float64(100))
-	s.Metrics.UnauthenticatedSessions.Set(float64(unauthenticated))
-	s.Metrics.LockedSessions.Set(float64(locked))
-	s.Metrics.SessionTablesLocks.Set(float64(table_lock_wait))
-	s.Metrics.SessionGlobalReadLocks.Set(float64(global_read_lock_wait))
-	s.Metrics.SessionsCopyingToTable.Set(float64(copy_to_table))
-	s.Metrics.SessionsStatistics.Set(float64(statistics))
-
+	s.infoLock.Unlock()
 	s.wg.Done()
-	return
 }
 
-//metrics from innodb
-func (s *MysqlStat) GetInnodbStats() {
-	res, err := s.db.QueryReturnColumnDict(innodbQuery)
-	if err != nil {
-		s.db.Log(err)
+//returns the metrics for a storage engine, initializing them if needed
+func (s *MysqlStat) checkEngine(engine string) *MysqlStatPerEngine {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	if s.engines == nil {
+		s.engines = make(map[string]*MysqlStatPerEngine)
+	}
+	if e, ok := s.engines[engine]; ok {
+		return e
+	}
+	e := new(MysqlStatPerEngine)
+	misc.InitializeMetrics(e, s.m, metricPrefix(s.namespace)+".engine."+engine, true)
+	s.engines[engine] = e
+	return e
+}
+
+//counts the InnoDB locks held and waited for, by lock mode, and the lock
+// waits between transactions. performance_schema.data_locks replaced
+// information_schema.innodb_locks in 8.0, so older servers are skipped.
+// gap and record flags of a mode are counted with it, and modes other
+// than S, X, IS and IX, such as AUTO_INC, are left out
+func (s *MysqlStat) GetDataLocks() {
+	if version := s.Identity().Version; version != "" && !versionAtLeast(version, 8, 0, 0) {
 		s.wg.Done()
 		return
 	}
-	var innodb_log_file_size int64
-	if err == nil && len(res["Value"]) > 0 {
-		innodb_log_file_size, err = strconv.ParseInt(res["Value"][0], 10, 64)
-		if err != nil {
+	res, err := s.db.QueryReturnColumnDict(s.query(dataLocksQuery))
+	if err != nil {
+		if tools.ClassifyError(err) == tools.ErrorUnsupported {
 			s.db.Log(err)
+		} else {
+			s.logError(err)
 		}
+		s.wg.Done()
+		return
 	}
-
-	res, err = s.db.QueryReturnColumnDict("SHOW ENGINE INNODB STATUS")
+	modes := map[string][2]*metrics.Gauge{
+		"S":  {s.Metrics.DataLocksGrantedS, s.Metrics.DataLocksWaitingS},
+		"X":  {s.Metrics.DataLocksGrantedX, s.Metrics.DataLocksWaitingX},
+		"IS": {s.Metrics.DataLocksGrantedIS, s.Metrics.DataLocksWaitingIS},
+		"IX": {s.Metrics.DataLocksGrantedIX, s.Metrics.DataLocksWaitingIX},
+	}
+	granted := make(map[string]float64)
+	waiting := make(map[string]float64)
+	for i := range res["lock_mode"] {
+		row := tools.NewResultRow(res, i, s.db.Log)
+		mode, ok := row.String("lock_mode")
+		if !ok {
+			continue
+		}
+		mode = strings.SplitN(mode, ",", 2)[0]
+		if _, ok := modes[mode]; !ok {
+			continue
+		}
+		status, _ := row.String("lock_status")
+		locks, ok := row.Float("locks")
+		if !ok {
+			continue
+		}
+		switch strings.ToUpper(status) {
+		case "GRANTED":
+			granted[mode] += locks
+		case "WAITING":
+			waiting[mode] += locks
+		}
+	}
+	for mode, gauges := range modes {
+		gauges[0].Set(granted[mode])
+		gauges[1].Set(waiting[mode])
+	}
+	res, err = s.db.QueryReturnColumnDict(dataLockWaitsQuery)
 	if err != nil {
 		s.db.Log(err)
 		s.wg.Done()
 		return
 	}
+	if waits, ok := tools.NewResultRow(res, 0, s.db.Log).Float("waits"); ok {
+		s.Metrics.DataLockWaits.Set(waits)
+	}
+	s.wg.Done()
+}
 
-	//parse the result
-	var idb *tools.InnodbStats
-	idb, _ = tools.ParseInnodbStats(res["Status"][0])
-	vars := map[string]interface{}{
-		"OS_file_reads":               s.Metrics.OSFileReads,
-		"OS_file_writes":              s.Metrics.OSFileWrites,
-		"adaptive_hash":               s.Metrics.AdaptiveHash,
-		"avg_bytes_per_read":          s.Metrics.AvgBytesPerRead,
-		"buffer_pool_hit_rate":        s.Metrics.BufferPoolHitRate,
-		"buffer_pool_size":            s.Metrics.BufferPoolSize,
-		"cache_hit_pct":               s.Metrics.CacheHitPct,
-		"checkpoint_age":              s.Metrics.InnodbCheckpointAge,
-		"checkpoint_age_target":       s.Metrics.InnodbCheckpointAgeTarget,
-		"database_pages":              s.Metrics.DatabasePages,
-		"dictionary_cache":            s.Metrics.DictionaryCache,
-		"dictionary_memory_allocated": s.Metrics.DictionaryMemoryAllocated,
-		"file_system":                 s.Metrics.FileSystem,
-		"free_buffers":                s.Metrics.FreeBuffers,
-		"fsyncs_per_s":                s.Metrics.FsyncsPerSec,
-		"history_list":                s.Metrics.InnodbHistoryLinkList,
-		"last_checkpoint_at":          s.Metrics.InnodbLastCheckpointAt,
-		"lock_system":                 s.Metrics.LockSystem,
-		"log_flushed_up_to":           s.Metrics.InnodbLogFlushedUpTo,
-		"log_io_per_sec":              s.Metrics.LogIOPerSec,
-		"log_sequence_number":         s.Metrics.InnodbLogSequenceNumber,
-		"max_checkpoint_age":          s.Metrics.InnodbMaxCheckpointAge,
-		"modified_age":                s.Metrics.InnodbModifiedAge,
-		"modified_db_pages":           s.Metrics.ModifiedDBPages,
-		"old_database_pages":          s.Metrics.OldDatabasePages,
-		"page_hash":                   s.Metrics.PageHash,
-		"pages_flushed_up_to":         s.Metrics.PagesFlushedUpTo,
-		"pages_made_young":            s.Metrics.PagesMadeYoung,
-		"pages_read":                  s.Metrics.PagesRead,
-		"pending_chkp_writes":         s.Metrics.InnodbPendingCheckpointWrites,
-		"pending_log_writes":          s.Metrics.InnodbPendingLogWrites,
-		"pending_reads":               s.Metrics.PendingReads,
-		"pending_writes_lru":          s.Metrics.PendingWritesLRU,
-		"reads_per_s":                 s.Metrics.ReadsPerSec,
-		"recovery_system":             s.Metrics.RecoverySystem,
-		"total_mem":                   s.Metrics.TotalMem,
-		"total_mem_by_read_views":     s.Metrics.TotalMemByReadViews,
-		"trx_id":                      s.Metrics.TransactionID,
-		"trxes_not_started":           s.Metrics.InnodbTransactionsNotStarted,
-		"undo":                        s.Metrics.InnodbUndo,
-		"writes_per_s":                s.Metrics.WritesPerSec,
+//one bucket of a latency histogram
+type latencyBucket struct {
+	high  float64 //upper bound, in milliseconds
+	count float64
+}
+
+//returns the upper bound of the bucket that the q share of the counts
+// in buckets, sorted by bound, falls in. NaN without counts
+func latencyPercentile(buckets []latencyBucket, q float64) float64 {
+	total := 0.0
+	for _, b := range buckets {
+		total += b.count
 	}
-	//store the result in the appropriate metrics
-	for name, metric := range vars {
-		v, ok := idb.Metrics[name]
-		if ok {
-			val, err := strconv.ParseFloat(string(v), 64)
-			if err != nil {
-				s.db.Log(err)
-			}
-			//case based on type so can switch between Gauge and Counter easily
-			switch met := metric.(type) {
-			case *metrics.Counter:
-				met.Set(uint64(val))
-			case *metrics.Gauge:
-				met.Set(float64(val))
-			}
-		}
+	if total == 0 {
+		return math.NaN()
 	}
-	if lsn, ok := idb.Metrics["log_sequence_number"]; ok && innodb_log_file_size != 0 {
-		lsn_s, _ := strconv.ParseFloat(lsn, 64)
-		s.Metrics.InnodbLogWriteRatio.Set((lsn_s * 3600.0) / float64(innodb_log_file_size))
+	seen := 0.0
+	for _, b := range buckets {
+		seen += b.count
+		if seen >= q*total {
+			return b.high
+		}
 	}
-	s.wg.Done()
-	return
+	return buckets[len(buckets)-1].high
 }
 
-//get backups count
-func (s *MysqlStat) GetBackups() {
-	out, err := exec.Command("ps", "aux").Output()
+//gets the 95th and 99th percentile of statement latency from
+// performance_schema's statement histogram, a latency SLI that doesn't
+// need the query response time plugin. the percentiles are over the
+// statements completed since the last collection, and since startup at
+// the first collection or after the histogram was truncated. each is
+// the upper bound of its bucket. 8.0 added the histogram, older servers
+// are skipped
+func (s *MysqlStat) GetStatementLatency() {
+	if version := s.Identity().Version; version != "" && !versionAtLeast(version, 8, 0, 0) {
+		s.wg.Done()
+		return
+	}
+	res, err := s.db.QueryReturnColumnDict(s.query(statementHistogramQuery))
 	if err != nil {
-		s.db.Log(err)
+		if tools.ClassifyError(err) == tools.ErrorUnsupported {
+			s.db.Log(err)
+		} else {
+			s.logError(err)
+		}
 		s.wg.Done()
 		return
 	}
-	blob := string(out)
-	lines := strings.Split(blob, "\n")
-	backupProcs := 0
-	for _, line := range lines {
-		words := strings.Split(line, " ")
-		if len(words) < 10 {
+	counts := make(map[int64]float64)
+	var buckets []latencyBucket
+	var numbers []int64
+	for i := range res["bucket_number"] {
+		row := tools.NewResultRow(res, i, s.db.Log)
+		number, ok := row.Int("bucket_number")
+		if !ok {
 			continue
 		}
-		command := strings.Join(words[10:], " ")
-		if strings.Contains(command, "innobackupex") ||
-			strings.Contains(command, "mysqldump") ||
-			strings.Contains(command, "mydumper") {
-			backupProcs += 1
+		high, hok := row.Float("bucket_timer_high")
+		count, cok := row.Float("count_bucket")
+		if !hok || !cok {
+			continue
 		}
+		counts[number] = count
+		numbers = append(numbers, number)
+		buckets = append(buckets, latencyBucket{high: high / 1e9, count: count})
 	}
-	s.Metrics.BackupsRunning.Set(float64(backupProcs))
-	s.wg.Done()
-	return
-}
-
-//get count unsecure users
-func (s *MysqlStat) GetSecurity() {
-	res, err := s.db.QueryReturnColumnDict(securityQuery)
-	if err != nil {
-		s.db.Log(err)
-		s.wg.Done()
-		return
+	s.infoLock.Lock()
+	prev := s.prevHistogram
+	s.prevHistogram = counts
+	s.infoLock.Unlock()
+	if prev != nil {
+		since := make([]latencyBucket, len(buckets))
+		reset := false
+		for i, b := range buckets {
+			if b.count < prev[numbers[i]] {
+				reset = true
+				break
+			}
+			since[i] = latencyBucket{high: b.high, count: b.count - prev[numbers[i]]}
+		}
+		if !reset {
+			buckets = since
+		}
 	}
-	s.Metrics.UnsecureUsers.Set(float64(len(res["users"])))
+	s.Metrics.StatementLatencyP95Ms.Set(latencyPercentile(buckets, 0.95))
+	s.Metrics.StatementLatencyP99Ms.Set(latencyPercentile(buckets, 0.99))
 	s.wg.Done()
-	return
 }
 
-// Closes database connection
+// Closes database connection, and the master's if SetMaster was called
+// and the replicas' if SetReplicaLag was. Closing again does nothing, so
+// a shutdown handler and deferred cleanup can both call it. A Collect
+// still running fails its remaining queries
 func (s *MysqlStat) Close() {
+	//closing our own pool twice is harmless, as *sql.DB.Close is
+	// idempotent. the flag's job is the master and replica handles, which
+	// come from SetMaster and the SetReplicaLag connect function and may
+	// be any tools.MysqlDB, so they are only closed once
+	s.infoLock.Lock()
+	closed := s.closed
+	s.closed = true
+	s.infoLock.Unlock()
+	if closed {
+		return
+	}
 	s.db.Close()
+	if s.master != nil {
+		s.master.Close()
+	}
+	s.infoLock.Lock()
+	for _, db := range s.replicaDBs {
+		db.Close()
+	}
+	s.replicaDBs = nil
+	s.infoLock.Unlock()
 }
 
 //CallByMethodName searches for a method implemented
 // by s with name. Runs all methods that match names.
+// Returns an error if none match
 func (s *MysqlStat) CallByMethodName(name string) error {
 	r := reflect.TypeOf(s)
-	re := regexp.MustCompile(strings.ToLower(name))
+	re, err := regexp.Compile(strings.ToLower(name))
+	if err != nil {
+		return err
+	}
 	f := false
 	for i := 0; i < r.NumMethod(); i++ {
-		n := strings.ToLower(r.Method(i).Name)
-		if strings.Contains(n, "get") && re.MatchString(n) {
+		if isGetter(r.Method(i)) && re.MatchString(strings.ToLower(r.Method(i).Name)) {
 			s.wg.Add(1)
 			reflect.ValueOf(s).Method(i).Call([]reflect.Value{})
 			f = true
@@ -852,27 +5238,164 @@ func (s *MysqlStat) CallByMethodName(name string) error {
 	return nil
 }
 
+//getters are the methods named Get... taking no arguments, the
+// receiver being the only input of the method's type. a group matching
+// other methods, such as SetSkipGetters, would call them without
+// their arguments
+func isGetter(m reflect.Method) bool {
+	return strings.HasPrefix(m.Name, "Get") && m.Type.NumIn() == 1
+}
+
+//AvailableGroups lists the names of the methods CallByMethodName
+// can run, in sorted order
+func (s *MysqlStat) AvailableGroups() []string {
+	r := reflect.TypeOf(s)
+	var groups []string
+	for i := 0; i < r.NumMethod(); i++ {
+		if isGetter(r.Method(i)) {
+			groups = append(groups, r.Method(i).Name)
+		}
+	}
+	return groups
+}
+
+//runs the getters matching each of groups, as CallByMethodName does, one
+// group after another over a single connection, and returns the value of
+// every metric set by then, by name as in JSON output. Closes s when
+// done, so it is meant for short-lived programmatic runs such as a
+// deploy gate. Groups that match no getter and getter errors are
+// returned as an error along with the values collected
+func (s *MysqlStat) RunBatch(groups []string) (map[string]float64, error) {
+	defer s.Close()
+	s.SetMaxConnections(1)
+	s.resetErrors()
+	var unknown []string
+	for _, group := range groups {
+		if err := s.CallByMethodName(group); err != nil {
+			unknown = append(unknown, group)
+		}
+	}
+	values, err := tools.SnapshotValues(s.WriteJSON)
+	if err != nil {
+		return nil, err
+	}
+	if len(unknown) > 0 {
+		return values, errors.New("no getters match " + strings.Join(unknown, ", "))
+	}
+	return values, s.errs.Err()
+}
+
 //returns []string of metric values of the form:
 // "metric_name metric_value"
-// This is the form that stats-collector uses to send messages to graphite
+// This is the form that stats-collector uses to send messages to graphite.
+// lines are sorted by metric name
 func (s *MysqlStat) FormatGraphite(w io.Writer) error {
-	metricstype := reflect.TypeOf(*s.Metrics)
-	metricvalue := reflect.ValueOf(*s.Metrics)
-	for i := 0; i < metricvalue.NumField(); i++ {
-		n := metricvalue.Field(i).Interface()
-		name := metricstype.Field(i).Name
-		switch metric := n.(type) {
-		case *metrics.Counter:
-			if !math.IsNaN(metric.ComputeRate()) {
-				fmt.Fprintln(w, name+".Value "+strconv.FormatUint(metric.Get(), 10))
-				fmt.Fprintln(w, name+".Rate "+strconv.FormatFloat(metric.ComputeRate(),
-					'f', 5, 64))
+	out := tools.NewSortedWriter(w)
+	w = out
+	precision := s.formatPrecision()
+	units := s.formatUnits()
+	ts := s.graphiteTimestamp()
+	prefix := s.graphiteNamePrefix()
+	for _, set := range s.metricSets() {
+		metricvalue := reflect.ValueOf(set.metrics).Elem()
+		metricstype := metricvalue.Type()
+		for i := 0; i < metricvalue.NumField(); i++ {
+			n := metricvalue.Field(i).Interface()
+			name := tools.GraphiteName(prefix + set.name + metricstype.Field(i).Name)
+			switch metric := n.(type) {
+			case *metrics.Counter:
+				if !math.IsNaN(metric.ComputeRate()) {
+					fmt.Fprintln(w, name+".Value "+strconv.FormatUint(metric.Get(), 10)+ts)
+					fmt.Fprintln(w, name+".Rate "+tools.FormatValue(metric.ComputeRate(), precision)+ts)
+					if rate, ok := s.counterRate(set.name + metricstype.Field(i).Name); ok {
+						fmt.Fprintln(w, name+"_per_sec.Value "+tools.FormatValue(rate, precision)+ts)
+					}
+				}
+			case *metrics.Gauge:
+				if !math.IsNaN(metric.Get()) {
+					v := units.Convert(metric.Get(), metricstype.Field(i).Tag.Get("unit"))
+					fmt.Fprintln(w, name+".Value "+tools.FormatValue(v, precision)+ts)
+				}
 			}
-		case *metrics.Gauge:
-			if !math.IsNaN(metric.Get()) {
-				fmt.Fprintln(w, name+".Value "+strconv.FormatFloat(metric.Get(), 'f', 5, 64))
+		}
+	}
+	keys, gauges := s.extraStatusGauges()
+	for _, key := range keys {
+		if v := gauges[key].Get(); !math.IsNaN(v) {
+			fmt.Fprintln(w, tools.GraphiteName(prefix+"status."+key)+".Value "+tools.FormatValue(v, precision)+ts)
+		}
+	}
+	return out.Flush()
+}
+
+//writes metrics to w as one JSON object per line
+func (s *MysqlStat) FormatNDJSON(w io.Writer) error {
+	return tools.WriteNDJSON(w, s.CollectedAt(), nil, s.WriteJSON)
+}
+
+//writes metrics to w in the Prometheus text exposition format, see
+// tools.WritePrometheus
+func (s *MysqlStat) FormatPrometheus(w io.Writer) error {
+	return tools.WritePrometheus(w, s.prometheusNames(), s.WriteJSON)
+}
+
+//returns name, e.g. a client host, cleaned into a single graphite name
+// component under kind, e.g. "sessions.host". names of one kind that
+// would clean the same get a "_2", "_3", ... suffix, and each name keeps
+// its component for the life of the collector
+func (s *MysqlStat) nameComponent(kind, name string) string {
+	s.namesLock.Lock()
+	if s.names == nil {
+		s.names = tools.NewNameSanitizer(tools.NamesGraphite)
+	}
+	names := s.names
+	s.namesLock.Unlock()
+	path := names.Path(kind, name)
+	return path[strings.LastIndex(path, ".")+1:]
+}
+
+//returns the sanitizer for Prometheus output, which keeps the names it
+// gave out between scrapes
+func (s *MysqlStat) prometheusNames() *tools.NameSanitizer {
+	s.namesLock.Lock()
+	defer s.namesLock.Unlock()
+	if s.promNames == nil {
+		s.promNames = tools.NewNameSanitizer(tools.NamesPrometheus)
+	}
+	return s.promNames
+}
+
+//writes metrics to w as a JSON list of metric records.
+// Records are streamed as they are read
+func (s *MysqlStat) FormatJSON(w io.Writer) error {
+	j := tools.NewJSONWriter(w)
+	s.WriteJSON(j)
+	return j.Close()
+}
+
+//writes a record for each metric to j, so metrics from several
+// collectors can share one list
+func (s *MysqlStat) WriteJSON(j *tools.JSONWriter) {
+	units := s.formatUnits()
+	for _, set := range s.metricSets() {
+		metricvalue := reflect.ValueOf(set.metrics).Elem()
+		metricstype := metricvalue.Type()
+		for i := 0; i < metricvalue.NumField(); i++ {
+			n := metricvalue.Field(i).Interface()
+			name := metricPrefix(s.namespace) + "." + set.name + metricstype.Field(i).Name
+			switch metric := n.(type) {
+			case *metrics.Counter:
+				j.Counter(name, metric.Get(), metric.ComputeRate())
+				if rate, ok := s.counterRate(set.name + metricstype.Field(i).Name); ok {
+					j.Gauge(name+"_per_sec", rate)
+				}
+			case *metrics.Gauge:
+				j.Gauge(name, units.Convert(metric.Get(), metricstype.Field(i).Tag.Get("unit")))
 			}
 		}
 	}
-	return nil
+	keys, gauges := s.extraStatusGauges()
+	for _, key := range keys {
+		j.Gauge(metricPrefix(s.namespace)+".status."+key, gauges[key].Get())
+	}
 }
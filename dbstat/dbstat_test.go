@@ -20,15 +20,27 @@
 package dbstat
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/measure/metrics"
+	"github.com/measure/mysql/tools"
 )
 
 type testMysqlDB struct {
@@ -43,6 +55,12 @@ var (
 	//Simulates QueryMapFirstColumnToRow
 	testqueryrow = map[string]map[string][]string{}
 
+	//maps a query string to the error it should fail with
+	testqueryerr = map[string]error{}
+
+	//what Stats() returns
+	testPoolStats = sql.DBStats{}
+
 	//Mapping of metric and its expected value
 	// defined as map of interface{}->interface{} so
 	// can switch between metrics.Gauge and metrics.Counter
@@ -57,10 +75,16 @@ func (s *testMysqlDB) QueryReturnColumnDict(query string) (map[string][]string,
 	if query == "SHOW ENGINE INNODB STATUS" {
 		return nil, errors.New(" not checking innodb parser in this test")
 	}
+	if err, ok := testqueryerr[query]; ok {
+		return nil, err
+	}
 	return testquerycol[query], nil
 }
 
 func (s *testMysqlDB) QueryMapFirstColumnToRow(query string) (map[string][]string, error) {
+	if err, ok := testqueryerr[query]; ok {
+		return nil, err
+	}
 	return testquerycol[query], nil
 }
 
@@ -76,6 +100,18 @@ func (s *testMysqlDB) SetMaxConnections(maxConns int) {
 	return
 }
 
+func (s *testMysqlDB) SetQueryTimeout(timeout time.Duration) {
+	return
+}
+
+func (s *testMysqlDB) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *testMysqlDB) Stats() sql.DBStats {
+	return testPoolStats
+}
+
 //initializes a test instance of MysqlStat.
 // instance does not connect with a db
 func initMysqlStat() *MysqlStat {
@@ -84,7 +120,9 @@ func initMysqlStat() *MysqlStat {
 	s.db = &testMysqlDB{
 		Logger: log.New(os.Stderr, "TESTING LOG: ", log.Lshortfile),
 	}
-	s.Metrics = MysqlStatMetricsNew(metrics.NewMetricContext("system"))
+	s.m = metrics.NewMetricContext("system")
+	s.Metrics = MysqlStatMetricsNew(s.m)
+	testqueryerr = map[string]error{}
 	return s
 }
 
@@ -181,9 +219,11 @@ func TestBasic(t *testing.T) {
 		//not going to include every metric since the parsing function is the same for each
 		// missing metrics should not break metrics collector
 		globalStatsQuery: map[string][]string{
-			"Queries":         []string{"8"},
-			"Uptime":          []string{"100"},
-			"Threads_running": []string{"5"},
+			"Queries":                    []string{"8"},
+			"Uptime":                     []string{"100"},
+			"Threads_running":            []string{"5"},
+			"Innodb_data_fsyncs":         []string{"367474"},
+			"Innodb_data_pending_fsyncs": []string{"3"},
 		},
 	}
 	//expected results
@@ -206,11 +246,13 @@ func TestBasic(t *testing.T) {
 		s.Metrics.IdenticalQueriesMaxAge:   float64(10),
 		s.Metrics.BinlogSeqFile:            float64(3),
 		s.Metrics.BinlogPosition:           uint64(73),
-		s.Metrics.Version:                  float64(1.234),
+		s.Metrics.Version:                  float64(10234),
 		s.Metrics.ActiveLongRunQueries:     float64(7),
 		s.Metrics.BinlogSize:               float64(1111),
 		s.Metrics.QueryResponseSec_0001:    uint64(300),
 		s.Metrics.OldestQueryS:             float64(12345),
+		s.Metrics.InnodbDataFsyncs:         uint64(367474),
+		s.Metrics.InnodbDataPendingFsyncs:  float64(3),
 	}
 	s.Collect()
 	time.Sleep(time.Millisecond * 1000 * 1)
@@ -230,12 +272,12 @@ func TestVersion1(t *testing.T) {
 	//set desired test result
 	testquerycol = map[string]map[string][]string{
 		versionQuery: map[string][]string{
-			"VERSION()": []string{"123-456-789.0987"},
+			"VERSION()": []string{"5.7.31-log"},
 		},
 	}
 	//set expected result
 	expectedValues = map[interface{}]interface{}{
-		s.Metrics.Version: float64(123.4567890987),
+		s.Metrics.Version: float64(50731),
 	}
 	//make sure to sleep for ~1 second before checking results
 	// otherwise no metrics will be collected in time
@@ -254,11 +296,11 @@ func TestVersion2(t *testing.T) {
 	//repeat for different test results
 	testquerycol = map[string]map[string][]string{
 		versionQuery: map[string][]string{
-			"VERSION()": []string{"123ABC456-abc-987"},
+			"VERSION()": []string{"10.4.13-MariaDB"},
 		},
 	}
 	expectedValues = map[interface{}]interface{}{
-		s.Metrics.Version: float64(123456.987),
+		s.Metrics.Version: float64(100413),
 	}
 	s.Collect()
 	time.Sleep(time.Millisecond * 1000 * 1)
@@ -273,11 +315,11 @@ func TestVersion3(t *testing.T) {
 	s := initMysqlStat()
 	testquerycol = map[string]map[string][]string{
 		versionQuery: map[string][]string{
-			"VERSION()": []string{"abcdefg-123-456-qwerty"},
+			"VERSION()": []string{"8.0"},
 		},
 	}
 	expectedValues = map[interface{}]interface{}{
-		s.Metrics.Version: float64(0.123456),
+		s.Metrics.Version: float64(80000),
 	}
 	s.Collect()
 	time.Sleep(time.Millisecond * 1000 * 1)
@@ -287,6 +329,45 @@ func TestVersion3(t *testing.T) {
 	}
 }
 
+// Test that versions which don't start with major.minor are left unset
+func TestVersionUnparseable(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		versionQuery: map[string][]string{
+			"VERSION()": []string{"abcdefg-123-456-qwerty"},
+		},
+	}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.Version.Get()) {
+		t.Error("expected no version, got " + strconv.FormatFloat(s.Metrics.Version.Get(), 'f', -1, 64))
+	}
+}
+
+// Test that encoded versions compare as the versions do
+func TestParseVersion(t *testing.T) {
+	for _, c := range []struct {
+		version  string
+		expected float64
+	}{
+		{"5.6.51", 50651},
+		{"5.7.31-34-log", 50731},
+		{"8.0.26", 80026},
+		{"8.0", 80000},
+		{"9.8.76a-54.3-log", 90876},
+		{"10.4.13-MariaDB", 100413},
+	} {
+		ver, err := parseVersion(c.version)
+		if err != nil || ver != c.expected {
+			t.Error("unexpected version for " + c.version + ": " + strconv.FormatFloat(ver, 'f', -1, 64))
+		}
+	}
+	for _, version := range []string{"", "8", "garbage", "a.b.c"} {
+		if _, err := parseVersion(version); err == nil {
+			t.Error("expected an error for " + version)
+		}
+	}
+}
+
 //Test Parsing of sessions query
 func TestSessions(t *testing.T) {
 	//initialize MysqlStat
@@ -328,6 +409,361 @@ func TestSessions(t *testing.T) {
 	}
 }
 
+// Test that sessions are counted by client host, without the port
+func TestHostSessions(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		sessionQuery1: map[string][]string{
+			"max_connections": []string{"100"},
+		},
+		sessionQuery2: map[string][]string{
+			"COMMAND": []string{"Sleep", "Query", "Sleep", "Sleep", "Daemon", "Query", "Sleep"},
+			"USER":    []string{"app", "app", "app", "batch", "event_scheduler", "root", "app"},
+			"STATE":   []string{"", "executing", "", "", "Waiting on empty queue", "init", ""},
+			"HOST": []string{"10.0.0.1:53422", "10.0.0.1:53423", "app2.example.com:40001",
+				"[fe80::1]:3306", "", "localhost", "app2_example.com:40002"},
+		},
+	}
+	s.Collect()
+	if len(s.hosts) != 5 {
+		t.Fatal("expected 5 hosts, got " + strconv.Itoa(len(s.hosts)))
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.hosts["10.0.0.1"].Sessions:         float64(2),
+		s.hosts["app2.example.com"].Sessions: float64(1),
+		s.hosts["fe80::1"].Sessions:          float64(1),
+		s.hosts["localhost"].Sessions:        float64(1),
+		s.hosts["app2_example.com"].Sessions: float64(1),
+	}
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//hosts that disconnected drop to 0
+	testquerycol[sessionQuery2] = map[string][]string{
+		"COMMAND": []string{"Sleep"},
+		"USER":    []string{"app"},
+		"STATE":   []string{""},
+		"HOST":    []string{"10.0.0.1:53424"},
+	}
+	s.Collect()
+	expectedValues = map[interface{}]interface{}{
+		s.hosts["10.0.0.1"].Sessions:  float64(1),
+		s.hosts["localhost"].Sessions: float64(0),
+	}
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	//hosts that clean to the same name are told apart by a suffix
+	for _, line := range []string{"sessions.host.10_0_0_1.Sessions.Value 1\n",
+		"sessions.host.app2_example_com.Sessions.Value 0\n",
+		"sessions.host.app2_example_com_2.Sessions.Value 0\n"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Error("expected " + strings.TrimSpace(line) + " in graphite output, got:\n" + buf.String())
+		}
+	}
+}
+
+// Test InnoDB locks counted by mode, with gap and record flags folded
+// into their mode
+func TestDataLocks(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		dataLocksQuery: map[string][]string{
+			"lock_mode":   []string{"IX", "X", "X,REC_NOT_GAP", "X,GAP,INSERT_INTENTION", "S", "IS", "AUTO_INC"},
+			"lock_status": []string{"GRANTED", "GRANTED", "GRANTED", "WAITING", "WAITING", "GRANTED", "GRANTED"},
+			"locks":       []string{"6", "3", "4", "2", "1", "5", "1"},
+		},
+		dataLockWaitsQuery: map[string][]string{
+			"waits": []string{"3"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.DataLocksGrantedS:  float64(0),
+		s.Metrics.DataLocksGrantedX:  float64(7),
+		s.Metrics.DataLocksGrantedIS: float64(5),
+		s.Metrics.DataLocksGrantedIX: float64(6),
+		s.Metrics.DataLocksWaitingS:  float64(1),
+		s.Metrics.DataLocksWaitingX:  float64(2),
+		s.Metrics.DataLocksWaitingIS: float64(0),
+		s.Metrics.DataLocksWaitingIX: float64(0),
+		s.Metrics.DataLockWaits:      float64(3),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//servers before 8.0 don't have data_locks
+	s = initMysqlStat()
+	s.identity.Version = "5.7.40-log"
+	//GetServerIdentity replaces the identity while the getters run
+	testquerycol[identityQuery] = map[string][]string{"version": []string{"5.7.40-log"}}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.DataLocksGrantedX.Get()) {
+		t.Error("expected no lock counts before 8.0")
+	}
+}
+
+// Test statement latency percentiles from the histogram buckets
+func TestStatementLatency(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		statementHistogramQuery: map[string][]string{
+			"bucket_number":     []string{"10", "11", "12", "13"},
+			"bucket_timer_high": []string{"1000000000", "2000000000", "5000000000", "10000000000"},
+			"count_bucket":      []string{"80", "15", "4", "1"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.StatementLatencyP95Ms: float64(2),
+		s.Metrics.StatementLatencyP99Ms: float64(5),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//only the statements since the last collection count
+	testquerycol[statementHistogramQuery]["count_bucket"] = []string{"80", "15", "4", "11"}
+	s.Collect()
+	if got := s.Metrics.StatementLatencyP95Ms.Get(); got != 10 {
+		t.Errorf("expected p95 of 10ms over the new statements, got %v", got)
+	}
+	s.Collect()
+	if got := s.Metrics.StatementLatencyP99Ms.Get(); !math.IsNaN(got) {
+		t.Errorf("expected no percentile without new statements, got %v", got)
+	}
+
+	//servers before 8.0 don't have the histogram
+	s = initMysqlStat()
+	s.identity.Version = "5.7.40-log"
+	//GetServerIdentity replaces the identity while the getters run
+	testquerycol[identityQuery] = map[string][]string{"version": []string{"5.7.40-log"}}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.StatementLatencyP95Ms.Get()) {
+		t.Error("expected no percentiles before 8.0")
+	}
+}
+
+// Test tables counted by storage engine
+func TestTableEngines(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		tableEnginesQuery: map[string][]string{
+			"engine": []string{"InnoDB", "MyISAM", "MEMORY", "ARCHIVE"},
+			"tables": []string{"120", "7", "2", "1"},
+		},
+	}
+	s.Collect()
+	if len(s.engines) != 4 {
+		t.Fatal("expected 4 engines, got " + strconv.Itoa(len(s.engines)))
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.engines["InnoDB"].TableCount:  float64(120),
+		s.engines["MyISAM"].TableCount:  float64(7),
+		s.engines["MEMORY"].TableCount:  float64(2),
+		s.engines["ARCHIVE"].TableCount: float64(1),
+	}
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//engines whose last tables were converted drop to 0
+	testquerycol[tableEnginesQuery] = map[string][]string{
+		"engine": []string{"InnoDB", "MEMORY"},
+		"tables": []string{"127", "2"},
+	}
+	s.Collect()
+	expectedValues = map[interface{}]interface{}{
+		s.engines["InnoDB"].TableCount:  float64(127),
+		s.engines["MyISAM"].TableCount:  float64(0),
+		s.engines["MEMORY"].TableCount:  float64(2),
+		s.engines["ARCHIVE"].TableCount: float64(0),
+	}
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	if !strings.Contains(buf.String(), "engine.MEMORY.TableCount.Value 2\n") {
+		t.Error("expected engine table counts in graphite output, got:\n" + buf.String())
+	}
+}
+
+// Test resource limits of accounts and their connection usage
+func TestAccountLimits(t *testing.T) {
+	s := initMysqlStat()
+	var buf bytes.Buffer
+	s.db = &testMysqlDB{Logger: log.New(&buf, "", 0)}
+	testquerycol = map[string]map[string][]string{
+		//app has two accounts, the smaller limit is checked
+		accountLimitsQuery: map[string][]string{
+			"user":                 []string{"app", "app", "batch", "report"},
+			"max_user_connections": []string{"50", "20", "10", "0"},
+			"max_questions":        []string{"0", "0", "0", "36000"},
+		},
+		userConnectionsQuery: map[string][]string{
+			"user":        []string{"app", "batch", "root"},
+			"connections": []string{"19", "3", "1"},
+		},
+	}
+	s.Collect()
+	if len(s.accounts) != 3 {
+		t.Fatal("expected 3 accounts with limits, got " + strconv.Itoa(len(s.accounts)))
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.accounts["app"].MaxUserConnections:  float64(20),
+		s.accounts["app"].Connections:         float64(19),
+		s.accounts["app"].ConnectionsPct:      float64(95),
+		s.accounts["batch"].ConnectionsPct:    float64(30),
+		s.accounts["report"].MaxQuestions:     float64(36000),
+		s.accounts["report"].Connections:      float64(0),
+		s.Metrics.AccountsNearConnectionLimit: float64(1),
+	}
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+	if !math.IsNaN(s.accounts["report"].ConnectionsPct.Get()) {
+		t.Error("expected no connection usage for an account without a connection limit")
+	}
+	if !strings.Contains(buf.String(), "accounts near max_user_connections: app (19 of 20)") {
+		t.Error("expected the account near its limit to be logged, got: " + buf.String())
+	}
+
+	//without SELECT on mysql.user nothing is collected
+	s = initMysqlStat()
+	testqueryerr = map[string]error{
+		accountLimitsQuery: errors.New("Error 1142: SELECT command denied to user 'monitor'@'localhost' for table 'user'"),
+	}
+	s.Collect()
+	if len(s.accounts) != 0 || s.LastErrors()["GetAccountLimits"] != nil {
+		t.Error("expected a missing privilege to be skipped")
+	}
+}
+
+// Test that getter errors add up across collections and that the
+// duration of each collection is set
+func TestGetterErrorCount(t *testing.T) {
+	s := initMysqlStat()
+	s.Collect()
+	first := s.Metrics.CollectGetterErrors.Get()
+	if math.IsNaN(s.Metrics.CollectDurationMs.Get()) || s.Metrics.CollectDurationMs.Get() < 0 {
+		t.Error("expected the collection's duration to be set")
+	}
+	testqueryerr = map[string]error{
+		versionQuery:     errors.New("dial tcp 127.0.0.1:3306: connection refused"),
+		globalStatsQuery: errors.New("dial tcp 127.0.0.1:3306: connection refused"),
+	}
+	s.Collect()
+	if second := s.Metrics.CollectGetterErrors.Get(); second != 2*first+2 {
+		t.Error("expected " + strconv.FormatUint(2*first+2, 10) + " errors, got " + strconv.FormatUint(second, 10))
+	}
+}
+
+// Test that the backup age is computed from the marker table's latest
+// time against the clock, and is unknown for an empty table
+func TestBackupAge(t *testing.T) {
+	s := initMysqlStat()
+	s.Collect()
+	if !math.IsNaN(s.Metrics.LastBackupAgeSeconds.Get()) {
+		t.Error("expected no backup age without a marker table")
+	}
+	s.SetBackupMarker("ops.backups", "finished_at")
+	s.now = func() time.Time { return time.Unix(1400003600, 0) }
+	query := "SELECT UNIX_TIMESTAMP(MAX(`finished_at`)) AS ts FROM `ops`.`backups`;"
+	testquerycol = map[string]map[string][]string{
+		query: map[string][]string{
+			"ts": []string{"1400000000.000000"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.LastBackupAgeSeconds: float64(3600),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	testquerycol[query]["ts"] = []string{""}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.LastBackupAgeSeconds.Get()) {
+		t.Error("expected no backup age for an empty table")
+	}
+}
+
+// Test counting binlog dump threads as connected replicas
+func TestConnectedReplicas(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		sessionQuery1: map[string][]string{
+			"max_connections": []string{"100"},
+		},
+		sessionQuery2: map[string][]string{
+			"COMMAND": []string{"Binlog Dump GTID", "Query", "Binlog Dump", "Sleep"},
+			"USER":    []string{"repl", "app", "repl", "app"},
+			"STATE":   []string{"Source has sent all binlog to replica; waiting for more updates", "executing", "", ""},
+			"HOST":    []string{"10.0.0.12:40022", "10.0.0.5:5123", "10.0.0.11:40001", "10.0.0.5:5124"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ConnectedReplicas: float64(2),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+	replicas := s.ConnectedReplicas()
+	if len(replicas) != 2 || replicas[0] != "10.0.0.11" || replicas[1] != "10.0.0.12" {
+		t.Error("unexpected replica hosts: " + strings.Join(replicas, " "))
+	}
+
+	//replicas that disconnected are gone at the next collection
+	testquerycol[sessionQuery2] = map[string][]string{
+		"COMMAND": []string{"Sleep"},
+		"USER":    []string{"app"},
+		"STATE":   []string{""},
+		"HOST":    []string{"10.0.0.5:5124"},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ConnectedReplicas: float64(0),
+	}
+	s.Collect()
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+	if len(s.ConnectedReplicas()) != 0 {
+		t.Error("expected no replicas after they disconnected")
+	}
+}
+
+// Test that only maxSessionHosts client hosts are tracked
+func TestHostSessionsLimit(t *testing.T) {
+	s := initMysqlStat()
+	hosts := make([]string, maxSessionHosts+10)
+	for i := range hosts {
+		hosts[i] = "client" + strconv.Itoa(i) + ":3306"
+	}
+	s.setHostSessions(hosts)
+	if len(s.hosts) != maxSessionHosts {
+		t.Error("expected " + strconv.Itoa(maxSessionHosts) + " hosts, got " + strconv.Itoa(len(s.hosts)))
+	}
+}
+
 // Test basic parsing of slave info query
 func TestSlave1(t *testing.T) {
 	//intitialize MysqlStat
@@ -417,3 +853,3232 @@ func TestSlave3(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// Test that Collect reports the getters that failed.
+// The test db always fails "SHOW ENGINE INNODB STATUS",
+// so GetInnodbStats should be the only failure.
+func TestCollectErrors(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		versionQuery: map[string][]string{
+			"VERSION()": []string{"1.2.34"},
+		},
+	}
+	err := s.Collect()
+	if err == nil {
+		t.Fatal("expected an error from Collect, got nil")
+	}
+	if !strings.Contains(err.Error(), "GetInnodbStats") {
+		t.Error("expected error to name GetInnodbStats, got: " + err.Error())
+	}
+	if len(s.LastErrors()) != 1 {
+		t.Error("expected 1 failed getter, got " + strconv.Itoa(len(s.LastErrors())) + ": " + err.Error())
+	}
+}
+
+// Test that a failed SHOW GLOBAL STATUS fails the collection
+func TestCollectGlobalStatusError(t *testing.T) {
+	s := initMysqlStat()
+	testqueryerr = map[string]error{
+		globalStatsQuery: errors.New("Error 1227: Access denied; you need the PROCESS privilege"),
+	}
+	err := s.Collect()
+	if err == nil {
+		t.Fatal("expected an error from Collect, got nil")
+	}
+	if _, ok := s.LastErrors()["GetGlobalStatus"]; !ok {
+		t.Error("expected GetGlobalStatus to fail, got: " + err.Error())
+	}
+}
+
+// Test that users without a password or SSL are counted from the user
+// column securityQuery returns
+func TestSecurity(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		securityQuery: map[string][]string{
+			"user": []string{"app", "", "backup"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.UnsecureUsers: float64(3),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	testquerycol[securityQuery] = map[string][]string{}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.UnsecureUsers: float64(0),
+	}
+	s.Collect()
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test counts of routines, triggers and events
+func TestSchemaObjects(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		routinesQuery: map[string][]string{
+			"count": []string{"12"},
+		},
+		triggersQuery: map[string][]string{
+			"count": []string{"3"},
+		},
+		eventsQuery: map[string][]string{
+			"count":   []string{"4"},
+			"enabled": []string{"1"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.Routines:      float64(12),
+		s.Metrics.Triggers:      float64(3),
+		s.Metrics.Events:        float64(4),
+		s.Metrics.EventsEnabled: float64(1),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test that the output precision applies to non-integer gauges only
+func TestFormatPrecision(t *testing.T) {
+	s := initMysqlStat()
+	s.Metrics.BufferPoolHitRate.Set(0.987654321)
+	s.Metrics.BinlogSize.Set(1111)
+	s.SetFormatPrecision(3)
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	out := buf.String()
+	for _, line := range []string{"BufferPoolHitRate.Value 0.988\n", "BinlogSize.Value 1111\n"} {
+		if !strings.Contains(out, line) {
+			t.Error("expected output to contain " + strconv.Quote(line) + ", got:\n" + out)
+		}
+	}
+}
+
+// Test that counters continue across a reconnect to a server that kept
+// running, and only start over when its uptime goes down
+func TestReconnectKeepsCounters(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Queries": []string{"1000"},
+			"Uptime":  []string{"3600"},
+		},
+	}
+	s.Collect()
+	queries := s.Metrics.Queries
+
+	s.SetDB(&testMysqlDB{Logger: s.db.(*testMysqlDB).Logger})
+	testquerycol[globalStatsQuery] = map[string][]string{
+		"Queries": []string{"1600"},
+		"Uptime":  []string{"3660"},
+	}
+	s.Collect()
+	if s.Metrics.Queries != queries {
+		t.Fatal("expected the counters to be kept after reconnecting")
+	}
+	if s.Metrics.Queries.Get() != 1600 || math.IsNaN(s.Metrics.Queries.ComputeRate()) {
+		t.Error("expected Queries to continue at 1600 with a rate, got " +
+			strconv.FormatUint(s.Metrics.Queries.Get(), 10))
+	}
+
+	//the server restarted
+	testquerycol[globalStatsQuery] = map[string][]string{
+		"Queries": []string{"20"},
+		"Uptime":  []string{"5"},
+	}
+	s.Collect()
+	if s.Metrics.Queries != queries {
+		t.Fatal("expected the counters to start over in place after a restart")
+	}
+	if s.Metrics.Queries.Get() != 20 || s.Metrics.Uptime.Get() != 5 {
+		t.Error("expected the values collected after the restart to be kept")
+	}
+	if !math.IsNaN(s.Metrics.Queries.ComputeRate()) {
+		t.Error("expected no rate across the restart")
+	}
+}
+
+// Test the graphite lines after a known collection: one name and value
+// per line, sorted by name, with counters only once they have a rate
+func TestFormatGraphite(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Queries":           []string{"1000"},
+			"Threads_connected": []string{"12"},
+			"Threads_running":   []string{"3"},
+		},
+	}
+	s.Collect()
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	if strings.Contains(buf.String(), "\nQueries.") {
+		t.Error("expected no counter lines before a rate is known, got:\n" + buf.String())
+	}
+
+	testquerycol[globalStatsQuery]["Queries"] = []string{"1100"}
+	testquerycol[globalStatsQuery]["Threads_connected"] = []string{"10"}
+	s.Collect()
+	buf.Reset()
+	s.FormatGraphite(&buf)
+	out := buf.String()
+	values := make(map[string]string)
+	var names []string
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		parts := strings.Split(line, " ")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			t.Fatal("expected name and value lines, got " + strconv.Quote(line))
+		}
+		if _, ok := values[parts[0]]; ok {
+			t.Error("duplicate metric " + parts[0])
+		}
+		values[parts[0]] = parts[1]
+		names = append(names, parts[0])
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Error("expected lines sorted by name, got:\n" + out)
+	}
+	for name, value := range map[string]string{
+		"Queries.Value":          "1100",
+		"ThreadsConnected.Value": "10",
+		"ThreadsRunning.Value":   "3",
+	} {
+		if values[name] != value {
+			t.Error("expected " + name + " " + value + ", got " + strconv.Quote(values[name]))
+		}
+	}
+	if _, err := strconv.ParseFloat(values["Queries.Rate"], 64); err != nil {
+		t.Error("expected a Queries rate, got:\n" + out)
+	}
+}
+
+// Test that the streamed JSON output is a valid list of
+// metric records holding the collected values
+func TestFormatJSON(t *testing.T) {
+	s := initMysqlStat()
+	s.Metrics.BufferPoolHitRate.Set(0.987654321)
+	s.Metrics.BinlogSize.Set(1111)
+	s.Metrics.Queries.Set(60)
+	var buf bytes.Buffer
+	if err := s.FormatJSON(&buf); err != nil {
+		t.Error(err)
+	}
+	var records []struct {
+		Type  string
+		Name  string
+		Value float64
+	}
+	if err := json.Unmarshal(buf.Bytes(), &records); err != nil {
+		t.Fatal("output is not valid JSON: " + err.Error())
+	}
+	result := map[string]float64{}
+	for _, rec := range records {
+		result[rec.Type+" "+rec.Name] = rec.Value
+	}
+	expected := map[string]float64{
+		"gauge mysqlstat.BufferPoolHitRate": 0.987654321,
+		"gauge mysqlstat.BinlogSize":        1111,
+		"counter mysqlstat.Queries":         60,
+	}
+	for name, val := range expected {
+		if v, ok := result[name]; !ok || v != val {
+			t.Error("missing or incorrect record for " + name + ", got:\n" + buf.String())
+		}
+	}
+	//unset gauges are left out
+	if _, ok := result["gauge mysqlstat.SlaveSecondsBehindMaster"]; ok {
+		t.Error("unexpected record for unset gauge")
+	}
+}
+
+// Test detection of replication filters
+func TestSlaveReplicationFilters(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		slaveQuery: map[string][]string{
+			"Seconds_Behind_Master":   []string{"0"},
+			"Replicate_Do_DB":         []string{""},
+			"Replicate_Ignore_DB":     []string{"scratch,tmp"},
+			"Replicate_Wild_Do_Table": []string{""},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SlaveHasReplicationFilters: float64(1),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+	filters := s.ReplicationFilters()
+	if len(filters) != 1 || filters["Replicate_Ignore_DB"] != "scratch,tmp" {
+		t.Error("unexpected replication filters")
+	}
+
+	//no filters set
+	testquerycol[slaveQuery]["Replicate_Ignore_DB"] = []string{""}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SlaveHasReplicationFilters: float64(0),
+	}
+	s.Collect()
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+	if len(s.ReplicationFilters()) != 0 {
+		t.Error("expected no replication filters")
+	}
+}
+
+// Test buffer pool LRU counters summed over buffer pool instances
+func TestBufferPoolLRU(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		bufferPoolLRUQuery: map[string][]string{
+			"pages_made_young":                 []string{"1000", "3000"},
+			"pages_not_made_young":             []string{"50000", "70000"},
+			"young_make_per_thousand_gets":     []string{"10", "20"},
+			"not_young_make_per_thousand_gets": []string{"300", "500"},
+		},
+		bufferPoolLRUStatusQuery: map[string][]string{
+			"Innodb_buffer_pool_pages_made_young":     []string{"1"},
+			"Innodb_buffer_pool_pages_made_not_young": []string{"2"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.InnodbPagesMadeYoung:          uint64(4000),
+		s.Metrics.InnodbPagesMadeNotYoung:       uint64(120000),
+		s.Metrics.InnodbYoungPerThousandGets:    float64(15),
+		s.Metrics.InnodbNotYoungPerThousandGets: float64(400),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//status variables are used when innodb_buffer_pool_stats can't be read
+	s = initMysqlStat()
+	testqueryerr = map[string]error{
+		bufferPoolLRUQuery: errors.New("Error 1227: Access denied; you need (at least one of) the PROCESS privilege(s)"),
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.InnodbPagesMadeYoung:    uint64(1),
+		s.Metrics.InnodbPagesMadeNotYoung: uint64(2),
+	}
+	s.Collect()
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+	if !math.IsNaN(s.Metrics.InnodbYoungPerThousandGets.Get()) {
+		t.Error("expected the per thousand gets rate to be left unset")
+	}
+}
+
+// Test the age of the oldest binary log, read from its header
+func TestOldestBinlogAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binlogs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//magic number, then the first event's timestamp
+	started := time.Now().Add(-36 * time.Hour).Unix()
+	header := []byte("\xfebin\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(header[4:], uint32(started))
+	if err := ioutil.WriteFile(filepath.Join(dir, "mysql-bin.000042"), header, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		binlogQuery: map[string][]string{
+			"Log_name":  []string{"mysql-bin.000042", "mysql-bin.000043"},
+			"File_size": []string{"1000", "2000"},
+		},
+		binlogBasenameQuery: map[string][]string{
+			"basename": []string{filepath.Join(dir, "mysql-bin")},
+		},
+	}
+	//only read with SetLocalBinlogs
+	s.Collect()
+	if !math.IsNaN(s.Metrics.OldestBinlogAgeSeconds.Get()) {
+		t.Error("expected the age to be left unset without SetLocalBinlogs")
+	}
+	s = initMysqlStat()
+	s.SetLocalBinlogs(true)
+	s.Collect()
+	age := s.Metrics.OldestBinlogAgeSeconds.Get()
+	if age < 36*3600 || age > 36*3600+60 {
+		t.Error("expected an age of 36 hours, got " + strconv.FormatFloat(age, 'f', -1, 64))
+	}
+
+	//not a binary log
+	ioutil.WriteFile(filepath.Join(dir, "mysql-bin.000042"), []byte("hello world"), 0600)
+	s = initMysqlStat()
+	s.SetLocalBinlogs(true)
+	s.Collect()
+	if !math.IsNaN(s.Metrics.OldestBinlogAgeSeconds.Get()) {
+		t.Error("expected the age to be left unset")
+	}
+
+	//binary logs on another host are skipped without logging
+	os.Remove(filepath.Join(dir, "mysql-bin.000042"))
+	s = initMysqlStat()
+	var buf bytes.Buffer
+	s.db = &testMysqlDB{Logger: log.New(&buf, "", 0)}
+	s.SetLocalBinlogs(true)
+	s.Collect()
+	if !math.IsNaN(s.Metrics.OldestBinlogAgeSeconds.Get()) || strings.Contains(buf.String(), "mysql-bin.000042") {
+		t.Error("expected a missing binary log to be skipped quietly, got: " + buf.String())
+	}
+}
+
+// Test counting of healthy channels on a multi-source replica
+func TestReplicationChannels(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		slaveQuery: map[string][]string{
+			"Channel_Name":          []string{"east", "west", "north", "south"},
+			"Seconds_Behind_Master": []string{"0", "", "", "3"},
+			"Slave_IO_Running":      []string{"Yes", "Connecting", "Yes", "Yes"},
+			"Slave_SQL_Running":     []string{"Yes", "Yes", "No", "Yes"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ReplicationChannelsTotal:   float64(4),
+		s.Metrics.ReplicationChannelsHealthy: float64(2),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//not a replica
+	testquerycol[slaveQuery] = map[string][]string{}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ReplicationChannelsTotal:   float64(0),
+		s.Metrics.ReplicationChannelsHealthy: float64(0),
+	}
+	s.Collect()
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test that named channels of multi-source replication get their own
+// metrics, and that the unnamed default channel keeps the unsuffixed ones
+func TestSlaveChannels(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		slaveQuery: map[string][]string{
+			"Channel_Name":          []string{"", "channel_foo", "new", "channel.foo"},
+			"Seconds_Behind_Master": []string{"5", "80", "", "9"},
+			"Relay_Master_Log_File": []string{"bin.000003", "some.name.bin.01345", "", ""},
+			"Exec_Master_Log_Pos":   []string{"4", "7", "0", "0"},
+		},
+		slaveBackupQuery: map[string][]string{
+			"count": []string{"0"},
+		},
+	}
+	s.Collect()
+	foo := s.channels["channel_foo"]
+	never := s.channels["new"]
+	if foo == nil || never == nil || len(s.channels) != 3 {
+		t.Fatal("expected metrics for the three named channels")
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SlaveSecondsBehindMaster: float64(5),
+		s.Metrics.SlaveSeqFile:             float64(3),
+		s.Metrics.SlavePosition:            uint64(4),
+		foo.SlaveSecondsBehindMaster:       float64(80),
+		foo.SlaveSeqFile:                   float64(1345),
+		foo.SlavePosition:                  uint64(7),
+	}
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+	if !math.IsNaN(never.SlaveSecondsBehindMaster.Get()) {
+		t.Error("expected no lag for a channel that never connected")
+	}
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	if !strings.Contains(buf.String(), "\nSlaveChannels.channel_foo.SlaveSecondsBehindMaster.Value 80\n") {
+		t.Error("expected per channel lag in graphite output, got:\n" + buf.String())
+	}
+	//a channel whose name cleans to one already taken gets a suffix
+	if !strings.Contains(buf.String(), "\nSlaveChannels.channel_foo_2.SlaveSecondsBehindMaster.Value 9\n") {
+		t.Error("expected a suffix for a clashing channel name, got:\n" + buf.String())
+	}
+
+	//channel removed
+	testquerycol[slaveQuery] = map[string][]string{
+		"Channel_Name":          []string{"channel_foo"},
+		"Seconds_Behind_Master": []string{"1"},
+	}
+	s.Collect()
+	if _, ok := s.channels["new"]; ok {
+		t.Error("expected a channel no longer listed to be dropped")
+	}
+}
+
+// Test parsing of whether replication uses SSL
+func TestSlaveSSLAllowed(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		slaveQuery: map[string][]string{
+			"Seconds_Behind_Master": []string{"0"},
+			"Master_SSL_Allowed":    []string{"Yes"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SlaveSSLAllowed: float64(1),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	for _, allowed := range []string{"No", "Ignored"} {
+		testquerycol[slaveQuery]["Master_SSL_Allowed"] = []string{allowed}
+		expectedValues = map[interface{}]interface{}{
+			s.Metrics.SlaveSSLAllowed: float64(0),
+		}
+		s.Collect()
+		err = checkResults()
+		if err != "" {
+			t.Error(allowed + ": " + err)
+		}
+	}
+}
+
+// Test parsing of whether replication uses GTID auto-positioning
+func TestSlaveAutoPosition(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		slaveQuery: map[string][]string{
+			"Seconds_Behind_Master": []string{"0"},
+			"Auto_Position":         []string{"1"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SlaveAutoPosition: float64(1),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test the lag percentile and maximum over the last few collections
+func TestSlaveLagWindow(t *testing.T) {
+	s := initMysqlStat()
+	s.SetLagWindow(4, 0)
+	for _, lag := range []string{"90", "1", "3", "2", "0"} {
+		testquerycol = map[string]map[string][]string{
+			slaveQuery: map[string][]string{
+				"Seconds_Behind_Master": []string{lag},
+			},
+		}
+		s.Collect()
+	}
+	//the 90s spike has left the window
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SlaveSecondsBehindMaster: float64(0),
+		s.Metrics.SlaveLagP95:              float64(3),
+		s.Metrics.SlaveLagMax:              float64(3),
+	}
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//off by default
+	s = initMysqlStat()
+	s.Collect()
+	if !math.IsNaN(s.Metrics.SlaveLagP95.Get()) {
+		t.Error("expected no lag percentile without a window")
+	}
+}
+
+// Test sql_slave_skip_counter is reported while events are being skipped
+func TestSkipCounter(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		skipCounterQuery: map[string][]string{
+			"skip_counter": []string{"3"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SlaveSkipCounterActive: float64(1),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	testquerycol = map[string]map[string][]string{
+		skipCounterQuery: map[string][]string{
+			"skip_counter": []string{"0"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SlaveSkipCounterActive: float64(0),
+	}
+	s.Collect()
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test replication metrics are parsed from SHOW REPLICA STATUS on 8.0.22+
+// and SHOW SLAVE STATUS before
+func TestReplicaStatus(t *testing.T) {
+	slave := map[string][]string{
+		"Seconds_Behind_Master": []string{"12"},
+		"Slave_IO_Running":      []string{"Yes"},
+		"Slave_SQL_Running":     []string{"Yes"},
+		"Master_SSL_Allowed":    []string{"Yes"},
+		"Exec_Master_Log_Pos":   []string{"4242"},
+		"Master_Host":           []string{"db1.example.com"},
+		"Replicate_Do_DB":       []string{"app"},
+	}
+	replica := map[string][]string{
+		"Seconds_Behind_Source": []string{"12"},
+		"Replica_IO_Running":    []string{"Yes"},
+		"Replica_SQL_Running":   []string{"Yes"},
+		"Source_SSL_Allowed":    []string{"Yes"},
+		"Exec_Source_Log_Pos":   []string{"4242"},
+		"Source_Host":           []string{"db1.example.com"},
+		"Replicate_Do_DB":       []string{"app"},
+	}
+	for _, c := range []struct {
+		version string
+		res     map[string]map[string][]string
+		errs    map[string]error
+	}{
+		{"5.7.31-log", map[string]map[string][]string{slaveQuery: slave}, nil},
+		{"8.0.25", map[string]map[string][]string{replicaQuery: replica}, nil},
+		//the version isn't known yet, and the old statement was removed
+		{"", map[string]map[string][]string{replicaQuery: replica},
+			map[string]error{slaveQuery: errors.New("Error 1064: You have an error in your SQL syntax")}},
+	} {
+		s := initMysqlStat()
+		s.identity.Version = c.version
+		testquerycol = c.res
+		testqueryerr = c.errs
+		if testqueryerr == nil {
+			testqueryerr = map[string]error{}
+		}
+		expectedValues = map[interface{}]interface{}{
+			s.Metrics.SlaveSecondsBehindMaster:   float64(12),
+			s.Metrics.ReplicationChannelsHealthy: float64(1),
+			s.Metrics.SlaveSSLAllowed:            float64(1),
+			s.Metrics.SlavePosition:              uint64(4242),
+		}
+		s.Collect()
+		if err := checkResults(); err != "" {
+			t.Error(c.version + ": " + err)
+		}
+		if s.Source().Host != "db1.example.com" || s.Metrics.SlaveHasReplicationFilters.Get() != 1 {
+			t.Error(c.version + ": expected the source and replication filters")
+		}
+		if _, failed := s.LastErrors()["GetSlaveStats"]; failed {
+			t.Error(c.version + ": unexpected error: " + s.LastErrors()["GetSlaveStats"].Error())
+		}
+	}
+	testqueryerr = map[string]error{}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	for _, c := range []struct {
+		version  string
+		expected bool
+	}{
+		{"8.0.22", true},
+		{"8.0.30-22-log", true},
+		{"8.1.0", true},
+		{"10.5.8-MariaDB", true},
+		{"8.0.21", false},
+		{"8.0.3-rc-log", false},
+		{"5.7.31-log", false},
+		{"", false},
+		{"garbage", false},
+	} {
+		if versionAtLeast(c.version, 8, 0, 22) != c.expected {
+			t.Error("unexpected result for " + c.version)
+		}
+	}
+}
+
+// Test the data directory's filesystem usage is read when the directory
+// is on this host
+func TestDataDirUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		dataDirQuery: map[string][]string{
+			"datadir": []string{dir + "/"},
+		},
+	}
+	s.Collect()
+	free, total := s.Metrics.DataDirFreeBytes.Get(), s.Metrics.DataDirTotalBytes.Get()
+	if math.IsNaN(free) || math.IsNaN(total) || total == 0 || free > total {
+		t.Error("unexpected data directory usage: " + strconv.FormatFloat(free, 'f', 0, 64) +
+			" of " + strconv.FormatFloat(total, 'f', 0, 64))
+	}
+
+	//the collector runs on another host
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		dataDirQuery: map[string][]string{
+			"datadir": []string{filepath.Join(dir, "missing")},
+		},
+	}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.DataDirTotalBytes.Get()) {
+		t.Error("expected no usage for a data directory on another host")
+	}
+}
+
+// Test corrupt tables are counted once each from error log messages
+func TestCorruptTables(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		corruptLogQuery: map[string][]string{
+			"data": []string{
+				"Table './shop/orders' is marked as crashed and should be repaired",
+				"InnoDB: Table `shop`.`items` is corrupted. Please drop the table and recreate.",
+				"Table './shop/orders' is marked as crashed and last (automatic?) repair failed",
+				"InnoDB: Database page corruption on disk or a failed file read of page [page id: space=5, page number=3]",
+			},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.CorruptTablesCount: float64(2),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+
+	//CHECK TABLE finds another
+	s = initMysqlStat()
+	schemas := []string{"shop"}
+	s.SetCheckTables(schemas, time.Hour)
+	testquerycol[checkTablesQuery(schemas)] = map[string][]string{
+		"table_schema": []string{"shop", "shop"},
+		"table_name":   []string{"orders", "users"},
+	}
+	testquerycol["CHECK TABLE `shop`.`orders` QUICK;"] = map[string][]string{
+		"Table":    []string{"shop.orders"},
+		"Msg_type": []string{"status"},
+		"Msg_text": []string{"OK"},
+	}
+	testquerycol["CHECK TABLE `shop`.`users` QUICK;"] = map[string][]string{
+		"Table":    []string{"shop.users", "shop.users"},
+		"Msg_type": []string{"Warning", "error"},
+		"Msg_text": []string{"InnoDB: The B-tree of index PRIMARY is corrupted.", "Corrupt"},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.CorruptTablesCount: float64(3),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+}
+
+// Test the IO and SQL thread gaps are computed from slave status and the
+// master's position, and left unset when they span binlog files
+func TestSlaveLagBytes(t *testing.T) {
+	s := initMysqlStat()
+	s.SetMaster(&testMysqlDB{Logger: log.New(os.Stderr, "TESTING LOG: ", log.Lshortfile)})
+	testquerycol = map[string]map[string][]string{
+		slaveQuery: map[string][]string{
+			"Master_Log_File":       []string{"mysql-bin.000042"},
+			"Read_Master_Log_Pos":   []string{"9000000"},
+			"Relay_Master_Log_File": []string{"mysql-bin.000042"},
+			"Exec_Master_Log_Pos":   []string{"8250000"},
+		},
+		//the master's SHOW MASTER STATUS
+		binlogStatsQuery: map[string][]string{
+			"File":     []string{"mysql-bin.000042"},
+			"Position": []string{"9500000"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SlaveIOLagBytes:  float64(500000),
+		s.Metrics.SlaveSQLLagBytes: float64(750000),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+
+	//the SQL thread is still applying an older file, and there is no
+	// master to compare with
+	s = initMysqlStat()
+	testquerycol[slaveQuery]["Relay_Master_Log_File"] = []string{"mysql-bin.000041"}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.SlaveSQLLagBytes.Get()) || !math.IsNaN(s.Metrics.SlaveIOLagBytes.Get()) {
+		t.Error("expected no byte lag across binlog files or without a master")
+	}
+}
+
+// Test the relay log left to apply, from the relay log space and the
+// coordinator's position in the relay log it reads
+func TestRelayLogApplyQueue(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		slaveQuery: map[string][]string{
+			"Relay_Log_File":  []string{"relay-bin.000007"},
+			"Relay_Log_Pos":   []string{"1200"},
+			"Relay_Log_Space": []string{"5000"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.RelayLogApplyQueueBytes: float64(3800),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+
+	//not a replica
+	s = initMysqlStat()
+	testquerycol[slaveQuery] = map[string][]string{}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.RelayLogApplyQueueBytes.Get()) {
+		t.Error("expected no relay log queue without replication")
+	}
+}
+
+// Test an applier that stops moving while the relay log keeps growing
+func TestSlaveApplyStalled(t *testing.T) {
+	s := initMysqlStat()
+	status := func(pos, space string) map[string][]string {
+		return map[string][]string{
+			"Slave_SQL_Running":     []string{"Yes"},
+			"Relay_Master_Log_File": []string{"mysql-bin.000042"},
+			"Exec_Master_Log_Pos":   []string{pos},
+			"Relay_Log_Space":       []string{space},
+		}
+	}
+	testquerycol = map[string]map[string][]string{
+		slaveQuery: status("1000", "5000"),
+	}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.SlaveApplyStalled.Get()) {
+		t.Error("expected no stall state after one collection")
+	}
+
+	//applying as the relay log grows
+	testquerycol[slaveQuery] = status("3000", "6000")
+	s.Collect()
+	if s.Metrics.SlaveApplyStalled.Get() != 0 {
+		t.Error("expected the applier not stalled while its position moves")
+	}
+
+	//the relay log grows, the position doesn't
+	testquerycol[slaveQuery] = status("3000", "9000")
+	s.Collect()
+	if s.Metrics.SlaveApplyStalled.Get() != 1 {
+		t.Error("expected the applier stalled")
+	}
+
+	//caught up, nothing new to apply
+	testquerycol[slaveQuery] = status("3000", "9000")
+	s.Collect()
+	if s.Metrics.SlaveApplyStalled.Get() != 0 {
+		t.Error("expected an idle applier with nothing new not stalled")
+	}
+}
+
+// Test replication state is read from performance_schema when the user
+// can't run SHOW SLAVE STATUS
+func TestPerfSchemaSlaveStatus(t *testing.T) {
+	s := initMysqlStat()
+	var logged bytes.Buffer
+	s.db = &testMysqlDB{Logger: log.New(&logged, "", 0)}
+	denied := errors.New("Error 1227: Access denied; you need (at least one of) the SUPER, REPLICATION CLIENT privilege(s) for this operation")
+	testqueryerr = map[string]error{slaveQuery: denied, replicaQuery: denied}
+	testquerycol = map[string]map[string][]string{
+		perfSchemaSlaveQuery: map[string][]string{
+			"channel_name": []string{""},
+			"host":         []string{"db-primary"},
+			"port":         []string{"3306"},
+			"io_state":     []string{"ON"},
+			"sql_state":    []string{"ON"},
+			"lag":          []string{"4"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SlaveSecondsBehindMaster:   float64(4),
+		s.Metrics.ReplicationRunning:         float64(1),
+		s.Metrics.ReplicationChannelsTotal:   float64(1),
+		s.Metrics.ReplicationChannelsHealthy: float64(1),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+	if !strings.Contains(logged.String(), "reading replication state from performance_schema") {
+		t.Error("expected the fallback to be logged, got: " + logged.String())
+	}
+	if src := s.Source(); src.Host != "db-primary" {
+		t.Error("expected the master host from performance_schema, got " + src.Host)
+	}
+	if errs := s.LastErrors(); errs["GetSlaveStats"] != nil {
+		t.Error("expected no error once the fallback worked, got", errs["GetSlaveStats"])
+	}
+
+	//the SQL thread stopped, two named channels
+	testquerycol[perfSchemaSlaveQuery] = map[string][]string{
+		"channel_name": []string{"east", "west"},
+		"host":         []string{"db-east", "db-west"},
+		"port":         []string{"3306", "3306"},
+		"io_state":     []string{"CONNECTING", "ON"},
+		"sql_state":    []string{"ON", "OFF"},
+		"lag":          []string{"0", "0"},
+	}
+	s.Collect()
+	if s.Metrics.ReplicationChannelsHealthy.Get() != 0 || s.Metrics.ReplicationChannelsTotal.Get() != 2 {
+		t.Error("expected neither channel healthy")
+	}
+	if !math.IsNaN(s.channels["west"].SlaveSecondsBehindMaster.Get()) {
+		t.Error("expected no lag while the SQL thread is stopped")
+	}
+	if s.channels["east"].SlaveSecondsBehindMaster.Get() != 0 {
+		t.Error("expected no lag on a channel with nothing to apply")
+	}
+
+	//performance_schema can't be read either
+	s = initMysqlStat()
+	testqueryerr = map[string]error{slaveQuery: denied, replicaQuery: denied,
+		perfSchemaSlaveQuery: errors.New("Error 1142: SELECT command denied to user")}
+	s.Collect()
+	if errs := s.LastErrors(); errs["GetSlaveStats"] == nil || !strings.Contains(errs["GetSlaveStats"].Error(), "1227") {
+		t.Error("expected the SHOW SLAVE STATUS error, got", errs["GetSlaveStats"])
+	}
+	testqueryerr = map[string]error{}
+}
+
+//a replica connected to by GetReplicaLag, returning its own slave status
+type testReplicaDB struct {
+	testMysqlDB
+	status map[string][]string
+	closed bool
+}
+
+func (r *testReplicaDB) QueryReturnColumnDict(query string) (map[string][]string, error) {
+	if query != slaveQuery {
+		return nil, errors.New("unexpected query on replica: " + query)
+	}
+	return r.status, nil
+}
+
+func (r *testReplicaDB) Close() {
+	r.closed = true
+}
+
+// Test the lag of replicas found from binlog dump threads is read over a
+// connection to each, and a replica that can't be reached is reported
+// without failing the collection
+func TestReplicaLag(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		replicaHostsQuery: map[string][]string{
+			"host": []string{"10.0.0.2:51234", "10.0.0.3:40112", "10.0.0.2:51240", "10.0.0.4:3306"},
+		},
+	}
+	logger := log.New(os.Stderr, "TESTING LOG: ", log.Lshortfile)
+	replicas := map[string]*testReplicaDB{
+		"10.0.0.2": &testReplicaDB{testMysqlDB{logger}, map[string][]string{"Seconds_Behind_Master": []string{"3"}}, false},
+		//replication stopped
+		"10.0.0.3": &testReplicaDB{testMysqlDB{logger}, map[string][]string{"Seconds_Behind_Master": []string{""}}, false},
+	}
+	var lock sync.Mutex
+	connects := map[string]int{}
+	s.SetReplicaLag(nil, 2, func(host string) (tools.MysqlDB, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		connects[host]++
+		if r, ok := replicas[host]; ok {
+			return r, nil
+		}
+		return nil, errors.New("connection refused")
+	})
+	s.Collect()
+	if err := s.LastErrors()["GetReplicaLag"]; err != nil {
+		t.Error("expected an unreachable replica not to fail the getter, got: " + err.Error())
+	}
+	first, second, down := s.replicaLag["10.0.0.2"], s.replicaLag["10.0.0.3"], s.replicaLag["10.0.0.4"]
+	if first == nil || second == nil || down == nil {
+		t.Fatal("expected every replica found to be checked")
+	}
+	expectedValues = map[interface{}]interface{}{
+		first.SecondsBehindMaster:  float64(3),
+		first.Reachable:            float64(1),
+		second.SecondsBehindMaster: float64(-1),
+		second.Reachable:           float64(1),
+		down.SecondsBehindMaster:   float64(-1),
+		down.Reachable:             float64(0),
+	}
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	if !strings.Contains(buf.String(), "replica.10_0_0_2.SecondsBehindMaster.Value 3\n") {
+		t.Error("expected the replica's lag in graphite output, got: " + buf.String())
+	}
+
+	//open connections are reused, and the unreachable replica is tried again
+	replicas["10.0.0.2"].status = map[string][]string{"Seconds_Behind_Master": []string{"7"}}
+	s.Collect()
+	if connects["10.0.0.2"] != 1 || connects["10.0.0.4"] != 2 {
+		t.Error("expected one connection to a reachable replica and a retry of the unreachable one")
+	}
+	if first.SecondsBehindMaster.Get() != 7 {
+		t.Error("expected the lag read again over the open connection")
+	}
+
+	//a replica that disconnected is reported unreachable and closed
+	testquerycol[replicaHostsQuery] = map[string][]string{"host": []string{"10.0.0.3:40112"}}
+	s.Collect()
+	if first.Reachable.Get() != 0 || !replicas["10.0.0.2"].closed {
+		t.Error("expected a replica no longer connected to be unreachable and its connection closed")
+	}
+	s.SetReplicaLag(nil, 1, nil)
+	if !replicas["10.0.0.3"].closed {
+		t.Error("expected SetReplicaLag to close the replica connections")
+	}
+}
+
+// Test getters turned off with SetSkipGetters don't run, and run again
+// once they are turned back on
+func TestSkipGetters(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{}
+	testqueryerr = map[string]error{
+		sqlModeQuery: errors.New("Error 1146: Table doesn't exist"),
+	}
+	s.SetSkipGetters([]string{"GetSqlMode", " GetVersion"})
+	s.Collect()
+	if _, ran := s.LastErrors()["GetSqlMode"]; ran {
+		t.Error("expected GetSqlMode to be skipped")
+	}
+	s.SetSkipGetters(nil)
+	s.Collect()
+	if _, ran := s.LastErrors()["GetSqlMode"]; !ran {
+		t.Error("expected GetSqlMode to run again")
+	}
+}
+
+// Test slave getters are skipped once the server is found to be a
+// primary, and binlog getters once log_bin is found off
+func TestRoleAware(t *testing.T) {
+	s := initMysqlStat()
+	s.SetRoleAware(true)
+	testquerycol = map[string]map[string][]string{
+		roleQuery: map[string][]string{
+			"read_only": []string{"0"},
+			"log_bin":   []string{"0"},
+		},
+		slaveQuery: map[string][]string{},
+	}
+	broken := errors.New("Error 1146: Table doesn't exist")
+	testqueryerr = map[string]error{
+		skipCounterQuery:        broken,
+		replicationWorkersQuery: broken,
+		binlogQuery:             broken,
+	}
+	//the role isn't known before the first collection
+	s.Collect()
+	if _, ran := s.LastErrors()["GetSkipCounter"]; !ran {
+		t.Error("expected every getter to run in the first collection")
+	}
+	if s.Role() != rolePrimary || s.Metrics.IsReplica.Get() != 0 {
+		t.Error("expected a primary, got " + s.Role())
+	}
+	s.Collect()
+	for _, getter := range []string{"GetSkipCounter", "GetReplicationWorkers", "GetBinlogFiles"} {
+		if _, ran := s.LastErrors()[getter]; ran {
+			t.Error("expected " + getter + " to be skipped")
+		}
+	}
+
+	//a replica runs the slave getters
+	testquerycol[slaveQuery] = map[string][]string{
+		"Seconds_Behind_Master": []string{"0"},
+	}
+	testquerycol[roleQuery]["read_only"] = []string{"1"}
+	s.Collect()
+	s.Collect()
+	if s.Role() != roleReplica || s.Metrics.IsReplica.Get() != 1 {
+		t.Error("expected a replica, got " + s.Role())
+	}
+	if _, ran := s.LastErrors()["GetSkipCounter"]; !ran {
+		t.Error("expected the slave getters to run on a replica")
+	}
+
+	//off by default
+	s = initMysqlStat()
+	testqueryerr[skipCounterQuery] = broken
+	testquerycol[slaveQuery] = map[string][]string{}
+	testquerycol[roleQuery]["read_only"] = []string{"0"}
+	s.Collect()
+	s.Collect()
+	if _, ran := s.LastErrors()["GetSkipCounter"]; !ran {
+		t.Error("expected every getter to run without SetRoleAware")
+	}
+}
+
+// Test that a role given with SetRole wins over the one found, and that
+// auto finds it again
+func TestSetRole(t *testing.T) {
+	s := initMysqlStat()
+	s.SetRoleAware(true)
+	testquerycol = map[string]map[string][]string{
+		roleQuery: map[string][]string{
+			"read_only": []string{"1"},
+		},
+		slaveQuery: map[string][]string{
+			"Seconds_Behind_Master": []string{"0"},
+		},
+	}
+	testqueryerr = map[string]error{
+		skipCounterQuery: errors.New("Error 1146: Table doesn't exist"),
+	}
+	if err := s.SetRole("primary"); err != nil {
+		t.Fatal(err)
+	}
+	//known before the first collection
+	s.Collect()
+	if _, ran := s.LastErrors()["GetSkipCounter"]; ran {
+		t.Error("expected the slave getters to be skipped on a primary")
+	}
+	if s.Role() != rolePrimary || s.Metrics.IsReplica.Get() != 0 {
+		t.Error("expected the given role to win, got " + s.Role())
+	}
+
+	if err := s.SetRole("auto"); err != nil {
+		t.Fatal(err)
+	}
+	s.Collect()
+	if s.Role() != roleReplica || s.Metrics.IsReplica.Get() != 1 {
+		t.Error("expected a replica to be found, got " + s.Role())
+	}
+	if err := s.SetRole("standby"); err == nil {
+		t.Error("expected an unknown role to be refused")
+	}
+}
+
+// Test parsing of semi-sync status, including a source that fell back
+// to async replication
+func TestSemiSync(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		semiSyncQuery: map[string][]string{
+			"Rpl_semi_sync_master_status": []string{"OFF"},
+			"Rpl_semi_sync_slave_status":  []string{"ON"},
+			"Rpl_semi_sync_master_yes_tx": []string{"51234"},
+			"Rpl_semi_sync_master_no_tx":  []string{"17"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SemiSyncMasterStatus: float64(0),
+		s.Metrics.SemiSyncSlaveStatus:  float64(1),
+		s.Metrics.SemiSyncMasterYesTx:  uint64(51234),
+		s.Metrics.SemiSyncMasterNoTx:   uint64(17),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//without the plugins nothing is set
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		semiSyncQuery: map[string][]string{},
+	}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.SemiSyncMasterStatus.Get()) {
+		t.Error("expected no semi-sync status without the plugin")
+	}
+}
+
+// Test parsing of sql_mode with and without strict flags
+func TestSqlMode(t *testing.T) {
+	s := initMysqlStat()
+	mode := "ONLY_FULL_GROUP_BY,STRICT_TRANS_TABLES,NO_ZERO_IN_DATE,NO_ENGINE_SUBSTITUTION"
+	testquerycol = map[string]map[string][]string{
+		sqlModeQuery: map[string][]string{
+			"sql_mode": []string{mode},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.StrictSqlMode: float64(1),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+	if s.SqlMode() != mode {
+		t.Error("unexpected sql_mode: " + s.SqlMode())
+	}
+
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		sqlModeQuery: map[string][]string{
+			"sql_mode": []string{"NO_ENGINE_SUBSTITUTION"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.StrictSqlMode: float64(0),
+	}
+	s.Collect()
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//an empty sql_mode isn't strict
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		sqlModeQuery: map[string][]string{
+			"sql_mode": []string{""},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.StrictSqlMode: float64(0),
+	}
+	s.Collect()
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test parsing of the server identity query
+func TestServerIdentity(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		identityQuery: map[string][]string{
+			"hostname":    []string{"db1.example.com"},
+			"version":     []string{"5.7.31-log"},
+			"server_id":   []string{"1234"},
+			"server_uuid": []string{"3e11fa47-71ca-11e1-9e33-c80aa9429562"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ServerID: float64(1234),
+	}
+	id, err := s.Probe()
+	if err != nil {
+		t.Error(err)
+	}
+	expected := ServerIdentity{
+		Hostname:   "db1.example.com",
+		Version:    "5.7.31-log",
+		ServerID:   "1234",
+		ServerUUID: "3e11fa47-71ca-11e1-9e33-c80aa9429562",
+	}
+	if id != expected {
+		t.Error("unexpected server identity")
+	}
+	if res := checkResults(); res != "" {
+		t.Error(res)
+	}
+}
+
+// Test that the master a replica replicates from is recorded, and
+// cleared once the server stops being a replica
+func TestReplicationSource(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		slaveQuery: map[string][]string{
+			"Master_Host":      []string{"db0.example.com", "db9.example.com"},
+			"Master_Port":      []string{"3306", "3307"},
+			"Master_Server_Id": []string{"1001", "1009"},
+		},
+	}
+	s.Collect()
+	expected := ReplicationSource{Host: "db0.example.com", Port: "3306", ServerID: "1001"}
+	if s.Source() != expected {
+		t.Error("unexpected replication source: " + s.Source().Host + ":" + s.Source().Port + " id " + s.Source().ServerID)
+	}
+
+	testquerycol = map[string]map[string][]string{}
+	s.Collect()
+	if s.Source() != (ReplicationSource{}) {
+		t.Error("expected no replication source, got: " + s.Source().Host + ":" + s.Source().Port + " id " + s.Source().ServerID)
+	}
+}
+
+// Test counting of user accounts
+func TestAccounts(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		accountsQuery: map[string][]string{
+			"count": []string{"25"},
+		},
+		lockedAccountsQuery: map[string][]string{
+			"locked":  []string{"3"},
+			"expired": []string{"1"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.UserAccounts:    float64(25),
+		s.Metrics.LockedAccounts:  float64(3),
+		s.Metrics.ExpiredAccounts: float64(1),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test checkpoint and modified page ages as a share of the redo log.
+// SHOW ENGINE INNODB STATUS always fails in these tests, so the parsed
+// LOG section is passed in directly
+func TestRedoAges(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		redoCapacityQuery: map[string][]string{
+			"innodb_log_file_size":      []string{"50331648"},
+			"innodb_log_files_in_group": []string{"2"},
+		},
+	}
+	//as printed by stock MySQL, without the ages
+	s.setRedoAges(map[string]string{
+		"log_sequence_number": "200000000",
+		"last_checkpoint_at":  "124502528",
+		"pages_flushed_up_to": "190000000",
+	})
+	expectedValues = map[interface{}]interface{}{
+		//75497472 of 100663296 bytes
+		s.Metrics.InnodbCheckpointAgePct: float64(75),
+		s.Metrics.InnodbModifiedAgePct:   float64(10000000) / float64(100663296) * 100,
+	}
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+
+	//8.0.30+ sizes the redo log with innodb_redo_log_capacity. Percona
+	// prints the ages itself
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		redoCapacityQuery: map[string][]string{
+			"innodb_log_file_size":      []string{"50331648"},
+			"innodb_log_files_in_group": []string{"2"},
+			"innodb_redo_log_capacity":  []string{"1000000"},
+		},
+	}
+	s.setRedoAges(map[string]string{
+		"log_sequence_number": "5000000",
+		"checkpoint_age":      "900000",
+		"modified_age":        "250000",
+	})
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.InnodbCheckpointAgePct: float64(90),
+		s.Metrics.InnodbModifiedAgePct:   float64(25),
+	}
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+
+	//no redo log size
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{}
+	s.setRedoAges(map[string]string{"checkpoint_age": "900000"})
+	if !math.IsNaN(s.Metrics.InnodbCheckpointAgePct.Get()) {
+		t.Error("expected no checkpoint age percentage without the redo log size")
+	}
+}
+
+// Test the redo log size from the variables of each version, and how
+// much of it is used on 8.0.30+
+func TestRedoLog(t *testing.T) {
+	//before 8.0.30 the files aren't listed
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		redoCapacityQuery: map[string][]string{
+			"innodb_log_file_size":      []string{"50331648"},
+			"innodb_log_files_in_group": []string{"2"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.InnodbRedoLogCapacityBytes: float64(100663296),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+	if !math.IsNaN(s.Metrics.InnodbRedoLogUsedPct.Get()) {
+		t.Error("expected no redo usage before 8.0.30")
+	}
+
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		redoCapacityQuery: map[string][]string{
+			"innodb_log_file_size":      []string{"50331648"},
+			"innodb_log_files_in_group": []string{"2"},
+			"innodb_redo_log_capacity":  []string{"104857600"},
+		},
+		redoFilesQuery: map[string][]string{
+			"used": []string{"26214400"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.InnodbRedoLogCapacityBytes: float64(104857600),
+		s.Metrics.InnodbRedoLogUsedBytes:     float64(26214400),
+		s.Metrics.InnodbRedoLogUsedPct:       float64(25),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+
+	//while a resize is under way the resized capacity is in effect
+	testquerycol[redoResizedQuery] = map[string][]string{
+		"Innodb_redo_log_capacity_resized": []string{"52428800"},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.InnodbRedoLogCapacityBytes: float64(52428800),
+		s.Metrics.InnodbRedoLogUsedPct:       float64(50),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+}
+
+// Test parsing of doublewrite buffer activity from global status
+func TestDoublewrite(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Innodb_dblwr_writes":        []string{"5120"},
+			"Innodb_dblwr_pages_written": []string{"327680"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.InnodbDblwrWrites:       uint64(5120),
+		s.Metrics.InnodbDblwrPagesWritten: uint64(327680),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test that latched buffer pool pages are collected where the server
+// reports them, and left unset on builds that don't
+func TestBufferPoolPagesLatched(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Innodb_buffer_pool_pages_latched": []string{"37"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.InnodbBufferPoolPagesLatched: float64(37),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Queries": []string{"1000"},
+		},
+	}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.InnodbBufferPoolPagesLatched.Get()) {
+		t.Error("expected no latched pages without the status variable")
+	}
+}
+
+// Test parsing of the Connection_errors_* counters, one per cause
+// of a refused connection
+func TestConnectionErrors(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Connection_errors_accept":          []string{"1"},
+			"Connection_errors_internal":        []string{"2"},
+			"Connection_errors_max_connections": []string{"350"},
+			"Connection_errors_peer_address":    []string{"4"},
+			"Connection_errors_select":          []string{"5"},
+			"Connection_errors_tcpwrap":         []string{"6"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ConnectionErrorsAccept:         uint64(1),
+		s.Metrics.ConnectionErrorsInternal:       uint64(2),
+		s.Metrics.ConnectionErrorsMaxConnections: uint64(350),
+		s.Metrics.ConnectionErrorsPeerAddress:    uint64(4),
+		s.Metrics.ConnectionErrorsSelect:         uint64(5),
+		s.Metrics.ConnectionErrorsTcpwrap:        uint64(6),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test the collector's connection pool stats are read after collecting
+func TestCollectorPool(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{}
+	testPoolStats = sql.DBStats{
+		MaxOpenConnections: 5,
+		InUse:              1,
+		Idle:               4,
+		WaitCount:          12,
+		WaitDuration:       3500 * time.Millisecond,
+	}
+	defer func() { testPoolStats = sql.DBStats{} }()
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.CollectorPoolInUse:        float64(1),
+		s.Metrics.CollectorPoolIdle:         float64(4),
+		s.Metrics.CollectorPoolWaitCount:    uint64(12),
+		s.Metrics.CollectorPoolWaitDuration: uint64(3500),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test binlog format and row image are mapped to their codes
+func TestBinlogSettings(t *testing.T) {
+	for _, c := range []struct {
+		format, image string
+		formatCode    float64
+		imageCode     float64
+	}{
+		{"STATEMENT", "FULL", 1, 1},
+		{"MIXED", "MINIMAL", 2, 2},
+		{"ROW", "NOBLOB", 3, 3},
+		{"row", "minimal", 3, 2},
+	} {
+		s := initMysqlStat()
+		testquerycol = map[string]map[string][]string{
+			binlogSettingsQuery: map[string][]string{
+				"binlog_format":     []string{c.format},
+				"binlog_row_image":  []string{c.image},
+				"log_slave_updates": []string{"1"},
+			},
+		}
+		expectedValues = map[interface{}]interface{}{
+			s.Metrics.BinlogFormat:    c.formatCode,
+			s.Metrics.BinlogRowImage:  c.imageCode,
+			s.Metrics.LogSlaveUpdates: float64(1),
+		}
+		s.Collect()
+		if err := checkResults(); err != "" {
+			t.Error(c.format + " " + c.image + ": " + err)
+		}
+	}
+
+	//durability settings are read as they are
+	for _, c := range []struct {
+		syncs, flush string
+	}{
+		{"1", "1"},
+		{"0", "2"},
+		{"100", "0"},
+	} {
+		s := initMysqlStat()
+		testquerycol = map[string]map[string][]string{
+			binlogSettingsQuery: map[string][]string{
+				"sync_binlog":                    []string{c.syncs},
+				"innodb_flush_log_at_trx_commit": []string{c.flush},
+			},
+		}
+		syncs, _ := strconv.ParseFloat(c.syncs, 64)
+		flush, _ := strconv.ParseFloat(c.flush, 64)
+		expectedValues = map[interface{}]interface{}{
+			s.Metrics.SyncBinlog:                syncs,
+			s.Metrics.InnodbFlushLogAtTrxCommit: flush,
+		}
+		s.Collect()
+		if err := checkResults(); err != "" {
+			t.Error(c.syncs + "/" + c.flush + ": " + err)
+		}
+	}
+
+	//a value without a code is left unset
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		binlogSettingsQuery: map[string][]string{
+			"binlog_format":     []string{"UNKNOWN"},
+			"binlog_row_image":  []string{"FULL"},
+			"log_slave_updates": []string{"0"},
+		},
+	}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.BinlogFormat.Get()) {
+		t.Error("expected no binlog format for an unknown value")
+	}
+}
+
+// Test the collector's own goroutines and heap are set by Collect
+func TestCollectorRuntime(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{}
+	s.Collect()
+	goroutines, heap := s.Metrics.CollectorGoroutines.Get(), s.Metrics.CollectorHeapBytes.Get()
+	if math.IsNaN(goroutines) || goroutines < 1 {
+		t.Error("unexpected goroutines: " + strconv.FormatFloat(goroutines, 'f', 0, 64))
+	}
+	if math.IsNaN(heap) || heap <= 0 {
+		t.Error("unexpected heap bytes: " + strconv.FormatFloat(heap, 'f', 0, 64))
+	}
+}
+
+// Test the time until the server certificate expires is read from the
+// date OpenSSL prints
+func TestSslServerCertExpiry(t *testing.T) {
+	s := initMysqlStat()
+	s.now = func() time.Time { return time.Date(2032, 4, 28, 12, 0, 0, 0, time.UTC) }
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Ssl_server_not_after": []string{"Apr 29 12:11:02 2032 GMT"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SslServerCertExpirySeconds: float64(86400 + 11*60 + 2),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//days before the 10th are padded with a space
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Ssl_server_not_after": []string{"Apr  2 12:00:00 2032 GMT"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SslServerCertExpirySeconds: float64(-26 * 86400),
+	}
+	s.Collect()
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//TLS turned off
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Ssl_server_not_after": []string{""},
+		},
+	}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.SslServerCertExpirySeconds.Get()) {
+		t.Error("expected no certificate expiry without TLS")
+	}
+}
+
+// Test the buffer pool warming from its dump is read from
+// Innodb_buffer_pool_load_status
+func TestBufferPoolLoad(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Innodb_buffer_pool_load_status": []string{"Loaded 1610/6440 pages"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.InnodbBufpoolLoadInProgress: float64(1),
+		s.Metrics.InnodbBufpoolLoadPct:        float64(25),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	testquerycol[globalStatsQuery] = map[string][]string{
+		"Innodb_buffer_pool_load_status": []string{"Buffer pool(s) load completed at 170601 12:34:56"},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.InnodbBufpoolLoadInProgress: float64(0),
+		s.Metrics.InnodbBufpoolLoadPct:        float64(100),
+	}
+	s.Collect()
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//started without a dump to load
+	s = initMysqlStat()
+	testquerycol[globalStatsQuery] = map[string][]string{
+		"Innodb_buffer_pool_load_status": []string{"Buffer pool(s) load not started"},
+	}
+	s.Collect()
+	if s.Metrics.InnodbBufpoolLoadInProgress.Get() != 0 || !math.IsNaN(s.Metrics.InnodbBufpoolLoadPct.Get()) {
+		t.Error("expected no load in progress and no progress without a dump")
+	}
+}
+
+// Test parsing of the counters of statements chatty clients send
+// around their queries
+func TestSessionCommands(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Com_admin_commands": []string{"81234"},
+			"Com_change_db":      []string{"5210"},
+			"Com_set_option":     []string{"190233"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ComAdminCommands: uint64(81234),
+		s.Metrics.ComChangeDb:      uint64(5210),
+		s.Metrics.ComSetOption:     uint64(190233),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test parsing of fetches through server side cursors
+func TestCursorFetches(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Com_stmt_fetch": []string{"5120"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ComStmtFetch: uint64(5120),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test parsing of KILL statements and of connections the server
+// aborted, such as those idle past wait_timeout
+func TestKills(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Com_kill":        []string{"17"},
+			"Aborted_clients": []string{"4021"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ComKill:        uint64(17),
+		s.Metrics.AbortedClients: uint64(4021),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test parsing of table lock counters and the share of lock
+// requests that waited
+func TestTableLocks(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Select_range":          []string{"42"},
+			"Table_locks_immediate": []string{"9900"},
+			"Table_locks_waited":    []string{"100"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SelectRange:              uint64(42),
+		s.Metrics.TableLocksImmediate:      uint64(9900),
+		s.Metrics.TableLocksWaited:         uint64(100),
+		s.Metrics.TableLockContentionRatio: float64(0.01),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//no table locks taken yet leaves the ratio unset
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Table_locks_immediate": []string{"0"},
+			"Table_locks_waited":    []string{"0"},
+		},
+	}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.TableLockContentionRatio.Get()) {
+		t.Error("expected no contention ratio without table locks")
+	}
+}
+
+// Test parsing of handler commits and rollbacks and the share of
+// transactions rolled back
+func TestRollbackRatio(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Handler_commit":   []string{"750"},
+			"Handler_rollback": []string{"250"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.HandlerCommit:   uint64(750),
+		s.Metrics.HandlerRollback: uint64(250),
+		s.Metrics.RollbackRatio:   float64(0.25),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//no transactions yet leaves the ratio unset
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Handler_commit":   []string{"0"},
+			"Handler_rollback": []string{"0"},
+		},
+	}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.RollbackRatio.Get()) {
+		t.Error("expected no rollback ratio without transactions")
+	}
+}
+
+// Test parsing of the seconds since FLUSH STATUS, which is less than
+// Uptime once the status counters have been flushed
+func TestUptimeSinceFlushStatus(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Uptime":                    []string{"86400"},
+			"Uptime_since_flush_status": []string{"600"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.Uptime:                 uint64(86400),
+		s.Metrics.UptimeSinceFlushStatus: float64(600),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test that extra status variables are collected as gauges, and that
+// values that aren't numbers are skipped
+func TestExtraStatus(t *testing.T) {
+	s := initMysqlStat()
+	s.SetExtraStatus([]string{"innodb_buffer_pool_reads", "Ssl_version", "No_such_status", ""})
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Innodb_buffer_pool_reads": []string{"42"},
+			"Ssl_version":              []string{"TLSv1.3"},
+		},
+	}
+	s.Collect()
+	if s.m.Gauges["mysqlstat.status.innodb_buffer_pool_reads"] == nil ||
+		s.m.Gauges["mysqlstat.status.innodb_buffer_pool_reads"].Get() != 42 {
+		t.Error("expected the extra status variable to be collected")
+	}
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	if !strings.Contains(buf.String(), "status.innodb_buffer_pool_reads.Value 42\n") ||
+		strings.Contains(buf.String(), "Ssl_version") || strings.Contains(buf.String(), "No_such_status") {
+		t.Error("unexpected graphite output:\n" + buf.String())
+	}
+	if !s.extraWarned["Ssl_version"] || !s.extraWarned["No_such_status"] {
+		t.Error("expected unusable extra status variables to be logged")
+	}
+
+	//a reload keeps the gauges of variables still named, while output is
+	// being written
+	reads := s.m.Gauges["mysqlstat.status.innodb_buffer_pool_reads"]
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			s.FormatGraphite(ioutil.Discard)
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		s.SetExtraStatus([]string{"Innodb_buffer_pool_reads", "innodb_buffer_pool_reads"})
+	}
+	<-done
+	if s.m.Gauges["mysqlstat.status.innodb_buffer_pool_reads"] != reads || reads.Get() != 42 {
+		t.Error("expected the gauge to be kept on reload")
+	}
+}
+
+// Test open transactions counted by age
+func TestActiveTrxAges(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		trxAgesQuery: map[string][]string{
+			"age": []string{"0", "1", "5", "45", "61", "900", "NULL"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ActiveTrxOver1s:   float64(4),
+		s.Metrics.ActiveTrxOver10s:  float64(3),
+		s.Metrics.ActiveTrxOver60s:  float64(2),
+		s.Metrics.ActiveTrxOver300s: float64(1),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test that the oldest of several open transactions is picked and its
+// owner logged
+func TestOldestTrxOwner(t *testing.T) {
+	s := initMysqlStat()
+	var logged bytes.Buffer
+	s.db = &testMysqlDB{Logger: log.New(&logged, "", 0)}
+	testquerycol = map[string]map[string][]string{
+		oldestTrxOwnerQuery: map[string][]string{
+			"trx_id":            []string{"5001", "4907", "5003"},
+			"age":               []string{"12", "3600", "0"},
+			"trx_state":         []string{"RUNNING", "LOCK WAIT", "RUNNING"},
+			"trx_rows_modified": []string{"3", "250000", "0"},
+			"thread_id":         []string{"81", "42", "90"},
+			"user":              []string{"app", "batch", "app"},
+			"host":              []string{"10.0.0.5:51234", "10.0.0.9:40110", "10.0.0.5:51240"},
+			"query":             []string{"SELECT 1", "", "UPDATE t SET a = 1"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.OldestTrxRowsModified: float64(250000),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+	want := "oldest transaction 4907 open 3600s, LOCK WAIT, thread 42 batch@10.0.0.9:40110, " +
+		"query: none, idle in transaction"
+	if !strings.Contains(logged.String(), want) {
+		t.Error("expected the owner to be logged, got: " + logged.String())
+	}
+
+	//young transactions aren't logged
+	logged.Reset()
+	testquerycol = map[string]map[string][]string{
+		oldestTrxOwnerQuery: map[string][]string{
+			"trx_id":            []string{"5001"},
+			"age":               []string{"12"},
+			"trx_rows_modified": []string{"3"},
+		},
+	}
+	s.Collect()
+	if s.Metrics.OldestTrxRowsModified.Get() != 3 || strings.Contains(logged.String(), "oldest transaction") {
+		t.Error("expected only the metric for a young transaction, got: " + logged.String())
+	}
+}
+
+// Test long running queries are grouped by fingerprint, only the top
+// fingerprints are kept and no query data is logged
+func TestQueryFingerprints(t *testing.T) {
+	s := initMysqlStat()
+	var logged bytes.Buffer
+	s.db = &testMysqlDB{Logger: log.New(&logged, "", 0)}
+	s.SetQueryFingerprints(1)
+	testquerycol = map[string]map[string][]string{
+		longQuery: map[string][]string{
+			"ID":   []string{"11", "12", "13", "14"},
+			"TIME": []string{"45", "300", "31", "60"},
+			"INFO": []string{
+				"SELECT * FROM orders WHERE customer = 'alice'",
+				"select * from orders where customer='bob' ",
+				"UPDATE stock SET qty = 0 WHERE sku = 991",
+				"SELECT * FROM orders WHERE customer = 'carol'",
+			},
+		},
+	}
+	s.Collect()
+	id := tools.FingerprintID("select * from orders where customer = ?")
+	if len(s.fingerprints) != 1 || s.fingerprints[id] == nil {
+		t.Fatal("expected only the orders fingerprint to be tracked")
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ActiveLongRunQueries: float64(4),
+		s.fingerprints[id].Count:       float64(2),
+		s.fingerprints[id].MaxTime:     float64(60),
+	}
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+	if !strings.Contains(logged.String(), id+": select * from orders where customer = ?") {
+		t.Error("expected the fingerprint to be logged, got: " + logged.String())
+	}
+	if strings.Contains(logged.String(), "alice") {
+		t.Error("expected no query data in the log, got: " + logged.String())
+	}
+
+	//fingerprints that drop out of the top aren't output
+	testquerycol[longQuery] = map[string][]string{
+		"ID":   []string{"13"},
+		"TIME": []string{"31"},
+		"INFO": []string{"UPDATE stock SET qty = 0 WHERE sku = 991"},
+	}
+	s.Collect()
+	if _, ok := s.fingerprints[id]; ok || len(s.fingerprints) != 1 {
+		t.Error("expected the orders fingerprint to be replaced")
+	}
+}
+
+// Test that a missing SELECT privilege on mysql.user leaves the
+// account metrics unset instead of reporting zero
+func TestAccountsDenied(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{}
+	testqueryerr = map[string]error{
+		accountsQuery: errors.New("Error 1142: SELECT command denied to user 'monitor'@'localhost' for table 'user'"),
+	}
+	err := s.Collect()
+	if err == nil || !strings.Contains(err.Error(), "GetAccounts") {
+		t.Error("expected GetAccounts to be reported as failed")
+	}
+	if !math.IsNaN(s.Metrics.UserAccounts.Get()) || !math.IsNaN(s.Metrics.LockedAccounts.Get()) {
+		t.Error("expected account metrics to be unset")
+	}
+}
+
+// Test detection of a held global read lock and of sessions
+// waiting on the backup lock
+func TestGlobalReadLock(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		sessionQuery1: map[string][]string{
+			"max_connections": []string{"10"},
+		},
+		sessionQuery2: map[string][]string{
+			"COMMAND": []string{"Query", "Query", "Query"},
+			"USER":    []string{"backup", "app", "app"},
+			"STATE":   []string{"executing", "Waiting for backup lock", "Waiting for global read lock"},
+		},
+		globalReadLockQuery: map[string][]string{
+			"locks": []string{"1"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.GlobalReadLockHeld:     float64(1),
+		s.Metrics.SessionBackupLockWaits: float64(1),
+		s.Metrics.SessionGlobalReadLocks: float64(1),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	testquerycol[globalReadLockQuery]["locks"] = []string{"0"}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.GlobalReadLockHeld: float64(0),
+	}
+	s.Collect()
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test that two collectors sharing a metric context keep their
+// metrics apart when given namespaces
+func TestNamespace(t *testing.T) {
+	m := metrics.NewMetricContext("system")
+	collectors := map[string]*MysqlStat{}
+	for _, ns := range []string{"a", "b"} {
+		s := initMysqlStat()
+		s.namespace = ns
+		s.Metrics = MysqlStatMetricsNewNamespace(m, ns)
+		collectors[ns] = s
+	}
+	a, b := collectors["a"], collectors["b"]
+	a.Metrics.Version.Set(5.6)
+	b.Metrics.Version.Set(8.0)
+	if m.Gauges["mysqlstat.a.Version"] != a.Metrics.Version ||
+		m.Gauges["mysqlstat.b.Version"] != b.Metrics.Version {
+		t.Error("metrics not registered under their namespace")
+	}
+	if a.Metrics.Version.Get() != 5.6 || b.Metrics.Version.Get() != 8.0 {
+		t.Error("collectors share metric values")
+	}
+
+	var buf bytes.Buffer
+	a.FormatGraphite(&buf)
+	out := buf.String()
+	if !strings.Contains(out, "a.Version.Value 5.6") || strings.Contains(out, "b.Version") {
+		t.Error("unexpected graphite output:\n" + out)
+	}
+	buf.Reset()
+	b.FormatJSON(&buf)
+	out = buf.String()
+	if !strings.Contains(out, `"mysqlstat.b.Version"`) || strings.Contains(out, "mysqlstat.a.") {
+		t.Error("unexpected JSON output:\n" + out)
+	}
+}
+
+// Test that the graphite prefix goes before the namespace, is joined
+// with a dot only when set, and that lines end with the collection time
+func TestGraphitePrefix(t *testing.T) {
+	s := initMysqlStat()
+	s.namespace = "a"
+	s.Metrics = MysqlStatMetricsNewNamespace(metrics.NewMetricContext("system"), "a")
+	s.Metrics.Version.Set(80026)
+	s.SetGraphitePrefix("mysql.db 1.")
+	s.SetGraphiteTimestamp(true)
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	parts := strings.Fields(buf.String())
+	if len(parts) != 3 || parts[0] != "mysql.db_1.a.Version.Value" || parts[1] != "80026" {
+		t.Fatal("unexpected graphite output:\n" + buf.String())
+	}
+	if _, err := strconv.ParseInt(parts[2], 10, 64); err != nil {
+		t.Error("expected a timestamp:\n" + buf.String())
+	}
+	s.SetGraphitePrefix("")
+	s.SetGraphiteTimestamp(false)
+	buf.Reset()
+	s.FormatGraphite(&buf)
+	if buf.String() != "a.Version.Value 80026\n" {
+		t.Error("unexpected graphite output without a prefix:\n" + buf.String())
+	}
+}
+
+// Test that current row lock waits are read as a gauge
+// and follow the server rather than accumulate
+func TestRowLockCurrentWaits(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{},
+	}
+	for _, waits := range []string{"4", "1"} {
+		testquerycol[globalStatsQuery]["Innodb_row_lock_current_waits"] = []string{waits}
+		expected, _ := strconv.ParseFloat(waits, 64)
+		expectedValues = map[interface{}]interface{}{
+			s.Metrics.InnodbRowLockCurrentWaits: expected,
+		}
+		s.Collect()
+		err := checkResults()
+		if err != "" {
+			t.Error(err)
+		}
+	}
+}
+
+// Test that an overridden query is the one the getter runs
+func TestSetQuery(t *testing.T) {
+	s := initMysqlStat()
+	custom := "SHOW GLOBAL STATUS WHERE Variable_name = 'Queries';"
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Queries": []string{"1"},
+		},
+		custom: map[string][]string{
+			"Queries": []string{"2"},
+		},
+	}
+	if err := s.SetQuery("GetGlobalStatus", custom); err != nil {
+		t.Error(err)
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.Queries: uint64(2),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+	if err := s.SetQuery("GetNothing", custom); err == nil {
+		t.Error("expected overriding an unknown method to fail")
+	}
+}
+
+// Test counting of running DDL, from performance_schema stages
+// and from the processlist when performance_schema is disabled
+func TestDDLOperations(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		ddlStagesQuery: map[string][]string{
+			"ddl":    []string{"2"},
+			"oldest": []string{"340"},
+		},
+		ddlProcesslistQuery: map[string][]string{
+			"ddl":    []string{"1"},
+			"oldest": []string{"125"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ActiveDDLOperations: float64(2),
+		s.Metrics.OldestDDLAgeSec:     float64(340),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//one ALTER copying to a temporary table, seen only in the processlist
+	testqueryerr[ddlStagesQuery] = errors.New("Error 1146: Table 'performance_schema.events_stages_current' doesn't exist")
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ActiveDDLOperations: float64(1),
+		s.Metrics.OldestDDLAgeSec:     float64(125),
+	}
+	if err := s.Collect(); err != nil && strings.Contains(err.Error(), "GetDDLOperations") {
+		t.Error("falling back to the processlist should not fail the getter")
+	}
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+//returns the next of a series of Threads_running values on each sample
+type samplingMysqlDB struct {
+	testMysqlDB
+	lock    sync.Mutex
+	samples []string
+	calls   int
+}
+
+func (s *samplingMysqlDB) QueryReturnColumnDict(query string) (map[string][]string, error) {
+	if query != threadsRunningQuery {
+		return s.testMysqlDB.QueryReturnColumnDict(query)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v := s.samples[s.calls%len(s.samples)]
+	s.calls++
+	return map[string][]string{
+		"Variable_name": []string{"Threads_running"},
+		"Value":         []string{v},
+	}, nil
+}
+
+// Test the summary of Threads_running samples
+func TestThreadsRunningSamples(t *testing.T) {
+	s := initMysqlStat()
+	db := &samplingMysqlDB{
+		testMysqlDB: *s.db.(*testMysqlDB),
+		samples:     []string{"2", "3", "2", "40", "3", "2", "2", "5", "3", "8"},
+	}
+	s.db = db
+	testquerycol = map[string]map[string][]string{}
+
+	//off by default
+	s.Collect()
+	if db.calls != 0 || !math.IsNaN(s.Metrics.ThreadsRunningMax.Get()) {
+		t.Error("expected no sampling by default")
+	}
+
+	s.SetThreadsRunningSampling(time.Millisecond, 10*time.Millisecond)
+	s.Collect()
+	if db.calls != 10 {
+		t.Error("expected 10 samples, got " + strconv.Itoa(db.calls))
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ThreadsRunningMax: float64(40),
+		s.Metrics.ThreadsRunningAvg: float64(7),
+		s.Metrics.ThreadsRunningP95: float64(40),
+	}
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test that graphite lines end with a parseable collection time
+// only when timestamps are turned on
+func TestGraphiteTimestamp(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{}
+	s.Metrics.BinlogSize.Set(1111)
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	if !strings.Contains(buf.String(), "BinlogSize.Value 1111\n") {
+		t.Error("expected no timestamp by default, got:\n" + buf.String())
+	}
+
+	s.SetGraphiteTimestamp(true)
+	before := time.Now().Unix()
+	s.Collect()
+	after := time.Now().Unix()
+	s.Metrics.BinlogSize.Set(1111)
+	buf.Reset()
+	s.FormatGraphite(&buf)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) != 3 {
+			t.Fatal("expected name, value and timestamp, got: " + line)
+		}
+		ts, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil || ts < before || ts > after {
+			t.Error("timestamp missing or not the collection time: " + line)
+		}
+	}
+}
+
+// Test counting of new error log entries. Entries at or before
+// the newest one already seen are not counted again
+func TestRecentErrorLog(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		errorLogMarkQuery: map[string][]string{
+			"logged": []string{"2026-10-14 10:00:00.000000"},
+		},
+		errorLogQuery("2026-10-14 10:00:00.000000"): map[string][]string{
+			"logged":     []string{"2026-10-14 09:59:59.000000", "2026-10-14 10:00:01.000000", "2026-10-14 10:00:02.500000"},
+			"error_code": []string{"MY-010914", "MY-013183", "MY-012574"},
+			"subsystem":  []string{"Server", "InnoDB", "InnoDB"},
+			"data":       []string{"old entry", "Assertion failure", "Out of memory"},
+		},
+	}
+	//off by default
+	s.Collect()
+	if !math.IsNaN(s.Metrics.RecentErrorLogEntries.Get()) {
+		t.Error("expected error log not to be read by default")
+	}
+
+	s.SetErrorLogTail(true)
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.RecentErrorLogEntries: float64(0),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.RecentErrorLogEntries: float64(2),
+	}
+	s.Collect()
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+	if s.errorLogSince != "2026-10-14 10:00:02.500000" {
+		t.Error("expected newest entry to be remembered, got: " + s.errorLogSince)
+	}
+}
+
+// Test that servers without performance_schema.error_log are skipped
+func TestRecentErrorLogMissing(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{}
+	testqueryerr[errorLogMarkQuery] = errors.New("Error 1146: Table 'performance_schema.error_log' doesn't exist")
+	s.SetErrorLogTail(true)
+	if err := s.Collect(); err != nil && strings.Contains(err.Error(), "GetRecentErrorLog") {
+		t.Error("missing table should not fail the getter")
+	}
+	if s.errorLogTail {
+		t.Error("expected error log reading to be turned off")
+	}
+}
+
+// Test per worker state for multi-threaded replication
+func TestReplicationWorkers(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		replicationWorkersQuery: map[string][]string{
+			"worker":       []string{"1", "2", "3", "4"},
+			"state":        []string{"ON", "ON", "ON", "OFF"},
+			"thread_state": []string{"Waiting for an event from Coordinator", "Executing event", "Waiting for an event from Coordinator", ""},
+			"transactions": []string{"100", "5400", "98", ""},
+		},
+	}
+	s.Collect()
+	if len(s.workers) != 4 {
+		t.Fatal("expected 4 workers, got " + strconv.Itoa(len(s.workers)))
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SlaveWorkersBusy:         float64(1),
+		s.Metrics.SlaveWorkersIdle:         float64(2),
+		s.workers["1"].ServiceOn:           float64(1),
+		s.workers["1"].Busy:                float64(0),
+		s.workers["1"].AppliedTransactions: uint64(100),
+		s.workers["2"].Busy:                float64(1),
+		s.workers["2"].AppliedTransactions: uint64(5400),
+		s.workers["3"].AppliedTransactions: uint64(98),
+		s.workers["4"].ServiceOn:           float64(0),
+		s.workers["4"].Busy:                float64(0),
+	}
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	if !strings.Contains(buf.String(), "SlaveWorkers.2.Busy.Value 1\n") {
+		t.Error("expected worker metrics in graphite output, got:\n" + buf.String())
+	}
+}
+
+// Test parsing of open temporary table counts
+func TestTempTables(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		slaveTempTablesQuery: map[string][]string{
+			"Variable_name": []string{"Slave_open_temp_tables"},
+			"Value":         []string{"3"},
+		},
+		innodbTempTablesQuery: map[string][]string{
+			"tables": []string{"12"},
+		},
+		tempTableMemoryQuery: map[string][]string{
+			"event_name": []string{"memory/temptable/physical_ram", "memory/temptable/physical_disk"},
+			"bytes":      []string{"16777216", "1048576"},
+		},
+		globalStatsQuery: map[string][]string{
+			"Created_tmp_tables":      []string{"400"},
+			"Created_tmp_disk_tables": []string{"100"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.SlaveOpenTempTables:       float64(3),
+		s.Metrics.InnodbTempTables:          float64(12),
+		s.Metrics.TempTableMemoryBytes:      float64(16777216),
+		s.Metrics.TempTableDiskBytes:        float64(1048576),
+		s.Metrics.CreatedTmpDiskTablesRatio: float64(0.25),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//servers without innodb_temp_table_info still report the replica count
+	s = initMysqlStat()
+	delete(testquerycol, innodbTempTablesQuery)
+	testqueryerr = map[string]error{
+		innodbTempTablesQuery: errors.New("Error 1109: Unknown table 'INNODB_TEMP_TABLE_INFO' in information_schema"),
+	}
+	cerr := s.Collect()
+	if v := s.Metrics.SlaveOpenTempTables.Get(); v != 3 {
+		t.Error("expected 3 replica temp tables, got " + strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	if v := s.Metrics.InnodbTempTables.Get(); !math.IsNaN(v) {
+		t.Error("expected innodb temp tables to be left unset")
+	}
+	if cerr != nil && strings.Contains(cerr.Error(), "GetTempTables") {
+		t.Error("missing innodb_temp_table_info should not fail the getter")
+	}
+}
+
+// Test summing of undo tablespace sizes
+func TestUndoTablespaces(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		undoTablespacesQuery: map[string][]string{
+			"name":      []string{"innodb_undo_001", "innodb_undo_002", "undo_big"},
+			"file_size": []string{"16777216", "16777216", "1073741824"},
+			"state":     []string{"active", "active", "inactive"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.UndoTablespaces:           float64(3),
+		s.Metrics.UndoTablespaceBytes:       float64(1107296256),
+		s.Metrics.UndoTablespacesTruncating: float64(1),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test undo metrics are read from the innodb_metrics counters that are
+// enabled, and Innodb_available_undo_logs from global status
+func TestUndoLogs(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		undoMetricsQuery: map[string][]string{
+			"trx_rseg_current_size":             []string{"4096"},
+			"undo_truncate_count":               []string{"12"},
+			"undo_truncate_start_logging_count": []string{"13"},
+			"undo_truncate_done_logging_count":  []string{"12"},
+		},
+		globalStatsQuery: map[string][]string{
+			"Innodb_available_undo_logs": []string{"128"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.UndoRsegCurrentPages:    float64(4096),
+		s.Metrics.UndoTruncations:         uint64(12),
+		s.Metrics.UndoTruncationActive:    float64(1),
+		s.Metrics.InnodbAvailableUndoLogs: float64(128),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+
+	//only trx_rseg_current_size is enabled
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		undoMetricsQuery: map[string][]string{
+			"trx_rseg_current_size": []string{"512"},
+		},
+	}
+	s.Collect()
+	if s.Metrics.UndoRsegCurrentPages.Get() != 512 || !math.IsNaN(s.Metrics.UndoTruncationActive.Get()) {
+		t.Error("expected only the rollback segment size to be set")
+	}
+}
+
+// Test that raw dumps hold each getter's unparsed result
+func TestDumpRaw(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		slaveQuery: map[string][]string{
+			"Seconds_Behind_Master": []string{"80"},
+			"Relay_Master_Log_File": []string{"some-name-bin.01345"},
+		},
+	}
+	testqueryerr = map[string]error{
+		securityQuery: errors.New("Error 1142: SELECT command denied to user 'monitor'@'localhost' for table 'user'"),
+	}
+	s.SetQuery("GetVersion", "SELECT @@version AS version;")
+	dump := s.DumpRaw()
+	if len(dump) != len(getterQueries) {
+		t.Error("expected a result for each of " + strconv.Itoa(len(getterQueries)) +
+			" getters, got " + strconv.Itoa(len(dump)))
+	}
+	slave := dump["GetSlaveStats"]
+	if slave.Query != slaveQuery || len(slave.Columns["Seconds_Behind_Master"]) != 1 ||
+		slave.Columns["Seconds_Behind_Master"][0] != "80" {
+		t.Error("unexpected raw result for GetSlaveStats")
+	}
+	if !strings.Contains(dump["GetSecurity"].Error, "1142") {
+		t.Error("expected the GetSecurity error to be kept, got: " + dump["GetSecurity"].Error)
+	}
+	if dump["GetVersion"].Query != "SELECT @@version AS version;" {
+		t.Error("expected the query set with SetQuery, got: " + dump["GetVersion"].Query)
+	}
+
+	out, err := json.Marshal(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `"Relay_Master_Log_File":["some-name-bin.01345"]`) {
+		t.Error("expected raw columns in JSON, got: " + string(out))
+	}
+}
+
+// Test that query checks fail a getter whose query lost a column
+func TestCheckQueries(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		//Master_SSL_Allowed is missing
+		slaveQuery: map[string][]string{
+			"Seconds_Behind_Master": []string{"80"},
+			"Relay_Master_Log_File": []string{"some-name-bin.01345"},
+			"Exec_Master_Log_Pos":   []string{"1234"},
+		},
+		versionQuery: map[string][]string{
+			"VERSION()": []string{"8.0.34"},
+		},
+		globalStatsQuery: map[string][]string{
+			"Variable_name": []string{"Queries", "Threads_connected", "Uptime"},
+			"Value":         []string{"1000", "10", "500"},
+		},
+	}
+	testqueryerr = map[string]error{
+		responseTimeQuery: errors.New("Error 1109: Unknown table 'QUERY_RESPONSE_TIME' in information_schema"),
+	}
+	checks := make(map[string]string)
+	for _, check := range s.CheckQueries() {
+		checks[check.Getter] = check.String()
+	}
+	if len(checks) != len(getterColumns) {
+		t.Error("expected a check for each of " + strconv.Itoa(len(getterColumns)) +
+			" getters, got " + strconv.Itoa(len(checks)))
+	}
+	expected := map[string]string{
+		"GetSlaveStats":        "FAIL GetSlaveStats: missing Master_SSL_Allowed",
+		"GetVersion":           "PASS GetVersion",
+		"GetGlobalStatus":      "FAIL GetGlobalStatus: missing Threads_running",
+		"GetQueryResponseTime": "SKIP GetQueryResponseTime: Error 1109: Unknown table 'QUERY_RESPONSE_TIME' in information_schema",
+	}
+	for getter, want := range expected {
+		if checks[getter] != want {
+			t.Error("expected \"" + want + "\", got \"" + checks[getter] + "\"")
+		}
+	}
+}
+
+// Test per second rates of counters across collections
+func TestCounterRates(t *testing.T) {
+	s := initMysqlStat()
+	s.SetCounterRates(true)
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Queries": []string{"1000"},
+		},
+	}
+	start := time.Now()
+	s.Collect()
+	if _, ok := s.counterRate("Queries"); ok {
+		t.Error("expected no rate after one collection")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	testquerycol[globalStatsQuery]["Queries"] = []string{"1100"}
+	s.Collect()
+	elapsed := time.Since(start)
+	rate, ok := s.counterRate("Queries")
+	//100 queries in a little over 100ms
+	if !ok || rate > 1000 || rate < 100/elapsed.Seconds() {
+		t.Error("unexpected rate: " + strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	if !strings.Contains(buf.String(), "\nQueries_per_sec.Value ") {
+		t.Error("expected rate in graphite output, got:\n" + buf.String())
+	}
+
+	//server restarted
+	testquerycol[globalStatsQuery]["Queries"] = []string{"20"}
+	s.Collect()
+	if rate, _ := s.counterRate("Queries"); rate != 0 {
+		t.Error("expected a rate of 0 after a reset, got " + strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+}
+
+// Test that options rejected before connecting come back as errors
+func TestNewWithOptionsErrors(t *testing.T) {
+	for _, c := range []struct {
+		host string
+		opts tools.Options
+	}{
+		{"", tools.Options{SessionInit: "SELECT 1"}},
+		{"", tools.Options{TLSMinVersion: "1.0"}},
+		{"tcp(127.0.0.1:1", tools.Options{}},
+		{"db1:notaport", tools.Options{}},
+	} {
+		s, err := NewWithOptions(metrics.NewMetricContext("system"), "monitor", "", c.host, "", c.opts)
+		if err == nil || s != nil {
+			t.Errorf("expected an error for host %q and options %+v", c.host, c.opts)
+		}
+	}
+}
+
+// Test that a malformed dsn is told apart from a server that can't be reached
+func TestNewDSNInvalid(t *testing.T) {
+	s, err := NewDSN(metrics.NewMetricContext("system"), "monitor@db1:3306")
+	if !errors.Is(err, tools.ErrInvalidDSN) || s != nil {
+		t.Errorf("expected an error wrapping ErrInvalidDSN, got %v", err)
+	}
+}
+
+// Test counters and uptime carried over to a new collector in the state file
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s := initMysqlStat()
+	s.SetCounterRates(true)
+	//a first run has no state yet
+	if err := s.LoadState(path); err != nil {
+		t.Error(err)
+	}
+	testquerycol = map[string]map[string][]string{
+		globalStatsQuery: map[string][]string{
+			"Queries": []string{"1000"},
+			"Uptime":  []string{"3600"},
+		},
+	}
+	s.Collect()
+	if err := s.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	//the collector restarted
+	time.Sleep(100 * time.Millisecond)
+	s = initMysqlStat()
+	s.SetCounterRates(true)
+	if err := s.LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	if s.lastUptime != 3600 {
+		t.Error("expected the uptime from the state file, got " + strconv.FormatUint(s.lastUptime, 10))
+	}
+	testquerycol[globalStatsQuery] = map[string][]string{
+		"Queries": []string{"1100"},
+		"Uptime":  []string{"3601"},
+	}
+	s.Collect()
+	if rate, ok := s.counterRate("Queries"); !ok || rate <= 0 || rate > 1000 {
+		t.Error("expected a rate at the first collection, got " + strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LoadState(path); err == nil {
+		t.Error("expected an error for a damaged state file")
+	}
+}
+
+// Test per statement type totals from performance_schema
+func TestStatementSummary(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		statementSummaryQuery: map[string][]string{
+			"event_name":             []string{"statement/sql/select", "statement/sql/insert", "statement/sql/alter_table"},
+			"count_star":             []string{"1200", "300", "2"},
+			"sum_timer_wait":         []string{"45000000000000", "9000000000", "120000000000000"},
+			"sum_no_index_used":      []string{"40", "0", "2"},
+			"sum_no_good_index_used": []string{"3", "0", "0"},
+			"sum_rows_examined":      []string{"90000", "0", "6000"},
+			"sum_rows_sent":          []string{"2400", "0", "0"},
+		},
+	}
+	s.Collect()
+	if len(s.statements) != 3 {
+		t.Fatal("expected 3 statement types, got " + strconv.Itoa(len(s.statements)))
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.statements["select"].Count:            uint64(1200),
+		s.statements["select"].TimerWaitUs:      uint64(45000000),
+		s.statements["insert"].Count:            uint64(300),
+		s.statements["insert"].TimerWaitUs:      uint64(9000),
+		s.statements["alter_table"].Count:       uint64(2),
+		s.statements["alter_table"].TimerWaitUs: uint64(120000000),
+		s.Metrics.StatementsNoIndexUsed:         uint64(42),
+		s.Metrics.StatementsNoGoodIndexUsed:     uint64(3),
+		s.Metrics.StatementsRowsExamined:        uint64(96000),
+		s.Metrics.StatementsRowsSent:            uint64(2400),
+		s.Metrics.RowsExaminedPerSent:           float64(40),
+	}
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//performance_schema tables missing
+	s = initMysqlStat()
+	testqueryerr = map[string]error{
+		statementSummaryQuery: errors.New("Error 1146: Table 'performance_schema.events_statements_summary_global_by_event_name' doesn't exist"),
+	}
+	cerr := s.Collect()
+	if cerr != nil && strings.Contains(cerr.Error(), "GetStatementSummary") {
+		t.Error("missing performance_schema tables should not fail the getter")
+	}
+	if len(s.statements) != 0 {
+		t.Error("expected no statement types")
+	}
+}
+
+// Test the share of connections using TLS
+func TestTLSConnections(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		tlsConnectionsQuery: map[string][]string{
+			"connections": []string{"40"},
+			"tls":         []string{"30"},
+		},
+		tlsAcceptsQuery: map[string][]string{
+			"Connections": []string{"1000"},
+			"Ssl_accepts": []string{"100"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.TlsConnectionsPct: float64(75),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//performance_schema off, fall back to the totals since startup
+	s = initMysqlStat()
+	testqueryerr = map[string]error{
+		tlsConnectionsQuery: errors.New("Error 1146: Table 'performance_schema.status_by_thread' doesn't exist"),
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.TlsConnectionsPct: float64(10),
+	}
+	s.Collect()
+	err = checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+}
+
+// Test thread pool metrics, and that servers without a thread pool
+// leave them unset
+func TestThreadPool(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		threadPoolStatusQuery: map[string][]string{
+			"Threadpool_threads":      []string{"16"},
+			"Threadpool_idle_threads": []string{"10"},
+		},
+		threadPoolQueueQuery: map[string][]string{
+			"queued": []string{"4"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ThreadpoolThreads:        float64(16),
+		s.Metrics.ThreadpoolIdleThreads:    float64(10),
+		s.Metrics.ThreadpoolActiveThreads:  float64(6),
+		s.Metrics.ThreadpoolQueuedRequests: float64(4),
+	}
+	s.Collect()
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+
+	//Percona Server has no THREAD_POOL_GROUPS
+	s = initMysqlStat()
+	testqueryerr = map[string]error{
+		threadPoolQueueQuery: errors.New("Error 1109: Unknown table 'THREAD_POOL_GROUPS' in information_schema"),
+	}
+	if err := s.Collect(); err != nil && strings.Contains(err.Error(), "GetThreadPool") {
+		t.Error("a missing queue table should not fail GetThreadPool")
+	}
+	if s.Metrics.ThreadpoolActiveThreads.Get() != 6 || !math.IsNaN(s.Metrics.ThreadpoolQueuedRequests.Get()) {
+		t.Error("expected active threads without queued requests")
+	}
+
+	//no thread pool
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.ThreadpoolThreads.Get()) || !math.IsNaN(s.Metrics.ThreadpoolActiveThreads.Get()) {
+		t.Error("expected thread pool metrics to be unset without a thread pool")
+	}
+}
+
+// Test the description of a collector's settings
+func TestString(t *testing.T) {
+	s := initMysqlStat()
+	s.target = tools.TargetName("monitor", "monitor:s3cret@tcp(db1:3306)")
+	s.namespace = "db1"
+	s.SetThreadsRunningSampling(100*time.Millisecond, time.Second)
+	s.SetCounterRates(true)
+	s.SetQuery("GetVersion", "SELECT @@version AS version;")
+	expected := "mysqlstat target monitor@tcp(db1:3306), namespace db1, " +
+		"threads running sampled every 100ms for 1s, counter rates on, queries set for GetVersion"
+	if result := s.String(); result != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + result)
+	}
+	if strings.Contains(s.String(), "s3cret") {
+		t.Error("password in description: " + s.String())
+	}
+}
+
+// Test that inconsistent metrics are reported by Validate
+func TestValidate(t *testing.T) {
+	s := initMysqlStat()
+	//nothing collected, nothing to check
+	if errs := s.Metrics.Validate(); len(errs) != 0 {
+		t.Error("expected no errors for uncollected metrics")
+	}
+
+	s.Metrics.ActiveSessions.Set(7)
+	s.Metrics.CurrentSessions.Set(5)
+	s.Metrics.ModifiedDBPages.Set(10)
+	s.Metrics.DatabasePages.Set(100)
+	s.Metrics.BufferPoolSize.Set(8191)
+	s.Metrics.BusySessionPct.Set(140)
+	s.Metrics.CacheHitPct.Set(99.5)
+	errs := s.Metrics.Validate()
+	expected := []string{
+		"ActiveSessions (7) is greater than CurrentSessions (5)",
+		"BusySessionPct (140) is not between 0 and 100",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("expected " + strconv.Itoa(len(expected)) + " errors, got " + strconv.Itoa(len(errs)))
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Error("expected: " + expected[i] + ", got: " + err.Error())
+		}
+	}
+}
+
+// Test that a batch runs only the getters of its groups and returns
+// their metrics
+func TestRunBatch(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		versionQuery: map[string][]string{
+			"VERSION()": []string{"8.0.32"},
+		},
+		sessionQuery1: map[string][]string{
+			"max_connections": []string{"10"},
+		},
+		sessionQuery2: map[string][]string{
+			"COMMAND": []string{"Sleep", "Query"},
+			"USER":    []string{"app", "app"},
+			"STATE":   []string{"", "executing"},
+		},
+		globalStatsQuery: map[string][]string{
+			"Threads_running": []string{"5"},
+		},
+	}
+	values, err := s.RunBatch([]string{"getversion", "getsessions"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["mysqlstat.Version"] != 80032 {
+		t.Error("unexpected version: " + strconv.FormatFloat(values["mysqlstat.Version"], 'f', -1, 64))
+	}
+	if values["mysqlstat.MaxConnections"] != 10 || values["mysqlstat.CurrentSessions"] != 2 {
+		t.Error("expected session metrics in the batch")
+	}
+	if _, ok := values["mysqlstat.ThreadsRunning"]; ok {
+		t.Error("GetGlobalStatus is not in the batch")
+	}
+
+	s = initMysqlStat()
+	if _, err := s.RunBatch([]string{"getversion", "nosuchgetter"}); err == nil ||
+		!strings.Contains(err.Error(), "nosuchgetter") {
+		t.Error("expected an error naming the unknown group")
+	}
+}
+
+// Test the state and progress of a clone from performance_schema
+func TestCloneStatus(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		cloneStatusQuery: map[string][]string{
+			"state":    []string{"In Progress"},
+			"data":     []string{"250"},
+			"estimate": []string{"1000"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.CloneInProgress:  float64(1),
+		s.Metrics.CloneState:       float64(1),
+		s.Metrics.CloneProgressPct: float64(25),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+
+	//no clone has been run
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		cloneStatusQuery: map[string][]string{
+			"state":    []string{},
+			"data":     []string{},
+			"estimate": []string{},
+		},
+	}
+	s.Collect()
+	if s.Metrics.CloneInProgress.Get() != 0 || !math.IsNaN(s.Metrics.CloneState.Get()) {
+		t.Error("expected no clone in progress")
+	}
+
+	//clone instrumentation missing
+	s = initMysqlStat()
+	testqueryerr = map[string]error{
+		cloneStatusQuery: errors.New("Error 1146: Table 'performance_schema.clone_status' doesn't exist"),
+	}
+	s.Collect()
+	if _, ok := s.LastErrors()["GetCloneStatus"]; ok {
+		t.Error("missing clone tables should not fail the getter")
+	}
+	if !math.IsNaN(s.Metrics.CloneInProgress.Get()) {
+		t.Error("expected CloneInProgress to be unset")
+	}
+}
+
+// Test the memory performance_schema uses is summed over its own
+// instruments, and nothing is set with performance_schema off
+func TestPerfSchemaMemory(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		perfSchemaMemoryQuery: map[string][]string{
+			"event_name": []string{
+				"memory/performance_schema/events_statements_history_long",
+				"memory/performance_schema/events_statements_summary_by_digest",
+				"memory/performance_schema/table_handles",
+			},
+			"bytes": []string{"14320000", "10240000", "9158656"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.PerfSchemaMemoryBytes: float64(33718656),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+
+	//performance_schema is off
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		perfSchemaMemoryQuery: map[string][]string{"event_name": []string{}, "bytes": []string{}},
+	}
+	s.Collect()
+	if !math.IsNaN(s.Metrics.PerfSchemaMemoryBytes.Get()) {
+		t.Error("expected no performance_schema memory with performance_schema off")
+	}
+
+	//no memory instrumentation before 5.7
+	s = initMysqlStat()
+	testqueryerr = map[string]error{
+		perfSchemaMemoryQuery: errors.New("Error 1146: Table 'performance_schema.memory_summary_global_by_event_name' doesn't exist"),
+	}
+	s.Collect()
+	if _, ok := s.LastErrors()["GetPerfSchemaMemory"]; ok {
+		t.Error("missing memory instrumentation should not fail the getter")
+	}
+}
+
+// Test cluster health from Group Replication and Galera, and that
+// standalone servers only get a ClusterType
+func TestClusterStatus(t *testing.T) {
+	s := initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		groupMembersQuery: map[string][]string{
+			"member_id":    []string{"uuid-1", "uuid-2", "uuid-3"},
+			"member_state": []string{"ONLINE", "ONLINE", "UNREACHABLE"},
+			"self":         []string{"1", "0", "0"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ClusterType:          float64(1),
+		s.Metrics.ClusterMembers:       float64(3),
+		s.Metrics.ClusterMembersOnline: float64(2),
+		s.Metrics.ClusterMemberState:   float64(1),
+		s.Metrics.ClusterMemberOnline:  float64(1),
+		s.Metrics.ClusterQuorum:        float64(1),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error("group replication: " + err)
+	}
+
+	//a recovering member of a group that lost its majority
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		groupMembersQuery: map[string][]string{
+			"member_id":    []string{"uuid-1", "uuid-2", "uuid-3"},
+			"member_state": []string{"RECOVERING", "ONLINE", "UNREACHABLE"},
+			"self":         []string{"1", "0", "0"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ClusterMembersOnline: float64(1),
+		s.Metrics.ClusterMemberState:   float64(2),
+		s.Metrics.ClusterMemberOnline:  float64(0),
+		s.Metrics.ClusterQuorum:        float64(0),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error("recovering member: " + err)
+	}
+
+	//Galera, with Group Replication not configured
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{
+		groupMembersQuery: map[string][]string{
+			"member_id":    []string{""},
+			"member_state": []string{"OFFLINE"},
+			"self":         []string{"0"},
+		},
+		wsrepStatusQuery: map[string][]string{
+			"wsrep_cluster_size":        []string{"3"},
+			"wsrep_cluster_status":      []string{"Primary"},
+			"wsrep_local_state_comment": []string{"Synced"},
+		},
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.Metrics.ClusterType:         float64(2),
+		s.Metrics.ClusterMembers:      float64(3),
+		s.Metrics.ClusterMemberState:  float64(1),
+		s.Metrics.ClusterMemberOnline: float64(1),
+		s.Metrics.ClusterQuorum:       float64(1),
+	}
+	s.Collect()
+	if err := checkResults(); err != "" {
+		t.Error("galera: " + err)
+	}
+
+	//a Galera node cut off from the primary component
+	testquerycol[wsrepStatusQuery]["wsrep_cluster_status"] = []string{"non-Primary"}
+	testquerycol[wsrepStatusQuery]["wsrep_local_state_comment"] = []string{"Initialized"}
+	s.Collect()
+	if s.Metrics.ClusterQuorum.Get() != 0 || s.Metrics.ClusterMemberOnline.Get() != 0 ||
+		s.Metrics.ClusterMemberState.Get() != 3 {
+		t.Error("expected a galera node outside the primary component to be offline")
+	}
+
+	//standalone 5.6, without replication_group_members
+	s = initMysqlStat()
+	testquerycol = map[string]map[string][]string{}
+	testqueryerr = map[string]error{
+		groupMembersQuery: errors.New("Error 1146: Table 'performance_schema.replication_group_members' doesn't exist"),
+	}
+	s.Collect()
+	if _, ok := s.LastErrors()["GetClusterStatus"]; ok {
+		t.Error("a standalone server should not fail the getter")
+	}
+	if s.Metrics.ClusterType.Get() != 0 || !math.IsNaN(s.Metrics.ClusterMembers.Get()) {
+		t.Error("expected a standalone server")
+	}
+}
+
+//counts Close calls
+type closeCountingDB struct {
+	*testMysqlDB
+	closes int
+}
+
+func (db *closeCountingDB) Close() {
+	db.closes++
+}
+
+// Test that closing again, as a shutdown handler and deferred cleanup
+// both do, doesn't close the connections twice
+func TestCloseTwice(t *testing.T) {
+	s := initMysqlStat()
+	db := &closeCountingDB{testMysqlDB: s.db.(*testMysqlDB)}
+	master := &closeCountingDB{testMysqlDB: s.db.(*testMysqlDB)}
+	s.db = db
+	s.master = master
+	s.Close()
+	s.Close()
+	if db.closes != 1 || master.closes != 1 {
+		t.Error("expected each connection closed once, got " + strconv.Itoa(db.closes) + " and " + strconv.Itoa(master.closes))
+	}
+
+	//a connection set after Close is closed again
+	next := &closeCountingDB{testMysqlDB: db.testMysqlDB}
+	s.SetDB(next)
+	s.Close()
+	if next.closes != 1 {
+		t.Error("expected the new connection to be closed")
+	}
+}
+
+//a connection whose pings take a while, recording whether it was closed
+// during one and the max connections it was given
+type pingingDB struct {
+	*testMysqlDB
+	pinging chan struct{} //closed once a ping started
+
+	lock             sync.Mutex
+	inPing           bool
+	closedDuringPing bool
+	maxConns         int
+}
+
+func (db *pingingDB) Ping(ctx context.Context) error {
+	db.lock.Lock()
+	db.inPing = true
+	db.lock.Unlock()
+	close(db.pinging)
+	time.Sleep(50 * time.Millisecond)
+	db.lock.Lock()
+	db.inPing = false
+	db.lock.Unlock()
+	return nil
+}
+
+func (db *pingingDB) Close() {
+	db.lock.Lock()
+	db.closedDuringPing = db.closedDuringPing || db.inPing
+	db.lock.Unlock()
+}
+
+func (db *pingingDB) SetMaxConnections(maxConns int) {
+	db.lock.Lock()
+	db.maxConns = maxConns
+	db.lock.Unlock()
+}
+
+// Test that a reload replacing the connection and the output settings
+// is safe while a health check pings and a scrape formats output, and
+// that the new connection gets the same max connections
+func TestSetDBDuringPing(t *testing.T) {
+	s := initMysqlStat()
+	old := &pingingDB{testMysqlDB: s.db.(*testMysqlDB), pinging: make(chan struct{})}
+	s.db = old
+	s.SetMaxConnections(7)
+	done := make(chan struct{})
+	go func() {
+		s.Ping(context.Background())
+		var buf bytes.Buffer
+		s.FormatGraphite(&buf)
+		close(done)
+	}()
+	<-old.pinging
+	next := &pingingDB{testMysqlDB: old.testMysqlDB, pinging: make(chan struct{})}
+	s.SetDB(next)
+	units, _ := tools.ParseUnits("MB", "ms")
+	s.SetUnits(units)
+	s.SetFormatPrecision(2)
+	<-done
+	if old.closedDuringPing {
+		t.Error("expected the old connection to be closed after the ping")
+	}
+	if next.maxConns != 7 {
+		t.Error("expected the new connection to keep 7 max connections, got " + strconv.Itoa(next.maxConns))
+	}
+}
@@ -6,11 +6,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
+	"os/user"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"code.google.com/p/goconf/conf"
@@ -18,12 +36,18 @@ import (
 	"github.com/measure/metrics"
 	"github.com/measure/mysql/dbstat"
 	"github.com/measure/mysql/tablestat"
+	"github.com/measure/mysql/tools"
 )
 
 func main() {
-	var user, password, host, address, cnf, group, form, checkConfigFile string
-	var stepSec int
-	var servermode, human, loop bool
+	var user, password, host, address, cnf, group, form, checkConfigFile, sanitize, graphiteAddr, grpcAddr, extraStatus, checkTables, labels, masterHost, replicaHosts, configFile, skipGetters, batch, byteUnit, timeUnit, target, dsn, graphitePrefix, influxScheme, backupTable, backupColumn, dbInclude, tableExclude, dropUser, role, alertRules, stateFile string
+	var opts tools.Options
+	var sampleInterval, sampleWindow, graphiteFlush, graphiteHeartbeat, minInterval, delay, scrapeTTL, lagWindowAge, queryTimeout, interval, checkEvery, shutdownGrace, bindRetry time.Duration
+	var stepSec, readyAfter, port, replicaConcurrency, precision, pkOffenders, historySize, lagWindowSize, samples, fingerprints, maxOpenConns int
+	var servermode, replicaLag, loop, roleAware, strict, probe, profile, timestamps, errorLog, localBinlogs, validate, dumpRaw, collectAllOnce, dumpConfig, counterRates, randomDelay, scrapeDriven, errorsJSON, alertLog bool
+	var autoConcurrency float64
+	var largeTableBytes int64
+	var nagios nagiosLimits
 	var checkConfig *conf.ConfigFile
 
 	m := metrics.NewMetricContext("system")
@@ -32,28 +56,443 @@ func main() {
 	flag.StringVar(&password, "p", "", "password for database")
 	flag.StringVar(&host, "h", "",
 		"address and protocol of the database to connect to. leave blank for tcp(127.0.0.1:3306)")
+	flag.StringVar(&host, "host", "", "same as -h")
+	flag.IntVar(&port, "port", 0, "port to connect to on -h, when it has none. 0 for 3306")
+	flag.StringVar(&dsn, "dsn", "",
+		"go-sql-driver dsn to connect with instead of -u, -p, -h and -cnf, e.g. user:password@tcp(db1:3306)/")
+	flag.StringVar(&target, "target", "",
+		"[user@]host[:port][/db] or [user@]/path/to/socket to connect to, instead of -u, -h and -default-db")
 	flag.BoolVar(&servermode, "server", false,
 		"Runs continously and exposes metrics as JSON on HTTP")
 	flag.StringVar(&address, "address", ":12345",
 		"address to listen on for http if running in server mode")
+	flag.DurationVar(&bindRetry, "bind-retry", 30*time.Second,
+		"in server mode, keep retrying for this long while -address is in use, e.g. by the process being replaced. 0 gives up at once")
+	flag.StringVar(&dropUser, "drop-privileges", "",
+		"when run as root, switch to this user or uid once connected. stays root when empty. "+
+			"not allowed over a unix socket, and the data directory and binary logs must be readable by the user")
+	flag.BoolVar(&scrapeDriven, "scrape-driven", false,
+		"in server mode, collect when metrics are requested instead of every -step")
+	flag.DurationVar(&scrapeTTL, "scrape-ttl", 5*time.Second,
+		"with -scrape-driven, requests within this long of the last collection reuse it")
+	flag.IntVar(&readyAfter, "ready-after", 1,
+		"successful full collections before /readyz answers 200 in server mode")
+	flag.IntVar(&historySize, "history-size", 300,
+		"collections kept in memory for /api/v1/history in server mode. 0 turns it off")
+	flag.StringVar(&alertRules, "alerts", "",
+		"comma separated <metric><op><threshold>[:<severity>] rules, e.g. mysqlstat.SlaveSecondsBehindMaster>30:warning, "+
+			"checked after each collection and listed on /alerts in server mode. op is one of > >= < <= == !=")
+	flag.BoolVar(&alertLog, "alerts-log", false, "log -alerts as they start and stop firing")
+	flag.BoolVar(&profile, "pprof", false,
+		"expose net/http/pprof handlers under /debug/pprof/ in server mode")
 	flag.IntVar(&stepSec, "step", 2, "metrics are collected every step seconds")
+	flag.DurationVar(&shutdownGrace, "shutdown-grace", 10*time.Second,
+		"on SIGINT or SIGTERM, time the collection and requests in progress get to finish before exiting")
+	flag.DurationVar(&minInterval, "min-interval", time.Second,
+		"smallest -step allowed, so a typo can't flood the server with collections")
+	flag.DurationVar(&delay, "startup-delay", 0,
+		"wait this long before the first collection, to stagger collectors started together")
+	flag.BoolVar(&randomDelay, "startup-delay-random", false,
+		"wait a random time up to -startup-delay instead")
+	flag.StringVar(&masterHost, "master-host", "",
+		"host of this replica's master, connected to with the same credentials to read how far the IO thread is behind it")
+	flag.BoolVar(&replicaLag, "replica-lag", false,
+		"also collect the lag of each replica with a binlog dump thread on this server, connecting to them with the same credentials")
+	flag.StringVar(&replicaHosts, "replica-hosts", "",
+		"comma separated replica hosts to collect the lag of, instead of finding them with -replica-lag")
+	flag.IntVar(&replicaConcurrency, "replica-lag-concurrency", 4, "replicas checked at once for -replica-lag")
 	flag.StringVar(&cnf, "cnf", "/root/.my.cnf", "configuration file")
-	flag.StringVar(&form, "form", "graphite", "output format of metrics to stdout")
-	flag.BoolVar(&human, "h", false,
-		"Makes output in MB for human readable sizes")
+	flag.StringVar(&opts.Charset, "charset", "utf8mb4",
+		"connection character set. fallbacks may follow after commas, e.g. utf8mb4,utf8")
+	flag.StringVar(&opts.Collation, "collation", "",
+		"connection collation. leave blank for the charset's default")
+	flag.StringVar(&opts.TLSMinVersion, "tls-min-version", "",
+		"connect over TLS 1.2 or 1.3 or newer. older versions are refused")
+	flag.StringVar(&opts.TLSCiphers, "tls-ciphers", "",
+		"comma separated TLS 1.2 cipher suites allowed, by Go name. turns TLS on")
+	flag.DurationVar(&opts.ConnectTimeout, "connect-timeout", 5*time.Second,
+		"give up connecting to the server after this long")
+	flag.IntVar(&maxOpenConns, "max-open-conns", 5, "connections the server metrics collector runs its queries on at once")
+	flag.Float64Var(&autoConcurrency, "auto-concurrency", 0,
+		"use the fewest connections, up to -max-open-conns, that keep a collection within this share of -step, e.g. 0.5. 0 always uses -max-open-conns")
+	flag.DurationVar(&queryTimeout, "query-timeout", 0,
+		"give up on a query running longer than this and kill it, leaving its metrics out of that collection. "+
+			"0 is -step with -loop or -server, and no limit otherwise")
+	flag.DurationVar(&opts.ReadTimeout, "read-timeout", 0,
+		"give up waiting on a read from the server after this long. 0 waits as long as it takes")
+	flag.DurationVar(&opts.WriteTimeout, "write-timeout", 0,
+		"give up waiting on a write to the server after this long. 0 waits as long as it takes")
+	flag.StringVar(&opts.DefaultDB, "default-db", "",
+		"database that unqualified names in queries resolve to. defaults to information_schema")
+	flag.StringVar(&opts.SessionInit, "session-init", "",
+		"SET SESSION statements, separated by semicolons, to run on every connection")
+	flag.StringVar(&opts.QueryTag, "query-tag", "inspect-mysql",
+		"name put in a comment ahead of every query, with the getter making it. empty for none")
+	flag.BoolVar(&opts.Redact, "redact", false,
+		"replace hostnames, IP addresses and accounts in log lines with a hash, for sharing logs")
+	flag.StringVar(&form, "form", "graphite",
+		"output format of metrics to stdout: graphite, graphite-tagged (graphite with -labels as tags), json, ndjson (one JSON object per line), "+
+			"prometheus (the text exposition format, also served on /metrics "+
+			"in server mode), influx (the InfluxDB line protocol), or nagios for a single check result")
+	flag.StringVar(&labels, "labels", "",
+		"comma separated key=value labels added to every -form ndjson line, and as tags to -form influx and graphite-tagged lines")
+	flag.StringVar(&influxScheme, "influx-scheme", "metric",
+		"how -form influx names measurements: metric (one measurement per metric, with a value field) "+
+			"or wide (metrics named alike are fields of one measurement, e.g. mysql_slave)")
+	flag.BoolVar(&nagios.replica, "nagios-replica", false,
+		"with -form nagios, the server is a replica and replication not running is critical")
+	flag.Float64Var(&nagios.lagWarn, "nagios-lag-warn", 60,
+		"with -form nagios, seconds of replication lag that are a warning")
+	flag.Float64Var(&nagios.lagCrit, "nagios-lag-crit", 300,
+		"with -form nagios, seconds of replication lag that are critical")
+	flag.Float64Var(&nagios.connWarn, "nagios-conn-warn", 80,
+		"with -form nagios, percent of max_connections in use that is a warning")
+	flag.Float64Var(&nagios.connCrit, "nagios-conn-crit", 95,
+		"with -form nagios, percent of max_connections in use that is critical")
+	flag.StringVar(&graphiteAddr, "graphite-addr", "",
+		"send graphite output to carbon at host:port over TCP instead of stdout. needs -form graphite or graphite-tagged")
+	flag.StringVar(&grpcAddr, "grpc-addr", "",
+		"push the metrics of every collection to a MetricsBus gRPC server at host:port, without TLS. see tools/metrics.proto")
+	flag.DurationVar(&graphiteFlush, "graphite-flush", 10*time.Second,
+		"how often buffered lines are sent to -graphite-addr during a collection. "+
+			"lines are also sent after every collection")
+	flag.DurationVar(&graphiteHeartbeat, "graphite-heartbeat", 0,
+		"only send -graphite-addr the metrics whose value changed, and every metric at least this often. 0 sends every metric")
+	flag.IntVar(&precision, "precision", 5,
+		"digits after the decimal point for non-integer values in graphite output")
+	flag.StringVar(&sanitize, "sanitize-names", "auto",
+		"character rules for database and table names in output: auto (per output format), "+
+			"none, graphite or prometheus")
+	flag.BoolVar(&timestamps, "graphite-timestamp", false,
+		"end each graphite line with the collection time, as carbon's plaintext protocol expects")
+	flag.StringVar(&graphitePrefix, "graphite-prefix", "",
+		"put this and a dot before every graphite metric name, e.g. mysql.db1, so hosts sharing carbon don't collide")
+	flag.StringVar(&extraStatus, "extra-status", "",
+		"comma separated global status variables to also collect as status.<name> gauges")
+	flag.BoolVar(&counterRates, "counter-rates", false,
+		"also output a <name>_per_sec gauge with each server counter's change per second between collections")
+	flag.StringVar(&stateFile, "state-file", "",
+		"file to keep the last collection's counters and server uptime in, so rates and restart detection "+
+			"carry over when the collector restarts. off when empty")
+	flag.StringVar(&checkTables, "check-tables", "",
+		"comma separated schemas to run CHECK TABLE ... QUICK on for CorruptTablesCount. reads every table, so off by default")
+	flag.DurationVar(&checkEvery, "check-tables-every", 24*time.Hour, "time between -check-tables runs")
+	flag.StringVar(&backupTable, "backup-table", "",
+		"table, as db.table, that backups record their completion in, for LastBackupAgeSeconds. off when empty")
+	flag.StringVar(&backupColumn, "backup-column", "finished_at",
+		"TIMESTAMP or DATETIME column of -backup-table holding when each backup finished")
+	flag.StringVar(&dbInclude, "db-include", "",
+		"regexp of the databases to collect table metrics for. all when empty")
+	flag.StringVar(&tableExclude, "table-exclude", "",
+		"regexp of the table names to leave out of table metrics. none when empty")
+	flag.IntVar(&fingerprints, "query-fingerprints", 0,
+		"group long running queries by fingerprint, with values left out, and output the n with the most queries")
+	flag.IntVar(&pkOffenders, "log-tables-without-pk", 0,
+		"log the names of the n largest InnoDB tables without a primary or unique key")
+	flag.Int64Var(&largeTableBytes, "large-table-bytes", 0,
+		"count the tables larger than this many bytes in LargeTablesCount and log their names. 0 turns it off")
+	flag.StringVar(&byteUnit, "byte-unit", "",
+		"output sizes in B, KB, MB or GB instead of the unit they are collected in. "+
+			"names aren't changed, so e.g. SizeBytes is then in MB; counters are left as they are")
+	flag.StringVar(&timeUnit, "time-unit", "",
+		"output times in ms or s instead of the unit they are collected in. "+
+			"names aren't changed, so e.g. a name ending in Ms or Seconds may then be in the other unit; counters are left as they are")
 	flag.StringVar(&group, "group", "", "group of metrics to collect")
+	flag.DurationVar(&sampleWindow, "threads-sample-window", 0,
+		"sample Threads_running for this long each collection to catch short spikes. 0 turns sampling off")
+	flag.DurationVar(&sampleInterval, "threads-sample-interval", 100*time.Millisecond,
+		"time between Threads_running samples")
+	flag.IntVar(&lagWindowSize, "lag-window", 0,
+		"also output the 95th percentile and max replication lag over this many collections. 0 turns it off")
+	flag.DurationVar(&lagWindowAge, "lag-window-age", 0,
+		"leave lag samples older than this out of -lag-window. 0 keeps them")
 	flag.BoolVar(&loop, "loop", false,
 		"loop on collecting metrics when specifying group")
 	flag.StringVar(&checkConfigFile, "check", "", "config file to check metrics with")
+	flag.BoolVar(&strict, "strict", false,
+		"exit non-zero, naming the failed getters, if the first collection has any errors, "+
+			"of every getter or of those in -group. in server/loop mode only the first collection is checked")
+	flag.BoolVar(&errorLog, "error-log", false,
+		"log new ERROR entries from performance_schema.error_log each collection (MySQL 8.0.22+)")
+	flag.BoolVar(&localBinlogs, "local-binlogs", false,
+		"read the oldest binary log's header for OldestBinlogAgeSeconds. only for a collector on the database host")
+	flag.BoolVar(&errorsJSON, "collect-errors-to-stderr-json", false,
+		`write each getter error of a full collection to stderr as a JSON line: {"getter": ..., "error": ..., "ts": ...}`)
+	flag.BoolVar(&validate, "validate", false,
+		"check collected metrics against each other after every collection and report inconsistencies")
+	flag.BoolVar(&probe, "probe", false,
+		"print the server's hostname, version, server_id and server_uuid and exit")
+	flag.BoolVar(&dumpRaw, "dump-raw", false,
+		"print the unparsed result of every getter's query as JSON and exit, for debugging metrics")
+	flag.BoolVar(&dumpConfig, "dump-config", false,
+		"print the settings the collector would run with as JSON, with the password left out, and exit")
+	flag.BoolVar(&collectAllOnce, "collect-all-once", false,
+		"collect once, print PASS/FAIL for whether each getter's query returned the columns it parses, "+
+			"and exit non-zero if any failed. meant for checking a new server version in CI")
+	flag.BoolVar(&roleAware, "role-aware", true,
+		"skip slave getters on a primary and binlog getters with log_bin off, going by the previous collection")
+	flag.StringVar(&role, "role", "auto",
+		"primary, replica or auto to find it from read_only and slave status. used by -role-aware and added as a role label")
+	flag.IntVar(&samples, "samples", 0,
+		"collect this many times, -interval apart, print the min, avg and max of every metric and exit")
+	flag.DurationVar(&interval, "interval", time.Second, "time between -samples collections")
+	flag.StringVar(&batch, "batch", "",
+		"comma separated groups to collect in order over one connection, e.g. slave,sessions. "+
+			"prints every metric collected and exits, non-zero if a getter failed")
+	flag.StringVar(&skipGetters, "skip-getters", "",
+		"comma separated getters not to collect, e.g. GetSessions,GetTableSizes")
+	flag.StringVar(&configFile, "config", "",
+		"file of flag=value lines, one per line, for flags not given on the command line. "+
+			"with -loop it is read again on SIGHUP")
 	flag.Parse()
 
-	if servermode {
-		go func() {
-			http.HandleFunc("/api/v1/metrics.json/", m.HttpJsonHandler)
-			log.Fatal(http.ListenAndServe(address, nil))
-		}()
+	//flags on the command line win over -config
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if configFile != "" {
+		if _, err := reloadConfig(flag.CommandLine, configFile, explicit, nil); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if err := applyTarget(target, &user, &host, &opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := applyPort(port, &host); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := checkDropPrivileges(dropUser, host, dsn); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := checkGraphiteAddr(graphiteAddr, form); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	//connect with -dsn when it is given, otherwise with the credentials,
+	// address and config file
+	newStat := func() (*dbstat.MysqlStat, error) {
+		if dsn != "" {
+			return dbstat.NewDSN(m, dsn)
+		}
+		return dbstat.NewWithOptions(m, user, password, host, cnf, opts)
+	}
+	newStatTables := func() (*tablestat.MysqlStatTables, error) {
+		if dsn != "" {
+			return tablestat.NewDSN(m, dsn)
+		}
+		return tablestat.NewWithOptions(m, user, password, host, cnf, opts)
+	}
+	connect := func() (tools.MysqlDB, error) {
+		if dsn != "" {
+			return tools.NewDSN(dsn)
+		}
+		return tools.NewWithOptions(user, password, host, cnf, opts)
+	}
+
+	if dumpConfig {
+		if err := writeConfig(os.Stdout, flag.CommandLine); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	policies := map[string]tools.NamePolicy{
+		"none":       tools.NamesRaw,
+		"graphite":   tools.NamesGraphite,
+		"prometheus": tools.NamesPrometheus,
+	}
+	policy, forcePolicy := policies[sanitize]
+	if !forcePolicy && sanitize != "auto" {
+		fmt.Fprintln(os.Stderr, "unknown -sanitize-names policy: "+sanitize)
+		os.Exit(1)
+	}
+	metricLabels, labelErr := parseLabels(labels)
+	if labelErr != nil {
+		fmt.Fprintln(os.Stderr, labelErr)
+		os.Exit(1)
+	}
+	rules, alertErr := parseAlertRules(alertRules)
+	if alertErr != nil {
+		fmt.Fprintln(os.Stderr, alertErr)
+		os.Exit(1)
+	}
+	var alerts *alerting
+	if rules != nil {
+		alerts = &alerting{rules: rules, log: alertLog}
+	}
+	scheme, schemeErr := tools.ParseInfluxScheme(influxScheme)
+	if schemeErr != nil {
+		fmt.Fprintln(os.Stderr, schemeErr)
+		os.Exit(1)
+	}
+
+	if probe {
+		sqlstat, err := newStat()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		id, err := sqlstat.Probe()
+		sqlstat.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("hostname: " + id.Hostname)
+		fmt.Println("version: " + id.Version)
+		fmt.Println("server_id: " + id.ServerID)
+		fmt.Println("server_uuid: " + id.ServerUUID)
+		os.Exit(0)
+	}
+
+	if dumpRaw {
+		sqlstat, err := newStat()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		sqlstatTables, err := newStatTables()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		dump := sqlstat.DumpRaw()
+		for method, result := range sqlstatTables.DumpRaw() {
+			dump[method] = result
+		}
+		sqlstat.Close()
+		sqlstatTables.Close()
+		out, err := json.MarshalIndent(dump, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+		os.Exit(0)
+	}
+
+	if collectAllOnce {
+		sqlstat, err := newStat()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		sqlstatTables, err := newStatTables()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		sqlstat.Collect()
+		sqlstatTables.Collect()
+		checks := append(sqlstat.CheckQueries(), sqlstatTables.CheckQueries()...)
+		sqlstat.Close()
+		sqlstatTables.Close()
+		if !reportChecks(os.Stdout, checks) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if samples > 0 {
+		sqlstat, err := newStat()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		sqlstatTables, err := newStatTables()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		var snaps []map[string]float64
+		for i := 0; i < samples; i++ {
+			if i > 0 {
+				time.Sleep(interval)
+			}
+			sqlstat.Collect()
+			sqlstatTables.Collect()
+			values, err := tools.SnapshotValues(func(j *tools.JSONWriter) {
+				sqlstat.WriteJSON(j)
+				sqlstatTables.WriteJSON(j)
+			})
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			snaps = append(snaps, values)
+		}
+		sqlstat.Close()
+		sqlstatTables.Close()
+		writeSampleStats(os.Stdout, tools.AggregateSamples(snaps), precision)
+		os.Exit(0)
+	}
+
+	if batch != "" {
+		sqlstat, err := newStat()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		values, err := sqlstat.RunBatch(strings.Split(batch, ","))
+		writeBatch(os.Stdout, values, precision)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if form == "nagios" {
+		sqlstat, err := newStat()
+		if err != nil {
+			fmt.Println("CRITICAL - " + err.Error())
+			os.Exit(nagiosCritical)
+		}
+		err = sqlstat.Collect()
+		code, line := nagiosCheck(sqlstat.Metrics, nagios, err)
+		sqlstat.Close()
+		fmt.Println(line)
+		os.Exit(code)
+	}
+
+	var push *tools.GRPCPush
+	if grpcAddr != "" {
+		push = tools.NewGRPCPush(grpcAddr)
+	}
+
+	var history *tools.History
+	if servermode && historySize > 0 {
+		history = tools.NewHistory(historySize)
+	}
+
+	var sink *tools.GraphiteSink
+	if graphiteAddr != "" {
+		sink = tools.NewGraphiteSink(graphiteAddr, graphiteFlush)
+		if graphiteHeartbeat > 0 {
+			sink.SetChangeFilter(tools.NewChangeFilter(graphiteHeartbeat))
+		}
+		//carbon needs a timestamp on every line
+		timestamps = true
+	}
+
+	if scrapeDriven && (!servermode || group != "") {
+		fmt.Fprintln(os.Stderr, "-scrape-driven needs -server and collects every group")
+		os.Exit(1)
 	}
+
 	step := time.Millisecond * time.Duration(stepSec) * 1000
+	if loop {
+		if err := checkStep(step, minInterval); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 
 	var err error
 	var c metricchecks.Checker
@@ -72,100 +511,1574 @@ func main() {
 		checkConfigFile = ""
 	}
 
+	//collectors started together must not pick the same delay
+	rand.Seed(time.Now().UnixNano())
+	startupDelay(delay, randomDelay, rand.Int63n, time.Sleep)
+
+	//applies the settings that can change on reload to both collectors.
+	// changed names the flags to apply, nil applies all of them
+	configure := func(sqlstat *dbstat.MysqlStat, sqlstatTables *tablestat.MysqlStatTables, changed map[string]bool) error {
+		apply := func(names ...string) bool {
+			if changed == nil {
+				return true
+			}
+			for _, name := range names {
+				if changed[name] {
+					return true
+				}
+			}
+			return false
+		}
+		if apply("precision") {
+			sqlstat.SetFormatPrecision(precision)
+			sqlstatTables.SetFormatPrecision(precision)
+		}
+		if apply("byte-unit", "time-unit") {
+			units, err := tools.ParseUnits(byteUnit, timeUnit)
+			if err != nil {
+				return err
+			}
+			sqlstat.SetUnits(units)
+			sqlstatTables.SetUnits(units)
+		}
+		if apply("query-timeout", "step") {
+			timeout := queryTimeout
+			if timeout == 0 && (loop || servermode) {
+				timeout = time.Duration(stepSec) * time.Second
+			}
+			sqlstat.SetQueryTimeout(timeout)
+			sqlstatTables.SetQueryTimeout(timeout)
+		}
+		if apply("max-open-conns", "auto-concurrency", "step") {
+			if maxOpenConns < 1 {
+				return errors.New("-max-open-conns must be at least 1")
+			}
+			if autoConcurrency < 0 || autoConcurrency > 1 {
+				return errors.New("-auto-concurrency must be between 0 and 1")
+			}
+			target := time.Duration(autoConcurrency * float64(time.Duration(stepSec)*time.Second))
+			sqlstat.SetAutoConcurrency(target, maxOpenConns)
+		}
+		if apply("threads-sample-interval", "threads-sample-window") {
+			sqlstat.SetThreadsRunningSampling(sampleInterval, sampleWindow)
+		}
+		if apply("error-log") {
+			sqlstat.SetErrorLogTail(errorLog)
+		}
+		if apply("local-binlogs") {
+			sqlstat.SetLocalBinlogs(localBinlogs)
+		}
+		if apply("counter-rates") {
+			sqlstat.SetCounterRates(counterRates)
+		}
+		if apply("lag-window", "lag-window-age") {
+			sqlstat.SetLagWindow(lagWindowSize, lagWindowAge)
+		}
+		if apply("role-aware") {
+			sqlstat.SetRoleAware(roleAware)
+		}
+		if apply("role") {
+			if err := sqlstat.SetRole(role); err != nil {
+				return err
+			}
+		}
+		if apply("query-fingerprints") {
+			sqlstat.SetQueryFingerprints(fingerprints)
+		}
+		if apply("check-tables", "check-tables-every") {
+			sqlstat.SetCheckTables(strings.Split(checkTables, ","), checkEvery)
+		}
+		if apply("backup-table", "backup-column") {
+			sqlstat.SetBackupMarker(backupTable, backupColumn)
+		}
+		if apply("extra-status") {
+			sqlstat.SetExtraStatus(strings.Split(extraStatus, ","))
+		}
+		if apply("db-include", "table-exclude") {
+			filter, err := tablestat.NewFilter(dbInclude, "", "", tableExclude)
+			if err != nil {
+				return err
+			}
+			sqlstatTables.SetFilter(filter)
+		}
+		if apply("log-tables-without-pk") {
+			sqlstatTables.SetLogTablesWithoutPK(pkOffenders)
+		}
+		if apply("large-table-bytes") {
+			sqlstatTables.SetLargeTableBytes(largeTableBytes)
+		}
+		if apply("skip-getters") {
+			sqlstat.SetSkipGetters(strings.Split(skipGetters, ","))
+			sqlstatTables.SetSkipGetters(strings.Split(skipGetters, ","))
+		}
+		if changed != nil && changedAny(changed, connectionFlags) {
+			db, err := connect()
+			if err != nil {
+				return errors.New("not reconnecting with the new connection settings: " + err.Error())
+			}
+			tables, err := connect()
+			if err != nil {
+				db.Close()
+				return errors.New("not reconnecting with the new connection settings: " + err.Error())
+			}
+			sqlstat.SetDB(db)
+			sqlstatTables.SetDB(tables)
+		}
+		if masterHost != "" && apply(append([]string{"master-host"}, connectionFlags...)...) {
+			master, err := tools.NewWithOptions(user, password, masterHost, cnf, opts)
+			if err != nil {
+				return err
+			}
+			sqlstat.SetMaster(master)
+		}
+		if apply(append([]string{"replica-lag", "replica-hosts", "replica-lag-concurrency"}, connectionFlags...)...) {
+			var connect func(string) (tools.MysqlDB, error)
+			if replicaLag || replicaHosts != "" {
+				user, password, cnf, opts := user, password, cnf, opts
+				connect = func(replica string) (tools.MysqlDB, error) {
+					db, err := tools.NewWithOptions(user, password, replica, cnf, opts)
+					if err != nil {
+						db.Close()
+						return nil, err
+					}
+					return db, nil
+				}
+			}
+			sqlstat.SetReplicaLag(strings.Split(replicaHosts, ","), replicaConcurrency, connect)
+		}
+		return nil
+	}
+
+	//reads -config again, after SIGHUP, and applies what changed. returns
+	// whether the step changed, so the caller can restart its ticker
+	reload := func(sqlstat *dbstat.MysqlStat, sqlstatTables *tablestat.MysqlStatTables) bool {
+		if configFile == "" {
+			log.Println("SIGHUP ignored, there is no -config to reload")
+			return false
+		}
+		changed, err := reloadConfig(flag.CommandLine, configFile, explicit, appliedOnReload)
+		if err != nil {
+			log.Println("not reloading " + configFile + ": " + err.Error())
+			return false
+		}
+		if err := applyTarget(target, &user, &host, &opts); err != nil {
+			log.Println(err)
+		}
+		if err := applyPort(port, &host); err != nil {
+			log.Println(err)
+		}
+		if err := configure(sqlstat, sqlstatTables, changed); err != nil {
+			log.Println(err)
+		}
+		for name := range changed {
+			if !appliedOnReload(name) {
+				log.Println("-" + name + " changed in " + configFile + ", restart to apply it")
+			}
+		}
+		if !changed["step"] {
+			return false
+		}
+		newStep := time.Duration(stepSec) * time.Second
+		if err := checkStep(newStep, minInterval); err != nil {
+			log.Println(err)
+			return false
+		}
+		step = newStep
+		return true
+	}
+
+	ctx := shutdownOnSignal()
+
 	//if a group is defined, run metrics collections for just that group
 	if group != "" {
 		//initialize metrics collectors to not loop and collect
-		sqlstat, err := dbstat.New(m, user, password, host, cnf)
+		sqlstat, err := newStat()
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		sqlstatTables, err := tablestat.New(m, user, password, host, cnf)
+		sqlstatTables, err := newStatTables()
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+		sqlstat.SetGraphiteTimestamp(timestamps)
+		sqlstatTables.SetGraphiteTimestamp(timestamps)
+		sqlstat.SetGraphitePrefix(graphitePrefix)
+		sqlstatTables.SetGraphitePrefix(graphitePrefix)
+		if forcePolicy {
+			sqlstatTables.SetNamePolicy(policy)
+		}
+		if err := configure(sqlstat, sqlstatTables, nil); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := dropPrivileges(dropUser); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		served := background(func() {
+			if servermode {
+				serveMetrics(ctx, address, sqlstat, sqlstatTables, history, alerts, nil, nil, profile, shutdownGrace, bindRetry)
+			}
+		})
 
 		//call the specific method name for the wanted group of metrics
-		sqlstat.CallByMethodName(group)
-		sqlstatTables.CallByMethodName(group)
+		if err := callGroup(sqlstat, sqlstatTables, group); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			sqlstat.Close()
+			sqlstatTables.Close()
+			os.Exit(1)
+		}
+		if strict {
+			exitOnErrors(tools.CollectionError(sqlstat.LastErrors()),
+				tools.CollectionError(sqlstatTables.LastErrors()))
+		}
+		recordHistory(history, alerts, sqlstat, sqlstatTables)
 		if checkConfigFile != "" {
 			checkMetrics(c, m)
 		}
-		outputMetrics(sqlstat, sqlstatTables, m, form)
+		outputMetrics(sqlstat, sqlstatTables, m, form, metricLabels, scheme, sink, push)
 		//if metrics collection for this group is wanted on a loop,
 		if loop {
-			ticker := time.NewTicker(step)
-			for _ = range ticker.C {
-				sqlstat.CallByMethodName(group)
-				sqlstatTables.CallByMethodName(group)
-				if checkConfigFile != "" {
-					checkMetrics(c, m)
-				}
-				outputMetrics(sqlstat, sqlstatTables, m, form)
+			err := run(ctx, runLoop{
+				step:  step,
+				grace: shutdownGrace,
+				collect: func() {
+					callGroup(sqlstat, sqlstatTables, group)
+					recordHistory(history, alerts, sqlstat, sqlstatTables)
+					if checkConfigFile != "" {
+						checkMetrics(c, m)
+					}
+					outputMetrics(sqlstat, sqlstatTables, m, form, metricLabels, scheme, sink, push)
+				},
+				reload: func() (time.Duration, bool) {
+					changed := reload(sqlstat, sqlstatTables)
+					return step, changed
+				},
+				trigger: collectOnSignal(),
+				hup:     reloadOnSignal(),
+				sink:    sink,
+				close: func() {
+					//requests in progress may still query the server
+					<-served
+					sqlstat.Close()
+					sqlstatTables.Close()
+				},
+			})
+			if err != nil {
+				log.Println(err)
 			}
+			return
 		}
+		closeSink(sink)
 		sqlstat.Close()
 		sqlstatTables.Close()
 		//if no group is specified, just run all metrics collections
 	} else {
-		sqlstat, err := dbstat.New(m, user, password, host, cnf)
+		sqlstat, err := newStat()
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		sqlstatTables, err := tablestat.New(m, user, password, host, cnf)
+		sqlstatTables, err := newStatTables()
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		sqlstat.Collect()
-		sqlstatTables.Collect()
+		sqlstat.SetGraphiteTimestamp(timestamps)
+		sqlstatTables.SetGraphiteTimestamp(timestamps)
+		sqlstat.SetGraphitePrefix(graphitePrefix)
+		sqlstatTables.SetGraphitePrefix(graphitePrefix)
+		if forcePolicy {
+			sqlstatTables.SetNamePolicy(policy)
+		}
+		if err := configure(sqlstat, sqlstatTables, nil); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := dropPrivileges(dropUser); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if stateFile != "" {
+			if err := sqlstat.LoadState(stateFile); err != nil {
+				log.Println(err)
+			}
+		}
+		ready := newReadiness(readyAfter)
+		if scrapeDriven {
+			scrape := tools.NewCachedCollect(scrapeTTL, func() error {
+				derr := sqlstat.Collect()
+				terr := sqlstatTables.Collect()
+				ready.record(derr, terr)
+				if errorsJSON {
+					writeCollectErrors(os.Stderr, sqlstat, sqlstatTables)
+				}
+				if validate {
+					reportInconsistencies(sqlstat)
+				}
+				recordHistory(history, alerts, sqlstat, sqlstatTables)
+				saveState(sqlstat, stateFile)
+				if derr != nil {
+					return derr
+				}
+				return terr
+			})
+			//returns once scrapes in progress at shutdown are done
+			serveMetrics(ctx, address, sqlstat, sqlstatTables, history, alerts, scrape, ready, profile, shutdownGrace, bindRetry)
+			closeSink(sink)
+			sqlstat.Close()
+			sqlstatTables.Close()
+			return
+		}
+		served := background(func() {
+			if servermode {
+				serveMetrics(ctx, address, sqlstat, sqlstatTables, history, alerts, nil, ready, profile, shutdownGrace, bindRetry)
+			}
+		})
+		start := time.Now()
+		derr := sqlstat.Collect()
+		terr := sqlstatTables.Collect()
+		ready.record(derr, terr)
+		if loop {
+			warnSlowCollection(step, time.Since(start))
+		}
+		if errorsJSON {
+			writeCollectErrors(os.Stderr, sqlstat, sqlstatTables)
+		}
+		if strict {
+			exitOnErrors(derr, terr)
+		}
+		if validate {
+			reportInconsistencies(sqlstat)
+		}
+		recordHistory(history, alerts, sqlstat, sqlstatTables)
+		saveState(sqlstat, stateFile)
 
 		if checkConfigFile != "" {
 			checkMetrics(c, m)
 		}
-		outputMetrics(sqlstat, sqlstatTables, m, form)
+		outputMetrics(sqlstat, sqlstatTables, m, form, metricLabels, scheme, sink, push)
 		if loop {
-			ticker := time.NewTicker(step)
-			for _ = range ticker.C {
-				sqlstat.Collect()
-				sqlstatTables.Collect()
-				outputMetrics(sqlstat, sqlstatTables, m, form)
+			err := run(ctx, runLoop{
+				step:  step,
+				grace: shutdownGrace,
+				collect: func() {
+					ready.record(sqlstat.Collect(), sqlstatTables.Collect())
+					if errorsJSON {
+						writeCollectErrors(os.Stderr, sqlstat, sqlstatTables)
+					}
+					if validate {
+						reportInconsistencies(sqlstat)
+					}
+					recordHistory(history, alerts, sqlstat, sqlstatTables)
+					saveState(sqlstat, stateFile)
+					outputMetrics(sqlstat, sqlstatTables, m, form, metricLabels, scheme, sink, push)
+				},
+				reload: func() (time.Duration, bool) {
+					changed := reload(sqlstat, sqlstatTables)
+					return step, changed
+				},
+				trigger: collectOnSignal(),
+				hup:     reloadOnSignal(),
+				sink:    sink,
+				close: func() {
+					//requests in progress may still query the server
+					<-served
+					sqlstat.Close()
+					sqlstatTables.Close()
+				},
+			})
+			if err != nil {
+				log.Println(err)
 			}
+			return
 		}
+		closeSink(sink)
 		sqlstat.Close()
 		sqlstatTables.Close()
 	}
 }
 
-func checkMetrics(c metricchecks.Checker, m *metrics.MetricContext) error {
-	err := c.NewScopeAndPackage()
-	if err != nil {
-		return err
+//waits before the first collection. with random set the wait is
+// anywhere up to max, so a fleet started at once spreads out
+func startupDelay(max time.Duration, random bool, rnd func(int64) int64, sleep func(time.Duration)) {
+	if max <= 0 {
+		return
 	}
-	err = c.InsertMetricValuesFromContext(m)
+	wait := max
+	if random {
+		wait = time.Duration(rnd(int64(max)))
+	}
+	sleep(wait)
+}
+
+//exit codes of a Nagios check plugin
+const (
+	nagiosOK       = 0
+	nagiosWarning  = 1
+	nagiosCritical = 2
+)
+
+//thresholds for -form nagios
+type nagiosLimits struct {
+	replica            bool
+	lagWarn, lagCrit   float64
+	connWarn, connCrit float64
+}
+
+//evaluates replication and connection usage against limits. returns the
+// exit code and a line of the form "OK - message | perfdata".
+// a failed collection is at least a warning
+func nagiosCheck(c *dbstat.MysqlStatMetrics, limits nagiosLimits, collectErr error) (int, string) {
+	code := nagiosOK
+	var msgs, perf []string
+	raise := func(to int, msg string) {
+		if to > code {
+			code = to
+		}
+		msgs = append(msgs, msg)
+	}
+	format := func(x float64) string {
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+
+	if limits.replica {
+		lag := c.SlaveSecondsBehindMaster.Get()
+		if c.ReplicationRunning.Get() != 1 {
+			raise(nagiosCritical, "replication not running")
+		} else if lag >= 0 {
+			perf = append(perf, "lag="+format(lag)+"s;"+format(limits.lagWarn)+";"+format(limits.lagCrit))
+			if lag >= limits.lagCrit {
+				raise(nagiosCritical, "replication lag "+format(lag)+"s")
+			} else if lag >= limits.lagWarn {
+				raise(nagiosWarning, "replication lag "+format(lag)+"s")
+			}
+		}
+	}
+
+	if pct := c.CurrentConnectionsPct.Get(); !math.IsNaN(pct) {
+		perf = append(perf, "connections="+format(pct)+"%;"+format(limits.connWarn)+";"+
+			format(limits.connCrit))
+		if pct >= limits.connCrit {
+			raise(nagiosCritical, "connections at "+format(pct)+"% of max")
+		} else if pct >= limits.connWarn {
+			raise(nagiosWarning, "connections at "+format(pct)+"% of max")
+		}
+	}
+
+	if collectErr != nil {
+		raise(nagiosWarning, collectErr.Error())
+	}
+
+	states := []string{"OK", "WARNING", "CRITICAL"}
+	msg := "all checks passed"
+	if len(msgs) > 0 {
+		msg = strings.Join(msgs, ", ")
+	}
+	line := states[code] + " - " + msg
+	if len(perf) > 0 {
+		line += " | " + strings.Join(perf, " ")
+	}
+	return code, line
+}
+
+//switches the process to account, a user name or uid, and its primary
+// group, dropping root's other groups. connections opened later, such as
+// when the pool grows or on reload, are opened as account. does nothing
+// when account is empty or the process already runs as it
+func dropPrivileges(account string) error {
+	if account == "" {
+		return nil
+	}
+	uid, gid, err := privilegeIDs(account, user.Lookup, user.LookupId)
 	if err != nil {
 		return err
 	}
-	checks, err := c.CheckAll()
-	for _, check := range checks {
-		fmt.Println(check)
+	if os.Getuid() == uid && os.Getgid() == gid {
+		return nil
 	}
-	return err
+	if os.Getuid() != 0 {
+		return errors.New("-drop-privileges needs the collector to start as root")
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return errors.New("can't drop supplementary groups: " + err.Error())
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return errors.New("can't switch to gid " + strconv.Itoa(gid) + ": " + err.Error())
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return errors.New("can't switch to uid " + strconv.Itoa(uid) + ": " + err.Error())
+	}
+	log.Println("running as " + account)
+	return nil
 }
 
-//output metrics in specific output format
-func outputMetrics(d *dbstat.MysqlStat, t *tablestat.MysqlStatTables,
-	m *metrics.MetricContext, form string) {
-	//print out json packages
-	if form == "json" {
-		m.EncodeJSON(os.Stdout)
+//refuses -drop-privileges when the collector connects over a unix
+// socket. the pool opens connections after the switch, and reconnects,
+// as account, so a server authenticating by socket would refuse them
+func checkDropPrivileges(account, host, dsn string) error {
+	if account == "" {
+		return nil
 	}
-	//print out in graphite form:
-	//<metric_name> <metric_value>
-	if form == "graphite" {
-		d.FormatGraphite(os.Stdout)
-		t.FormatGraphite(os.Stdout)
+	socket := strings.Contains(dsn, "unix(")
+	if dsn == "" {
+		if t, err := tools.ParseTarget(host); err == nil && t.Socket != "" {
+			socket = true
+		}
+	}
+	if socket {
+		return errors.New("-drop-privileges can't be used over a unix socket, connections opened later would " +
+			"authenticate as " + account + ". connect over tcp instead")
+	}
+	return nil
+}
+
+//finds the uid and primary gid of account, looking it up as a name and
+// then, if it is a number, as a uid. root is refused, since staying root
+// is what -drop-privileges is meant to avoid
+func privilegeIDs(account string, lookup, lookupID func(string) (*user.User, error)) (int, int, error) {
+	u, err := lookup(account)
+	if err != nil {
+		if _, nerr := strconv.Atoi(account); nerr != nil {
+			return 0, 0, errors.New("can't drop privileges to " + account + ": " + err.Error())
+		}
+		if u, err = lookupID(account); err != nil {
+			return 0, 0, errors.New("can't drop privileges to " + account + ": " + err.Error())
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, errors.New("uid " + u.Uid + " of " + account + " isn't a number")
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, errors.New("gid " + u.Gid + " of " + account + " isn't a number")
+	}
+	if uid == 0 {
+		return 0, 0, errors.New("can't drop privileges to " + account + ", it is root")
+	}
+	return uid, gid, nil
+}
+
+//rejects a collection step below the floor
+func checkStep(step, floor time.Duration) error {
+	if step < floor {
+		return errors.New("-step of " + step.String() + " is below the " + floor.String() +
+			" minimum, set with -min-interval")
+	}
+	return nil
+}
+
+//returns a channel that receives when SIGUSR1 asks for a collection
+// before the next tick
+func collectOnSignal() chan struct{} {
+	trigger := make(chan struct{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		for range sigs {
+			requestCollection(trigger)
+		}
+	}()
+	return trigger
+}
+
+//returns a context that is done when SIGINT or SIGTERM asks the
+// collector to exit. A second signal exits right away
+func shutdownOnSignal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Println("shutting down")
+		signal.Stop(sigs)
+		cancel()
+	}()
+	return ctx
+}
+
+//runs f in the background. the returned channel is closed once f
+// returns
+func background(f func()) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	return done
+}
+
+//a collection loop, see run
+type runLoop struct {
+	step    time.Duration
+	grace   time.Duration //time a collection in progress at shutdown gets to finish
+	collect func()        //collects and outputs once
+	//called when hup receives, returns the step to use and whether it changed
+	reload       func() (time.Duration, bool)
+	trigger, hup <-chan struct{}
+	sink         *tools.GraphiteSink //flushed before close, can be nil
+	close        func()              //closes the collectors' connections
+}
+
+//collects every step, or when trigger receives, until ctx is done. A
+// collection in progress then gets grace to finish so its metrics are
+// output, before the sink is flushed and the connections are closed.
+// Returns an error if the collection was abandoned
+func run(ctx context.Context, l runLoop) error {
+	ticker := time.NewTicker(l.step)
+	defer func() { ticker.Stop() }()
+	var err error
+collect:
+	for {
+		select {
+		case <-ctx.Done():
+			break collect
+		case <-ticker.C:
+		case <-l.trigger:
+		case <-l.hup:
+			if step, changed := l.reload(); changed {
+				ticker.Stop()
+				ticker = time.NewTicker(step)
+			}
+			continue
+		}
+		done := make(chan struct{})
+		go func() {
+			l.collect()
+			close(done)
+		}()
+		select {
+		case <-done:
+			continue
+		case <-ctx.Done():
+		}
+		select {
+		case <-done:
+		case <-time.After(l.grace):
+			err = errors.New("collection still running " + l.grace.String() + " after shutdown, abandoning it")
+		}
+		break collect
+	}
+	closeSink(l.sink)
+	l.close()
+	return err
+}
+
+//returns a channel that receives when SIGHUP asks for -config to be
+// read again
+func reloadOnSignal() chan struct{} {
+	reload := make(chan struct{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			requestCollection(reload)
+		}
+	}()
+	return reload
+}
+
+//flags that change how the collectors connect. changing one in -config
+// reconnects on reload
+var connectionFlags = []string{"dsn", "target", "u", "p", "h", "host", "port", "cnf", "charset", "collation", "tls-min-version", "tls-ciphers",
+	"connect-timeout", "read-timeout", "write-timeout", "default-db", "session-init", "query-tag", "redact"}
+
+//flags that are applied on reload without reconnecting. others only
+// take effect after a restart
+var reloadableFlags = map[string]bool{
+	"step": true, "precision": true, "byte-unit": true, "time-unit": true, "threads-sample-interval": true, "threads-sample-window": true,
+	"query-timeout": true, "error-log": true, "local-binlogs": true, "counter-rates": true, "lag-window": true, "lag-window-age": true,
+	"role-aware": true, "role": true, "max-open-conns": true, "auto-concurrency": true, "query-fingerprints": true, "check-tables": true, "check-tables-every": true, "backup-table": true, "backup-column": true,
+	"db-include": true, "table-exclude": true,
+	"extra-status": true, "log-tables-without-pk": true, "large-table-bytes": true, "skip-getters": true, "master-host": true,
+	"replica-lag": true, "replica-hosts": true, "replica-lag-concurrency": true,
+}
+
+//whether a reload sets flag name. flags only read at startup keep
+// their values until a restart
+func appliedOnReload(name string) bool {
+	return reloadableFlags[name] || changedAny(map[string]bool{name: true}, connectionFlags)
+}
+
+//sets the port of host to port, unless port is 0. host may be given
+// in any form -target takes, without a user or database
+func applyPort(port int, host *string) error {
+	if port == 0 {
+		return nil
+	}
+	if port < 0 || port > 65535 {
+		return errors.New("-port " + strconv.Itoa(port) + " is out of range")
+	}
+	t, err := tools.ParseTarget(*host)
+	if err != nil {
+		return err
+	}
+	if t.Socket != "" {
+		return errors.New("-port can't be used with the socket " + t.Socket)
+	}
+	t.Port = port
+	*host = t.Address()
+	return nil
+}
+
+//sets the user, host and default database from -target. a target
+// without a user or database leaves those as they are
+func applyTarget(target string, user, host *string, opts *tools.Options) error {
+	if target == "" {
+		return nil
+	}
+	t, err := tools.ParseTarget(target)
+	if err != nil {
+		return err
+	}
+	if t.User != "" {
+		*user = t.User
+	}
+	*host = t.Address()
+	if t.DB != "" {
+		opts.DefaultDB = t.DB
+	}
+	return nil
+}
+
+//whether any of names is in changed
+func changedAny(changed map[string]bool, names []string) bool {
+	for _, name := range names {
+		if changed[name] {
+			return true
+		}
+	}
+	return false
+}
+
+//sets the flags of fs named in the config file at path, one name=value
+// per line, with # starting a comment. flags in explicit, those given
+// on the command line, are left as they are, and other flags the file
+// doesn't name go back to their defaults, so a line taken out of the
+// file is undone on reload. when settable isn't nil, only the flags it
+// returns true for are set, and the others keep their values however
+// the file changed them. nothing changes if the file has an error.
+// returns the flags whose values changed, or would have when not
+// settable
+func reloadConfig(fs *flag.FlagSet, path string, explicit map[string]bool,
+	settable func(name string) bool) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		name := strings.TrimPrefix(strings.TrimSpace(kv[0]), "-")
+		if len(kv) != 2 || fs.Lookup(name) == nil {
+			return nil, errors.New(path + " line " + strconv.Itoa(i+1) + ": expected flag=value, got " + strconv.Quote(line))
+		}
+		values[name] = strings.TrimSpace(kv[1])
+	}
+	before := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) { before[f.Name] = f.Value.String() })
+	var setErr error
+	changed := make(map[string]bool)
+	fs.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || setErr != nil {
+			return
+		}
+		value, ok := values[f.Name]
+		if !ok {
+			value = f.DefValue
+		}
+		if settable != nil && !settable(f.Name) {
+			if flagText(f, value) != before[f.Name] {
+				changed[f.Name] = true
+			}
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			setErr = errors.New(path + ": -" + f.Name + ": " + err.Error())
+		}
+	})
+	fs.VisitAll(func(f *flag.Flag) {
+		if setErr != nil {
+			fs.Set(f.Name, before[f.Name])
+		} else if f.Value.String() != before[f.Name] {
+			changed[f.Name] = true
+		}
+	})
+	if setErr != nil {
+		return nil, setErr
+	}
+	return changed, nil
+}
+
+//returns value as f prints it once set, e.g. 1m0s for a duration of 1m,
+// without setting f. value is returned as is when it can't be parsed
+func flagText(f *flag.Flag, value string) string {
+	t := reflect.TypeOf(f.Value)
+	if t.Kind() != reflect.Ptr {
+		return value
+	}
+	scratch, ok := reflect.New(t.Elem()).Interface().(flag.Value)
+	if !ok || scratch.Set(value) != nil {
+		return value
+	}
+	return scratch.String()
+}
+
+//queues a collection on trigger. one is collected after the running
+// collection however many are requested meanwhile, so collections
+// never overlap
+func requestCollection(trigger chan struct{}) {
+	select {
+	case trigger <- struct{}{}:
+	default:
+	}
+}
+
+//collections that take longer than the step run back to back
+func warnSlowCollection(step, took time.Duration) {
+	if took > step {
+		fmt.Fprintln(os.Stderr, "warning: collecting took "+took.String()+
+			", longer than the -step of "+step.String()+". collections will run back to back")
+	}
+}
+
+//flags whose values are never printed
+var secretFlags = map[string]bool{"p": true, "dsn": true}
+
+//the settings resolved from flags and their defaults, as -dump-config
+// prints them
+type resolvedConfig struct {
+	Target  string            `json:"target"`
+	Getters string            `json:"getters"`
+	TLS     string            `json:"tls"`
+	Flags   map[string]string `json:"flags"`
+}
+
+//writes the settings fs resolved to as JSON. secret flags are written
+// as "<redacted>" when set
+func writeConfig(w io.Writer, fs *flag.FlagSet) error {
+	value := func(name string) string {
+		if f := fs.Lookup(name); f != nil {
+			return f.Value.String()
+		}
+		return ""
+	}
+	config := resolvedConfig{
+		Target:  tools.TargetName(value("u"), value("h")),
+		Getters: "all",
+		TLS:     "off",
+		Flags:   make(map[string]string),
+	}
+	if dsn := value("dsn"); dsn != "" {
+		config.Target = tools.DSNTargetName(dsn)
+	}
+	if group := value("group"); group != "" {
+		config.Getters = group
+	}
+	if value("tls-min-version") != "" || value("tls-ciphers") != "" {
+		min := value("tls-min-version")
+		if min == "" {
+			min = "1.2"
+		}
+		config.TLS = "TLS " + min + " or newer"
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretFlags[f.Name] && v != "" {
+			v = "<redacted>"
+		}
+		config.Flags[f.Name] = v
+	})
+	out, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(out))
+	return err
+}
+
+//prints one line per getter check, returning whether all of them passed
+func reportChecks(w io.Writer, checks []tools.GetterCheck) bool {
+	passed := true
+	for _, check := range checks {
+		fmt.Fprintln(w, check.String())
+		if !check.Passed() {
+			passed = false
+		}
+	}
+	return passed
+}
+
+//in strict mode, a failed collection ends the process.
+// the errors name each getter that failed
+func exitOnErrors(errs ...error) {
+	if reportErrors(os.Stderr, errs...) {
+		os.Exit(1)
+	}
+}
+
+//writes each error that isn't nil to w, one per line, and returns if
+// there were any
+func reportErrors(w io.Writer, errs ...error) bool {
+	failed := false
+	for _, err := range errs {
+		if err != nil {
+			fmt.Fprintln(w, err)
+			failed = true
+		}
+	}
+	return failed
+}
+
+//runs the getters of d and t matching group. A group only has to
+// match on one of them, so an error lists the groups of both
+func callGroup(d *dbstat.MysqlStat, t *tablestat.MysqlStatTables, group string) error {
+	derr := d.CallByMethodName(group)
+	terr := t.CallByMethodName(group)
+	if derr == nil || terr == nil {
+		return nil
+	}
+	groups := append(d.AvailableGroups(), t.AvailableGroups()...)
+	sort.Strings(groups)
+	return errors.New("unknown group " + group + "; valid groups are " + strings.Join(groups, ", "))
+}
+
+//writes a record for each getter that failed in the last collection of
+// d and t to w, one JSON object per line sorted by getter, so an
+// orchestrator can alert on them apart from the metrics on stdout:
+// {"getter": "GetSlaveStats", "error": "...", "ts": "2014-05-13T15:04:05Z"}
+func writeCollectErrors(w io.Writer, d *dbstat.MysqlStat, t *tablestat.MysqlStatTables) error {
+	type record struct {
+		Getter string `json:"getter"`
+		Error  string `json:"error"`
+		TS     string `json:"ts"`
+	}
+	var records []record
+	for _, c := range []struct {
+		errs map[string]error
+		at   time.Time
+	}{
+		{d.LastErrors(), d.CollectedAt()},
+		{t.LastErrors(), t.CollectedAt()},
+	} {
+		for getter, err := range c.errs {
+			records = append(records, record{getter, err.Error(), c.at.UTC().Format(time.RFC3339)})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Getter < records[j].Getter })
+	for _, rec := range records {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//prints the values of a batch as "name value" lines, sorted by name
+func writeBatch(w io.Writer, values map[string]float64, precision int) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(w, name+" "+tools.FormatValue(values[name], precision))
+	}
+}
+
+//exposes metrics as JSON on HTTP until ctx is done. Responses are
+// streamed from the collectors rather than built in memory first.
+// Requests in progress at shutdown get grace to finish. While address
+// is in use binding is retried for up to bindRetry
+func serveMetrics(ctx context.Context, address string, d *dbstat.MysqlStat, t *tablestat.MysqlStatTables,
+	history *tools.History, alerts *alerting, scrape *tools.CachedCollect, ready *readiness, profile bool, grace, bindRetry time.Duration) {
+	ln, err := listenRetry(ctx, address, bindRetry)
+	if err != nil {
+		if ctx.Err() != nil {
+			return //shut down while waiting for the address
+		}
+		log.Fatal(err)
+	}
+	srv := &http.Server{Addr: address, Handler: newServeMux(d, t, history, alerts, scrape, ready, profile)}
+	done := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.Println(err)
+		}
+		close(done)
+	}()
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
+
+//first and longest wait between attempts of listenRetry
+const (
+	bindRetryMin = 100 * time.Millisecond
+	bindRetryMax = 5 * time.Second
+)
+
+//listens on address over tcp. while the address is in use, such as
+// during a rolling restart before the old process has let go of the
+// port, it tries again with backoff for up to retry. other errors, and
+// ctx being done, end it at once
+func listenRetry(ctx context.Context, address string, retry time.Duration) (net.Listener, error) {
+	deadline := time.Now().Add(retry)
+	wait := bindRetryMin
+	for {
+		ln, err := net.Listen("tcp", address)
+		if err == nil {
+			return ln, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, errors.New("gave up listening on " + address + " after " + retry.String() +
+				", it is still in use: " + err.Error())
+		}
+		if wait > left {
+			wait = left
+		}
+		log.Println(address + " is in use, trying again in " + wait.String())
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > bindRetryMax {
+			wait = bindRetryMax
+		}
+	}
+}
+
+//routes for server mode. The pprof handlers are only added when
+// profile is set, so a private mux is used instead of the default
+// one that importing net/http/pprof registers them on.
+// /api/v1/history is only added when history is kept, /alerts when
+// there are alert rules, and /readyz when ready counts full collections.
+// With scrape set, metrics are collected when requested rather than
+// served from the last collection of the main loop
+func newServeMux(d *dbstat.MysqlStat, t *tablestat.MysqlStatTables,
+	history *tools.History, alerts *alerting, scrape *tools.CachedCollect, ready *readiness, profile bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/metrics.json/", func(w http.ResponseWriter, r *http.Request) {
+		if scrape != nil {
+			//getters that failed leave their metrics as they were
+			if err := scrape.Collect(); err != nil {
+				log.Println(err)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := writeJSON(w, d, t); err != nil {
+			log.Println(err)
+		}
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if scrape != nil {
+			if err := scrape.Collect(); err != nil {
+				log.Println(err)
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := writePrometheus(w, d, t); err != nil {
+			log.Println(err)
+		}
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthzTimeout)
+		defer cancel()
+		if err := d.Ping(ctx); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+	if ready != nil {
+		mux.HandleFunc("/readyz", ready.handler)
+	}
+	if history != nil {
+		mux.HandleFunc("/api/v1/history", historyHandler(history))
+	}
+	if alerts != nil {
+		mux.HandleFunc("/alerts", alertsHandler(alerts.rules))
+	}
+	if profile {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+//counts the full collections that succeeded, so /readyz can wait for
+// the collector to have data before traffic is routed to it
+type readiness struct {
+	threshold int //successful collections needed to be ready
+	lock      sync.Mutex
+	successes int
+}
+
+func newReadiness(threshold int) *readiness {
+	return &readiness{threshold: threshold}
+}
+
+//counts a full collection as successful if neither collector failed
+func (r *readiness) record(derr, terr error) {
+	if derr != nil || terr != nil {
+		return
+	}
+	r.lock.Lock()
+	r.successes++
+	r.lock.Unlock()
+}
+
+//answers /readyz with 200 once threshold collections succeeded, and
+// 503 until then. unlike /healthz it doesn't touch the database
+func (r *readiness) handler(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	successes := r.successes
+	r.lock.Unlock()
+	if successes < r.threshold {
+		http.Error(w, strconv.Itoa(successes)+" of "+strconv.Itoa(r.threshold)+
+			" successful collections so far", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+//answers /api/v1/history?metric=<name> with the values of the metric
+// kept in history, oldest first:
+// {"metric": "mysqlstat.Queries", "values": [{"time": "2014-05-13T15:04:05Z", "value": 9342251}, ...]}
+func historyHandler(history *tools.History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metric := r.URL.Query().Get("metric")
+		if metric == "" {
+			http.Error(w, "metric parameter required", http.StatusBadRequest)
+			return
+		}
+		out, err := json.Marshal(struct {
+			Metric string               `json:"metric"`
+			Values []tools.HistoryPoint `json:"values"`
+		}{metric, history.Values(metric)})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(out, '\n'))
+	}
+}
+
+//writes a line with the min, avg and max of each metric, sorted by name
+func writeSampleStats(w io.Writer, stats map[string]tools.SampleStats, precision int) {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		st := stats[name]
+		fmt.Fprintln(w, name+" min="+tools.FormatValue(st.Min, precision)+
+			" avg="+tools.FormatValue(st.Avg, precision)+
+			" max="+tools.FormatValue(st.Max, precision))
+	}
+}
+
+//adds the values of the last collection to history, if it is kept, and
+// checks them against the alert rules, if there are any
+func recordHistory(history *tools.History, alerts *alerting, d *dbstat.MysqlStat, t *tablestat.MysqlStatTables) {
+	if history == nil && alerts == nil {
+		return
+	}
+	values, err := tools.SnapshotValues(func(j *tools.JSONWriter) {
+		d.WriteJSON(j)
+		t.WriteJSON(j)
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	at := d.CollectedAt()
+	if at.IsZero() {
+		at = time.Now()
+	}
+	if history != nil {
+		history.Add(at, values)
+	}
+	alerts.evaluate(at, values)
+}
+
+//writes the collector's state to path for the next run, if -state-file
+// is set
+func saveState(d *dbstat.MysqlStat, path string) {
+	if path == "" {
+		return
+	}
+	if err := d.SaveState(path); err != nil {
+		log.Println(err)
+	}
+}
+
+//alert rules set with -alerts, and whether to log alerts as they start
+// and stop firing
+type alerting struct {
+	rules *tools.Alerts
+	log   bool
+}
+
+//checks the rules against the values of a collection. does nothing
+// without rules
+func (a *alerting) evaluate(at time.Time, values map[string]float64) {
+	if a == nil {
+		return
+	}
+	started, resolved := a.rules.Evaluate(at, values)
+	if !a.log {
+		return
+	}
+	for _, alert := range started {
+		log.Println("alert firing: " + alert.String())
+	}
+	for _, alert := range resolved {
+		log.Println("alert resolved: " + alert.String())
+	}
+}
+
+//operators of -alerts rules, longer ones first so >= isn't read as >
+var alertOperators = []string{">=", "<=", "==", "!=", ">", "<"}
+
+//parses -alerts, <metric><op><threshold>[:<severity>] rules separated by
+// commas. the severity is warning when left out. nil without rules
+func parseAlertRules(s string) (*tools.Alerts, error) {
+	var alerts *tools.Alerts
+	for _, rule := range strings.Split(s, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		severity := "warning"
+		if i := strings.LastIndex(rule, ":"); i >= 0 {
+			rule, severity = rule[:i], strings.TrimSpace(rule[i+1:])
+		}
+		i, op := -1, ""
+		for _, o := range alertOperators {
+			if j := strings.Index(rule, o); j >= 0 && (i < 0 || j < i) {
+				i, op = j, o
+			}
+		}
+		if i < 0 {
+			return nil, errors.New("alert rule " + strconv.Quote(rule) + " has no operator")
+		}
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(rule[i+len(op):]), 64)
+		if err != nil {
+			return nil, errors.New("alert rule " + strconv.Quote(rule) + " has no numeric threshold")
+		}
+		if alerts == nil {
+			alerts = tools.NewAlerts()
+		}
+		if err := alerts.AddAlertRule(strings.TrimSpace(rule[:i]), op, threshold, severity); err != nil {
+			return nil, err
+		}
+	}
+	return alerts, nil
+}
+
+//lists the alerts firing at the last collection. operators are left
+// unescaped, so > reads as > rather than \u003e
+func alertsHandler(alerts *tools.Alerts) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		err := enc.Encode(struct {
+			Alerts []tools.Alert `json:"alerts"`
+		}{alerts.Firing()})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf.Bytes())
+	}
+}
+
+//how long /healthz waits for the database to answer
+const healthzTimeout = 2 * time.Second
+
+//version of the JSON output's shape, bump it whenever the shape changes
+const jsonSchemaVersion = 1
+
+//writes metrics from both collectors as a single JSON list, in the
+// versioned envelope
+func writeJSON(w io.Writer, d *dbstat.MysqlStat, t *tablestat.MysqlStatTables) error {
+	return writeEnvelope(w, d.CollectedAt(), func(j *tools.JSONWriter) {
+		d.WriteJSON(j)
+		t.WriteJSON(j)
+	})
+}
+
+//writes metrics from both collectors as one JSON object per line
+func writeNDJSON(w io.Writer, d *dbstat.MysqlStat, t *tablestat.MysqlStatTables, labels map[string]string) error {
+	return tools.WriteNDJSON(w, d.CollectedAt(), labels, func(j *tools.JSONWriter) {
+		d.WriteJSON(j)
+		t.WriteJSON(j)
+	})
+}
+
+//returns labels with a role label added, unless role is "" or -labels
+// already sets one. labels is left as it is
+func roleLabel(labels map[string]string, role string) map[string]string {
+	if _, ok := labels["role"]; ok || role == "" {
+		return labels
+	}
+	with := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		with[k] = v
+	}
+	with["role"] = role
+	return with
+}
+
+//returns labels with master_host, master_port and master_server_id
+// labels added for the master src names, so a run across a fleet can
+// rebuild the replication topology. nothing is added on a server that
+// isn't a replica, and -labels wins for a key it sets. labels is left as
+// it is
+func sourceLabels(labels map[string]string, src dbstat.ReplicationSource) map[string]string {
+	if src == (dbstat.ReplicationSource{}) {
+		return labels
+	}
+	with := make(map[string]string, len(labels)+3)
+	for k, v := range map[string]string{"master_host": src.Host, "master_port": src.Port, "master_server_id": src.ServerID} {
+		if v != "" {
+			with[k] = v
+		}
+	}
+	for k, v := range labels {
+		with[k] = v
+	}
+	return with
+}
+
+//parses -labels, key=value pairs separated by commas
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, errors.New("label " + strconv.Quote(pair) + " isn't key=value")
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
+//names given out in Prometheus output, kept for the life of the process
+// so a name doesn't change between scrapes
+var prometheusNames = tools.NewNameSanitizer(tools.NamesPrometheus)
+
+//writes metrics from both collectors in the Prometheus text format
+func writePrometheus(w io.Writer, d *dbstat.MysqlStat, t *tablestat.MysqlStatTables) error {
+	return tools.WritePrometheus(w, prometheusNames, func(j *tools.JSONWriter) {
+		d.WriteJSON(j)
+		t.WriteJSON(j)
+	})
+}
+
+func pushMetrics(push *tools.GRPCPush, d *dbstat.MysqlStat, t *tablestat.MysqlStatTables, labels map[string]string) error {
+	return push.Push(d.CollectedAt(), labels, func(j *tools.JSONWriter) {
+		d.WriteJSON(j)
+		t.WriteJSON(j)
+	})
+}
+
+func writeInflux(w io.Writer, d *dbstat.MysqlStat, t *tablestat.MysqlStatTables,
+	labels map[string]string, scheme tools.InfluxScheme) error {
+	return tools.WriteInflux(w, d.CollectedAt(), scheme, labels, func(j *tools.JSONWriter) {
+		d.WriteJSON(j)
+		t.WriteJSON(j)
+	})
+}
+
+//wraps the list of metrics written by write in an object naming the
+// schema version and collection time, which is null before the first
+// full collection:
+// {"schema_version": 1, "collected_at": "2014-05-13T15:04:05Z", "metrics": [...]}
+func writeEnvelope(w io.Writer, collected time.Time, write func(*tools.JSONWriter)) error {
+	at := "null"
+	if !collected.IsZero() {
+		at = `"` + collected.UTC().Format(time.RFC3339) + `"`
+	}
+	_, err := io.WriteString(w, `{"schema_version": `+strconv.Itoa(jsonSchemaVersion)+
+		`, "collected_at": `+at+`, "metrics": `)
+	if err != nil {
+		return err
+	}
+	j := tools.NewJSONWriter(w)
+	write(j)
+	if err := j.Close(); err != nil {
+		return err
+	}
+	logDuplicates(j.Duplicates())
+	_, err = io.WriteString(w, "}\n")
+	return err
+}
+
+//writes the graphite lines of both collectors to w in one write. dbstat
+// owns the server wide metrics and tablestat the per database and table
+// ones, so names shouldn't clash, but if they do the line written first,
+// dbstat's, is kept and the others dropped
+func writeGraphite(w io.Writer, d *dbstat.MysqlStat, t *tablestat.MysqlStatTables) error {
+	var buf, out bytes.Buffer
+	d.FormatGraphite(&buf)
+	t.FormatGraphite(&buf)
+	seen := make(map[string]bool)
+	var dups []string
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		name := strings.SplitN(line, " ", 2)[0]
+		if seen[name] {
+			dups = append(dups, name)
+			continue
+		}
+		seen[name] = true
+		out.WriteString(line)
+	}
+	logDuplicates(dups)
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+//writes graphite lines from both collectors with labels as graphite tags
+func writeGraphiteTagged(w io.Writer, d *dbstat.MysqlStat, t *tablestat.MysqlStatTables,
+	labels map[string]string) error {
+	var buf bytes.Buffer
+	if err := writeGraphite(&buf, d, t); err != nil {
+		return err
+	}
+	return tools.FormatGraphiteTagged(w, buf.Bytes(), labels)
+}
+
+//logs metrics left out of output because another had the same name
+func logDuplicates(names []string) {
+	if len(names) > 0 {
+		log.Println("metrics written more than once, keeping the first: " + strings.Join(names, ", "))
+	}
+}
+
+//prints metrics that are inconsistent with each other
+func reportInconsistencies(d *dbstat.MysqlStat) {
+	for _, err := range d.Metrics.Validate() {
+		fmt.Fprintln(os.Stderr, "inconsistent metrics: "+err.Error())
+	}
+}
+
+func checkMetrics(c metricchecks.Checker, m *metrics.MetricContext) error {
+	err := c.NewScopeAndPackage()
+	if err != nil {
+		return err
+	}
+	err = c.InsertMetricValuesFromContext(m)
+	if err != nil {
+		return err
+	}
+	checks, err := c.CheckAll()
+	for _, check := range checks {
+		fmt.Println(check)
+	}
+	return err
+}
+
+//output metrics in specific output format. labels, and a role label
+// once the role is known, are added to ndjson lines, influx tags and
+// graphite tags.
+// graphite output goes to sink instead of stdout when sink isn't nil.
+// metrics are also sent to push when it isn't nil, whatever form is
+func outputMetrics(d *dbstat.MysqlStat, t *tablestat.MysqlStatTables,
+	m *metrics.MetricContext, form string, labels map[string]string, scheme tools.InfluxScheme,
+	sink *tools.GraphiteSink, push *tools.GRPCPush) {
+	labels = sourceLabels(roleLabel(labels, d.Role()), d.Source())
+	if push != nil {
+		if err := pushMetrics(push, d, t, labels); err != nil {
+			log.Println(err)
+		}
+	}
+	//print out json packages
+	if form == "json" {
+		writeJSON(os.Stdout, d, t)
+	}
+	if form == "ndjson" {
+		writeNDJSON(os.Stdout, d, t, labels)
+	}
+	if form == "prometheus" {
+		writePrometheus(os.Stdout, d, t)
+	}
+	if form == "influx" {
+		writeInflux(os.Stdout, d, t, labels, scheme)
+	}
+	//print out in graphite form:
+	//<metric_name> <metric_value>
+	//or with the labels as tags:
+	//<metric_name>;<key>=<value> <metric_value>
+	if form == "graphite" || form == "graphite-tagged" {
+		var w io.Writer = os.Stdout
+		if sink != nil {
+			w = sink
+			d.Metrics.GraphiteDroppedLines.Set(sink.Dropped())
+		}
+		if form == "graphite-tagged" {
+			writeGraphiteTagged(w, d, t, labels)
+		} else {
+			writeGraphite(w, d, t)
+		}
+		if sink != nil {
+			if err := sink.Flush(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+//-graphite-addr only carries graphite lines, so any other -form would
+// be printed to stdout while nothing is sent
+func checkGraphiteAddr(addr, form string) error {
+	if addr != "" && form != "graphite" && form != "graphite-tagged" {
+		return errors.New("-graphite-addr needs -form graphite or graphite-tagged, not " + form)
+	}
+	return nil
+}
+
+//sends what is left in sink before exiting
+func closeSink(sink *tools.GraphiteSink) {
+	if sink == nil {
+		return
+	}
+	if err := sink.Close(); err != nil {
+		log.Println(err)
 	}
 }
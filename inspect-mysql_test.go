@@ -0,0 +1,873 @@
+//Copyright (c) 2014 Square, Inc
+//
+// Tests the server mode setup, JSON output and flag checks in inspect-mysql.go.
+// Handlers are looked up on the mux without starting a server.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/measure/metrics"
+	"github.com/measure/mysql/dbstat"
+	"github.com/measure/mysql/tablestat"
+	"github.com/measure/mysql/tools"
+)
+
+func TestPprofRoutes(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/debug/pprof/", nil)
+
+	_, pattern := newServeMux(nil, nil, nil, nil, nil, nil, false).Handler(req)
+	if pattern != "" {
+		t.Error("pprof index should not be registered by default")
+	}
+	_, pattern = newServeMux(nil, nil, nil, nil, nil, nil, true).Handler(req)
+	if pattern != "/debug/pprof/" {
+		t.Error("pprof index not registered, got pattern: " + pattern)
+	}
+
+	req, _ = http.NewRequest("GET", "/healthz", nil)
+	_, pattern = newServeMux(nil, nil, nil, nil, nil, nil, false).Handler(req)
+	if pattern != "/healthz" {
+		t.Error("health check route not registered, got pattern: " + pattern)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/metrics.json/", nil)
+	_, pattern = newServeMux(nil, nil, nil, nil, nil, nil, true).Handler(req)
+	if pattern != "/api/v1/metrics.json/" {
+		t.Error("metrics route not registered, got pattern: " + pattern)
+	}
+}
+
+// Test /readyz answers 503 until enough full collections succeed, and
+// isn't served without a count of them
+func TestReadyz(t *testing.T) {
+	ready := newReadiness(2)
+	mux := newServeMux(nil, nil, nil, nil, nil, ready, false)
+	status := func() int {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := status(); code != http.StatusServiceUnavailable {
+		t.Error("expected not ready before the first collection, got " + strconv.Itoa(code))
+	}
+	ready.record(nil, nil)
+	ready.record(errors.New("GetSessions: Error 1045: Access denied"), nil)
+	if code := status(); code != http.StatusServiceUnavailable {
+		t.Error("expected a failed collection not to count, got " + strconv.Itoa(code))
+	}
+	ready.record(nil, nil)
+	if code := status(); code != http.StatusOK {
+		t.Error("expected ready after two successful collections, got " + strconv.Itoa(code))
+	}
+
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	if _, pattern := newServeMux(nil, nil, nil, nil, nil, nil, false).Handler(req); pattern != "" {
+		t.Error("readiness route should not be registered without full collections")
+	}
+}
+
+func TestCheckStep(t *testing.T) {
+	if err := checkStep(0, time.Second); err == nil {
+		t.Error("expected a step of 0 to be rejected")
+	}
+	if err := checkStep(time.Second, 5*time.Second); err == nil {
+		t.Error("expected a step below -min-interval to be rejected")
+	}
+	if err := checkStep(2*time.Second, time.Second); err != nil {
+		t.Error(err)
+	}
+	//the floor can be lowered on purpose
+	if err := checkStep(0, 0); err != nil {
+		t.Error(err)
+	}
+}
+
+//-drop-privileges is refused over a unix socket, where connections
+// opened after the switch would authenticate as the new user
+func TestCheckDropPrivileges(t *testing.T) {
+	for _, c := range []struct {
+		account, host, dsn string
+		ok                 bool
+	}{
+		{"", "/var/lib/mysql/mysql.sock", "", true},
+		{"mysql", "", "", true},
+		{"mysql", "db1:3306", "", true},
+		{"mysql", "/var/lib/mysql/mysql.sock", "", false},
+		{"mysql", "unix(/var/lib/mysql/mysql.sock)", "", false},
+		{"mysql", "", "monitor@unix(/var/lib/mysql/mysql.sock)/", false},
+		{"mysql", "", "monitor@tcp(db1:3306)/", true},
+	} {
+		if err := checkDropPrivileges(c.account, c.host, c.dsn); (err == nil) != c.ok {
+			t.Errorf("-drop-privileges %q with host %q and dsn %q: unexpected result %v", c.account, c.host, c.dsn, err)
+		}
+	}
+}
+
+//-graphite-addr is refused with output forms it wouldn't send
+func TestCheckGraphiteAddr(t *testing.T) {
+	for _, c := range []struct {
+		addr, form string
+		ok         bool
+	}{
+		{"", "json", true},
+		{"carbon:2003", "graphite", true},
+		{"carbon:2003", "graphite-tagged", true},
+		{"carbon:2003", "json", false},
+		{"carbon:2003", "prometheus", false},
+	} {
+		if err := checkGraphiteAddr(c.addr, c.form); (err == nil) != c.ok {
+			t.Errorf("-graphite-addr %q with -form %q: unexpected result %v", c.addr, c.form, err)
+		}
+	}
+}
+
+func TestPrivilegeIDs(t *testing.T) {
+	accounts := map[string]*user.User{
+		"mysql": &user.User{Username: "mysql", Uid: "27", Gid: "28"},
+		"root":  &user.User{Username: "root", Uid: "0", Gid: "0"},
+	}
+	lookup := func(name string) (*user.User, error) {
+		if u, ok := accounts[name]; ok {
+			return u, nil
+		}
+		return nil, user.UnknownUserError(name)
+	}
+	lookupID := func(id string) (*user.User, error) {
+		for _, u := range accounts {
+			if u.Uid == id {
+				return u, nil
+			}
+		}
+		return nil, errors.New("unknown uid " + id)
+	}
+	for _, account := range []string{"mysql", "27"} {
+		uid, gid, err := privilegeIDs(account, lookup, lookupID)
+		if err != nil || uid != 27 || gid != 28 {
+			t.Error("expected uid 27 and gid 28 for "+account+", got", uid, gid, err)
+		}
+	}
+	for _, account := range []string{"root", "0", "nobody", "1000"} {
+		if _, _, err := privilegeIDs(account, lookup, lookupID); err == nil {
+			t.Error("expected " + account + " to be refused")
+		}
+	}
+	if err := dropPrivileges(""); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRoleLabel(t *testing.T) {
+	labels := map[string]string{"dc": "east"}
+	with := roleLabel(labels, "replica")
+	if len(with) != 2 || with["role"] != "replica" || with["dc"] != "east" {
+		t.Error("expected a role label, got", with)
+	}
+	if _, ok := labels["role"]; ok {
+		t.Error("labels should be left as they are")
+	}
+	if got := roleLabel(labels, ""); len(got) != 1 {
+		t.Error("expected no role label while the role isn't known, got", got)
+	}
+	if got := roleLabel(map[string]string{"role": "standby"}, "replica"); got["role"] != "standby" {
+		t.Error("expected -labels to win, got", got)
+	}
+}
+
+func TestSourceLabels(t *testing.T) {
+	labels := map[string]string{"dc": "east"}
+	with := sourceLabels(labels, dbstat.ReplicationSource{Host: "db-primary", Port: "3306", ServerID: "7"})
+	if len(with) != 4 || with["master_host"] != "db-primary" || with["master_port"] != "3306" ||
+		with["master_server_id"] != "7" || with["dc"] != "east" {
+		t.Error("expected master labels, got", with)
+	}
+	if len(labels) != 1 {
+		t.Error("labels should be left as they are")
+	}
+	if got := sourceLabels(labels, dbstat.ReplicationSource{}); len(got) != 1 {
+		t.Error("expected no master labels on a server that isn't a replica, got", got)
+	}
+	got := sourceLabels(map[string]string{"master_host": "primary"}, dbstat.ReplicationSource{Host: "10.0.0.1"})
+	if len(got) != 1 || got["master_host"] != "primary" {
+		t.Error("expected -labels to win, got", got)
+	}
+}
+
+func TestAlertRules(t *testing.T) {
+	rules, err := parseAlertRules("mysqlstat.SlaveSecondsBehindMaster>=30, mysqlstat.ReplicationRunning==0:critical")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerts := &alerting{rules: rules}
+	alerts.evaluate(time.Unix(1400000000, 0), map[string]float64{
+		"mysqlstat.SlaveSecondsBehindMaster": 30,
+		"mysqlstat.ReplicationRunning":       1,
+	})
+	mux := newServeMux(nil, nil, nil, alerts, nil, nil, false)
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/alerts", nil)
+	mux.ServeHTTP(rec, req)
+	expected := `{"alerts":[{"metric":"mysqlstat.SlaveSecondsBehindMaster","op":">=","threshold":30,` +
+		`"severity":"warning","value":30,"since":"` + time.Unix(1400000000, 0).Format(time.RFC3339) + `"}]}` + "\n"
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + rec.Body.String())
+	}
+
+	for _, bad := range []string{"mysqlstat.Queries", "mysqlstat.Queries>many", ">5"} {
+		if _, err := parseAlertRules(bad); err == nil {
+			t.Error("expected " + bad + " to be refused")
+		}
+	}
+	if rules, err := parseAlertRules(""); rules != nil || err != nil {
+		t.Error("expected no rules")
+	}
+	req, _ = http.NewRequest("GET", "/alerts", nil)
+	if _, pattern := newServeMux(nil, nil, nil, nil, nil, nil, false).Handler(req); pattern != "" {
+		t.Error("alerts route should not be registered without rules")
+	}
+}
+
+func TestListenRetry(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := taken.Addr().String()
+	start := time.Now()
+	if _, err := listenRetry(context.Background(), address, 300*time.Millisecond); err == nil ||
+		!strings.Contains(err.Error(), "still in use") {
+		t.Error("expected to give up on an address in use, got", err)
+	}
+	if time.Since(start) < 300*time.Millisecond {
+		t.Error("expected binding to be retried before giving up")
+	}
+
+	//the old process lets go of the port while binding is retried
+	time.AfterFunc(200*time.Millisecond, func() { taken.Close() })
+	ln, err := listenRetry(context.Background(), address, 5*time.Second)
+	if err != nil {
+		t.Fatal("expected to bind once the address was free, got", err)
+	}
+	ln.Close()
+
+	if _, err := listenRetry(context.Background(), "127.0.0.1:notaport", time.Minute); err == nil ||
+		strings.Contains(err.Error(), "still in use") {
+		t.Error("expected other errors to end it at once, got", err)
+	}
+}
+
+func TestJSONEnvelope(t *testing.T) {
+	var buf bytes.Buffer
+	collected := time.Unix(1400000000, 0)
+	err := writeEnvelope(&buf, collected, func(j *tools.JSONWriter) {
+		j.Counter("mysqlstat.Queries", 9342251, 31.5)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		SchemaVersion *int                     `json:"schema_version"`
+		CollectedAt   *string                  `json:"collected_at"`
+		Metrics       []map[string]interface{} `json:"metrics"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err.Error() + ": " + buf.String())
+	}
+	if out.SchemaVersion == nil || *out.SchemaVersion != jsonSchemaVersion {
+		t.Error("expected schema_version, got: " + buf.String())
+	}
+	if out.CollectedAt == nil || *out.CollectedAt != "2014-05-13T16:53:20Z" {
+		t.Error("expected collected_at, got: " + buf.String())
+	}
+	if len(out.Metrics) != 1 || out.Metrics[0]["name"] != "mysqlstat.Queries" {
+		t.Error("expected the metrics list, got: " + buf.String())
+	}
+
+	//nothing collected yet
+	buf.Reset()
+	writeEnvelope(&buf, time.Time{}, func(j *tools.JSONWriter) {})
+	expected := `{"schema_version": 1, "collected_at": null, "metrics": []` + "\n}\n"
+	if buf.String() != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + buf.String())
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	var slept []time.Duration
+	sleep := func(d time.Duration) { slept = append(slept, d) }
+	half := func(n int64) int64 { return n / 2 }
+
+	startupDelay(0, true, half, sleep)
+	if len(slept) != 0 {
+		t.Error("expected no delay by default")
+	}
+	startupDelay(30*time.Second, false, half, sleep)
+	startupDelay(30*time.Second, true, half, sleep)
+	if len(slept) != 2 || slept[0] != 30*time.Second || slept[1] != 15*time.Second {
+		t.Error("unexpected delays: " + fmt.Sprint(slept))
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	fs := flag.NewFlagSet("inspect-mysql", flag.ContinueOnError)
+	fs.String("u", "root", "")
+	fs.String("p", "", "")
+	fs.String("h", "", "")
+	fs.String("group", "", "")
+	fs.String("tls-min-version", "", "")
+	fs.String("tls-ciphers", "", "")
+	fs.Int("step", 2, "")
+	if err := fs.Parse([]string{"-u", "monitor", "-p", "hunter2", "-h", "tcp(db1:3306)", "-tls-min-version", "1.3"}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeConfig(&buf, fs); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Error("expected the password to be left out, got: " + buf.String())
+	}
+	var config resolvedConfig
+	if err := json.Unmarshal(buf.Bytes(), &config); err != nil {
+		t.Fatal("expected valid JSON: " + err.Error())
+	}
+	if config.Target != "monitor@tcp(db1:3306)" || config.Getters != "all" || config.TLS != "TLS 1.3 or newer" {
+		t.Error("unexpected config: " + buf.String())
+	}
+	if config.Flags["step"] != "2" || config.Flags["p"] != "<redacted>" {
+		t.Error("unexpected flags: " + fmt.Sprint(config.Flags))
+	}
+}
+
+// Test that metrics of a collection in progress at shutdown are sent to
+// the sink before the connections are closed
+func TestRunDrain(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		data, _ := ioutil.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := tools.NewGraphiteSink(l.Addr().String(), 0)
+	trigger := make(chan struct{}, 1)
+	started := make(chan struct{})
+	closed := false
+	trigger <- struct{}{}
+	go func() {
+		<-started
+		cancel()
+	}()
+	err = run(ctx, runLoop{
+		step:  time.Hour,
+		grace: time.Second,
+		collect: func() {
+			close(started)
+			<-ctx.Done()
+			sink.Write([]byte("mysqlstat.Queries 10\n"))
+		},
+		trigger: trigger,
+		sink:    sink,
+		close:   func() { closed = true },
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if !closed {
+		t.Error("expected the connections to be closed")
+	}
+	select {
+	case data := <-received:
+		if data != "mysqlstat.Queries 10\n" {
+			t.Error("unexpected lines sent: " + data)
+		}
+	case <-time.After(time.Second):
+		t.Error("lines of the last collection were not sent")
+	}
+
+	//a collection that outlasts the grace period is abandoned
+	ctx, cancel = context.WithCancel(context.Background())
+	trigger <- struct{}{}
+	release := make(chan struct{})
+	defer close(release)
+	started = make(chan struct{})
+	go func() {
+		<-started
+		cancel()
+	}()
+	err = run(ctx, runLoop{
+		step:  time.Hour,
+		grace: 10 * time.Millisecond,
+		collect: func() {
+			close(started)
+			<-release
+		},
+		trigger: trigger,
+		close:   func() {},
+	})
+	if err == nil || !strings.Contains(err.Error(), "abandoning") {
+		t.Error("expected the collection to be abandoned")
+	}
+}
+
+func TestRequestCollection(t *testing.T) {
+	trigger := make(chan struct{}, 1)
+	//signals arriving during a collection queue only one more
+	for i := 0; i < 3; i++ {
+		requestCollection(trigger)
+	}
+	if len(trigger) != 1 {
+		t.Error("expected 1 queued collection, got " + fmt.Sprint(len(trigger)))
+	}
+	<-trigger
+	requestCollection(trigger)
+	if len(trigger) != 1 {
+		t.Error("expected a collection to be queued again once the last one started")
+	}
+}
+
+func TestNagiosCheck(t *testing.T) {
+	limits := nagiosLimits{replica: true, lagWarn: 60, lagCrit: 300, connWarn: 80, connCrit: 95}
+	tests := []struct {
+		running, lag, conns float64
+		err                 error
+		code                int
+		line                string
+	}{
+		{1, 5, 40, nil, nagiosOK,
+			"OK - all checks passed | lag=5s;60;300 connections=40%;80;95"},
+		{1, 120, 40, nil, nagiosWarning,
+			"WARNING - replication lag 120s | lag=120s;60;300 connections=40%;80;95"},
+		{1, 5, 85, nil, nagiosWarning,
+			"WARNING - connections at 85% of max | lag=5s;60;300 connections=85%;80;95"},
+		{1, 5, 40, errors.New("collection failed: GetSessions: timeout"), nagiosWarning,
+			"WARNING - collection failed: GetSessions: timeout | lag=5s;60;300 connections=40%;80;95"},
+		{1, 400, 85, nil, nagiosCritical,
+			"CRITICAL - replication lag 400s, connections at 85% of max | lag=400s;60;300 connections=85%;80;95"},
+		{-1, -1, 96, nil, nagiosCritical,
+			"CRITICAL - replication not running, connections at 96% of max | connections=96%;80;95"},
+	}
+	for _, test := range tests {
+		c := dbstat.MysqlStatMetricsNew(metrics.NewMetricContext("system"))
+		c.ReplicationRunning.Set(test.running)
+		c.SlaveSecondsBehindMaster.Set(test.lag)
+		c.CurrentConnectionsPct.Set(test.conns)
+		code, line := nagiosCheck(c, limits, test.err)
+		if code != test.code || line != test.line {
+			t.Error("expected " + strconv.Itoa(test.code) + " " + test.line +
+				" but got " + strconv.Itoa(code) + " " + line)
+		}
+	}
+
+	//replication isn't checked on a primary
+	c := dbstat.MysqlStatMetricsNew(metrics.NewMetricContext("system"))
+	c.ReplicationRunning.Set(-1)
+	limits.replica = false
+	if code, line := nagiosCheck(c, limits, nil); code != nagiosOK || line != "OK - all checks passed" {
+		t.Error("unexpected result on a primary: " + line)
+	}
+}
+
+func TestWriteSampleStats(t *testing.T) {
+	var buf bytes.Buffer
+	writeSampleStats(&buf, map[string]tools.SampleStats{
+		"mysqlstat.Uptime":          {Min: 10, Avg: 12, Max: 14, Count: 3},
+		"mysqlstat.Threads_running": {Min: 1, Avg: 2.5, Max: 4, Count: 3},
+	}, 2)
+	expected := "mysqlstat.Threads_running min=1 avg=2.50 max=4\n" +
+		"mysqlstat.Uptime min=10 avg=12 max=14\n"
+	if buf.String() != expected {
+		t.Error("unexpected output:\n" + buf.String())
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels("env=prod, dc = east,,role=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(labels, map[string]string{"env": "prod", "dc": "east", "role": ""}) {
+		t.Error("unexpected labels: " + fmt.Sprint(labels))
+	}
+	if _, err := parseLabels("env"); err == nil {
+		t.Error("expected a label without = to be rejected")
+	}
+}
+
+//a SIGHUP reads -config again, changing the step and turning a getter
+// off, while flags from the command line keep their values
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inspect-mysql.conf")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	step := fs.Int("step", 2, "")
+	skip := fs.String("skip-getters", "", "")
+	user := fs.String("u", "root", "")
+	fs.Parse([]string{"-u", "monitor"})
+	explicit := map[string]bool{"u": true}
+
+	if err := ioutil.WriteFile(path, []byte("# collect often\nstep = 1\nu = other\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadConfig(fs, path, explicit, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *step != 1 || *user != "monitor" {
+		t.Error("unexpected settings after loading: step " + strconv.Itoa(*step) + ", user " + *user)
+	}
+
+	hup := reloadOnSignal()
+	if err := ioutil.WriteFile(path, []byte("step = 5\nskip-getters = GetTableSizes\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	select {
+	case <-hup:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected SIGHUP to ask for a reload")
+	}
+	changed, err := reloadConfig(fs, path, explicit, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *step != 5 || !changed["step"] || !changed["skip-getters"] || changed["u"] {
+		t.Error("unexpected reload: step " + strconv.Itoa(*step) + ", changed " + fmt.Sprint(changed))
+	}
+	db, err := sql.Open("mysql", "root@tcp(127.0.0.1:1)/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tbl := tablestat.NewFromDB(metrics.NewMetricContext("system"), db)
+	tbl.SetSkipGetters(strings.Split(*skip, ","))
+	err = tbl.Collect()
+	if err == nil || strings.Contains(err.Error(), "GetTableSizes") || !strings.Contains(err.Error(), "GetDBSizes") {
+		t.Error("expected only GetTableSizes to be skipped, got: " + fmt.Sprint(err))
+	}
+
+	//flags only read at startup are reported but keep their values
+	form := fs.String("form", "graphite", "")
+	if err := ioutil.WriteFile(path, []byte("step = 5\nform = json\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed, err = reloadConfig(fs, path, explicit, func(name string) bool { return name != "form" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *form != "graphite" || !changed["form"] || *skip != "" || !changed["skip-getters"] {
+		t.Error("unexpected reload: form " + *form + ", changed " + fmt.Sprint(changed))
+	}
+	if changed, _ := reloadConfig(fs, path, explicit, func(name string) bool { return name != "form" }); changed["step"] {
+		t.Error("expected an unchanged step not to be reported")
+	}
+
+	//a bad file changes nothing
+	if err := ioutil.WriteFile(path, []byte("step = 9\nno-such-flag = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadConfig(fs, path, explicit, nil); err == nil || *step != 5 {
+		t.Error("expected a file with an unknown flag to be rejected")
+	}
+}
+
+//both collectors on one metric context, as main runs them
+// Test that getter errors are written as one JSON record per line
+func TestWriteCollectErrors(t *testing.T) {
+	//nothing listens on port 1, so every getter fails
+	db, err := sql.Open("mysql", "root@tcp(127.0.0.1:1)/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m := metrics.NewMetricContext("system")
+	d := dbstat.NewFromDB(m, db)
+	tbl := tablestat.NewFromDB(m, db)
+	d.Collect()
+	tbl.Collect()
+
+	//write to stderr as main does, and read it back
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	err = writeCollectErrors(os.Stderr, d, tbl)
+	os.Stderr = stderr
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ioutil.ReadAll(r)
+	getters := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		var rec struct {
+			Getter string `json:"getter"`
+			Error  string `json:"error"`
+			TS     string `json:"ts"`
+		}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err.Error() + ": " + line)
+		}
+		if rec.Error == "" {
+			t.Error("expected an error message for " + rec.Getter)
+		}
+		if _, err := time.Parse(time.RFC3339, rec.TS); err != nil {
+			t.Error("unexpected ts " + rec.TS)
+		}
+		getters[rec.Getter] = true
+	}
+	if !getters["GetGlobalStatus"] || !getters["GetTableSizes"] {
+		t.Error("expected records for failed dbstat and tablestat getters:\n" + string(out))
+	}
+}
+
+//Test that a group is only unknown if neither collector has it
+func TestCallGroup(t *testing.T) {
+	db, err := sql.Open("mysql", "root@tcp(127.0.0.1:1)/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m := metrics.NewMetricContext("system")
+	d := dbstat.NewFromDB(m, db)
+	tbl := tablestat.NewFromDB(m, db)
+	if err := callGroup(d, tbl, "TableSizes"); err != nil {
+		t.Error("expected a tablestat only group to be found: " + err.Error())
+	}
+	if err := callGroup(d, tbl, "Sessions"); err != nil {
+		t.Error("expected a dbstat only group to be found: " + err.Error())
+	}
+	err = callGroup(d, tbl, "Sessons")
+	if err == nil {
+		t.Fatal("expected an error for an unknown group")
+	}
+	for _, want := range []string{"unknown group Sessons", "GetSessions", "GetTableSizes"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Error("expected " + want + " in: " + err.Error())
+		}
+	}
+	for _, setter := range []string{"SetSkipGetters", "SetLargeTableBytes"} {
+		if strings.Contains(err.Error(), setter) {
+			t.Error("expected only getters in: " + err.Error())
+		}
+	}
+}
+
+// Test that in strict mode a group's failed getters are reported, as
+// they are for a full collection
+func TestStrictGroup(t *testing.T) {
+	db, err := sql.Open("mysql", "root@tcp(127.0.0.1:1)/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m := metrics.NewMetricContext("system")
+	d := dbstat.NewFromDB(m, db)
+	tbl := tablestat.NewFromDB(m, db)
+	if err := callGroup(d, tbl, "Sessions"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if !reportErrors(&buf, tools.CollectionError(d.LastErrors()), tools.CollectionError(tbl.LastErrors())) {
+		t.Fatal("expected the failed group to be reported")
+	}
+	if !strings.Contains(buf.String(), "collection failed: GetSessions: ") || strings.Count(buf.String(), "\n") != 1 {
+		t.Error("expected one line naming GetSessions, got: " + buf.String())
+	}
+	buf.Reset()
+	if reportErrors(&buf, nil, nil) || buf.Len() != 0 {
+		t.Error("expected nothing reported without errors, got: " + buf.String())
+	}
+}
+
+// Test that the duration and errors of a collection are output even
+// when every query failed
+func TestCollectStats(t *testing.T) {
+	db, err := sql.Open("mysql", "root@tcp(127.0.0.1:1)/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m := metrics.NewMetricContext("system")
+	d := dbstat.NewFromDB(m, db)
+	tbl := tablestat.NewFromDB(m, db)
+	d.Collect()
+	tbl.Collect()
+	if d.Metrics.CollectGetterErrors.Get() == 0 || tbl.Server.TablesCollectGetterErrors.Get() == 0 {
+		t.Error("expected getter errors to be counted")
+	}
+	var buf bytes.Buffer
+	writeJSON(&buf, d, tbl)
+	for _, name := range []string{"CollectDurationMs", "CollectGetterErrors", "TablesCollectDurationMs", "TablesCollectGetterErrors"} {
+		if !strings.Contains(buf.String(), `"mysqlstat.`+name+`"`) {
+			t.Error("expected " + name + " in:\n" + buf.String())
+		}
+	}
+}
+
+func TestCombinedOutput(t *testing.T) {
+	db, err := sql.Open("mysql", "root@tcp(127.0.0.1:1)/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m := metrics.NewMetricContext("system")
+	d := dbstat.NewFromDB(m, db)
+	tbl := tablestat.NewFromDB(m, db)
+	d.Metrics.SlaveSecondsBehindMaster.Set(5)
+
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, d, tbl); err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Metrics []struct {
+			Name string `json:"name"`
+		} `json:"metrics"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err.Error() + ": " + buf.String())
+	}
+	seen := make(map[string]bool)
+	for _, metric := range out.Metrics {
+		if seen[metric.Name] {
+			t.Error("metric in JSON output twice: " + metric.Name)
+		}
+		seen[metric.Name] = true
+	}
+	if !seen["mysqlstat.SlaveSecondsBehindMaster"] {
+		t.Error("expected dbstat metrics in JSON output")
+	}
+
+	buf.Reset()
+	if err := writeGraphite(&buf, d, tbl); err != nil {
+		t.Fatal(err)
+	}
+	seen = make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		name := strings.Fields(line)[0]
+		if seen[name] {
+			t.Error("metric in graphite output twice: " + name)
+		}
+		seen[name] = true
+	}
+	if !seen["SlaveSecondsBehindMaster.Value"] {
+		t.Error("expected dbstat metrics in graphite output:\n" + buf.String())
+	}
+}
+
+func TestHistory(t *testing.T) {
+	history := tools.NewHistory(2)
+	start := time.Unix(1400000000, 0)
+	for i := 0; i < 3; i++ {
+		history.Add(start.Add(time.Duration(i)*2*time.Second),
+			map[string]float64{"mysqlstat.Queries": float64(1000 + i)})
+	}
+	mux := newServeMux(nil, nil, history, nil, nil, nil, false)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/history?metric=mysqlstat.Queries", nil)
+	mux.ServeHTTP(rec, req)
+	expected := `{"metric":"mysqlstat.Queries","values":[` +
+		`{"time":"` + start.Add(2*time.Second).Format(time.RFC3339) + `","value":1001},` +
+		`{"time":"` + start.Add(4*time.Second).Format(time.RFC3339) + `","value":1002}]}` + "\n"
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/history", nil)
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Error("expected a missing metric to be rejected, got " + strconv.Itoa(rec.Code))
+	}
+
+	//no history kept
+	req, _ = http.NewRequest("GET", "/api/v1/history?metric=mysqlstat.Queries", nil)
+	if _, pattern := newServeMux(nil, nil, nil, nil, nil, nil, false).Handler(req); pattern != "" {
+		t.Error("history route should not be registered without history")
+	}
+}
+
+//Test that a group matching setters, such as SetLargeTableBytes, only
+// runs the getters
+func TestCallGroupGetters(t *testing.T) {
+	db, err := sql.Open("mysql", "root@tcp(127.0.0.1:1)/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m := metrics.NewMetricContext("system")
+	d := dbstat.NewFromDB(m, db)
+	tbl := tablestat.NewFromDB(m, db)
+	if err := callGroup(d, tbl, "Table"); err != nil {
+		t.Fatal(err)
+	}
+	//nothing can be queried, so every getter that ran failed
+	failed := tbl.LastErrors()
+	if _, ok := failed["GetTableSizes"]; !ok {
+		t.Error("expected GetTableSizes to run")
+	}
+	for name := range failed {
+		if !strings.HasPrefix(name, "Get") || !strings.Contains(name, "Table") {
+			t.Error("unexpected getter run for group Table: " + name)
+		}
+	}
+}
+
+//Test that groups naming SetSkipGetters of either collector don't call
+// it, Skip only matching the GetSkipCounter getter
+func TestCallGroupSkipGetters(t *testing.T) {
+	db, err := sql.Open("mysql", "root@tcp(127.0.0.1:1)/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m := metrics.NewMetricContext("system")
+	d := dbstat.NewFromDB(m, db)
+	tbl := tablestat.NewFromDB(m, db)
+	if err := callGroup(d, tbl, "Skip"); err != nil {
+		t.Fatal(err)
+	}
+	if failed := d.LastErrors(); len(failed) != 1 || failed["GetSkipCounter"] == nil {
+		t.Error("expected only GetSkipCounter to run, got:", failed)
+	}
+	if err := callGroup(d, tbl, "Getters"); err == nil {
+		t.Error("expected no getter to match Getters")
+	}
+}
@@ -4,15 +4,18 @@
 package tablestat
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/measure/metrics"
 	"github.com/measure/mysql/tools"
@@ -37,48 +40,320 @@ SELECT table_schema AS db, table_name AS tbl,
        rows_read, rows_changed, rows_changed_x_indexes  
   FROM INFORMATION_SCHEMA.TABLE_STATISTICS
  WHERE rows_read > 0;`
-	defaultMaxConns = 5
+	tblAgesQuery = `
+    SELECT table_schema AS db, table_name AS tbl,
+           TIMESTAMPDIFF(SECOND, update_time, NOW()) AS update_age,
+           TIMESTAMPDIFF(SECOND, check_time, NOW()) AS check_age
+      FROM information_schema.TABLES
+     WHERE table_schema NOT IN ('performance_schema', 'information_schema', 'mysql')
+       AND (update_time IS NOT NULL OR check_time IS NOT NULL);`
+	tblsWithoutPKQuery = `
+    SELECT t.table_schema AS db, t.table_name AS tbl, t.table_rows AS tbl_rows
+      FROM information_schema.TABLES t
+      LEFT JOIN information_schema.TABLE_CONSTRAINTS c
+        ON c.table_schema = t.table_schema AND c.table_name = t.table_name
+       AND c.constraint_type IN ('PRIMARY KEY', 'UNIQUE')
+     WHERE t.table_schema NOT IN ('performance_schema', 'information_schema', 'mysql')
+       AND t.engine = 'InnoDB' AND t.table_type = 'BASE TABLE'
+       AND c.constraint_name IS NULL
+     ORDER BY t.table_rows DESC;`
+	//LIMIT is maxIOTables
+	tblIOQuery = `
+    SELECT object_schema AS db, object_name AS tbl, count_read, count_write
+      FROM performance_schema.table_io_waits_summary_by_table
+     WHERE object_schema NOT IN ('performance_schema', 'information_schema', 'mysql')
+       AND count_star > 0
+     ORDER BY count_star DESC
+     LIMIT 100;`
+	//tables with the most IO that get IO metrics, so busy servers with
+	// many tables don't create a metric per table
+	maxIOTables = 100
+	//ENCRYPTION='Y' is in the create options of encrypted tables
+	tblEncryptionQuery = `
+    SELECT table_schema AS db, table_name AS tbl, create_options
+      FROM information_schema.TABLES
+     WHERE table_schema NOT IN ('performance_schema', 'information_schema', 'mysql', 'sys')
+       AND engine = 'InnoDB' AND table_type = 'BASE TABLE';`
+	//a row per index column, so indexes and tables are counted distinct
+	indexTypesQuery = `
+    SELECT index_type,
+           COUNT(DISTINCT table_schema, table_name) AS tables,
+           COUNT(DISTINCT table_schema, table_name, index_name) AS indexes
+      FROM information_schema.STATISTICS
+     WHERE table_schema NOT IN ('performance_schema', 'information_schema', 'mysql', 'sys')
+       AND index_type IN ('FULLTEXT', 'SPATIAL')
+     GROUP BY index_type;`
+	//the cardinality of an index is that of its last column, which is
+	// also the highest. LIMIT is maxCardinalityIndexes
+	indexCardinalityQuery = `
+    SELECT table_schema AS db, table_name AS tbl, index_name AS idx,
+           MAX(cardinality) AS cardinality
+      FROM information_schema.STATISTICS
+     WHERE table_schema NOT IN ('performance_schema', 'information_schema', 'mysql', 'sys')
+       AND cardinality IS NOT NULL
+     GROUP BY table_schema, table_name, index_name
+     ORDER BY cardinality DESC
+     LIMIT 1000;`
+	//indexes with the highest cardinality that are tracked between
+	// collections and get cardinality metrics
+	maxCardinalityIndexes = 1000
+	//change in cardinality since the last collection, in percent, above
+	// which an index's statistics are reported as stale
+	staleStatsChangePct = 50
+	//tables that get an Encrypted metric, unencrypted ones first. the
+	// counts cover every table
+	maxEncryptionTables = 1000
+	defaultMaxConns     = 5
+
+	//digits after the decimal point used when formatting non-integer values
+	defaultFormatPrecision = 5
 )
 
+//main query run by each getter, which SetQuery can replace
+var getterQueries = map[string]string{
+	"GetDBSizes":          dbSizesQuery,
+	"GetIndexCardinality": indexCardinalityQuery,
+	"GetIndexTypes":       indexTypesQuery,
+	"GetTableAges":        tblAgesQuery,
+	"GetTableEncryption":  tblEncryptionQuery,
+	"GetTableIO":          tblIOQuery,
+	"GetTableSizes":       tblSizesQuery,
+	"GetTableStatistics":  tblStatisticsQuery,
+	"GetTablesWithoutPK":  tblsWithoutPKQuery,
+}
+
+//what each getter parses out of its main query, checked by CheckQueries
+var getterColumns = map[string]tools.Expected{
+	"GetDBSizes":          {Columns: []string{"db", "db_size_bytes"}},
+	"GetIndexCardinality": {Columns: []string{"db", "tbl", "idx", "cardinality"}},
+	"GetIndexTypes":       {Columns: []string{"index_type", "tables", "indexes"}},
+	"GetTableAges":        {Columns: []string{"db", "tbl", "update_age", "check_age"}},
+	"GetTableEncryption":  {Columns: []string{"db", "tbl", "create_options"}},
+	"GetTableIO":          {Columns: []string{"db", "tbl", "count_read", "count_write"}, Optional: true},
+	"GetTableSizes":       {Columns: []string{"db", "tbl", "tbl_size_bytes"}},
+	"GetTableStatistics":  {Columns: []string{"db", "tbl", "rows_read", "rows_changed", "rows_changed_x_indexes"}, Optional: true},
+	"GetTablesWithoutPK":  {Columns: []string{"db", "tbl", "tbl_rows"}},
+}
+
 // MysqlStatTables - main struct that contains connection to database, metric context, and map to database stats struct
 type MysqlStatTables struct {
-	DBs   map[string]*DBStats
-	m     *metrics.MetricContext
-	db    tools.MysqlDB
-	nLock *sync.Mutex
-	wg    sync.WaitGroup
+	DBs     map[string]*DBStats
+	m       *metrics.MetricContext
+	db      tools.MysqlDB
+	nLock   *sync.Mutex
+	wg      sync.WaitGroup
+	errLock sync.Mutex
+	errs    tools.GetterErrors //errors hit by each getter during the last Collect
+
+	formatLock   sync.Mutex //guards precision and units, which a reload changes while output is formatted
+	precision    int        //digits after the decimal point in formatted output
+	precisionSet bool
+	units        tools.Units //units of sizes and ages in formatted output
+
+	queryTimeout time.Duration //how long a query may run, see SetQueryTimeout
+	maxConns     int           //connections db may open, 0 until SetMaxConnections is called
+
+	namespace string //set when several collectors share a metric context
+	target    string //user@host, for String
+
+	queryLock sync.Mutex
+	queries   map[string]string //queries set with SetQuery, by the query they replace
+
+	Server *MysqlStatServer
+
+	pkOffenders int //largest tables without a primary key to log, 0 logs none
+
+	largeTableBytes float64 //tables larger than this are counted and logged, 0 turns it off
+
+	cardLock        sync.Mutex
+	prevCardinality map[string]float64 //cardinality at the last collection, by db.tbl.idx
+
+	skipLock    sync.Mutex
+	skipGetters map[string]bool //getters Collect doesn't run, see SetSkipGetters
+
+	filterLock sync.Mutex
+	filter     Filter //databases and tables collected, see SetFilter
+
+	timestamps     bool      //end graphite lines with the collection time
+	graphitePrefix string    //put before every graphite name, see SetGraphitePrefix
+	collectedAt    time.Time //start of the last Collect
+
+	namesLock     sync.Mutex
+	graphiteNames *tools.NameSanitizer //builds database and table names in graphite output
+	jsonNames     *tools.NameSanitizer //builds database and table names in JSON output
+	promNames     *tools.NameSanitizer //builds metric names in Prometheus output
 }
 
 //database stats struct
 //contains metrics for databases and map to tables stats struct
 type DBStats struct {
 	Tables  map[string]*MysqlStatPerTable
+	IO      map[string]*MysqlStatPerTableIO //tables among the busiest on the server, by table
+	Indexes map[string]*MysqlStatPerIndex   //indexes with the highest cardinality, by tbl.idx
 	Metrics *MysqlStatPerDB
 }
 
 //  MysqlStatPerTable - metrics for each table
 type MysqlStatPerTable struct {
-	SizeBytes           *metrics.Gauge
+	SizeBytes           *metrics.Gauge `unit:"bytes"`
 	RowsRead            *metrics.Counter
 	RowsChanged         *metrics.Counter
 	RowsChangedXIndexes *metrics.Counter
+	UpdateAgeSec        *metrics.Gauge `unit:"s"`
+	CheckAgeSec         *metrics.Gauge `unit:"s"`
+	Encrypted           *metrics.Gauge //1 if the table is encrypted at rest
+}
+
+// MysqlStatServer - metrics aggregated over every database
+type MysqlStatServer struct {
+	TablesWithoutPK        *metrics.Gauge
+	EncryptedTablesCount   *metrics.Gauge
+	UnencryptedTablesCount *metrics.Gauge
+	FulltextIndexes        *metrics.Gauge
+	TablesWithFulltext     *metrics.Gauge
+	SpatialIndexes         *metrics.Gauge
+	TablesWithSpatial      *metrics.Gauge
+	StaleStatsTablesCount  *metrics.Gauge //tables with an index whose cardinality changed drastically
+	LargeTablesCount       *metrics.Gauge //tables larger than SetLargeTableBytes
+
+	//set at the end of every Collect, even one where every query failed:
+	// how long it took, and the getters that failed in all collections
+	// so far, one per getter per collection. named apart from dbstat's,
+	// which share the mysqlstat prefix
+	TablesCollectDurationMs   *metrics.Gauge
+	TablesCollectGetterErrors *metrics.Counter
+}
+
+// MysqlStatPerIndex - optimizer statistics of one of the indexes with
+// the highest cardinality
+type MysqlStatPerIndex struct {
+	Cardinality          *metrics.Gauge
+	CardinalityChangePct *metrics.Gauge //change since the last collection
+}
+
+// MysqlStatPerTableIO - reads and writes of one of the busiest tables,
+// from performance_schema
+type MysqlStatPerTableIO struct {
+	IOReads   *metrics.Counter
+	IOWrites  *metrics.Counter
+	IOReadPct *metrics.Gauge //share of the table's IO that was reads
 }
 
 // MysqlStatPerDB - metrics for each database
 type MysqlStatPerDB struct {
-	SizeBytes *metrics.Gauge
+	SizeBytes *metrics.Gauge `unit:"bytes"`
+}
+
+// Filter - the databases and tables to collect metrics for. Rows of
+// others are dropped once a query returns. A nil pattern matches every
+// name, so the zero Filter collects everything. Server wide counts of
+// index types aren't filtered
+type Filter struct {
+	DBInclude    *regexp.Regexp //when set, only databases matching it
+	DBExclude    *regexp.Regexp //no databases matching it
+	TableInclude *regexp.Regexp //when set, only tables whose name matches it
+	TableExclude *regexp.Regexp //no tables whose name matches it
+}
+
+//compiles the patterns of a Filter. empty patterns are left nil, and a
+// pattern that doesn't compile is an error naming it
+func NewFilter(dbInclude, dbExclude, tableInclude, tableExclude string) (Filter, error) {
+	var f Filter
+	for _, p := range []struct {
+		name, pattern string
+		re            **regexp.Regexp
+	}{
+		{"database include", dbInclude, &f.DBInclude},
+		{"database exclude", dbExclude, &f.DBExclude},
+		{"table include", tableInclude, &f.TableInclude},
+		{"table exclude", tableExclude, &f.TableExclude},
+	} {
+		if p.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.pattern)
+		if err != nil {
+			return Filter{}, errors.New("invalid " + p.name + " pattern " + p.pattern + ": " + err.Error())
+		}
+		*p.re = re
+	}
+	return f, nil
+}
+
+//reports whether f collects the database dbname and, unless tblname is
+// empty, its table tblname
+func (f Filter) Match(dbname, tblname string) bool {
+	if (f.DBInclude != nil && !f.DBInclude.MatchString(dbname)) ||
+		(f.DBExclude != nil && f.DBExclude.MatchString(dbname)) {
+		return false
+	}
+	if tblname == "" {
+		return true
+	}
+	return (f.TableInclude == nil || f.TableInclude.MatchString(tblname)) &&
+		(f.TableExclude == nil || !f.TableExclude.MatchString(tblname))
 }
 
 //initializes mysqlstat
 //takes as input: metrics context, username, password, path to config file for
 // mysql. username and password can be left as "" if a config file is specified.
 func New(m *metrics.MetricContext, user, password, host, config string) (*MysqlStatTables, error) {
+	return NewWithNamespace(m, "", user, password, host, config)
+}
+
+//initializes mysqlstat with its metrics registered under
+// "mysqlstat.<namespace>.<db>" instead of "mysqlstat.<db>", so several
+// collectors can share a metric context without overwriting each other's
+// metrics. Formatted output is prefixed with the namespace as well.
+func NewWithNamespace(m *metrics.MetricContext, namespace, user, password, host,
+	config string) (*MysqlStatTables, error) {
+	return newMysqlStatTables(m, namespace, user, password, host, config, tools.Options{})
+}
+
+//initializes mysqlstat with connection options such as the charset
+func NewWithOptions(m *metrics.MetricContext, user, password, host, config string,
+	opts tools.Options) (*MysqlStatTables, error) {
+	return newMysqlStatTables(m, "", user, password, host, config, opts)
+}
+
+//initializes mysqlstat on a connection pool the caller already has open.
+// Close leaves db open
+func NewFromDB(m *metrics.MetricContext, db *sql.DB) *MysqlStatTables {
 	s := new(MysqlStatTables)
 	s.m = m
+	s.target = "existing connection"
+	s.nLock = &sync.Mutex{}
+	s.db = tools.NewFromDB(db)
+	s.DBs = make(map[string]*DBStats)
+	return s
+}
+
+//initializes mysqlstat from a dsn, see tools.NewDSN, instead of a config
+// file. a malformed dsn fails with an error wrapping tools.ErrInvalidDSN
+func NewDSN(m *metrics.MetricContext, dsn string) (*MysqlStatTables, error) {
+	s := new(MysqlStatTables)
+	s.m = m
+	s.target = tools.DSNTargetName(dsn)
+	s.nLock = &sync.Mutex{}
+	var err error
+	s.db, err = tools.NewDSN(dsn)
+	s.DBs = make(map[string]*DBStats)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newMysqlStatTables(m *metrics.MetricContext, namespace, user, password, host, config string,
+	opts tools.Options) (*MysqlStatTables, error) {
+	s := new(MysqlStatTables)
+	s.m = m
+	s.namespace = namespace
+	s.target = tools.TargetName(user, host)
 	s.nLock = &sync.Mutex{}
 	// connect to database
 	var err error
-	s.db, err = tools.New(user, password, host, config)
+	s.db, err = tools.NewWithOptions(user, password, host, config, opts)
 	s.nLock.Lock()
 	s.DBs = make(map[string]*DBStats)
 	s.nLock.Unlock()
@@ -88,42 +363,364 @@ func New(m *metrics.MetricContext, user, password, host, config string) (*MysqlS
 	return s, nil
 }
 
-// Set the max number of concurrent connections that the mysql client can use
+// Set the max number of concurrent connections that the mysql client can use.
+// Kept across SetDB
 func (s *MysqlStatTables) SetMaxConnections(maxConns int) {
+	s.maxConns = maxConns
 	s.db.SetMaxConnections(maxConns)
 }
 
+// Give up on a query that runs longer than timeout, and kill it on the
+// server. The getter that ran it records the error and its metrics keep
+// their last values. 0 lets queries run as long as they take. Kept
+// across SetDB
+func (s *MysqlStatTables) SetQueryTimeout(timeout time.Duration) {
+	s.queryTimeout = timeout
+	s.db.SetQueryTimeout(timeout)
+}
+
+// Set the number of digits written after the decimal point for
+// non-integer values in formatted output. Whole numbers are always
+// written without a decimal point.
+func (s *MysqlStatTables) SetFormatPrecision(precision int) {
+	s.formatLock.Lock()
+	s.precision = precision
+	s.precisionSet = true
+	s.formatLock.Unlock()
+}
+
+// Output sizes and ages in the units of u rather than bytes and seconds
+func (s *MysqlStatTables) SetUnits(u tools.Units) {
+	s.formatLock.Lock()
+	s.units = u
+	s.formatLock.Unlock()
+}
+
+// Replace the main query of the getter named method, for example
+// "GetTableSizes". The getter parses the result as before, so the
+// query must return the same column names.
+func (s *MysqlStatTables) SetQuery(method, query string) error {
+	def, ok := getterQueries[method]
+	if !ok {
+		return errors.New("no query to override for " + method)
+	}
+	s.queryLock.Lock()
+	if s.queries == nil {
+		s.queries = make(map[string]string)
+	}
+	s.queries[def] = query
+	s.queryLock.Unlock()
+	return nil
+}
+
+//returns the query set to replace def, or def itself
+func (s *MysqlStatTables) query(def string) string {
+	s.queryLock.Lock()
+	defer s.queryLock.Unlock()
+	if q, ok := s.queries[def]; ok {
+		return q
+	}
+	return def
+}
+
+//runs the query of every getter, including queries set with SetQuery,
+// and returns the results without parsing them into metrics
+func (s *MysqlStatTables) DumpRaw() map[string]tools.RawResult {
+	queries := make(map[string]string)
+	for method, def := range getterQueries {
+		queries[method] = s.query(def)
+	}
+	return tools.QueryRaw(s.db, queries)
+}
+
+// Run the query of every getter once and check it returned the columns
+// the getter parses
+func (s *MysqlStatTables) CheckQueries() []tools.GetterCheck {
+	return tools.CheckColumns(s.DumpRaw(), getterColumns)
+}
+
+// Log the names of the n largest InnoDB tables that have neither a
+// primary nor a unique key each time they are counted. 0 turns it off.
+func (s *MysqlStatTables) SetLogTablesWithoutPK(n int) {
+	s.pkOffenders = n
+}
+
+// Count the tables larger than bytes in LargeTablesCount, and log their
+// names each time they are counted, to catch tables that grew
+// unexpectedly without a metric per table. 0 turns it off.
+func (s *MysqlStatTables) SetLargeTableBytes(bytes int64) {
+	s.largeTableBytes = float64(bytes)
+}
+
+// End each line of graphite output with the Unix time of the last
+// collection, as the plaintext protocol expects
+func (s *MysqlStatTables) SetGraphiteTimestamp(on bool) {
+	s.timestamps = on
+}
+
+// Put prefix, e.g. "mysql.<hostname>", and a dot before every name in
+// graphite output, ahead of any namespace. An empty prefix adds nothing
+func (s *MysqlStatTables) SetGraphitePrefix(prefix string) {
+	s.graphitePrefix = tools.GraphiteName(prefix)
+}
+
+// Returns when the last Collect started, or the zero time if
+// Collect hasn't run
+func (s *MysqlStatTables) CollectedAt() time.Time {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.collectedAt
+}
+
+//returns " <unix time>" of the last collection when timestamps are on,
+// or the current time if nothing has been collected with Collect
+func (s *MysqlStatTables) graphiteTimestamp() string {
+	if !s.timestamps {
+		return ""
+	}
+	t := s.CollectedAt()
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return " " + strconv.FormatInt(t.Unix(), 10)
+}
+
+// Apply policy to database and table names in every output format.
+// By default graphite output uses tools.NamesGraphite and JSON output
+// keeps names as they are.
+func (s *MysqlStatTables) SetNamePolicy(policy tools.NamePolicy) {
+	s.namesLock.Lock()
+	s.graphiteNames = tools.NewNameSanitizer(policy)
+	s.jsonNames = tools.NewNameSanitizer(policy)
+	s.namesLock.Unlock()
+}
+
+//returns the name sanitizers for graphite and JSON output
+func (s *MysqlStatTables) sanitizers() (*tools.NameSanitizer, *tools.NameSanitizer) {
+	s.namesLock.Lock()
+	defer s.namesLock.Unlock()
+	if s.graphiteNames == nil {
+		s.graphiteNames = tools.NewNameSanitizer(tools.NamesGraphite)
+	}
+	if s.jsonNames == nil {
+		s.jsonNames = tools.NewNameSanitizer(tools.NamesRaw)
+	}
+	return s.graphiteNames, s.jsonNames
+}
+
+//returns the sanitizer for Prometheus output, which keeps the names it
+// gave out between scrapes
+func (s *MysqlStatTables) prometheusNames() *tools.NameSanitizer {
+	s.namesLock.Lock()
+	defer s.namesLock.Unlock()
+	if s.promNames == nil {
+		s.promNames = tools.NewNameSanitizer(tools.NamesPrometheus)
+	}
+	return s.promNames
+}
+
+// Describes the collector's target and settings for log lines. It never
+// includes the password
+func (s *MysqlStatTables) String() string {
+	parts := []string{"target " + s.target}
+	if s.namespace != "" {
+		parts = append(parts, "namespace "+s.namespace)
+	}
+	if s.timestamps {
+		parts = append(parts, "graphite timestamps on")
+	}
+	s.queryLock.Lock()
+	var overridden []string
+	for method, def := range getterQueries {
+		if _, ok := s.queries[def]; ok {
+			overridden = append(overridden, method)
+		}
+	}
+	s.queryLock.Unlock()
+	if len(overridden) > 0 {
+		sort.Strings(overridden)
+		parts = append(parts, "queries set for "+strings.Join(overridden, " "))
+	}
+	return "mysqltablestat " + strings.Join(parts, ", ")
+}
+
+//returns the configured output precision, or the default if unset
+func (s *MysqlStatTables) formatPrecision() int {
+	s.formatLock.Lock()
+	defer s.formatLock.Unlock()
+	if !s.precisionSet {
+		return defaultFormatPrecision
+	}
+	return s.precision
+}
+
+//returns the units set with SetUnits
+func (s *MysqlStatTables) formatUnits() tools.Units {
+	s.formatLock.Lock()
+	defer s.formatLock.Unlock()
+	return s.units
+}
+
+//prefix of every metric name, "mysqlstat" or "mysqlstat.<namespace>"
+func (s *MysqlStatTables) metricPrefix() string {
+	if s.namespace == "" {
+		return "mysqlstat"
+	}
+	return "mysqlstat." + s.namespace
+}
+
 //initialize  per database metrics
-func newMysqlStatPerDB(m *metrics.MetricContext, dbname string) *MysqlStatPerDB {
+func newMysqlStatPerDB(m *metrics.MetricContext, prefix, dbname string) *MysqlStatPerDB {
 	o := new(MysqlStatPerDB)
-	misc.InitializeMetrics(o, m, "mysqlstat."+dbname, true)
+	misc.InitializeMetrics(o, m, prefix+"."+dbname, true)
 	return o
 }
 
 //initialize per table metrics
-func newMysqlStatPerTable(m *metrics.MetricContext, dbname, tblname string) *MysqlStatPerTable {
+func newMysqlStatPerTable(m *metrics.MetricContext, prefix, dbname, tblname string) *MysqlStatPerTable {
 	o := new(MysqlStatPerTable)
 
-	misc.InitializeMetrics(o, m, "mysqlstat."+dbname+"."+tblname, true)
+	misc.InitializeMetrics(o, m, prefix+"."+dbname+"."+tblname, true)
 	return o
 }
 
 //collects metrics.
 // sql.DB is thread safe so launching metrics collectors
-// in their own goroutines is safe
-func (s *MysqlStatTables) Collect() {
-	s.wg.Add(3)
-	go s.GetDBSizes()
-	go s.GetTableSizes()
-	go s.GetTableStatistics()
+// in their own goroutines is safe.
+// Returns an error naming every getter that failed.
+func (s *MysqlStatTables) Collect() error {
+	start := time.Now()
+	s.errLock.Lock()
+	s.errs.Reset()
+	s.collectedAt = time.Now()
+	s.errLock.Unlock()
+	skip := s.skippedGetters()
+	s.wg.Add(9)
+	s.runGetter(skip, "GetDBSizes", s.GetDBSizes)
+	s.runGetter(skip, "GetTableSizes", s.GetTableSizes)
+	s.runGetter(skip, "GetTableStatistics", s.GetTableStatistics)
+	s.runGetter(skip, "GetTableAges", s.GetTableAges)
+	s.runGetter(skip, "GetTablesWithoutPK", s.GetTablesWithoutPK)
+	s.runGetter(skip, "GetTableIO", s.GetTableIO)
+	s.runGetter(skip, "GetTableEncryption", s.GetTableEncryption)
+	s.runGetter(skip, "GetIndexTypes", s.GetIndexTypes)
+	s.runGetter(skip, "GetIndexCardinality", s.GetIndexCardinality)
 	s.wg.Wait()
+	s.checkServer()
+	s.Server.TablesCollectGetterErrors.Set(s.errs.Total())
+	s.Server.TablesCollectDurationMs.Set(float64(time.Since(start)) / float64(time.Millisecond))
+	return s.errs.Err()
+}
+
+//starts getter unless it is in skip
+func (s *MysqlStatTables) runGetter(skip map[string]bool, name string, getter func()) {
+	if skip[name] {
+		s.wg.Done()
+		return
+	}
+	go getter()
+}
+
+//returns a copy of the getters turned off with SetSkipGetters
+func (s *MysqlStatTables) skippedGetters() map[string]bool {
+	s.skipLock.Lock()
+	defer s.skipLock.Unlock()
+	skip := make(map[string]bool)
+	for name := range s.skipGetters {
+		skip[name] = true
+	}
+	return skip
+}
+
+// Don't run the getters named in names, e.g. GetTableSizes, in Collect.
+// Their metrics keep the last value collected. Replaces the names set by
+// an earlier call
+func (s *MysqlStatTables) SetSkipGetters(names []string) {
+	s.skipLock.Lock()
+	defer s.skipLock.Unlock()
+	s.skipGetters = make(map[string]bool)
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			s.skipGetters[name] = true
+		}
+	}
+}
+
+// Only collect metrics for the databases and tables f matches. Metrics
+// already collected for others are dropped from output. The zero Filter,
+// the default, collects everything
+func (s *MysqlStatTables) SetFilter(f Filter) {
+	s.filterLock.Lock()
+	s.filter = f
+	s.filterLock.Unlock()
+	s.nLock.Lock()
+	defer s.nLock.Unlock()
+	for dbname, db := range s.DBs {
+		if !f.Match(dbname, "") {
+			delete(s.DBs, dbname)
+			continue
+		}
+		for tblname := range db.Tables {
+			if !f.Match(dbname, tblname) {
+				delete(db.Tables, tblname)
+			}
+		}
+		for tblname := range db.IO {
+			if !f.Match(dbname, tblname) {
+				delete(db.IO, tblname)
+			}
+		}
+		for key := range db.Indexes {
+			if !f.Match(dbname, strings.SplitN(key, ".", 2)[0]) {
+				delete(db.Indexes, key)
+			}
+		}
+	}
+}
+
+//reports whether the filter set with SetFilter collects dbname and,
+// unless tblname is empty, its table tblname
+func (s *MysqlStatTables) collects(dbname, tblname string) bool {
+	s.filterLock.Lock()
+	defer s.filterLock.Unlock()
+	return s.filter.Match(dbname, tblname)
+}
+
+// Collect over db from now on, e.g. after connection settings changed,
+// and close the connection used before. Metrics and settings are kept.
+// Call it between collections
+func (s *MysqlStatTables) SetDB(db tools.MysqlDB) {
+	old := s.db
+	s.db = db
+	s.db.SetQueryTimeout(s.queryTimeout)
+	if s.maxConns > 0 {
+		s.db.SetMaxConnections(s.maxConns)
+	}
+	if old != nil {
+		old.Close()
+	}
+}
+
+//records an error returned by a query against the getter that made it
+// and logs it
+func (s *MysqlStatTables) logError(err error) {
+	name := s.errs.Record(err)
+	s.db.Log(name + ": " + err.Error())
+}
+
+// Returns the error each getter that failed during the last collection
+// hit, by getter name, e.g. GetSlaveStats
+func (s *MysqlStatTables) LastErrors() map[string]error {
+	return s.errs.Last()
 }
 
 //instantiate database metrics struct
 func (s *MysqlStatTables) initializeDB(dbname string) *DBStats {
 	n := new(DBStats)
-	n.Metrics = newMysqlStatPerDB(s.m, dbname)
+	n.Metrics = newMysqlStatPerDB(s.m, s.metricPrefix(), dbname)
 	n.Tables = make(map[string]*MysqlStatPerTable)
+	n.IO = make(map[string]*MysqlStatPerTableIO)
+	n.Indexes = make(map[string]*MysqlStatPerIndex)
 	return n
 }
 
@@ -137,22 +734,61 @@ func (s *MysqlStatTables) checkDB(dbname string) {
 	return
 }
 
+//check if server metrics struct is instantiated, and instantiate if not
+func (s *MysqlStatTables) checkServer() {
+	s.nLock.Lock()
+	if s.Server == nil {
+		s.Server = new(MysqlStatServer)
+		misc.InitializeMetrics(s.Server, s.m, s.metricPrefix(), true)
+	}
+	s.nLock.Unlock()
+}
+
 //check if table struct is instantiated, and instantiate if not
 func (s *MysqlStatTables) checkTable(dbname, tblname string) {
 	s.checkDB(dbname)
 	s.nLock.Lock()
 	if _, ok := s.DBs[dbname].Tables[tblname]; !ok {
-		s.DBs[dbname].Tables[tblname] = newMysqlStatPerTable(s.m, dbname, tblname)
+		s.DBs[dbname].Tables[tblname] = newMysqlStatPerTable(s.m, s.metricPrefix(), dbname, tblname)
 	}
 	s.nLock.Unlock()
 	return
 }
 
+//check if table IO struct is instantiated, and instantiate if not
+func (s *MysqlStatTables) checkTableIO(dbname, tblname string) *MysqlStatPerTableIO {
+	s.checkDB(dbname)
+	s.nLock.Lock()
+	defer s.nLock.Unlock()
+	tio, ok := s.DBs[dbname].IO[tblname]
+	if !ok {
+		tio = new(MysqlStatPerTableIO)
+		misc.InitializeMetrics(tio, s.m, s.metricPrefix()+"."+dbname+"."+tblname, true)
+		s.DBs[dbname].IO[tblname] = tio
+	}
+	return tio
+}
+
+//check if index struct is instantiated, and instantiate if not
+func (s *MysqlStatTables) checkIndex(dbname, tblname, idxname string) *MysqlStatPerIndex {
+	s.checkDB(dbname)
+	s.nLock.Lock()
+	defer s.nLock.Unlock()
+	key := tblname + "." + idxname
+	idx, ok := s.DBs[dbname].Indexes[key]
+	if !ok {
+		idx = new(MysqlStatPerIndex)
+		misc.InitializeMetrics(idx, s.m, s.metricPrefix()+"."+dbname+"."+key, true)
+		s.DBs[dbname].Indexes[key] = idx
+	}
+	return idx
+}
+
 //gets sizes of databases
 func (s *MysqlStatTables) GetDBSizes() {
 	res, err := s.db.QueryReturnColumnDict(innodbMetadataCheck)
 	if err != nil {
-		s.db.Log(err)
+		s.logError(err)
 		s.wg.Done()
 		return
 	}
@@ -166,15 +802,18 @@ func (s *MysqlStatTables) GetDBSizes() {
 		break
 	}
 
-	res, err = s.db.QueryMapFirstColumnToRow(dbSizesQuery)
+	res, err = s.db.QueryMapFirstColumnToRow(s.query(dbSizesQuery))
 	if err != nil {
-		s.db.Log(err)
+		s.logError(err)
 		s.wg.Done()
 		return
 	}
 	for key, value := range res {
 		//key being the name of the database, value being its size in bytes
 		dbname := string(key)
+		if !s.collects(dbname, "") {
+			continue
+		}
 		size, _ := strconv.ParseInt(string(value[0]), 10, 64)
 		if size > 0 {
 			s.checkDB(dbname)
@@ -191,7 +830,7 @@ func (s *MysqlStatTables) GetDBSizes() {
 func (s *MysqlStatTables) GetTableSizes() {
 	res, err := s.db.QueryReturnColumnDict(innodbMetadataCheck)
 	if err != nil {
-		s.db.Log(err)
+		s.logError(err)
 		s.wg.Done()
 		return
 	}
@@ -204,17 +843,22 @@ func (s *MysqlStatTables) GetTableSizes() {
 		}
 		break
 	}
-	res, err = s.db.QueryReturnColumnDict(tblSizesQuery)
+	res, err = s.db.QueryReturnColumnDict(s.query(tblSizesQuery))
 	if err != nil {
-		s.db.Log(err)
+		s.logError(err)
 		s.wg.Done()
 		return
 	}
+	type largeTable struct {
+		name string
+		size float64
+	}
+	var large []largeTable
 	tbl_count := len(res["tbl"])
 	for i := 0; i < tbl_count; i++ {
 		dbname := string(res["db"][i])
 		tblname := string(res["tbl"][i])
-		if res["tbl_size_bytes"][i] == "" {
+		if res["tbl_size_bytes"][i] == "" || !s.collects(dbname, tblname) {
 			continue
 		}
 		s.checkDB(dbname)
@@ -228,21 +872,359 @@ func (s *MysqlStatTables) GetTableSizes() {
 			s.DBs[dbname].Tables[tblname].SizeBytes.Set(float64(size))
 			s.nLock.Unlock()
 		}
+		if s.largeTableBytes > 0 && float64(size) > s.largeTableBytes {
+			large = append(large, largeTable{dbname + "." + tblname, float64(size)})
+		}
+	}
+	if s.largeTableBytes > 0 {
+		s.checkServer()
+		s.Server.LargeTablesCount.Set(float64(len(large)))
+	}
+	if len(large) > 0 {
+		sort.Slice(large, func(a, b int) bool { return large[a].size > large[b].size })
+		names := make([]string, len(large))
+		for i, tbl := range large {
+			names[i] = tbl.name + " (" + strconv.FormatFloat(tbl.size, 'f', 0, 64) + " bytes)"
+		}
+		s.db.Log("tables larger than " + strconv.FormatFloat(s.largeTableBytes, 'f', 0, 64) +
+			" bytes: " + strings.Join(names, ", "))
+	}
+	s.wg.Done()
+	return
+}
+
+//gets seconds since each table was last updated and last checked.
+// update_time is NULL for InnoDB tables on older versions and check_time
+// is NULL for tables that were never checked, those ages are left unset
+func (s *MysqlStatTables) GetTableAges() {
+	res, err := s.db.QueryReturnColumnDict(innodbMetadataCheck)
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	for _, val := range res {
+		if v, _ := strconv.ParseInt(string(val[0]), 10, 64); v == int64(1) {
+			s.db.Log(errors.New("not capturing table ages: innodb_stats_on_metadata = 1"))
+			s.wg.Done()
+			return
+		}
+		break
+	}
+	res, err = s.db.QueryReturnColumnDict(s.query(tblAgesQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	for i, tblname := range res["tbl"] {
+		dbname := res["db"][i]
+		if !s.collects(dbname, tblname) {
+			continue
+		}
+		s.checkTable(dbname, tblname)
+		s.nLock.Lock()
+		tbl := s.DBs[dbname].Tables[tblname]
+		tbl.UpdateAgeSec.Set(s.parseAge(res["update_age"], i))
+		tbl.CheckAgeSec.Set(s.parseAge(res["check_age"], i))
+		s.nLock.Unlock()
+	}
+	s.wg.Done()
+	return
+}
+
+//counts InnoDB tables with neither a primary nor a unique key. Row based
+// replication has to scan such tables for every changed row.
+// The largest are logged when SetLogTablesWithoutPK is set
+func (s *MysqlStatTables) GetTablesWithoutPK() {
+	res, err := s.db.QueryReturnColumnDict(s.query(tblsWithoutPKQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if len(res) == 0 {
+		s.wg.Done()
+		return
+	}
+	var rows []int
+	for i, tblname := range res["tbl"] {
+		if i < len(res["db"]) && s.collects(res["db"][i], tblname) {
+			rows = append(rows, i)
+		}
+	}
+	s.checkServer()
+	s.Server.TablesWithoutPK.Set(float64(len(rows)))
+	if s.pkOffenders > 0 && len(rows) > 0 {
+		var names []string
+		for n, i := range rows {
+			if n == s.pkOffenders {
+				break
+			}
+			tblname := res["tbl"][i]
+			name := res["db"][i] + "." + tblname
+			if i < len(res["tbl_rows"]) && res["tbl_rows"][i] != "" {
+				name += " (" + res["tbl_rows"][i] + " rows)"
+			}
+			names = append(names, name)
+		}
+		s.db.Log("tables without a primary key: " + strings.Join(names, ", "))
+	}
+	s.wg.Done()
+	return
+}
+
+//gets reads and writes of the maxIOTables tables with the most IO from
+// performance_schema. servers without performance_schema are skipped
+func (s *MysqlStatTables) GetTableIO() {
+	res, err := s.db.QueryReturnColumnDict(s.query(tblIOQuery))
+	if err != nil {
+		//performance_schema is too old or missing
+		if tools.ClassifyError(err) == tools.ErrorUnsupported {
+			s.db.Log(err)
+		} else {
+			s.logError(err)
+		}
+		s.wg.Done()
+		return
+	}
+	type tableIO struct {
+		db, tbl       string
+		reads, writes uint64
+	}
+	var tables []tableIO
+	for i, tblname := range res["tbl"] {
+		row := tools.NewResultRow(res, i, s.db.Log)
+		dbname, ok := row.String("db")
+		if !ok {
+			break
+		}
+		reads, rok := row.Uint("count_read")
+		writes, wok := row.Uint("count_write")
+		if !rok || !wok || !s.collects(dbname, tblname) {
+			continue
+		}
+		tables = append(tables, tableIO{dbname, tblname, reads, writes})
+	}
+	//the query is already ordered, unless it was replaced with SetQuery
+	sort.SliceStable(tables, func(i, j int) bool {
+		return tables[i].reads+tables[i].writes > tables[j].reads+tables[j].writes
+	})
+	if len(tables) > maxIOTables {
+		tables = tables[:maxIOTables]
+	}
+	for _, tbl := range tables {
+		tio := s.checkTableIO(tbl.db, tbl.tbl)
+		tio.IOReads.Set(tbl.reads)
+		tio.IOWrites.Set(tbl.writes)
+		if total := tbl.reads + tbl.writes; total > 0 {
+			tio.IOReadPct.Set(float64(tbl.reads) / float64(total) * 100)
+		}
+	}
+	s.wg.Done()
+	return
+}
+
+//counts InnoDB tables that are and aren't encrypted at rest, and sets
+// Encrypted on up to maxEncryptionTables tables, unencrypted ones first
+func (s *MysqlStatTables) GetTableEncryption() {
+	res, err := s.db.QueryReturnColumnDict(s.query(tblEncryptionQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if len(res) == 0 {
+		s.wg.Done()
+		return
+	}
+	type tableEncryption struct {
+		db, tbl   string
+		encrypted bool
+	}
+	var tables []tableEncryption
+	encrypted := 0
+	for i, tblname := range res["tbl"] {
+		if i >= len(res["db"]) || i >= len(res["create_options"]) {
+			break
+		}
+		if !s.collects(res["db"][i], tblname) {
+			continue
+		}
+		opts := strings.ToUpper(strings.Replace(res["create_options"][i], `"`, "'", -1))
+		tbl := tableEncryption{res["db"][i], tblname, strings.Contains(opts, "ENCRYPTION='Y'")}
+		if tbl.encrypted {
+			encrypted++
+		}
+		tables = append(tables, tbl)
+	}
+	s.checkServer()
+	s.Server.EncryptedTablesCount.Set(float64(encrypted))
+	s.Server.UnencryptedTablesCount.Set(float64(len(tables) - encrypted))
+	sort.SliceStable(tables, func(i, j int) bool {
+		return !tables[i].encrypted && tables[j].encrypted
+	})
+	if len(tables) > maxEncryptionTables {
+		tables = tables[:maxEncryptionTables]
+	}
+	for _, tbl := range tables {
+		s.checkTable(tbl.db, tbl.tbl)
+		s.nLock.Lock()
+		if tbl.encrypted {
+			s.DBs[tbl.db].Tables[tbl.tbl].Encrypted.Set(float64(1))
+		} else {
+			s.DBs[tbl.db].Tables[tbl.tbl].Encrypted.Set(float64(0))
+		}
+		s.nLock.Unlock()
+	}
+	s.wg.Done()
+	return
+}
+
+//counts FULLTEXT and SPATIAL indexes and the tables that have them.
+// FULLTEXT indexes are maintained through their own auxiliary tables and
+// caches, so writes to those tables behave differently
+func (s *MysqlStatTables) GetIndexTypes() {
+	res, err := s.db.QueryReturnColumnDict(s.query(indexTypesQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if len(res) == 0 {
+		s.wg.Done()
+		return
+	}
+	s.checkServer()
+	types := map[string][2]*metrics.Gauge{
+		"FULLTEXT": {s.Server.FulltextIndexes, s.Server.TablesWithFulltext},
+		"SPATIAL":  {s.Server.SpatialIndexes, s.Server.TablesWithSpatial},
+	}
+	//types without a row have no indexes
+	for _, gauges := range types {
+		gauges[0].Set(float64(0))
+		gauges[1].Set(float64(0))
+	}
+	for i, indexType := range res["index_type"] {
+		gauges, ok := types[strings.ToUpper(indexType)]
+		if !ok {
+			continue
+		}
+		row := tools.NewResultRow(res, i, s.db.Log)
+		if indexes, ok := row.Float("indexes"); ok {
+			gauges[0].Set(indexes)
+		}
+		if tables, ok := row.Float("tables"); ok {
+			gauges[1].Set(tables)
+		}
 	}
 	s.wg.Done()
 	return
 }
 
+//gets the cardinality of the maxCardinalityIndexes indexes with the
+// highest cardinality and compares it with the last collection. Tables
+// with an index whose cardinality changed by more than staleStatsChangePct
+// are counted in StaleStatsTablesCount, as their statistics likely need
+// ANALYZE TABLE
+func (s *MysqlStatTables) GetIndexCardinality() {
+	res, err := s.db.QueryReturnColumnDict(s.query(indexCardinalityQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if len(res) == 0 {
+		s.wg.Done()
+		return
+	}
+	type index struct {
+		db, tbl, idx string
+		cardinality  float64
+	}
+	var indexes []index
+	for i, tblname := range res["tbl"] {
+		row := tools.NewResultRow(res, i, s.db.Log)
+		dbname, ok := row.String("db")
+		if !ok {
+			break
+		}
+		idxname, iok := row.String("idx")
+		cardinality, cok := row.Float("cardinality")
+		if !iok || !cok || !s.collects(dbname, tblname) {
+			continue
+		}
+		indexes = append(indexes, index{dbname, tblname, idxname, cardinality})
+	}
+	//the query is already ordered, unless it was replaced with SetQuery
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return indexes[i].cardinality > indexes[j].cardinality
+	})
+	if len(indexes) > maxCardinalityIndexes {
+		indexes = indexes[:maxCardinalityIndexes]
+	}
+	s.cardLock.Lock()
+	prev := s.prevCardinality
+	s.prevCardinality = make(map[string]float64, len(indexes))
+	for _, ix := range indexes {
+		s.prevCardinality[ix.db+"."+ix.tbl+"."+ix.idx] = ix.cardinality
+	}
+	s.cardLock.Unlock()
+	stale := make(map[string]bool)
+	for _, ix := range indexes {
+		m := s.checkIndex(ix.db, ix.tbl, ix.idx)
+		m.Cardinality.Set(ix.cardinality)
+		old, ok := prev[ix.db+"."+ix.tbl+"."+ix.idx]
+		if !ok {
+			continue
+		}
+		pct := math.Abs(ix.cardinality-old) / math.Max(old, 1) * 100
+		m.CardinalityChangePct.Set(pct)
+		if pct > staleStatsChangePct {
+			stale[ix.db+"."+ix.tbl] = true
+			s.db.Log(fmt.Sprintf("cardinality of index %s on %s.%s changed from %v to %v",
+				ix.idx, ix.db, ix.tbl, old, ix.cardinality))
+		}
+	}
+	//nothing to compare with on the first collection
+	if prev != nil {
+		s.checkServer()
+		s.Server.StaleStatsTablesCount.Set(float64(len(stale)))
+	}
+	s.wg.Done()
+	return
+}
+
+//returns the age in row i of col, or NaN when it is NULL
+func (s *MysqlStatTables) parseAge(col []string, i int) float64 {
+	if i >= len(col) || col[i] == "" {
+		return math.NaN()
+	}
+	age, err := strconv.ParseFloat(col[i], 64)
+	if err != nil {
+		s.db.Log(err)
+		return math.NaN()
+	}
+	return age
+}
+
 //get table statistics: rows read, rows changed, rows changed x indices
 func (s *MysqlStatTables) GetTableStatistics() {
-	res, err := s.db.QueryReturnColumnDict(tblStatisticsQuery)
-	if len(res) == 0 || err != nil {
-		s.db.Log(err)
+	res, err := s.db.QueryReturnColumnDict(s.query(tblStatisticsQuery))
+	if err != nil {
+		s.logError(err)
+		s.wg.Done()
+		return
+	}
+	if len(res) == 0 {
 		s.wg.Done()
 		return
 	}
 	for i, tblname := range res["tbl"] {
 		dbname := res["db"][i]
+		if !s.collects(dbname, tblname) {
+			continue
+		}
 		rows_read, err := strconv.ParseInt(res["rows_read"][i], 10, 64)
 		if err != nil {
 			s.db.Log(err)
@@ -281,20 +1263,25 @@ func (s *MysqlStatTables) GetTableStatistics() {
 	return
 }
 
-//Closes connection with database
+//Closes connection with database. Closing again does nothing, as for
+// any tools.MysqlDB, and a Collect still running fails its remaining
+// queries
 func (s *MysqlStatTables) Close() {
 	s.db.Close()
 }
 
 //CallByMethodName searches for a method implemented
 // by s with name. Runs all methods that match names.
+// Returns an error if none match
 func (s *MysqlStatTables) CallByMethodName(name string) error {
 	r := reflect.TypeOf(s)
-	re := regexp.MustCompile(strings.ToLower(name))
+	re, err := regexp.Compile(strings.ToLower(name))
+	if err != nil {
+		return err
+	}
 	f := false
 	for i := 0; i < r.NumMethod(); i++ {
-		n := strings.ToLower(r.Method(i).Name)
-		if strings.Contains(n, "get") && re.MatchString(n) {
+		if isGetter(r.Method(i)) && re.MatchString(strings.ToLower(r.Method(i).Name)) {
 			s.wg.Add(1)
 			reflect.ValueOf(s).Method(i).Call([]reflect.Value{})
 			f = true
@@ -306,27 +1293,178 @@ func (s *MysqlStatTables) CallByMethodName(name string) error {
 	return nil
 }
 
+//getters are the methods named Get... taking no arguments, so a
+// group can't match a setter such as SetLargeTableBytes. the method's
+// type includes the receiver
+func isGetter(m reflect.Method) bool {
+	return strings.HasPrefix(m.Name, "Get") && m.Type.NumIn() == 1
+}
+
+//AvailableGroups lists the names of the methods CallByMethodName
+// can run, in sorted order
+func (s *MysqlStatTables) AvailableGroups() []string {
+	r := reflect.TypeOf(s)
+	var groups []string
+	for i := 0; i < r.NumMethod(); i++ {
+		if isGetter(r.Method(i)) {
+			groups = append(groups, r.Method(i).Name)
+		}
+	}
+	return groups
+}
+
 //writes metrics in the form
 // "metric_name metric_value"
-// to the input writer
+// to the input writer, sorted by metric name
 func (s *MysqlStatTables) FormatGraphite(w io.Writer) error {
-	for dbname, db := range s.DBs {
+	out := tools.NewSortedWriter(w)
+	w = out
+	precision := s.formatPrecision()
+	units := s.formatUnits()
+	ts := s.graphiteTimestamp()
+	names, _ := s.sanitizers()
+	nsprefix := ""
+	if s.graphitePrefix != "" {
+		nsprefix = s.graphitePrefix + "."
+	}
+	if s.namespace != "" {
+		nsprefix += s.namespace + "."
+	}
+	if s.Server != nil {
+		for _, m := range []struct {
+			name  string
+			gauge *metrics.Gauge
+		}{
+			{"TablesWithoutPK", s.Server.TablesWithoutPK},
+			{"EncryptedTablesCount", s.Server.EncryptedTablesCount},
+			{"UnencryptedTablesCount", s.Server.UnencryptedTablesCount},
+			{"FulltextIndexes", s.Server.FulltextIndexes},
+			{"TablesWithFulltext", s.Server.TablesWithFulltext},
+			{"SpatialIndexes", s.Server.SpatialIndexes},
+			{"TablesWithSpatial", s.Server.TablesWithSpatial},
+			{"StaleStatsTablesCount", s.Server.StaleStatsTablesCount},
+			{"LargeTablesCount", s.Server.LargeTablesCount},
+			{"TablesCollectDurationMs", s.Server.TablesCollectDurationMs},
+		} {
+			if !math.IsNaN(m.gauge.Get()) {
+				fmt.Fprintln(w, nsprefix+m.name+" "+tools.FormatValue(m.gauge.Get(), precision)+ts)
+			}
+		}
+		fmt.Fprintln(w, nsprefix+"TablesCollectGetterErrors "+strconv.FormatUint(s.Server.TablesCollectGetterErrors.Get(), 10)+ts)
+	}
+	for name, db := range s.DBs {
+		dbname := nsprefix + names.Path(name)
 		if !math.IsNaN(db.Metrics.SizeBytes.Get()) {
 			fmt.Fprintln(w, dbname+".SizeBytes "+
-				strconv.FormatFloat(db.Metrics.SizeBytes.Get(), 'f', 5, 64))
+				tools.FormatValue(units.Convert(db.Metrics.SizeBytes.Get(), tools.UnitBytes), precision)+ts)
 		}
 		for tblname, tbl := range db.Tables {
+			tblpath := nsprefix + names.Path(name, tblname)
 			if !math.IsNaN(tbl.SizeBytes.Get()) {
-				fmt.Fprintln(w, dbname+"."+tblname+".SizeBytes "+
-					strconv.FormatFloat(tbl.SizeBytes.Get(), 'f', 5, 64))
+				fmt.Fprintln(w, tblpath+".SizeBytes "+
+					tools.FormatValue(units.Convert(tbl.SizeBytes.Get(), tools.UnitBytes), precision)+ts)
+			}
+			fmt.Fprintln(w, tblpath+".RowsRead "+
+				strconv.FormatUint(tbl.RowsRead.Get(), 10)+ts)
+			fmt.Fprintln(w, tblpath+".RowsChanged "+
+				strconv.FormatUint(tbl.RowsChanged.Get(), 10)+ts)
+			fmt.Fprintln(w, tblpath+".RowsChangedXIndexes "+
+				strconv.FormatUint(tbl.RowsChangedXIndexes.Get(), 10)+ts)
+			if !math.IsNaN(tbl.UpdateAgeSec.Get()) {
+				fmt.Fprintln(w, tblpath+".UpdateAgeSec "+
+					tools.FormatValue(units.Convert(tbl.UpdateAgeSec.Get(), tools.UnitSeconds), precision)+ts)
+			}
+			if !math.IsNaN(tbl.CheckAgeSec.Get()) {
+				fmt.Fprintln(w, tblpath+".CheckAgeSec "+
+					tools.FormatValue(units.Convert(tbl.CheckAgeSec.Get(), tools.UnitSeconds), precision)+ts)
+			}
+			if !math.IsNaN(tbl.Encrypted.Get()) {
+				fmt.Fprintln(w, tblpath+".Encrypted "+
+					tools.FormatValue(tbl.Encrypted.Get(), precision)+ts)
+			}
+		}
+		for tblname, tio := range db.IO {
+			tblpath := nsprefix + names.Path(name, tblname)
+			fmt.Fprintln(w, tblpath+".IOReads "+strconv.FormatUint(tio.IOReads.Get(), 10)+ts)
+			fmt.Fprintln(w, tblpath+".IOWrites "+strconv.FormatUint(tio.IOWrites.Get(), 10)+ts)
+			if !math.IsNaN(tio.IOReadPct.Get()) {
+				fmt.Fprintln(w, tblpath+".IOReadPct "+tools.FormatValue(tio.IOReadPct.Get(), precision)+ts)
+			}
+		}
+		for key, idx := range db.Indexes {
+			parts := strings.SplitN(key, ".", 2)
+			idxpath := nsprefix + names.Path(name, parts[0], parts[1])
+			fmt.Fprintln(w, idxpath+".Cardinality "+tools.FormatValue(idx.Cardinality.Get(), precision)+ts)
+			if !math.IsNaN(idx.CardinalityChangePct.Get()) {
+				fmt.Fprintln(w, idxpath+".CardinalityChangePct "+
+					tools.FormatValue(idx.CardinalityChangePct.Get(), precision)+ts)
 			}
-			fmt.Fprintln(w, dbname+"."+tblname+".RowsRead "+
-				strconv.FormatUint(tbl.RowsRead.Get(), 10))
-			fmt.Fprintln(w, dbname+"."+tblname+".RowsChanged "+
-				strconv.FormatUint(tbl.RowsChanged.Get(), 10))
-			fmt.Fprintln(w, dbname+"."+tblname+".RowsChangedXIndexes "+
-				strconv.FormatUint(tbl.RowsChangedXIndexes.Get(), 10))
 		}
 	}
-	return nil
+	return out.Flush()
+}
+
+//writes metrics to w as one JSON object per line
+func (s *MysqlStatTables) FormatNDJSON(w io.Writer) error {
+	return tools.WriteNDJSON(w, s.CollectedAt(), nil, s.WriteJSON)
+}
+
+//writes metrics to w in the Prometheus text exposition format, see
+// tools.WritePrometheus
+func (s *MysqlStatTables) FormatPrometheus(w io.Writer) error {
+	return tools.WritePrometheus(w, s.prometheusNames(), s.WriteJSON)
+}
+
+//writes metrics to w as a JSON list of metric records
+func (s *MysqlStatTables) FormatJSON(w io.Writer) error {
+	j := tools.NewJSONWriter(w)
+	s.WriteJSON(j)
+	return j.Close()
+}
+
+//writes a record for each database and table metric to j
+func (s *MysqlStatTables) WriteJSON(j *tools.JSONWriter) {
+	_, names := s.sanitizers()
+	units := s.formatUnits()
+	if s.Server != nil {
+		j.Gauge(s.metricPrefix()+".TablesWithoutPK", s.Server.TablesWithoutPK.Get())
+		j.Gauge(s.metricPrefix()+".EncryptedTablesCount", s.Server.EncryptedTablesCount.Get())
+		j.Gauge(s.metricPrefix()+".UnencryptedTablesCount", s.Server.UnencryptedTablesCount.Get())
+		j.Gauge(s.metricPrefix()+".FulltextIndexes", s.Server.FulltextIndexes.Get())
+		j.Gauge(s.metricPrefix()+".TablesWithFulltext", s.Server.TablesWithFulltext.Get())
+		j.Gauge(s.metricPrefix()+".SpatialIndexes", s.Server.SpatialIndexes.Get())
+		j.Gauge(s.metricPrefix()+".TablesWithSpatial", s.Server.TablesWithSpatial.Get())
+		j.Gauge(s.metricPrefix()+".StaleStatsTablesCount", s.Server.StaleStatsTablesCount.Get())
+		j.Gauge(s.metricPrefix()+".LargeTablesCount", s.Server.LargeTablesCount.Get())
+		j.Gauge(s.metricPrefix()+".TablesCollectDurationMs", s.Server.TablesCollectDurationMs.Get())
+		j.Counter(s.metricPrefix()+".TablesCollectGetterErrors", s.Server.TablesCollectGetterErrors.Get(),
+			s.Server.TablesCollectGetterErrors.ComputeRate())
+	}
+	for dbname, db := range s.DBs {
+		prefix := s.metricPrefix() + "." + names.Path(dbname)
+		j.Gauge(prefix+".SizeBytes", units.Convert(db.Metrics.SizeBytes.Get(), tools.UnitBytes))
+		for tblname, tbl := range db.Tables {
+			tblprefix := s.metricPrefix() + "." + names.Path(dbname, tblname)
+			j.Gauge(tblprefix+".SizeBytes", units.Convert(tbl.SizeBytes.Get(), tools.UnitBytes))
+			j.Counter(tblprefix+".RowsRead", tbl.RowsRead.Get(), tbl.RowsRead.ComputeRate())
+			j.Counter(tblprefix+".RowsChanged", tbl.RowsChanged.Get(), tbl.RowsChanged.ComputeRate())
+			j.Counter(tblprefix+".RowsChangedXIndexes", tbl.RowsChangedXIndexes.Get(),
+				tbl.RowsChangedXIndexes.ComputeRate())
+			j.Gauge(tblprefix+".UpdateAgeSec", units.Convert(tbl.UpdateAgeSec.Get(), tools.UnitSeconds))
+			j.Gauge(tblprefix+".CheckAgeSec", units.Convert(tbl.CheckAgeSec.Get(), tools.UnitSeconds))
+			j.Gauge(tblprefix+".Encrypted", tbl.Encrypted.Get())
+		}
+		for tblname, tio := range db.IO {
+			tblprefix := s.metricPrefix() + "." + names.Path(dbname, tblname)
+			j.Counter(tblprefix+".IOReads", tio.IOReads.Get(), tio.IOReads.ComputeRate())
+			j.Counter(tblprefix+".IOWrites", tio.IOWrites.Get(), tio.IOWrites.ComputeRate())
+			j.Gauge(tblprefix+".IOReadPct", tio.IOReadPct.Get())
+		}
+		for key, idx := range db.Indexes {
+			parts := strings.SplitN(key, ".", 2)
+			idxprefix := s.metricPrefix() + "." + names.Path(dbname, parts[0], parts[1])
+			j.Gauge(idxprefix+".Cardinality", idx.Cardinality.Get())
+			j.Gauge(idxprefix+".CardinalityChangePct", idx.CardinalityChangePct.Get())
+		}
+	}
 }
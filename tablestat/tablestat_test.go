@@ -19,15 +19,21 @@
 package tablestat
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/measure/metrics"
+	"github.com/measure/mysql/tools"
 	"log"
+	"math"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
 	"time"
-
-	"github.com/measure/metrics"
 )
 
 type testMysqlDB struct {
@@ -72,6 +78,18 @@ func (s *testMysqlDB) SetMaxConnections(maxConns int) {
 	return
 }
 
+func (s *testMysqlDB) SetQueryTimeout(timeout time.Duration) {
+	return
+}
+
+func (s *testMysqlDB) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *testMysqlDB) Stats() sql.DBStats {
+	return sql.DBStats{}
+}
+
 func initMysqlStatTable() *MysqlStatTables {
 	syscall.Dup2(int(logFile.Fd()), 2)
 	s := new(MysqlStatTables)
@@ -262,6 +280,42 @@ func TestTableSizes(t *testing.T) {
 	}
 }
 
+func TestLargeTables(t *testing.T) {
+	s := initMysqlStatTable()
+	var logged bytes.Buffer
+	s.db = &testMysqlDB{Logger: log.New(&logged, "", 0)}
+	s.SetLargeTableBytes(1000)
+	testquerycol = map[string]map[string][]string{
+		innodbMetadataCheck: map[string][]string{
+			"innodb_stats_on_metadata": []string{"0"},
+		},
+		tblSizesQuery: map[string][]string{
+			"db":             []string{"db1", "db1", "db2", "db2", "db3"},
+			"tbl":            []string{"small", "events", "audit", "limit", "big"},
+			"tbl_size_bytes": []string{"10", "5000", "1200", "1000", "90000"},
+		},
+	}
+	s.Collect()
+	expectedValues = map[interface{}]interface{}{
+		s.Server.LargeTablesCount: float64(3),
+	}
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+	want := "tables larger than 1000 bytes: db3.big (90000 bytes), db1.events (5000 bytes), db2.audit (1200 bytes)"
+	if !strings.Contains(logged.String(), want) {
+		t.Error("unexpected log output: " + logged.String())
+	}
+
+	//nothing over the threshold
+	s.SetLargeTableBytes(100000)
+	logged.Reset()
+	s.Collect()
+	if s.Server.LargeTablesCount.Get() != 0 || strings.Contains(logged.String(), "larger than") {
+		t.Error("expected no large tables")
+	}
+}
+
 func TestTableStats(t *testing.T) {
 
 	s := initMysqlStatTable()
@@ -306,6 +360,100 @@ func TestTableStats(t *testing.T) {
 	}
 }
 
+// Test parsing of table update and check ages.
+// NULL columns come back empty and leave the age unset
+func TestTableAges(t *testing.T) {
+	s := initMysqlStatTable()
+	testquerycol = map[string]map[string][]string{
+		innodbMetadataCheck: map[string][]string{
+			"innodb_stats_on_metadata": []string{"0"},
+		},
+		tblAgesQuery: map[string][]string{
+			"db":         []string{"db1", "db1", "db2"},
+			"tbl":        []string{"t1", "t2", "t1"},
+			"update_age": []string{"30", "", "86400"},
+			"check_age":  []string{"", "600", "7200"},
+		},
+	}
+	s.Collect()
+	expectedValues = map[interface{}]interface{}{
+		s.DBs["db1"].Tables["t1"].UpdateAgeSec: float64(30),
+		s.DBs["db1"].Tables["t2"].CheckAgeSec:  float64(600),
+		s.DBs["db2"].Tables["t1"].UpdateAgeSec: float64(86400),
+		s.DBs["db2"].Tables["t1"].CheckAgeSec:  float64(7200),
+	}
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+	if !math.IsNaN(s.DBs["db1"].Tables["t1"].CheckAgeSec.Get()) ||
+		!math.IsNaN(s.DBs["db1"].Tables["t2"].UpdateAgeSec.Get()) {
+		t.Error("expected NULL ages to be unset")
+	}
+
+	//a table whose update time becomes NULL goes back to unknown
+	testquerycol[tblAgesQuery]["update_age"] = []string{"", "", "86400"}
+	s.Collect()
+	if !math.IsNaN(s.DBs["db1"].Tables["t1"].UpdateAgeSec.Get()) {
+		t.Error("expected NULL update age to be unset")
+	}
+}
+
+// Test that the streamed JSON output is a valid list of
+// metric records holding the collected values
+func TestFormatJSON(t *testing.T) {
+	s := initMysqlStatTable()
+	testquerycol = map[string]map[string][]string{
+		innodbMetadataCheck: map[string][]string{
+			"innodb_stats_on_metadata": []string{"0"},
+		},
+		dbSizesQuery: map[string][]string{
+			"db1": []string{"100"},
+		},
+		tblSizesQuery: map[string][]string{
+			"tbl":            []string{"t1", "t2"},
+			"db":             []string{"db1", "db1"},
+			"tbl_size_bytes": []string{"1", "2"},
+		},
+	}
+	s.Collect()
+	var buf bytes.Buffer
+	if err := s.FormatJSON(&buf); err != nil {
+		t.Error(err)
+	}
+	var records []struct {
+		Type  string
+		Name  string
+		Value float64
+	}
+	if err := json.Unmarshal(buf.Bytes(), &records); err != nil {
+		t.Fatal("output is not valid JSON: " + err.Error())
+	}
+	result := map[string]float64{}
+	for _, rec := range records {
+		result[rec.Type+" "+rec.Name] = rec.Value
+	}
+	expected := map[string]float64{
+		"gauge mysqlstat.db1.SizeBytes":        100,
+		"gauge mysqlstat.db1.t1.SizeBytes":     1,
+		"gauge mysqlstat.db1.t2.SizeBytes":     2,
+		"counter mysqlstat.db1.t1.RowsRead":    0,
+		"counter mysqlstat.db1.t2.RowsChanged": 0,
+	}
+	for name, val := range expected {
+		if v, ok := result[name]; !ok || v != val {
+			t.Error("missing or incorrect record for " + name + ", got:\n" + buf.String())
+		}
+	}
+	if _, ok := result["counter mysqlstat.TablesCollectGetterErrors"]; !ok {
+		t.Error("missing record for the collection's errors, got:\n" + buf.String())
+	}
+	//and the collection's duration
+	if len(records) != 11 {
+		t.Error("expected 11 records, got " + strconv.Itoa(len(records)))
+	}
+}
+
 //Because innodb stats on metadata is being collected,
 //metrics collector should not collect these metrics
 func TestNoSizes(t *testing.T) {
@@ -345,3 +493,491 @@ func TestNoSizes(t *testing.T) {
 		t.Error("found database, but should not have")
 	}
 }
+
+// Test that two collectors sharing a metric context keep their
+// metrics apart when given namespaces
+func TestNamespace(t *testing.T) {
+	m := metrics.NewMetricContext("system")
+	testquerycol = map[string]map[string][]string{
+		innodbMetadataCheck: map[string][]string{
+			"innodb_stats_on_metadata": []string{"0"},
+		},
+		dbSizesQuery: map[string][]string{
+			"db1": []string{"100"},
+		},
+	}
+	collectors := map[string]*MysqlStatTables{}
+	for _, ns := range []string{"a", "b"} {
+		s := initMysqlStatTable()
+		s.m = m
+		s.namespace = ns
+		s.Collect()
+		collectors[ns] = s
+	}
+	a, b := collectors["a"], collectors["b"]
+	a.DBs["db1"].Metrics.SizeBytes.Set(1)
+	if m.Gauges["mysqlstat.a.db1.SizeBytes"] != a.DBs["db1"].Metrics.SizeBytes ||
+		m.Gauges["mysqlstat.b.db1.SizeBytes"] != b.DBs["db1"].Metrics.SizeBytes {
+		t.Error("metrics not registered under their namespace")
+	}
+	if b.DBs["db1"].Metrics.SizeBytes.Get() != 100 {
+		t.Error("collectors share metric values")
+	}
+
+	var buf bytes.Buffer
+	a.FormatGraphite(&buf)
+	if out := withoutCollectStats(buf.String()); out != "a.db1.SizeBytes 1\n" {
+		t.Error("unexpected graphite output:\n" + out)
+	}
+}
+
+// Test that an overridden query is the one the getter runs
+func TestSetQuery(t *testing.T) {
+	s := initMysqlStatTable()
+	custom := "SELECT db, tbl, rows_read, rows_changed, rows_changed_x_indexes FROM custom_stats;"
+	testquerycol = map[string]map[string][]string{
+		custom: map[string][]string{
+			"db":                     []string{"db1"},
+			"tbl":                    []string{"t1"},
+			"rows_read":              []string{"11"},
+			"rows_changed":           []string{"21"},
+			"rows_changed_x_indexes": []string{"31"},
+		},
+	}
+	if err := s.SetQuery("GetTableStatistics", custom); err != nil {
+		t.Error(err)
+	}
+	s.Collect()
+	if _, ok := s.DBs["db1"]; !ok {
+		t.Fatal("overridden query was not run")
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.DBs["db1"].Tables["t1"].RowsRead: uint64(11),
+	}
+	err := checkResults()
+	if err != "" {
+		t.Error(err)
+	}
+	if err := s.SetQuery("GetNothing", custom); err == nil {
+		t.Error("expected overriding an unknown method to fail")
+	}
+}
+
+// Test that graphite lines end with a parseable collection time
+func TestGraphiteTimestamp(t *testing.T) {
+	s := initMysqlStatTable()
+	testquerycol = map[string]map[string][]string{
+		innodbMetadataCheck: map[string][]string{
+			"innodb_stats_on_metadata": []string{"0"},
+		},
+		dbSizesQuery: map[string][]string{
+			"db1": []string{"100"},
+		},
+	}
+	s.SetGraphiteTimestamp(true)
+	before := time.Now().Unix()
+	s.Collect()
+	after := time.Now().Unix()
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	parts := strings.Fields(withoutCollectStats(buf.String()))
+	if len(parts) != 3 || parts[0] != "db1.SizeBytes" || parts[1] != "100" {
+		t.Fatal("unexpected graphite output: " + buf.String())
+	}
+	ts, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || ts < before || ts > after {
+		t.Error("timestamp missing or not the collection time: " + buf.String())
+	}
+}
+
+//drops the lines of the duration and errors of the collection itself
+// from graphite output
+func withoutCollectStats(out string) string {
+	var lines []string
+	for _, line := range strings.SplitAfter(out, "\n") {
+		if !strings.Contains(line, "TablesCollect") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// Test that the graphite prefix goes before database names
+func TestGraphitePrefix(t *testing.T) {
+	s := initMysqlStatTable()
+	testquerycol = map[string]map[string][]string{
+		innodbMetadataCheck: map[string][]string{
+			"innodb_stats_on_metadata": []string{"0"},
+		},
+		dbSizesQuery: map[string][]string{
+			"db1": []string{"100"},
+		},
+	}
+	s.SetGraphitePrefix("mysql.host1")
+	s.Collect()
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	if withoutCollectStats(buf.String()) != "mysql.host1.db1.SizeBytes 100\n" {
+		t.Error("unexpected graphite output:\n" + buf.String())
+	}
+}
+
+// Test that graphite lines come out sorted by metric name, and the
+// same on every write, though databases are kept in a map
+func TestGraphiteSorted(t *testing.T) {
+	s := initMysqlStatTable()
+	testquerycol = map[string]map[string][]string{
+		innodbMetadataCheck: map[string][]string{
+			"innodb_stats_on_metadata": []string{"0"},
+		},
+		dbSizesQuery: map[string][]string{
+			"db3": []string{"300"},
+			"db1": []string{"100"},
+			"db4": []string{"400"},
+			"db2": []string{"200"},
+		},
+	}
+	s.Collect()
+	var first bytes.Buffer
+	s.FormatGraphite(&first)
+	expected := "db1.SizeBytes 100\ndb2.SizeBytes 200\ndb3.SizeBytes 300\ndb4.SizeBytes 400\n"
+	if withoutCollectStats(first.String()) != expected {
+		t.Fatal("Incorrect result, expected:\n" + expected + "but got:\n" + first.String())
+	}
+	for i := 0; i < 10; i++ {
+		var buf bytes.Buffer
+		s.FormatGraphite(&buf)
+		if buf.String() != first.String() {
+			t.Fatal("output changed between writes:\n" + buf.String())
+		}
+	}
+}
+
+// Test that table names are cleaned for graphite output,
+// and that names which clean to the same string stay apart
+func TestSanitizedNames(t *testing.T) {
+	s := initMysqlStatTable()
+	testquerycol = map[string]map[string][]string{
+		innodbMetadataCheck: map[string][]string{
+			"innodb_stats_on_metadata": []string{"0"},
+		},
+		tblSizesQuery: map[string][]string{
+			"tbl":            []string{"my table.v2", "my_table_v2"},
+			"db":             []string{"db1", "db1"},
+			"tbl_size_bytes": []string{"1", "2"},
+		},
+	}
+	s.Collect()
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	sizes := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		parts := strings.Fields(line)
+		if strings.HasSuffix(parts[0], ".SizeBytes") {
+			sizes[parts[0]] = parts[1]
+		}
+	}
+	a, b := sizes["db1.my_table_v2.SizeBytes"], sizes["db1.my_table_v2_2.SizeBytes"]
+	if len(sizes) != 2 || a == "" || b == "" || a == b {
+		t.Error("unexpected graphite output:\n" + buf.String())
+	}
+
+	//JSON keeps the names as they are
+	buf.Reset()
+	s.FormatJSON(&buf)
+	if !strings.Contains(buf.String(), `"mysqlstat.db1.my table.v2.SizeBytes"`) {
+		t.Error("unexpected JSON output:\n" + buf.String())
+	}
+}
+
+// Test that InnoDB tables without a primary key are counted and
+// that the largest are logged when asked for
+func TestTablesWithoutPK(t *testing.T) {
+	s := initMysqlStatTable()
+	var logged bytes.Buffer
+	s.db = &testMysqlDB{Logger: log.New(&logged, "", 0)}
+	s.SetLogTablesWithoutPK(2)
+	//the query only returns tables lacking a key, db1.keyed and its
+	// unique-keyed neighbours never appear
+	testquerycol = map[string]map[string][]string{
+		tblsWithoutPKQuery: map[string][]string{
+			"db":       []string{"db1", "db2", "db1"},
+			"tbl":      []string{"events", "audit", "tmp"},
+			"tbl_rows": []string{"5000", "120", "3"},
+		},
+	}
+	s.Collect()
+	expectedValues = map[interface{}]interface{}{
+		s.Server.TablesWithoutPK: float64(3),
+	}
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+	want := "tables without a primary key: db1.events (5000 rows), db2.audit (120 rows)"
+	if !strings.Contains(logged.String(), want) || strings.Contains(logged.String(), "db1.tmp") {
+		t.Error("unexpected log output: " + logged.String())
+	}
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	if !strings.Contains(buf.String(), "TablesWithoutPK 3\n") {
+		t.Error("aggregate missing from graphite output:\n" + buf.String())
+	}
+
+	//every table has a key
+	testquerycol = map[string]map[string][]string{
+		tblsWithoutPKQuery: map[string][]string{
+			"db":       []string{},
+			"tbl":      []string{},
+			"tbl_rows": []string{},
+		},
+	}
+	logged.Reset()
+	s.Collect()
+	if s.Server.TablesWithoutPK.Get() != 0 || strings.Contains(logged.String(), "primary key") {
+		t.Error("expected no tables without a primary key, got " +
+			strconv.FormatFloat(s.Server.TablesWithoutPK.Get(), 'f', 0, 64))
+	}
+}
+
+// Test counting encrypted and unencrypted tables from their create options
+func TestTableEncryption(t *testing.T) {
+	s := initMysqlStatTable()
+	testquerycol = map[string]map[string][]string{
+		tblEncryptionQuery: map[string][]string{
+			"db":             []string{"db1", "db1", "db2", "db2"},
+			"tbl":            []string{"users", "sessions", "audit", "cards"},
+			"create_options": []string{"ENCRYPTION='Y'", "", "row_format=COMPRESSED encryption=\"N\"", "ENCRYPTION=\"Y\" stats_persistent=1"},
+		},
+	}
+	s.Collect()
+	expectedValues = map[interface{}]interface{}{
+		s.Server.EncryptedTablesCount:             float64(2),
+		s.Server.UnencryptedTablesCount:           float64(2),
+		s.DBs["db1"].Tables["users"].Encrypted:    float64(1),
+		s.DBs["db1"].Tables["sessions"].Encrypted: float64(0),
+		s.DBs["db2"].Tables["audit"].Encrypted:    float64(0),
+		s.DBs["db2"].Tables["cards"].Encrypted:    float64(1),
+	}
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	if !strings.Contains(buf.String(), "UnencryptedTablesCount 2\n") ||
+		!strings.Contains(buf.String(), "db1.sessions.Encrypted 0\n") {
+		t.Error("encryption metrics missing from graphite output:\n" + buf.String())
+	}
+}
+
+// Test counting FULLTEXT and SPATIAL indexes
+func TestIndexTypes(t *testing.T) {
+	s := initMysqlStatTable()
+	testquerycol = map[string]map[string][]string{
+		indexTypesQuery: map[string][]string{
+			"index_type": []string{"FULLTEXT"},
+			"tables":     []string{"3"},
+			"indexes":    []string{"5"},
+		},
+	}
+	s.Collect()
+	expectedValues = map[interface{}]interface{}{
+		s.Server.FulltextIndexes:    float64(5),
+		s.Server.TablesWithFulltext: float64(3),
+		s.Server.SpatialIndexes:     float64(0),
+		s.Server.TablesWithSpatial:  float64(0),
+	}
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	if !strings.Contains(buf.String(), "FulltextIndexes 5\n") ||
+		!strings.Contains(buf.String(), "TablesWithSpatial 0\n") {
+		t.Error("index counts missing from graphite output:\n" + buf.String())
+	}
+
+	//no FULLTEXT or SPATIAL indexes at all
+	testquerycol = map[string]map[string][]string{
+		indexTypesQuery: map[string][]string{
+			"index_type": []string{},
+			"tables":     []string{},
+			"indexes":    []string{},
+		},
+	}
+	s.Collect()
+	if s.Server.FulltextIndexes.Get() != 0 || s.Server.TablesWithFulltext.Get() != 0 {
+		t.Error("expected no FULLTEXT indexes")
+	}
+}
+
+// Test that the tables with the most IO get IO metrics, busiest first
+func TestTableIO(t *testing.T) {
+	s := initMysqlStatTable()
+	testquerycol = map[string]map[string][]string{
+		tblIOQuery: map[string][]string{
+			"db":          []string{"db1", "db2"},
+			"tbl":         []string{"quiet", "busy"},
+			"count_read":  []string{"30", "900"},
+			"count_write": []string{"10", "100"},
+		},
+	}
+	s.Collect()
+	busy, quiet := s.DBs["db2"].IO["busy"], s.DBs["db1"].IO["quiet"]
+	if busy == nil || quiet == nil {
+		t.Fatal("expected IO metrics for both tables")
+	}
+	expectedValues = map[interface{}]interface{}{
+		busy.IOReads:    uint64(900),
+		busy.IOWrites:   uint64(100),
+		busy.IOReadPct:  float64(90),
+		quiet.IOReads:   uint64(30),
+		quiet.IOWrites:  uint64(10),
+		quiet.IOReadPct: float64(75),
+	}
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	if !strings.Contains(buf.String(), "db2.busy.IOReads 900\n") {
+		t.Error("IO metrics missing from graphite output:\n" + buf.String())
+	}
+}
+
+// Test that only the busiest maxIOTables tables get IO metrics
+func TestTableIOLimit(t *testing.T) {
+	s := initMysqlStatTable()
+	res := map[string][]string{}
+	for i := 0; i <= maxIOTables; i++ {
+		res["db"] = append(res["db"], "db1")
+		res["tbl"] = append(res["tbl"], "t"+strconv.Itoa(i))
+		//the last table is the busiest
+		res["count_read"] = append(res["count_read"], strconv.Itoa(i+1))
+		res["count_write"] = append(res["count_write"], "0")
+	}
+	testquerycol = map[string]map[string][]string{tblIOQuery: res}
+	s.Collect()
+	if len(s.DBs["db1"].IO) != maxIOTables {
+		t.Error("expected " + strconv.Itoa(maxIOTables) + " tables with IO metrics, got " +
+			strconv.Itoa(len(s.DBs["db1"].IO)))
+	}
+	if s.DBs["db1"].IO["t0"] != nil || s.DBs["db1"].IO["t"+strconv.Itoa(maxIOTables)] == nil {
+		t.Error("expected the least busy table to be left out")
+	}
+}
+
+// Test that an index whose cardinality changes drastically between two
+// collections marks its table as having stale statistics
+func TestIndexCardinality(t *testing.T) {
+	s := initMysqlStatTable()
+	testquerycol = map[string]map[string][]string{
+		indexCardinalityQuery: map[string][]string{
+			"db":          []string{"db1", "db1"},
+			"tbl":         []string{"t1", "t2"},
+			"idx":         []string{"PRIMARY", "idx_a"},
+			"cardinality": []string{"1000", "200"},
+		},
+	}
+	s.Collect()
+	if s.Server != nil && !math.IsNaN(s.Server.StaleStatsTablesCount.Get()) {
+		t.Error("expected no stale statistics on the first collection")
+	}
+	primary := s.DBs["db1"].Indexes["t1.PRIMARY"]
+	if primary == nil || primary.Cardinality.Get() != 1000 ||
+		!math.IsNaN(primary.CardinalityChangePct.Get()) {
+		t.Error("unexpected cardinality metrics for db1.t1.PRIMARY")
+	}
+
+	//t1's cardinality grows tenfold, t2's barely moves
+	testquerycol[indexCardinalityQuery]["cardinality"] = []string{"10000", "210"}
+	s.Collect()
+	expectedValues = map[interface{}]interface{}{
+		s.Server.StaleStatsTablesCount:                        float64(1),
+		primary.Cardinality:                                   float64(10000),
+		primary.CardinalityChangePct:                          float64(900),
+		s.DBs["db1"].Indexes["t2.idx_a"].CardinalityChangePct: float64(5),
+	}
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+	var buf bytes.Buffer
+	s.FormatGraphite(&buf)
+	if !strings.Contains(buf.String(), "StaleStatsTablesCount 1\n") ||
+		!strings.Contains(buf.String(), "db1.t1.PRIMARY.CardinalityChangePct 900\n") {
+		t.Error("stale statistics missing from graphite output:\n" + buf.String())
+	}
+}
+
+func TestFilter(t *testing.T) {
+	s := initMysqlStatTable()
+	f, err := NewFilter("^db[12]$", "", "", "^tmp_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetFilter(f)
+	s.nLock.Lock()
+	testquerycol = map[string]map[string][]string{
+		innodbMetadataCheck: map[string][]string{
+			"innodb_stats_on_metadata": []string{"0"},
+		},
+		dbSizesQuery: map[string][]string{
+			"db1": []string{"100"},
+			"db3": []string{"300"},
+		},
+		tblSizesQuery: map[string][]string{
+			"tbl":            []string{"t1", "tmp_t2", "t1"},
+			"db":             []string{"db1", "db1", "db3"},
+			"tbl_size_bytes": []string{"1", "2", "3"},
+		},
+	}
+	s.nLock.Unlock()
+	s.Collect()
+	time.Sleep(time.Millisecond * 1000 * 1)
+
+	s.nLock.Lock()
+	defer s.nLock.Unlock()
+	if _, ok := s.DBs["db3"]; ok {
+		t.Error("db3 collected, but it doesn't match -db-include")
+	}
+	if _, ok := s.DBs["db1"].Tables["tmp_t2"]; ok {
+		t.Error("db1.tmp_t2 collected, but it matches -table-exclude")
+	}
+	expectedValues = map[interface{}]interface{}{
+		s.DBs["db1"].Metrics.SizeBytes:      float64(100),
+		s.DBs["db1"].Tables["t1"].SizeBytes: float64(1),
+	}
+	if err := checkResults(); err != "" {
+		t.Error(err)
+	}
+}
+
+func TestNewFilter(t *testing.T) {
+	if _, err := NewFilter("", "", "", "("); err == nil || !strings.Contains(err.Error(), "table exclude pattern (") {
+		t.Error("expected an error naming the bad table exclude pattern, got", err)
+	}
+	f, err := NewFilter("", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Match("db1", "") || !f.Match("db1", "t1") {
+		t.Error("empty filter should collect everything")
+	}
+}
+
+// Test that closing again, as a shutdown handler and deferred cleanup
+// both do, is harmless
+func TestCloseTwice(t *testing.T) {
+	s := initMysqlStatTable()
+	//nothing listens on port 1, but the pool is still opened
+	db, err := tools.NewDSN("root@tcp(127.0.0.1:1)/")
+	if db == nil {
+		t.Fatal(err)
+	}
+	s.SetDB(db)
+	s.Close()
+	s.Close()
+	err = db.Ping(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Error("expected the pool to be closed")
+	}
+}
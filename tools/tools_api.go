@@ -1,9 +1,19 @@
 package tools
 
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
 type MysqlDB interface {
 	// set the max number of database connections allowed at once
 	SetMaxConnections(maxConns int)
 
+	// give up on queries running longer than timeout, killing them on
+	// the server. 0 lets them run as long as they take
+	SetQueryTimeout(timeout time.Duration)
+
 	// makes query to database
 	// returns result as a mapping of strings to string arrays
 	// where key is column name and value is the items stored in column
@@ -17,9 +27,16 @@ type MysqlDB interface {
 	// in the order as they appeared in the row
 	QueryMapFirstColumnToRow(query string) (map[string][]string, error)
 
+	// checks the database can be reached without running a query,
+	// giving up when ctx is done
+	Ping(ctx context.Context) error
+
+	// returns the statistics of the connection pool
+	Stats() sql.DBStats
+
 	// Log Prints in to the logger
 	Log(in interface{})
 
-	// Closes the connection with the database
+	// Closes the connection with the database. Closing again does nothing
 	Close()
 }
@@ -6,32 +6,118 @@
 package tools
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
 
 	"code.google.com/p/goconf/conf" // used for parsing config files
 )
 
 // sql packages and driver
 import "database/sql"
-import _ "github.com/go-sql-driver/mysql"
+import "database/sql/driver"
+import "github.com/go-sql-driver/mysql"
 
 type mysqlDB struct {
+	poolLock  sync.RWMutex //guards db and maxConns, see reconnect
 	db        *sql.DB
 	dsnString string
+	maxConns  int
+	queryTag  string //name put in a comment ahead of every query, "" for none
+	borrowed  bool   //db was opened by the caller, who closes it
+	redact    bool   //mask hosts, addresses and accounts in Log
+
+	queryTimeout time.Duration //how long a query may run, 0 for as long as it takes
 }
 
 const (
 	DEFAULT_MYSQL_USER = "root"
 	MAX_RETRIES        = 5
+
+	//how long killing a timed out query may take
+	killQueryTimeout = 5 * time.Second
+
+	//where a target without a host or port connects
+	defaultTargetHost = "127.0.0.1"
+	defaultTargetPort = 3306
 )
 
+//connection settings beyond the credentials and address.
+// empty fields leave the driver's and server's defaults in place
+type Options struct {
+	Charset   string //connection character set, fallbacks may follow after commas: "utf8mb4,utf8"
+	Collation string //connection collation, e.g. "utf8mb4_general_ci"
+
+	//SET SESSION statements separated by semicolons, run on every new
+	// connection: "SET SESSION transaction_isolation='READ-UNCOMMITTED'"
+	SessionInit string
+
+	//tag queries with a comment naming this tag and the getter running
+	// them, so they can be told apart in the processlist and slow log:
+	// "/* inspect-mysql:GetSlaveStats */ SHOW SLAVE STATUS;". "" leaves queries untagged
+	QueryTag string
+
+	//database that unqualified names in queries resolve to. queries
+	// that come with the collector name their schema, so they don't
+	// depend on it. "" connects to information_schema
+	DefaultDB string
+
+	//replace hostnames, IP addresses and accounts in log lines with a
+	// hash, so logs can be shared. metrics are not changed
+	Redact bool
+
+	//connect over TLS allowing no version older than this, "1.2" or
+	// "1.3". older versions are refused. "" leaves TLS to the dsn
+	TLSMinVersion string
+
+	//comma separated cipher suites allowed, by their Go names, e.g.
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". TLS 1.3 suites can't be
+	// restricted. "" allows Go's defaults. setting it turns TLS on
+	TLSCiphers string
+
+	//how long connecting may take, so an unreachable host fails fast.
+	// 0 keeps the default of 30s
+	ConnectTimeout time.Duration
+
+	//how long the driver waits on a read or a write on the connection.
+	// 0 waits as long as the server takes
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+//name the collector's TLS settings are registered with the driver under
+const tlsConfigName = "inspect-mysql"
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//single variable assignments are all the driver can run on connect
+var sessionInitRe = regexp.MustCompile(`(?is)^SET\s+(?:SESSION\s+|@@SESSION\.|@@)?([a-z_][a-z0-9_]*)\s*=\s*(.+)$`)
+
 type Config struct {
 	Client struct {
 		Password string
@@ -47,34 +133,160 @@ type InnodbStats struct {
 }
 
 //wrapper for make_query, where if there is an error querying the database
-// retry connecting to the db and make the query
+// retry connecting to the db and make the query. a query that lost its
+// connection is retried on the same pool, which drops the broken
+// connection and opens another. the pool is only replaced when the
+// server can't be reached at all
 func (database *mysqlDB) queryDb(query string) ([]string, [][]string, error) {
 	var err error
+	query = database.tagQuery(query)
 	for attempts := 0; attempts <= MAX_RETRIES; attempts++ {
-		err = database.db.Ping()
+		db := database.pool()
+		err = db.Ping()
 		if err == nil {
-			if cols, data, err := database.makeQuery(query); err == nil {
+			cols, data, qerr := database.makeQuery(db, query)
+			if qerr == nil {
 				return cols, data, nil
-			} else {
-				return nil, nil, err
 			}
+			//another getter replaced the pool while the query ran on it
+			if ClassifyError(qerr) != ErrorConnectionLost && database.pool() == db {
+				return nil, nil, qerr
+			}
+			err = qerr
+			continue
+		}
+		//sql.DB reopens its own connections, a pool we didn't open
+		// can't be replaced
+		if database.borrowed {
+			continue
+		}
+		if cerr := database.reconnect(db); cerr != nil {
+			err = cerr
 		}
-		database.db.Close()
-		database.db, err = sql.Open("mysql", database.dsnString)
 	}
 	return nil, nil, err
 }
 
+//returns the pool to run queries on
+func (database *mysqlDB) pool() *sql.DB {
+	database.poolLock.RLock()
+	defer database.poolLock.RUnlock()
+	return database.db
+}
+
+//replaces the pool old with a new one, unless another getter that
+// couldn't reach the server already did. queries still running on old
+// fail and are retried on the new pool
+func (database *mysqlDB) reconnect(old *sql.DB) error {
+	database.poolLock.Lock()
+	if database.db != old {
+		database.poolLock.Unlock()
+		return nil
+	}
+	err := database.connect()
+	database.poolLock.Unlock()
+	if err == nil {
+		old.Close()
+	}
+	return err
+}
+
+//prefixes query with a comment naming the tag and the getter making it
+func (database *mysqlDB) tagQuery(query string) string {
+	if database.queryTag == "" {
+		return query
+	}
+	tag := database.queryTag
+	if name := GetterName(); name != "unknown" {
+		tag = tag + ":" + name
+	}
+	return "/* " + tag + " */ " + query
+}
+
+//opens a connection pool from the stored dsn and reapplies the pool
+// settings, so reconnecting keeps everything that was configured. the
+// caller holds poolLock once queries may be running
+func (database *mysqlDB) connect() error {
+	db, err := sql.Open("mysql", database.dsnString)
+	if err != nil {
+		return err
+	}
+	if database.maxConns > 0 {
+		db.SetMaxOpenConns(database.maxConns)
+	}
+	database.db = db
+	return nil
+}
+
 //makes a query to the database
 // returns array of column names and arrays of data stored as string
 // string equivalent to []byte
 // data stored as 2d array with each subarray containing a single column's data
-func (database *mysqlDB) makeQuery(query string) ([]string, [][]string, error) {
-	rows, err := database.db.Query(query)
+func (database *mysqlDB) makeQuery(db *sql.DB, query string) ([]string, [][]string, error) {
+	if database.queryTimeout > 0 {
+		return database.makeQueryTimeout(db, query)
+	}
+	rows, err := db.Query(query)
 	if err != nil {
 		return nil, nil, err
 	}
+	return readRows(rows)
+}
+
+//makes a query that gives up after queryTimeout. the driver only drops
+// its connection when the query is abandoned, which the server may not
+// notice until the query is done, so the query is also killed by the
+// id of the connection it ran on
+func (database *mysqlDB) makeQueryTimeout(db *sql.DB, query string) ([]string, [][]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), database.queryTimeout)
+	defer cancel()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, nil, database.timeoutError(ctx, err)
+	}
+	var id string
+	err = conn.QueryRowContext(ctx, "SELECT CONNECTION_ID();").Scan(&id)
+	var columns []string
+	var values [][]string
+	if err == nil {
+		var rows *sql.Rows
+		rows, err = conn.QueryContext(ctx, query)
+		if err == nil {
+			columns, values, err = readRows(rows)
+		}
+	}
+	//back to the pool before killing, which may need the connection
+	conn.Close()
+	if ctx.Err() == context.DeadlineExceeded {
+		if id != "" {
+			database.killQuery(db, id)
+		}
+		return nil, nil, database.timeoutError(ctx, err)
+	}
+	return columns, values, err
+}
+
+//wraps err, from a query that ran out of time, with how long it had
+func (database *mysqlDB) timeoutError(ctx context.Context, err error) error {
+	if ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	return fmt.Errorf("query timed out after %s: %w", database.queryTimeout, context.DeadlineExceeded)
+}
+
+//stops the query running on the connection with id, over another
+// connection, so it doesn't keep using the server after being abandoned
+func (database *mysqlDB) killQuery(db *sql.DB, id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), killQueryTimeout)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "KILL QUERY "+id); err != nil {
+		database.Log("killing the timed out query on connection " + id + ": " + err.Error())
+	}
+}
 
+//reads every row of rows into columns and closes it
+func readRows(rows *sql.Rows) ([]string, [][]string, error) {
+	defer rows.Close()
 	column_names, err := rows.Columns()
 	if err != nil {
 		return nil, nil, err
@@ -99,15 +311,36 @@ func (database *mysqlDB) makeQuery(query string) ([]string, [][]string, error) {
 			values[i] = append(values[i], str)
 		}
 	}
-	err = rows.Err()
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
 
 	return column_names, values, nil
 }
 
 func (database *mysqlDB) SetMaxConnections(maxConns int) {
+	database.poolLock.Lock()
+	defer database.poolLock.Unlock()
+	database.maxConns = maxConns
 	database.db.SetMaxOpenConns(maxConns)
 }
 
+func (database *mysqlDB) SetQueryTimeout(timeout time.Duration) {
+	database.queryTimeout = timeout
+}
+
+//checks connectivity with the driver's ping, which stops waiting when
+// ctx is done, instead of retrying like queries do
+func (database *mysqlDB) Ping(ctx context.Context) error {
+	return database.pool().PingContext(ctx)
+}
+
+//how the pool queries run on is used, including how often and how long
+// queries waited for a connection because all maxConns were in use
+func (database *mysqlDB) Stats() sql.DBStats {
+	return database.pool().Stats()
+}
+
 //return values of query in a mapping of column_name -> column
 func (database *mysqlDB) QueryReturnColumnDict(query string) (map[string][]string, error) {
 	column_names, values, err := database.queryDb(query)
@@ -121,6 +354,9 @@ func (database *mysqlDB) QueryReturnColumnDict(query string) (map[string][]strin
 //return values of query in a mapping of first columns entry -> row
 func (database *mysqlDB) QueryMapFirstColumnToRow(query string) (map[string][]string, error) {
 	_, values, err := database.queryDb(query)
+	if err != nil {
+		return nil, err
+	}
 	result := make(map[string][]string)
 	if len(values) == 0 {
 		return nil, nil
@@ -153,19 +389,148 @@ func makeDsn(dsn map[string]string) string {
 	}
 	dsnString = dsnString + dsn["host"]
 	dsnString = dsnString + "/" + dsn["dbname"]
-	dsnString = dsnString + "?timeout=30s"
+	timeout := "30s"
+	if t, ok := dsn["timeout"]; ok && t != "" {
+		timeout = t
+	}
+	dsnString = dsnString + "?timeout=" + timeout
+	if t, ok := dsn["readTimeout"]; ok && t != "" {
+		dsnString = dsnString + "&readTimeout=" + t
+	}
+	if t, ok := dsn["writeTimeout"]; ok && t != "" {
+		dsnString = dsnString + "&writeTimeout=" + t
+	}
+	if charset, ok := dsn["charset"]; ok && charset != "" {
+		dsnString = dsnString + "&charset=" + charset
+	}
+	if collation, ok := dsn["collation"]; ok && collation != "" {
+		dsnString = dsnString + "&collation=" + collation
+	}
+	if name, ok := dsn["tls"]; ok && name != "" {
+		dsnString = dsnString + "&tls=" + name
+	}
+	dsnString = dsnString + dsn["session"]
 	return dsnString
 }
 
+//turns SET SESSION statements into dsn parameters. the driver runs them
+// on every connection it opens, so they also apply after reconnecting
+// and to every connection in the pool
+func sessionParams(init string) (string, error) {
+	var params string
+	for _, stmt := range strings.Split(init, ";") {
+		stmt = strings.TrimSpace(stmt)
+		if stmt == "" {
+			continue
+		}
+		m := sessionInitRe.FindStringSubmatch(stmt)
+		//a comma outside quotes means more than one assignment
+		if m == nil || (strings.Contains(m[2], ",") && !strings.HasPrefix(m[2], "'")) {
+			return "", errors.New("session init: expected SET SESSION <variable> = <value>, got: " + stmt)
+		}
+		params = params + "&" + m[1] + "=" + url.QueryEscape(strings.TrimSpace(m[2]))
+	}
+	return params, nil
+}
+
+//builds the TLS settings asked for in opts, or nil when TLS isn't
+// configured. unknown versions and ciphers are errors, and so are
+// TLS 1.0 and 1.1
+func (opts Options) tlsConfig() (*tls.Config, error) {
+	if opts.TLSMinVersion == "" && opts.TLSCiphers == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.TLSMinVersion != "" {
+		version, ok := tlsVersions[opts.TLSMinVersion]
+		if !ok {
+			return nil, errors.New("unsupported TLS minimum version " + opts.TLSMinVersion +
+				", expected 1.2 or 1.3")
+		}
+		config.MinVersion = version
+	}
+	if opts.TLSCiphers != "" {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range strings.Split(opts.TLSCiphers, ",") {
+			name = strings.TrimSpace(name)
+			id, ok := suites[name]
+			if !ok {
+				return nil, errors.New("unknown or insecure TLS cipher suite " + name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	return config, nil
+}
+
+//returns the database to connect to
+func (opts Options) defaultDB() string {
+	if opts.DefaultDB == "" {
+		return "information_schema"
+	}
+	return opts.DefaultDB
+}
+
 // create connection to mysql database here
 // when an error is encountered, still return database so that the logger may be used
 func New(user, password, host, config string) (MysqlDB, error) {
+	return NewWithOptions(user, password, host, config, Options{})
+}
+
+// create connection to mysql database with the given connection options
+func NewWithOptions(user, password, host, config string, opts Options) (MysqlDB, error) {
 
-	dsn := map[string]string{"dbname": "information_schema"}
+	dsn := map[string]string{"dbname": opts.defaultDB()}
+	dsn["charset"] = opts.Charset
+	dsn["collation"] = opts.Collation
+	for key, timeout := range map[string]time.Duration{
+		"timeout":      opts.ConnectTimeout,
+		"readTimeout":  opts.ReadTimeout,
+		"writeTimeout": opts.WriteTimeout,
+	} {
+		if timeout > 0 {
+			dsn[key] = timeout.String()
+		}
+	}
 	creds := map[string]string{"root": "/root/.my.cnf", "nrpe": "/etc/my_nrpe.cnf"}
 
-	database := &mysqlDB{}
+	//a */ in the tag would end the comment early
+	database := &mysqlDB{queryTag: strings.Replace(opts.QueryTag, "*/", "", -1), redact: opts.Redact}
+
+	session, err := sessionParams(opts.SessionInit)
+	if err != nil {
+		return database, err
+	}
+	dsn["session"] = session
+
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return database, err
+	}
+	if tlsConfig != nil {
+		if err := mysql.RegisterTLSConfig(tlsConfigName, tlsConfig); err != nil {
+			return database, err
+		}
+		dsn["tls"] = tlsConfigName
+	}
+
+	// ex: "unix(/var/lib/mysql/mysql.sock)"
+	// ex: "db1.example.com:3306", see ParseTarget
+	target, err := ParseTarget(host)
+	if err != nil {
+		return database, err
+	}
+	dsn["host"] = target.Address()
+	if target.DB != "" && opts.DefaultDB == "" {
+		dsn["dbname"] = target.DB
+	}
 
+	if user == "" {
+		user = target.User
+	}
 	if user == "" {
 		user = DEFAULT_MYSQL_USER
 		dsn["user"] = DEFAULT_MYSQL_USER
@@ -176,16 +541,12 @@ func New(user, password, host, config string) (MysqlDB, error) {
 		dsn["password"] = password
 	}
 
-	// ex: "unix(/var/lib/mysql/mysql.sock)"
-	// ex: "tcp(your.db.host.com:3306)"
-	dsn["host"] = host
-
 	//Parse ini file to get password
 	ini_file := creds[user]
 	if config != "" {
 		ini_file = config
 	}
-	_, err := os.Stat(ini_file)
+	_, err = os.Stat(ini_file)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return database, errors.New("'" + ini_file + "' does not exist")
@@ -200,140 +561,2247 @@ func New(user, password, host, config string) (MysqlDB, error) {
 	database.dsnString = makeDsn(dsn)
 
 	//make connection to db
-	db, err := sql.Open("mysql", database.dsnString)
+	err = database.connect()
 	if err != nil {
 		return database, err
 	}
-	database.db = db
 
 	//ping db to verify connection
 	err = database.db.Ping()
 	if err != nil {
+		return database, pingError(err, dsn["dbname"])
+	}
+	return database, nil
+}
+
+//says which default database is missing when the server doesn't know
+// dbname, error 1049. other errors are returned as they are, even if
+// their text has 1049 in it, e.g. as a port
+func pingError(err error, dbname string) error {
+	var me *mysql.MySQLError
+	if errors.As(err, &me) && me.Number == 1049 {
+		return errors.New("default database " + dbname + " does not exist: " + err.Error())
+	}
+	return err
+}
+
+// use a connection pool the caller already has open. Close leaves it
+// open, and failed queries are retried on it rather than reconnecting
+func NewFromDB(db *sql.DB) MysqlDB {
+	return &mysqlDB{db: db, borrowed: true}
+}
+
+// returned, wrapped, by NewDSN when its dsn can't be parsed, so that can
+// be told apart from failing to connect to the server the dsn names
+var ErrInvalidDSN = errors.New("invalid dsn")
+
+// create connection to mysql database from a go-sql-driver dsn, e.g.
+// user:password@tcp(db1.example.com:3306)/information_schema?timeout=5s,
+// for connecting without a config file. The dsn is given to the driver
+// as it is, except that a host without a port connects to 3306, no
+// address to 127.0.0.1:3306 and no database to information_schema.
+// when an error is encountered, still return database so that the
+// logger may be used
+func NewDSN(dsn string) (MysqlDB, error) {
+	database := &mysqlDB{}
+	normalized, err := normalizeDSN(dsn)
+	if err != nil {
+		return database, err
+	}
+	database.dsnString = normalized
+	if err := database.connect(); err != nil {
+		return database, err
+	}
+	if err := database.db.Ping(); err != nil {
 		return database, err
 	}
 	return database, nil
 }
 
+//checks dsn has the [user[:password]@][protocol[(address)]]/[dbname][?params]
+// form the driver reads and fills in the address and database if they
+// are left out. errors wrap ErrInvalidDSN and leave the dsn out, since
+// it may hold a password
+func normalizeDSN(dsn string) (string, error) {
+	invalid := func(msg string) error {
+		return fmt.Errorf("%w: %s", ErrInvalidDSN, msg)
+	}
+	//like the driver, the last / starts the database, since the password
+	// and socket path may have one
+	i := strings.LastIndex(dsn, "/")
+	if i < 0 || strings.Contains(dsn[i:], ")") {
+		return "", invalid("missing the / ahead of the database name")
+	}
+	prefix, rest := dsn[:i], dsn[i+1:]
+	creds, addr := "", prefix
+	if j := strings.LastIndex(prefix, "@"); j >= 0 {
+		creds, addr = prefix[:j+1], prefix[j+1:]
+	}
+	switch {
+	case addr == "" || addr == "tcp":
+		addr = Target{}.Address()
+	case strings.HasPrefix(addr, "tcp(") && strings.HasSuffix(addr, ")"):
+		host, port, err := splitTargetAddress(addr[len("tcp(") : len(addr)-1])
+		if err != nil {
+			return "", invalid(err.Error())
+		}
+		addr = Target{Host: host, Port: port}.Address()
+	case strings.HasPrefix(addr, "unix(") && strings.HasSuffix(addr, ")") && len(addr) > len("unix()"):
+	default:
+		return "", invalid("expected tcp(host:port) or unix(/path/to/socket) ahead of the database, got " +
+			strconv.Quote(addr))
+	}
+	name, params := rest, ""
+	if j := strings.Index(rest, "?"); j >= 0 {
+		name, params = rest[:j], rest[j+1:]
+		if _, err := url.ParseQuery(params); err != nil {
+			return "", invalid("parameters: " + err.Error())
+		}
+		params = "?" + params
+	}
+	if name == "" {
+		name = Options{}.defaultDB()
+	}
+	return creds + addr + "/" + name + params, nil
+}
+
+//returns user@address for dsn, leaving out the password, for naming the
+// server in output
+func DSNTargetName(dsn string) string {
+	user, addr := "", dsn
+	if i := strings.LastIndex(dsn, "/"); i >= 0 {
+		addr = dsn[:i]
+	}
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		user, addr = addr[:i], addr[i+1:]
+		if j := strings.Index(user, ":"); j >= 0 {
+			user = user[:j]
+		}
+	}
+	return TargetName(user, addr)
+}
+
 func (database *mysqlDB) Log(in interface{}) {
 	_, f, line, ok := runtime.Caller(1)
 	if ok {
 		log.Println("Log from: " + f + " line: " + strconv.Itoa(line))
 	}
+	if database.redact {
+		log.Println(Redact(fmt.Sprint(in)))
+		return
+	}
 	log.Println(in)
 }
 
-func (database *mysqlDB) Close() {
-	database.db.Close()
+//formats a metric value for output.
+// whole numbers are written without a decimal point, anything else
+// with precision digits after it
+func FormatValue(v float64, precision int) string {
+	if v == math.Trunc(v) && !math.IsInf(v, 0) {
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(v, 'f', precision, 64)
 }
 
-//Parse results from "SHOW ENGINE INNODB STATUS" query
-func ParseInnodbStats(blob string) (*InnodbStats, error) {
-	idb := new(InnodbStats)
-	idb.Metrics = make(map[string]string)
+//units a metric can be tagged with, as `unit:"bytes"` on its field in a
+// metrics struct
+const (
+	UnitBytes        = "bytes"
+	UnitSeconds      = "s"
+	UnitMilliseconds = "ms"
+)
 
-	chunks := regexp.MustCompile("\n[-=]{3,80}\n").Split(blob, -1)
-	for i, chunk := range chunks {
-		m := regexp.MustCompile("([/ A-Z])\\s*$").MatchString(chunk)
-		if m {
-			chunk = strings.Trim(chunk, " \n")
-			if m, _ := regexp.MatchString("FILE I/O", chunk); m {
-				idb.parseFileIO(chunks[i+1])
-			} else if chunk == "LOG" {
-				idb.parseLog(chunks[i+1])
-			} else if chunk == "BUFFER POOL AND MEMORY" {
-				idb.parseBufferPoolAndMem(chunks[i+1])
-			} else if chunk == "TRANSACTIONS" {
-				idb.parseTransactions(chunks[i+1])
-			}
-		}
+//size of each unit byte metrics can be output in, in bytes
+var byteUnits = map[string]float64{"B": 1, "KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30}
+
+//length of each unit time metrics can be output in, in seconds
+var timeUnits = map[string]float64{"ms": 0.001, "s": 1}
+
+// Units - the units byte and time metrics are output in. Empty fields
+// leave metrics in the units they were collected in
+type Units struct {
+	Bytes string //B, KB, MB or GB
+	Time  string //ms or s
+}
+
+//returns Units for byte and time unit names, e.g. "MB" and "ms". either
+// can be empty
+func ParseUnits(bytes, time string) (Units, error) {
+	if _, ok := byteUnits[bytes]; bytes != "" && !ok {
+		return Units{}, errors.New("unknown byte unit " + strconv.Quote(bytes) + ", expected B, KB, MB or GB")
 	}
-	return idb, nil
+	if _, ok := timeUnits[time]; time != "" && !ok {
+		return Units{}, errors.New("unknown time unit " + strconv.Quote(time) + ", expected ms or s")
+	}
+	return Units{Bytes: bytes, Time: time}, nil
 }
 
-//parse the File I/O section of the "show engine innodb status;" command
-//stores expressions of the form:     123.456 metric_name
-func (idb *InnodbStats) parseFileIO(blob string) {
-	lines := strings.Split(blob, "\n")
-	for _, line := range lines {
-		if strings.Contains(line, ",") {
-			elements := strings.Split(line, ",")
-			for _, element := range elements {
-				element = strings.Trim(element, " \n")
-				m := regexp.MustCompile("^(\\d+(\\.\\d+)?) ([A-Za-z/ ]+)\\s*$").FindStringSubmatch(element)
-				if len(m) == 4 {
-					key := strings.Replace(strings.Replace(m[3], " ", "_", -1), "/", "_per_", -1)
-					idb.Metrics[key] = m[1]
-				}
-			}
+//returns v, collected in unit, in the units of u. values of metrics
+// without a unit are returned as they are
+func (u Units) Convert(v float64, unit string) float64 {
+	switch unit {
+	case UnitBytes:
+		if size, ok := byteUnits[u.Bytes]; ok {
+			return v / size
+		}
+	case UnitSeconds, UnitMilliseconds:
+		if length, ok := timeUnits[u.Time]; ok {
+			return v * timeUnits[unit] / length
 		}
 	}
+	return v
 }
 
-//parse the log section of the "show engine innodb status;" command
-func (idb *InnodbStats) parseLog(blob string) {
-	lines := strings.Split(blob, "\n")
-	for _, line := range lines {
-		line := strings.Trim(line, " \n")
-		if regexp.MustCompile("^(.+?)\\s+(\\d+)\\s*$").MatchString(line) {
-			elements := strings.Split(line, " ")
-			c := len(elements)
-			val := elements[c-1]
-			key := strings.Trim(strings.ToLower(strings.Join(elements[:c-1], "_")), "_")
-			idb.Metrics[key] = val
+//per second rates of counters between collections, for consumers that
+// can't compute rates themselves. the zero value is ready to use
+type CounterRates struct {
+	lock  sync.Mutex
+	prev  map[string]counterSample
+	rates map[string]float64
+}
+
+type counterSample struct {
+	value uint64
+	at    time.Time
+}
+
+//records the value of counter name at time at, and computes its rate
+// since the previous value. a counter that went down was reset, e.g.
+// by a server restart, and gets a rate of 0
+func (r *CounterRates) Update(name string, value uint64, at time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.prev == nil {
+		r.prev = make(map[string]counterSample)
+		r.rates = make(map[string]float64)
+	}
+	if p, ok := r.prev[name]; ok && at.After(p.at) {
+		if value < p.value {
+			r.rates[name] = 0
 		} else {
-			elements := strings.Split(line, ",")
-			for _, element := range elements {
-				element = strings.Trim(element, " \n\t\r\f")
-				if regexp.MustCompile("(\\d+) ([A-Za-z/ ,']+)\\s*$").MatchString(element) {
-					element = strings.Replace(strings.Replace(element, "i/o's", "io", -1), "/second", "_per_sec", -1)
-					words := strings.Split(element, " ")
-					key := strings.Trim(strings.ToLower(strings.Join(words[1:], "_")), "_")
-					idb.Metrics[key] = words[0]
-				}
-			}
+			r.rates[name] = float64(value-p.value) / at.Sub(p.at).Seconds()
 		}
 	}
+	r.prev[name] = counterSample{value, at}
 }
 
-func (idb *InnodbStats) parseBufferPoolAndMem(blob string) {
-	lines := strings.Split(blob, "\n")
-	matches := []string{"Page hash", "Dictionary cache", "File system", "Lock system", "Recovery system",
-		"Dictionary memory allocated", "Buffer pool size", "Free buffers", "Database pages", "Old database pages",
-		"Modified db pages", "Pending reads", "Pending writes: LRU", "Pages made young", "Pages read"}
-	for _, line := range lines {
-		line = strings.Split(strings.Trim(line, " \n"), ",")[0]
-		//so many regular expressions. just gonna hard code some of them
-		words := strings.Split(line, " ")
-		if m, _ := regexp.MatchString("Total memory allocated by read views \\d+", line); m {
-			idb.Metrics["total_mem_by_read_views"] = words[len(words)-1]
-		} else if m, _ := regexp.MatchString("Total memory allocated \\d+", line); m {
-			line := strings.Split(line, ";")[0]
-			words := strings.Split(line, " ")
-			idb.Metrics["total_mem"] = words[len(words)-1]
-		} else if m, _ := regexp.MatchString("Adaptive hash index", line); m {
-			idb.Metrics["adaptive_hash"] = words[3]
-		} else {
-			for _, match := range matches {
-				if m, _ := regexp.MatchString(match, line); m {
-					line = strings.Split(line, ",")[0]
-					key := strings.Trim(strings.ToLower(strings.Replace(strings.Replace(match, " ", "_", -1), ":", "", -1)), " \n\t\f\r")
-					if _, ok := idb.Metrics[key]; ok {
-						continue
-					}
-					key_len := len(strings.Split(key, "_"))
-					idb.Metrics[key] = strings.Trim(strings.Split(strings.Join(words[key_len:], ""), "(")[0], " \n\t\f\r")
-				} else if m, _ := regexp.MatchString("Buffer pool hit rate", line); m {
-					line := strings.Split(line, ",")[0]
-					words := strings.Split(line, " ")
-					num, _ := strconv.ParseFloat(words[4], 64)
-					den, _ := strconv.ParseFloat(words[6], 64)
-					idb.Metrics["buffer_pool_hit_rate"] = strconv.FormatFloat(num/den, 'f', -1, 64)
-					idb.Metrics["cache_hit_pct"] = strconv.FormatFloat((num/den)*100.0, 'f', -1, 64)
-				}
-			}
-		}
+//returns the last rate computed for counter name. false until the
+// counter has been updated twice
+func (r *CounterRates) Rate(name string) (float64, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rate, ok := r.rates[name]
+	return rate, ok
+}
+
+//one counter value recorded by CounterRates, as saved between runs
+type CounterSample struct {
+	Value uint64    `json:"value"`
+	At    time.Time `json:"at"`
+}
+
+//returns the last value recorded for each counter, to be given to
+// Restore by the next run so its first rates aren't lost
+func (r *CounterRates) Samples() map[string]CounterSample {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	samples := make(map[string]CounterSample, len(r.prev))
+	for name, p := range r.prev {
+		samples[name] = CounterSample{p.value, p.at}
+	}
+	return samples
+}
+
+//sets the previous value of each counter in samples, as returned by
+// Samples, so the next Update computes a rate from it. counters
+// updated since are kept
+func (r *CounterRates) Restore(samples map[string]CounterSample) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.prev == nil {
+		r.prev = make(map[string]counterSample)
+		r.rates = make(map[string]float64)
+	}
+	for name, sample := range samples {
+		if _, ok := r.prev[name]; !ok {
+			r.prev[name] = counterSample{sample.Value, sample.At}
+		}
+	}
+}
+
+//a sliding window of samples of one value, for stats over the last few
+// collections rather than only the latest. it holds at most size
+// samples, and drops samples older than age when age is set
+type Window struct {
+	lock    sync.Mutex
+	size    int
+	age     time.Duration
+	samples []windowSample
+}
+
+type windowSample struct {
+	at    time.Time
+	value float64
+}
+
+//creates a window of the last size samples. an age of 0 keeps samples
+// until size newer ones replace them
+func NewWindow(size int, age time.Duration) *Window {
+	return &Window{size: size, age: age}
+}
+
+//records value, sampled at time at
+func (w *Window) Add(at time.Time, value float64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.samples = append(w.samples, windowSample{at, value})
+	drop := 0
+	for drop < len(w.samples) && (len(w.samples)-drop > w.size ||
+		(w.age > 0 && at.Sub(w.samples[drop].at) > w.age)) {
+		drop++
+	}
+	w.samples = append(w.samples[:0], w.samples[drop:]...)
+}
+
+//returns the p-th percentile of the samples in the window, the
+// smallest sample at least p percent of samples are no greater than.
+// NaN if the window is empty
+func (w *Window) Percentile(p float64) float64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.samples) == 0 {
+		return math.NaN()
+	}
+	values := make([]float64, len(w.samples))
+	for i, sample := range w.samples {
+		values[i] = sample.value
+	}
+	sort.Float64s(values)
+	rank := int(math.Ceil(p/100*float64(len(values)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(values) {
+		rank = len(values) - 1
+	}
+	return values[rank]
+}
+
+//returns the largest sample in the window, NaN if it is empty
+func (w *Window) Max() float64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	max := math.NaN()
+	for _, sample := range w.samples {
+		if math.IsNaN(max) || sample.value > max {
+			max = sample.value
+		}
+	}
+	return max
+}
+
+// ResultRow - row i of a result from QueryReturnColumnDict, read with
+// typed accessors. NULL, empty and missing values all read as not set,
+// and values that don't parse are logged in one place
+type ResultRow struct {
+	res map[string][]string
+	i   int
+	log func(interface{}) //gets values that don't parse, nil to not log
+}
+
+//returns row i of res. log is usually the Log method of the MysqlDB res
+// came from
+func NewResultRow(res map[string][]string, i int, log func(interface{})) ResultRow {
+	return ResultRow{res, i, log}
+}
+
+//returns the value of col, false if it is NULL, empty or missing
+func (r ResultRow) String(col string) (string, bool) {
+	values := r.res[col]
+	if r.i < 0 || r.i >= len(values) || values[r.i] == "" {
+		return "", false
+	}
+	return values[r.i], true
+}
+
+//returns the value of col as a float, false if it isn't set or doesn't
+// parse
+func (r ResultRow) Float(col string) (float64, bool) {
+	v, ok := r.String(col)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		r.parseError(col, v)
+		return 0, false
+	}
+	return f, true
+}
+
+//returns the value of col as an integer, false if it isn't set or
+// doesn't parse
+func (r ResultRow) Int(col string) (int64, bool) {
+	v, ok := r.String(col)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		r.parseError(col, v)
+		return 0, false
+	}
+	return n, true
+}
+
+//returns the value of col as an unsigned integer, for counters. false if
+// it isn't set or doesn't parse
+func (r ResultRow) Uint(col string) (uint64, bool) {
+	v, ok := r.String(col)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		r.parseError(col, v)
+		return 0, false
+	}
+	return n, true
+}
+
+func (r ResultRow) parseError(col, v string) {
+	if r.log != nil {
+		r.log("can't parse " + col + ": " + strconv.Quote(v))
+	}
+}
+
+//lists of values that fingerprint to (?, ?, ...), and repeats of them
+// as in multi-row inserts
+var (
+	fingerprintList    = regexp.MustCompile(`\(\s*\?(\s*,\s*\?)*\s*\)`)
+	fingerprintRepeats = regexp.MustCompile(`\(\?\+\)(\s*,\s*\(\?\+\))+`)
+)
+
+//returns the shape of query with the data left out, so queries that
+// differ only in their values fingerprint the same: quoted strings and
+// numbers become ?, lists of values become (?+), comments are dropped,
+// whitespace is collapsed and everything but `quoted` names is lower
+// case
+func Fingerprint(query string) string {
+	var b strings.Builder
+	in := []rune(query)
+	space := false
+	prev := ' '
+	for i := 0; i < len(in); i++ {
+		c := in[i]
+		switch {
+		case c == '/' && i+1 < len(in) && in[i+1] == '*':
+			for i += 2; i < len(in) && !(in[i] == '*' && i+1 < len(in) && in[i+1] == '/'); i++ {
+			}
+			i++
+			space = true
+			continue
+		case c == '#' || (c == '-' && i+1 < len(in) && in[i+1] == '-'):
+			for ; i < len(in) && in[i] != '\n'; i++ {
+			}
+			space = true
+			continue
+		case unicode.IsSpace(c):
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteRune(' ')
+		}
+		space = false
+		switch {
+		case c == '\'' || c == '"':
+			for i++; i < len(in); i++ {
+				if in[i] == '\\' {
+					i++
+				} else if in[i] == c {
+					if i+1 < len(in) && in[i+1] == c {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			b.WriteRune('?')
+		case c == '`':
+			b.WriteRune(c)
+			for i++; i < len(in); i++ {
+				b.WriteRune(in[i])
+				if in[i] == '`' {
+					break
+				}
+			}
+		case unicode.IsDigit(c) && !(unicode.IsLetter(prev) || unicode.IsDigit(prev) || prev == '_'):
+			for i+1 < len(in) && (unicode.IsLetter(in[i+1]) || unicode.IsDigit(in[i+1]) || in[i+1] == '.') {
+				i++
+			}
+			b.WriteRune('?')
+			c = '?'
+		default:
+			b.WriteRune(unicode.ToLower(c))
+		}
+		prev = c
+	}
+	fingerprint := fingerprintList.ReplaceAllString(b.String(), "(?+)")
+	return fingerprintRepeats.ReplaceAllString(fingerprint, "(?+)")
+}
+
+//returns a short id for fingerprint, usable as a metric name component
+func FingerprintID(fingerprint string) string {
+	sum := sha256.Sum256([]byte(fingerprint))
+	return hex.EncodeToString(sum[:8])
+}
+
+//returns the bytes available to unprivileged users and the total size of
+// the filesystem holding path
+func DiskUsage(path string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
+
+// RawResult - the unparsed result of a getter's query, for debugging parsers
+type RawResult struct {
+	Query   string              `json:"query"`
+	Columns map[string][]string `json:"columns,omitempty"`
+	Error   string              `json:"error,omitempty"`
+}
+
+//runs each query and returns what it returned by column, keyed the
+// same way as queries. failed queries keep their error instead
+func QueryRaw(db MysqlDB, queries map[string]string) map[string]RawResult {
+	results := make(map[string]RawResult)
+	for name, query := range queries {
+		res, err := db.QueryReturnColumnDict(query)
+		result := RawResult{Query: query, Columns: res}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results[name] = result
+	}
+	return results
+}
+
+// Expected - what a getter needs from its query to parse it
+type Expected struct {
+	Columns  []string //column names
+	Names    []string //values of the Variable_name column, for SHOW STATUS queries
+	Optional bool     //the query fails on servers without the feature
+}
+
+// GetterCheck - whether a getter's query returned what the getter expects
+type GetterCheck struct {
+	Getter  string
+	Missing []string //expected columns or names that weren't returned
+	Err     string   //error running the query
+	Skipped bool     //an optional query failed
+}
+
+func (c GetterCheck) Passed() bool {
+	return c.Skipped || (c.Err == "" && len(c.Missing) == 0)
+}
+
+func (c GetterCheck) String() string {
+	switch {
+	case c.Skipped:
+		return "SKIP " + c.Getter + ": " + c.Err
+	case c.Err != "":
+		return "FAIL " + c.Getter + ": " + c.Err
+	case len(c.Missing) > 0:
+		return "FAIL " + c.Getter + ": missing " + strings.Join(c.Missing, ", ")
+	}
+	return "PASS " + c.Getter
+}
+
+//compares the raw result of each getter in expected with what it
+// expects, returning one check per getter sorted by name
+func CheckColumns(raw map[string]RawResult, expected map[string]Expected) []GetterCheck {
+	var getters []string
+	for getter := range expected {
+		getters = append(getters, getter)
+	}
+	sort.Strings(getters)
+	checks := make([]GetterCheck, 0, len(getters))
+	for _, getter := range getters {
+		want := expected[getter]
+		check := GetterCheck{Getter: getter}
+		result, ok := raw[getter]
+		switch {
+		case !ok:
+			check.Err = "no result"
+		case result.Error != "":
+			check.Err = result.Error
+			check.Skipped = want.Optional && ClassifyError(errors.New(result.Error)) == ErrorUnsupported
+		default:
+			for _, col := range want.Columns {
+				if _, ok := result.Columns[col]; !ok {
+					check.Missing = append(check.Missing, col)
+				}
+			}
+			names := make(map[string]bool)
+			for _, name := range result.Columns["Variable_name"] {
+				names[name] = true
+			}
+			for _, name := range want.Names {
+				if !names[name] {
+					check.Missing = append(check.Missing, name)
+				}
+			}
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+//holds lines of graphite output until Flush, which writes them to w
+// sorted by metric name, so output is the same from one collection to
+// the next whatever order the metrics were read in
+type SortedWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func NewSortedWriter(w io.Writer) *SortedWriter {
+	return &SortedWriter{w: w}
+}
+
+func (s *SortedWriter) Write(p []byte) (int, error) {
+	return s.buf.Write(p)
+}
+
+//writes the lines held so far to w, sorted by their first field.
+// lines of the same metric keep the order they were written in
+func (s *SortedWriter) Flush() error {
+	lines := strings.SplitAfter(s.buf.String(), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	s.buf.Reset()
+	name := func(line string) string {
+		if i := strings.IndexAny(line, " \n"); i >= 0 {
+			return line[:i]
+		}
+		return line
+	}
+	sort.SliceStable(lines, func(a, b int) bool { return name(lines[a]) < name(lines[b]) })
+	for _, line := range lines {
+		if _, err := io.WriteString(s.w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//writes metrics to w as a JSON list, one record at a time, so large
+// sets of metrics are never held in memory as a whole
+type JSONWriter struct {
+	w     io.Writer
+	count int
+	err   error
+	names map[string]bool //names written so far
+	dups  []string        //names written again, whose records were dropped
+}
+
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{w: w}
+}
+
+//writes a counter record. rates that can't be computed yet are written as 0
+func (j *JSONWriter) Counter(name string, value uint64, rate float64) {
+	if math.IsNaN(rate) || math.IsInf(rate, 0) {
+		rate = 0
+	}
+	j.record(name, `{"type": "counter", "name": `+quoteJSON(name)+
+		`, "value": `+strconv.FormatUint(value, 10)+
+		`, "rate": `+strconv.FormatFloat(rate, 'f', -1, 64)+`}`)
+}
+
+//writes a gauge record. gauges without a value are skipped
+func (j *JSONWriter) Gauge(name string, value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	j.record(name, `{"type": "gauge", "name": `+quoteJSON(name)+
+		`, "value": `+strconv.FormatFloat(value, 'f', -1, 64)+`}`)
+}
+
+//after the first write error, further records are dropped. so are
+// records for a name that was already written, so a list never holds
+// two values for one metric
+func (j *JSONWriter) record(name, rec string) {
+	if j.err != nil {
+		return
+	}
+	if j.names == nil {
+		j.names = make(map[string]bool)
+	}
+	if j.names[name] {
+		j.dups = append(j.dups, name)
+		return
+	}
+	j.names[name] = true
+	sep := ",\n"
+	if j.count == 0 {
+		sep = "[\n"
+	}
+	_, j.err = io.WriteString(j.w, sep+rec)
+	j.count++
+}
+
+//returns the names of records dropped because a record of the same name
+// was written before them
+func (j *JSONWriter) Duplicates() []string {
+	return j.dups
+}
+
+//ends the list and returns the first error hit while writing
+func (j *JSONWriter) Close() error {
+	if j.err != nil {
+		return j.err
+	}
+	end := "]\n"
+	if j.count == 0 {
+		end = "[]\n"
+	}
+	_, j.err = io.WriteString(j.w, end)
+	return j.err
+}
+
+func quoteJSON(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+const (
+	minGraphiteBackoff = time.Second
+	maxGraphiteBackoff = time.Minute
+	graphiteTimeout    = 10 * time.Second
+	//lines past this are dropped while carbon can't be reached
+	maxGraphiteBuffer = 4 << 20
+)
+
+//buffers graphite lines and sends them to carbon over TCP. buffered
+// lines are sent once the flush interval has passed and on Flush.
+// a failed send drops the connection, keeps the lines not sent whole and
+// reconnects on a later flush, waiting longer after each failure
+type GraphiteSink struct {
+	addr       string
+	interval   time.Duration
+	minBackoff time.Duration
+
+	lock      sync.Mutex
+	conn      net.Conn
+	buf       bytes.Buffer
+	lastFlush time.Time
+	backoff   time.Duration
+	retryAt   time.Time
+	changes   *ChangeFilter //drops unchanged lines, nil to send every line
+	dropped   uint64        //lines dropped because the buffer was full
+}
+
+//creates a sink for the carbon server at addr, host:port. an interval
+// of 0 only sends lines on Flush
+func NewGraphiteSink(addr string, interval time.Duration) *GraphiteSink {
+	return &GraphiteSink{
+		addr:       addr,
+		interval:   interval,
+		minBackoff: minGraphiteBackoff,
+		lastFlush:  time.Now(),
+	}
+}
+
+//only send lines f lets through, see ChangeFilter. nil sends every line
+func (g *GraphiteSink) SetChangeFilter(f *ChangeFilter) {
+	g.lock.Lock()
+	g.changes = f
+	g.lock.Unlock()
+}
+
+//buffers p, sending the buffer if the flush interval has passed. p
+// holds whole lines
+func (g *GraphiteSink) Write(p []byte) (int, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	//checked before filtering, so the filter doesn't take dropped lines
+	// for sent and hold them back as unchanged
+	if g.buf.Len()+len(p) > maxGraphiteBuffer {
+		g.dropped += uint64(bytes.Count(p, []byte("\n")))
+		return 0, errors.New("graphite buffer full, dropping metrics for " + g.addr)
+	}
+	lines := p
+	if g.changes != nil {
+		lines = g.changes.Filter(p, time.Now())
+	}
+	g.buf.Write(lines)
+	if g.interval > 0 && time.Since(g.lastFlush) >= g.interval {
+		//lines carbon didn't get whole stay buffered for the next flush
+		g.flush()
+	}
+	return len(p), nil
+}
+
+//returns how many lines have been dropped because the buffer was full
+// while carbon couldn't be reached
+func (g *GraphiteSink) Dropped() uint64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.dropped
+}
+
+//sends everything buffered
+func (g *GraphiteSink) Flush() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.flush()
+}
+
+func (g *GraphiteSink) flush() error {
+	now := time.Now()
+	g.lastFlush = now
+	if g.buf.Len() == 0 {
+		return nil
+	}
+	if g.conn == nil {
+		if now.Before(g.retryAt) {
+			return errors.New("waiting to reconnect to graphite at " + g.addr)
+		}
+		conn, err := net.DialTimeout("tcp", g.addr, graphiteTimeout)
+		if err != nil {
+			g.retry(now)
+			return err
+		}
+		g.conn = conn
+	}
+	g.conn.SetWriteDeadline(now.Add(graphiteTimeout))
+	n, err := g.conn.Write(g.buf.Bytes())
+	if err != nil {
+		//the last line may have been cut off, it is sent again whole
+		n = bytes.LastIndexByte(g.buf.Bytes()[:n], '\n') + 1
+	}
+	g.buf.Next(n)
+	if err != nil {
+		g.conn.Close()
+		g.conn = nil
+		g.retry(now)
+		return err
+	}
+	g.backoff = 0
+	return nil
+}
+
+//doubles the wait before the next connection attempt
+func (g *GraphiteSink) retry(now time.Time) {
+	if g.backoff == 0 {
+		g.backoff = g.minBackoff
+	} else {
+		g.backoff *= 2
+	}
+	if g.backoff > maxGraphiteBackoff {
+		g.backoff = maxGraphiteBackoff
+	}
+	g.retryAt = now.Add(g.backoff)
+}
+
+//sends what is buffered and closes the connection
+func (g *GraphiteSink) Close() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	err := g.flush()
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+	return err
+}
+
+const (
+	minPushBackoff = time.Second
+	maxPushBackoff = time.Minute
+	pushTimeout    = 10 * time.Second
+	//the Push rpc of the MetricsBus service in metrics.proto
+	pushMethod = "/inspectmysql.MetricsBus/Push"
+)
+
+//protobuf wire types used by the messages in metrics.proto
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+//pushes metrics to a MetricsBus server, see metrics.proto, with a unary
+// gRPC call over HTTP/2 without TLS. a failed push drops the connection
+// and a later push reconnects, waiting longer after each failure.
+// metrics collected while waiting aren't sent
+type GRPCPush struct {
+	addr       string
+	minBackoff time.Duration
+	transport  *http.Transport
+	client     *http.Client
+
+	lock    sync.Mutex
+	backoff time.Duration
+	retryAt time.Time
+}
+
+//creates a client for the MetricsBus server at addr, host:port
+func NewGRPCPush(addr string) *GRPCPush {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{Protocols: protocols}
+	return &GRPCPush{
+		addr:       addr,
+		minBackoff: minPushBackoff,
+		transport:  transport,
+		client:     &http.Client{Transport: transport, Timeout: pushTimeout},
+	}
+}
+
+//sends each record write makes as a Metric with the collection time at
+// and labels
+func (p *GRPCPush) Push(at time.Time, labels map[string]string, write func(j *JSONWriter)) error {
+	msg, err := encodePushRequest(at, labels, write)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	if now.Before(p.retryAt) {
+		return errors.New("waiting to reconnect to the gRPC server at " + p.addr)
+	}
+	if err := p.call(msg); err != nil {
+		p.transport.CloseIdleConnections()
+		p.retry(now)
+		return err
+	}
+	p.backoff = 0
+	return nil
+}
+
+//makes the Push call with the encoded PushRequest msg
+func (p *GRPCPush) call(msg []byte) error {
+	//each message is framed by a compressed flag and its length
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+	req, err := http.NewRequest("POST", "http://"+p.addr+pushMethod, bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	//trailers are only there once the body is read
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("gRPC push to " + p.addr + " failed: " + resp.Status)
+	}
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	//a call that fails before answering has only headers
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		if m, err := url.PathUnescape(message); err == nil {
+			message = m
+		}
+		return errors.New("gRPC push to " + p.addr + " failed with status " + status + ": " + message)
+	}
+	return nil
+}
+
+//doubles the wait before the next push
+func (p *GRPCPush) retry(now time.Time) {
+	if p.backoff == 0 {
+		p.backoff = p.minBackoff
+	} else {
+		p.backoff *= 2
+	}
+	if p.backoff > maxPushBackoff {
+		p.backoff = maxPushBackoff
+	}
+	p.retryAt = now.Add(p.backoff)
+}
+
+//encodes the records write makes as a PushRequest from metrics.proto
+func encodePushRequest(at time.Time, labels map[string]string, write func(j *JSONWriter)) ([]byte, error) {
+	var buf bytes.Buffer
+	j := NewJSONWriter(&buf)
+	write(j)
+	if err := j.Close(); err != nil {
+		return nil, err
+	}
+	var records []struct {
+		Type  string      `json:"type"`
+		Name  string      `json:"name"`
+		Value json.Number `json:"value"`
+	}
+	dec := json.NewDecoder(&buf)
+	dec.UseNumber()
+	if err := dec.Decode(&records); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ms := uint64(at.UnixNano() / int64(time.Millisecond))
+	var req []byte
+	for _, rec := range records {
+		value, err := rec.Value.Float64()
+		if err != nil {
+			return nil, err
+		}
+		var m []byte
+		m = appendProtoVarint(m, 1<<3|protoVarint)
+		m = appendProtoVarint(m, ms)
+		m = appendProtoBytes(m, 2, []byte(rec.Name))
+		//GAUGE is the default and left out
+		if rec.Type == "counter" {
+			m = appendProtoVarint(m, 3<<3|protoVarint)
+			m = appendProtoVarint(m, 1)
+		}
+		m = appendProtoVarint(m, 4<<3|protoFixed64)
+		m = binary.LittleEndian.AppendUint64(m, math.Float64bits(value))
+		for _, k := range keys {
+			entry := appendProtoBytes(appendProtoBytes(nil, 1, []byte(k)), 2, []byte(labels[k]))
+			m = appendProtoBytes(m, 5, entry)
+		}
+		//counters are also sent exactly, doubles lose precision past 2^53
+		if rec.Type == "counter" {
+			count, err := strconv.ParseUint(rec.Value.String(), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			m = appendProtoVarint(m, 6<<3|protoVarint)
+			m = appendProtoVarint(m, count)
+		}
+		req = appendProtoBytes(req, 1, m)
+	}
+	return req, nil
+}
+
+func appendProtoVarint(b []byte, v uint64) []byte {
+	return binary.AppendUvarint(b, v)
+}
+
+//appends field as a length delimited value
+func appendProtoBytes(b []byte, field uint64, v []byte) []byte {
+	b = appendProtoVarint(b, field<<3|protoBytes)
+	b = appendProtoVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+//drops graphite lines whose value is the same as when the metric was
+// last let through, so a push sink with little bandwidth only gets what
+// changed. every metric is still let through at least once a heartbeat,
+// so the backend doesn't take its series for dead
+type ChangeFilter struct {
+	heartbeat time.Duration
+
+	lock sync.Mutex
+	sent map[string]sentValue //last line let through, by metric name
+}
+
+type sentValue struct {
+	value string
+	at    time.Time
+}
+
+func NewChangeFilter(heartbeat time.Duration) *ChangeFilter {
+	return &ChangeFilter{heartbeat: heartbeat, sent: make(map[string]sentValue)}
+}
+
+//returns the lines of p, "<name> <value> [timestamp]" graphite lines,
+// whose value changed since they were last let through or whose
+// heartbeat is due at now
+func (f *ChangeFilter) Filter(p []byte, now time.Time) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var out bytes.Buffer
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			out.WriteString(line)
+			continue
+		}
+		last, ok := f.sent[fields[0]]
+		if ok && last.value == fields[1] && now.Sub(last.at) < f.heartbeat {
+			continue
+		}
+		f.sent[fields[0]] = sentValue{value: fields[1], at: now}
+		out.WriteString(line)
+	}
+	return out.Bytes()
+}
+
+//characters graphite doesn't allow in tag names and values, and spaces,
+// which end the name of a line
+var (
+	graphiteTagKeyEscaper   = strings.NewReplacer(";", "_", "!", "_", "^", "_", "=", "_", " ", "_")
+	graphiteTagValueEscaper = strings.NewReplacer(";", "_", " ", "_")
+)
+
+//writes p, "<name> <value> [timestamp]" graphite lines, to w with labels
+// added to every name as graphite tags, sorted by key:
+// Queries.Value;host=db1;role=primary 10
+// so labels such as the host don't have to be part of the dotted name.
+// labels with an empty key or value are left out, as graphite doesn't
+// accept them, and a value can't start with ~
+func FormatGraphiteTagged(w io.Writer, p []byte, labels map[string]string) error {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	tags := ""
+	for _, key := range keys {
+		value := strings.TrimLeft(graphiteTagValueEscaper.Replace(labels[key]), "~")
+		if key == "" || value == "" {
+			continue
+		}
+		tags += ";" + graphiteTagKeyEscaper.Replace(key) + "=" + value
+	}
+	var out bytes.Buffer
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		i := strings.Index(line, " ")
+		if i <= 0 {
+			out.WriteString(line)
+			continue
+		}
+		out.WriteString(line[:i] + tags + line[i:])
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// ConcurrencyTuner - picks how many connections a collection runs its
+// queries on, between min and max, from the query time of the last
+// window collections. A collection on n connections takes about its
+// getters' query time over n, and the fewest connections that keep that
+// within target are picked, to spare the server
+type ConcurrencyTuner struct {
+	min, max int
+	target   time.Duration
+	window   int
+	work     []time.Duration //query time of recent collections, oldest first
+	current  int
+}
+
+func NewConcurrencyTuner(min, max int, target time.Duration, window int) *ConcurrencyTuner {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	if window < 1 {
+		window = 1
+	}
+	return &ConcurrencyTuner{min: min, max: max, target: target, window: window, current: max}
+}
+
+//records how long each getter of a collection took, of which waited
+// was spent waiting for a free connection rather than querying. returns
+// the connections to use next, and whether that changed. the first
+// window collections run on max connections while they are measured
+func (t *ConcurrencyTuner) Observe(latencies []time.Duration, waited time.Duration) (int, bool) {
+	work := -waited
+	for _, latency := range latencies {
+		work += latency
+	}
+	if work < 0 {
+		work = 0
+	}
+	t.work = append(t.work, work)
+	if len(t.work) > t.window {
+		t.work = t.work[1:]
+	}
+	if len(t.work) < t.window {
+		return t.current, false
+	}
+	var total time.Duration
+	for _, w := range t.work {
+		total += w
+	}
+	avg := total / time.Duration(len(t.work))
+	next := t.max
+	for n := t.min; n < t.max; n++ {
+		if avg/time.Duration(n) <= t.target {
+			next = n
+			break
+		}
+	}
+	changed := next != t.current
+	t.current = next
+	return next, changed
+}
+
+// HistoryPoint - the value of a metric at one collection
+type HistoryPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type historySnapshot struct {
+	at     time.Time
+	values map[string]float64
+}
+
+//the values of every metric at the last few collections, for a quick
+// look back on a host without a time series database. once full, each
+// new snapshot replaces the oldest
+type History struct {
+	lock  sync.Mutex
+	snaps []historySnapshot
+	next  int //index the next snapshot is written to
+	full  bool
+}
+
+//creates a history holding the last size snapshots
+func NewHistory(size int) *History {
+	return &History{snaps: make([]historySnapshot, size)}
+}
+
+//records the metric values of the collection made at time at
+func (h *History) Add(at time.Time, values map[string]float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.snaps) == 0 {
+		return
+	}
+	h.snaps[h.next] = historySnapshot{at, values}
+	h.next = (h.next + 1) % len(h.snaps)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+//returns the recorded values of metric, oldest first. snapshots
+// without the metric are left out
+func (h *History) Values(metric string) []HistoryPoint {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	start, n := 0, h.next
+	if h.full {
+		start, n = h.next, len(h.snaps)
+	}
+	points := []HistoryPoint{}
+	for i := 0; i < n; i++ {
+		snap := h.snaps[(start+i)%len(h.snaps)]
+		if v, ok := snap.values[metric]; ok {
+			points = append(points, HistoryPoint{snap.at, v})
+		}
+	}
+	return points
+}
+
+//returns the value of each record write makes, by name, as it would
+// appear in JSON output. counters give their value, not their rate
+func SnapshotValues(write func(j *JSONWriter)) (map[string]float64, error) {
+	var buf bytes.Buffer
+	j := NewJSONWriter(&buf)
+	write(j)
+	if err := j.Close(); err != nil {
+		return nil, err
+	}
+	var records []struct {
+		Name  string  `json:"name"`
+		Value float64 `json:"value"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &records); err != nil {
+		return nil, err
+	}
+	values := make(map[string]float64, len(records))
+	for _, rec := range records {
+		values[rec.Name] = rec.Value
+	}
+	return values, nil
+}
+
+// Alert - an alert rule whose metric matched it at the last evaluation
+type Alert struct {
+	Metric    string    `json:"metric"`
+	Op        string    `json:"op"`
+	Threshold float64   `json:"threshold"`
+	Severity  string    `json:"severity"`
+	Value     float64   `json:"value"`
+	Since     time.Time `json:"since"` //first of the evaluations in a row that matched
+}
+
+//describes the alert for log lines, e.g.
+// warning: mysqlstat.SlaveSecondsBehindMaster 45 > 30
+func (a Alert) String() string {
+	return a.Severity + ": " + a.Metric + " " + FormatValue(a.Value, 5) + " " + a.Op + " " +
+		FormatValue(a.Threshold, 5)
+}
+
+//comparisons alert rules can make, by operator
+var alertOps = map[string]func(v, threshold float64) bool{
+	">":  func(v, threshold float64) bool { return v > threshold },
+	">=": func(v, threshold float64) bool { return v >= threshold },
+	"<":  func(v, threshold float64) bool { return v < threshold },
+	"<=": func(v, threshold float64) bool { return v <= threshold },
+	"==": func(v, threshold float64) bool { return v == threshold },
+	"!=": func(v, threshold float64) bool { return v != threshold },
+}
+
+// Alerts - rules comparing a metric with a threshold, evaluated after
+// each collection, for basic alerting without Prometheus or another
+// alerting system
+type Alerts struct {
+	lock   sync.Mutex
+	rules  []Alert       //the rules, without a value
+	firing map[int]Alert //rules that matched at the last evaluation, by index in rules
+}
+
+func NewAlerts() *Alerts {
+	return &Alerts{firing: make(map[int]Alert)}
+}
+
+//adds a rule that fires while metric, named as in JSON output, compares
+// to threshold with op, one of >, >=, <, <=, == and !=
+func (a *Alerts) AddAlertRule(metric string, op string, threshold float64, severity string) error {
+	if _, ok := alertOps[op]; !ok {
+		return errors.New("unknown alert operator " + strconv.Quote(op))
+	}
+	if metric == "" {
+		return errors.New("alert rule without a metric")
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.rules = append(a.rules, Alert{Metric: metric, Op: op, Threshold: threshold, Severity: severity})
+	return nil
+}
+
+//compares values, as returned by SnapshotValues, with every rule.
+// returns the alerts that started firing and the ones that stopped
+// since the last evaluation. a metric that is missing or NaN doesn't
+// match any rule
+func (a *Alerts) Evaluate(at time.Time, values map[string]float64) (started, resolved []Alert) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for i, rule := range a.rules {
+		v, ok := values[rule.Metric]
+		matched := ok && !math.IsNaN(v) && alertOps[rule.Op](v, rule.Threshold)
+		last, firing := a.firing[i]
+		switch {
+		case matched && firing:
+			last.Value = v
+			a.firing[i] = last
+		case matched:
+			alert := rule
+			alert.Value = v
+			alert.Since = at
+			a.firing[i] = alert
+			started = append(started, alert)
+		case firing:
+			delete(a.firing, i)
+			resolved = append(resolved, last)
+		}
+	}
+	return started, resolved
+}
+
+//returns the alerts firing at the last evaluation, in the order their
+// rules were added
+func (a *Alerts) Firing() []Alert {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	alerts := []Alert{}
+	for i := range a.rules {
+		if alert, ok := a.firing[i]; ok {
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts
+}
+
+// SampleStats - the spread of a metric's values over several collections
+type SampleStats struct {
+	Min   float64 `json:"min"`
+	Avg   float64 `json:"avg"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"` //samples the metric was in
+}
+
+//returns the min, average and max of each metric over samples, as
+// returned by SnapshotValues. a metric missing from some samples is
+// aggregated over the samples it is in
+func AggregateSamples(samples []map[string]float64) map[string]SampleStats {
+	stats := make(map[string]SampleStats)
+	for _, values := range samples {
+		for name, v := range values {
+			st, ok := stats[name]
+			if !ok {
+				st = SampleStats{Min: v, Max: v}
+			}
+			st.Min = math.Min(st.Min, v)
+			st.Max = math.Max(st.Max, v)
+			//Avg holds the running sum until every sample is in
+			st.Avg += v
+			st.Count++
+			stats[name] = st
+		}
+	}
+	for name, st := range stats {
+		st.Avg /= float64(st.Count)
+		stats[name] = st
+	}
+	return stats
+}
+
+//writes each record write makes in the Prometheus text exposition
+// format, each metric after a # TYPE line saying if it is a counter or a
+// gauge:
+// # TYPE mysqlstat_Queries counter
+// mysqlstat_Queries 1000
+// runs of characters Prometheus doesn't allow in names become one "_",
+// so mysqlstat.&buf_pool->LRU_list_mutex is mysqlstat_buf_pool_LRU_list_mutex.
+// names that would then clash get a "_2", "_3", ... suffix. names
+// remembers the name each metric got, so a suffix doesn't move to
+// another metric when the one it clashed with comes or goes; with a nil
+// names they are only kept for this write. values are
+// written as they were formatted, so counters above 2^53 keep every digit
+func WritePrometheus(w io.Writer, names *NameSanitizer, write func(j *JSONWriter)) error {
+	var buf bytes.Buffer
+	j := NewJSONWriter(&buf)
+	write(j)
+	if err := j.Close(); err != nil {
+		return err
+	}
+	var records []struct {
+		Type  string      `json:"type"`
+		Name  string      `json:"name"`
+		Value json.Number `json:"value"`
+	}
+	dec := json.NewDecoder(&buf)
+	dec.UseNumber()
+	if err := dec.Decode(&records); err != nil {
+		return err
+	}
+	if names == nil {
+		names = NewNameSanitizer(NamesPrometheus)
+	}
+	sort.Slice(records, func(a, b int) bool { return records[a].Name < records[b].Name })
+	for _, rec := range records {
+		name := names.Path(rec.Name)
+		_, err := io.WriteString(w, "# TYPE "+name+" "+rec.Type+"\n"+
+			name+" "+rec.Value.String()+"\n")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//how WriteInflux maps metric names to InfluxDB measurements
+type InfluxScheme int
+
+const (
+	InfluxPerMetric InfluxScheme = iota //a measurement for each metric, with a single value field
+	InfluxWide                          //metrics named alike are fields of one measurement
+)
+
+var (
+	influxNameChars = regexp.MustCompile("[^a-zA-Z0-9_]+")
+	influxEscaper   = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+//parses the name of an InfluxScheme, metric or wide
+func ParseInfluxScheme(s string) (InfluxScheme, error) {
+	switch s {
+	case "metric":
+		return InfluxPerMetric, nil
+	case "wide":
+		return InfluxWide, nil
+	}
+	return InfluxPerMetric, errors.New("unknown influx scheme " + s + ", expected metric or wide")
+}
+
+//writes each record write makes in the InfluxDB line protocol. names
+// are split into lower case words, and mysqlstat becomes mysql. with
+// InfluxPerMetric each metric is a measurement of its own:
+// mysql_slave_seconds_behind_master value=3
+// with InfluxWide the first word of the last part of a name joins the
+// measurement, and metrics sharing a measurement are fields of one line:
+// mysql_slave seconds_behind_master=3,position=73i
+// counters are written as integers. labels, if any, are added to every
+// line as tags, and lines end with at in nanoseconds unless it is zero.
+// names that clash get a "_2", "_3", ... suffix, as in WritePrometheus
+func WriteInflux(w io.Writer, at time.Time, scheme InfluxScheme, labels map[string]string,
+	write func(j *JSONWriter)) error {
+	var buf bytes.Buffer
+	j := NewJSONWriter(&buf)
+	write(j)
+	if err := j.Close(); err != nil {
+		return err
+	}
+	var records []struct {
+		Type  string      `json:"type"`
+		Name  string      `json:"name"`
+		Value json.Number `json:"value"`
+	}
+	dec := json.NewDecoder(&buf)
+	dec.UseNumber()
+	if err := dec.Decode(&records); err != nil {
+		return err
+	}
+	sort.SliceStable(records, func(a, b int) bool { return records[a].Name < records[b].Name })
+	tags := ""
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tags += "," + influxEscaper.Replace(key) + "=" + influxEscaper.Replace(labels[key])
+	}
+	ts := ""
+	if !at.IsZero() {
+		ts = " " + strconv.FormatInt(at.UnixNano(), 10)
+	}
+	var measurements []string
+	fields := make(map[string][]string) //fields of each measurement, as name=value
+	taken := make(map[string]bool)      //measurement and field names in use
+	for _, rec := range records {
+		measurement, field := influxNames(rec.Name, scheme)
+		if scheme == InfluxPerMetric {
+			for k, base := 2, measurement; taken[measurement]; k++ {
+				measurement = base + "_" + strconv.Itoa(k)
+			}
+		} else {
+			for k, base := 2, field; taken[measurement+" "+field]; k++ {
+				field = base + "_" + strconv.Itoa(k)
+			}
+		}
+		taken[measurement] = true
+		taken[measurement+" "+field] = true
+		value := rec.Value.String()
+		if rec.Type == "counter" {
+			value += "i"
+		}
+		if _, ok := fields[measurement]; !ok {
+			measurements = append(measurements, measurement)
+		}
+		fields[measurement] = append(fields[measurement], field+"="+value)
+	}
+	sort.Strings(measurements)
+	for _, measurement := range measurements {
+		line := measurement + tags + " " + strings.Join(fields[measurement], ",") + ts + "\n"
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//returns the measurement and field name of the metric name under scheme
+func influxNames(name string, scheme InfluxScheme) (string, string) {
+	parts := strings.Split(name, ".")
+	if parts[0] == "mysqlstat" {
+		parts[0] = "mysql"
+	}
+	var measurement []string
+	for _, part := range parts[:len(parts)-1] {
+		measurement = append(measurement, influxWords(part)...)
+	}
+	field := influxWords(parts[len(parts)-1])
+	if scheme == InfluxPerMetric || len(measurement) == 0 {
+		return strings.Join(append(measurement, field...), "_"), "value"
+	}
+	if len(field) > 1 {
+		measurement = append(measurement, field[0])
+		field = field[1:]
+	}
+	return strings.Join(measurement, "_"), strings.Join(field, "_")
+}
+
+//splits a CamelCase name into lower case words, keeping runs of
+// capitals together, so InnodbLRUListLength is innodb lru list length.
+// characters other than letters, digits and "_" separate words too
+func influxWords(s string) []string {
+	var words []string
+	var word []rune
+	runes := []rune(influxNameChars.ReplaceAllString(s, "_"))
+	for i, r := range runes {
+		if r == '_' {
+			if len(word) > 0 {
+				words = append(words, string(word))
+				word = nil
+			}
+			continue
+		}
+		if unicode.IsUpper(r) && len(word) > 0 &&
+			(!unicode.IsUpper(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			words = append(words, string(word))
+			word = nil
+		}
+		word = append(word, unicode.ToLower(r))
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+//writes each record write makes as a JSON object on a line of its own,
+// for log pipelines that ship lines one at a time:
+// {"name": "mysqlstat.Queries", "value": 1000, "type": "counter", "ts": "2014-05-13T15:04:05Z"}
+// at is the collection time, and ts is null before the first
+// collection. labels, if any, are added to every line as "labels".
+// lines are sorted by name
+func WriteNDJSON(w io.Writer, at time.Time, labels map[string]string, write func(j *JSONWriter)) error {
+	var buf bytes.Buffer
+	j := NewJSONWriter(&buf)
+	write(j)
+	if err := j.Close(); err != nil {
+		return err
+	}
+	var records []struct {
+		Type  string      `json:"type"`
+		Name  string      `json:"name"`
+		Value json.Number `json:"value"`
+	}
+	dec := json.NewDecoder(&buf)
+	dec.UseNumber()
+	if err := dec.Decode(&records); err != nil {
+		return err
+	}
+	sort.SliceStable(records, func(a, b int) bool { return records[a].Name < records[b].Name })
+	ts := "null"
+	if !at.IsZero() {
+		ts = quoteJSON(at.UTC().Format(time.RFC3339))
+	}
+	extra := ""
+	if len(labels) > 0 {
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, key := range keys {
+			pairs[i] = quoteJSON(key) + ": " + quoteJSON(labels[key])
+		}
+		extra = `, "labels": {` + strings.Join(pairs, ", ") + `}`
+	}
+	for _, rec := range records {
+		_, err := io.WriteString(w, `{"name": `+quoteJSON(rec.Name)+`, "value": `+rec.Value.String()+
+			`, "type": `+quoteJSON(rec.Type)+`, "ts": `+ts+extra+"}\n")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//runs a collection on demand, at most once per ttl. callers arriving
+// while a collection runs wait for it and share its result instead of
+// starting another
+type CachedCollect struct {
+	collect func() error
+	ttl     time.Duration
+	now     func() time.Time
+
+	lock      sync.Mutex
+	collected bool
+	last      time.Time //when the last collection finished
+	err       error     //error of the last collection
+	running   chan struct{}
+}
+
+func NewCachedCollect(ttl time.Duration, collect func() error) *CachedCollect {
+	return &CachedCollect{collect: collect, ttl: ttl, now: time.Now}
+}
+
+//collects unless the last collection finished less than ttl ago,
+// returning the error of the collection the result came from
+func (c *CachedCollect) Collect() error {
+	c.lock.Lock()
+	if c.collected && c.now().Sub(c.last) < c.ttl {
+		err := c.err
+		c.lock.Unlock()
+		return err
+	}
+	if running := c.running; running != nil {
+		c.lock.Unlock()
+		<-running
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.err
+	}
+	running := make(chan struct{})
+	c.running = running
+	c.lock.Unlock()
+
+	err := c.collect()
+
+	c.lock.Lock()
+	c.collected = true
+	c.last = c.now()
+	c.err = err
+	c.running = nil
+	c.lock.Unlock()
+	close(running)
+	return err
+}
+
+//rules for the characters allowed in metric names built from
+// database objects, such as table names
+type NamePolicy int
+
+const (
+	NamesRaw        NamePolicy = iota //names are used as they are
+	NamesGraphite                     //only [a-zA-Z0-9_-] within a path component, components joined by "."
+	NamesPrometheus                   //only [a-zA-Z0-9_:], runs of others as one "_", not starting with a digit, components joined by "_"
+)
+
+var (
+	graphiteNameChars  = regexp.MustCompile("[^a-zA-Z0-9_-]")
+	graphitePathChars  = regexp.MustCompile("[^a-zA-Z0-9_.-]")
+	prometheusNameRuns = regexp.MustCompile("[^a-zA-Z0-9_:]+")
+)
+
+//builds metric names from source names under a NamePolicy.
+// Each source path always maps to the same name, and two source paths
+// never map to the same name: when cleaning would make them collide,
+// the later one gets a "_2", "_3", ... suffix.
+type NameSanitizer struct {
+	policy NamePolicy
+	lock   sync.Mutex
+	names  map[string]string          //cleaned component, by source path
+	taken  map[string]map[string]bool //cleaned components in use, by parent source path
+}
+
+func NewNameSanitizer(policy NamePolicy) *NameSanitizer {
+	return &NameSanitizer{
+		policy: policy,
+		names:  make(map[string]string),
+		taken:  make(map[string]map[string]bool),
+	}
+}
+
+//returns the metric name for the path of source names, e.g. a
+// database and a table, with each component cleaned
+func (n *NameSanitizer) Path(parts ...string) string {
+	sep := "."
+	if n.policy == NamesPrometheus {
+		sep = "_"
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	out := make([]string, len(parts))
+	parent := ""
+	for i, part := range parts {
+		key := parent + "\x00" + part
+		name, ok := n.names[key]
+		if !ok {
+			name = n.clean(part, i == 0)
+			if n.taken[parent] == nil {
+				n.taken[parent] = make(map[string]bool)
+			}
+			base := name
+			for k := 2; n.taken[parent][name]; k++ {
+				name = base + "_" + strconv.Itoa(k)
+			}
+			n.taken[parent][name] = true
+			n.names[key] = name
+		}
+		out[i] = name
+		parent = key
+	}
+	return strings.Join(out, sep)
+}
+
+//cleans a dotted graphite metric name, or a prefix for one, keeping
+// the dots between components and replacing other characters graphite
+// can't take, such as spaces and the & and > of mutex names, with "_".
+// empty components are left out
+func GraphiteName(name string) string {
+	var parts []string
+	for _, part := range strings.Split(graphitePathChars.ReplaceAllString(name, "_"), ".") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+//cleans a single path component
+func (n *NameSanitizer) clean(part string, first bool) string {
+	switch n.policy {
+	case NamesGraphite:
+		return graphiteNameChars.ReplaceAllString(part, "_")
+	case NamesPrometheus:
+		part = prometheusNameRuns.ReplaceAllString(part, "_")
+		if first && (part == "" || (part[0] >= '0' && part[0] <= '9')) {
+			part = "_" + part
+		}
+		return part
+	}
+	return part
+}
+
+// Target - the server, account and database to connect to
+type Target struct {
+	Host   string //name or IP address, when connecting over TCP
+	Port   int
+	Socket string //path of a unix socket, used instead of Host and Port
+	User   string //empty for the user given separately
+	DB     string //default database, empty for Options.DefaultDB
+}
+
+//parses a target of the form [user@]address[/db], where address is
+// host, host:port, [ipv6]:port, tcp(host:port), unix(/path/to/socket) or
+// a socket path starting with /, which can't be followed by a database.
+// the host defaults to 127.0.0.1 and the port to 3306. a password after
+// the user, as in a pasted dsn, is dropped so it can't end up in logs
+func ParseTarget(s string) (Target, error) {
+	var t Target
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		t.User = s[:i]
+		if j := strings.Index(t.User, ":"); j >= 0 {
+			t.User = t.User[:j]
+		}
+		s = s[i+1:]
+	}
+	rest := ""
+	switch {
+	case strings.HasPrefix(s, "unix("):
+		end := strings.Index(s, ")")
+		if end < 0 {
+			return Target{}, errors.New("target " + strconv.Quote(s) + " is missing a )")
+		}
+		t.Socket, rest = s[len("unix("):end], s[end+1:]
+		if t.Socket == "" {
+			return Target{}, errors.New("target " + strconv.Quote(s) + " has an empty socket path")
+		}
+	case strings.HasPrefix(s, "/"):
+		t.Socket = s
+	default:
+		addr := s
+		if strings.HasPrefix(s, "tcp(") {
+			end := strings.Index(s, ")")
+			if end < 0 {
+				return Target{}, errors.New("target " + strconv.Quote(s) + " is missing a )")
+			}
+			addr, rest = s[len("tcp("):end], s[end+1:]
+		} else if i := strings.Index(s, "/"); i >= 0 {
+			addr, rest = s[:i], s[i:]
+		}
+		host, port, err := splitTargetAddress(addr)
+		if err != nil {
+			return Target{}, errors.New("target " + strconv.Quote(s) + ": " + err.Error())
+		}
+		t.Host, t.Port = host, port
+	}
+	if rest != "" {
+		if !strings.HasPrefix(rest, "/") {
+			return Target{}, errors.New("unexpected " + strconv.Quote(rest) + " after the address in a target")
+		}
+		t.DB = rest[1:]
+	}
+	return t, nil
+}
+
+//splits host:port, filling in the default host and port when either is
+// left out. IPv6 addresses take brackets when followed by a port
+func splitTargetAddress(addr string) (string, int, error) {
+	host, port := addr, ""
+	switch {
+	case strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]"):
+		host = addr[1 : len(addr)-1]
+	case strings.HasPrefix(addr, "[") || strings.Count(addr, ":") == 1:
+		var err error
+		host, port, err = net.SplitHostPort(addr)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	if host == "" {
+		host = defaultTargetHost
+	}
+	if port == "" {
+		return host, defaultTargetPort, nil
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", 0, errors.New("invalid port " + strconv.Quote(port))
+	}
+	return host, n, nil
+}
+
+//returns the address as the driver takes it in a dsn, tcp(host:port) or
+// unix(/path/to/socket)
+func (t Target) Address() string {
+	if t.Socket != "" {
+		return "unix(" + t.Socket + ")"
+	}
+	host, port := t.Host, t.Port
+	if host == "" {
+		host = defaultTargetHost
+	}
+	if port == 0 {
+		port = defaultTargetPort
+	}
+	return "tcp(" + net.JoinHostPort(host, strconv.Itoa(port)) + ")"
+}
+
+//names the account and address connected to, for log lines. the
+// password is never part of it, even when host is a whole dsn
+func TargetName(user, host string) string {
+	if user == "" {
+		user = DEFAULT_MYSQL_USER
+	}
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		host = host[i+1:]
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return user + "@" + host
+}
+
+var (
+	//'user'@'host' in server errors
+	redactAccountRe = regexp.MustCompile(`'([^']*)'@'([^']*)'`)
+	//the address in a dsn, tcp(db1:3306) or unix(/tmp/mysql.sock)
+	redactAddressRe = regexp.MustCompile(`\b(tcp|unix)\(([^)]*)\)`)
+	//host names in net errors, dial tcp: lookup db1.internal: no such host
+	// or dial tcp db1.internal:3306: i/o timeout
+	redactLookupRe = regexp.MustCompile(`\blookup ([^\s:]+)`)
+	redactDialRe   = regexp.MustCompile(`\bdial (tcp[46]?) ([^\s:\[\]]+):(\d+)`)
+	redactIPv4Re   = regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}\b`)
+	//four groups or more, so times such as 12:34:56 are left alone
+	redactIPv6Re = regexp.MustCompile(`(?:[0-9a-fA-F]{1,4}:){3,7}[0-9a-fA-F]{1,4}|` +
+		`[0-9a-fA-F]{0,4}(?::[0-9a-fA-F]{1,4})*::(?:[0-9a-fA-F]{1,4}:)*[0-9a-fA-F]{0,4}`)
+)
+
+//kinds of errors a query can fail with, which decide whether it's
+// retried, recorded as a failed getter or only logged
+type ErrorClass int
+
+const (
+	ErrorFatal          ErrorClass = iota //anything not classified below
+	ErrorTransient                        //worth trying again, e.g. a deadlock or lock wait timeout
+	ErrorPrivilege                        //the user isn't allowed to run the query
+	ErrorConnectionLost                   //the connection went away mid query
+	ErrorUnsupported                      //the server has no such table, column or variable
+)
+
+var (
+	errorClasses = map[uint16]ErrorClass{
+		1040: ErrorTransient,      //too many connections
+		1203: ErrorTransient,      //max_user_connections
+		1205: ErrorTransient,      //lock wait timeout
+		1213: ErrorTransient,      //deadlock
+		1317: ErrorTransient,      //query interrupted
+		3024: ErrorTransient,      //max_execution_time exceeded
+		1044: ErrorPrivilege,      //access denied to database
+		1045: ErrorPrivilege,      //access denied for user
+		1142: ErrorPrivilege,      //command denied on table
+		1143: ErrorPrivilege,      //command denied on column
+		1227: ErrorPrivilege,      //needs SUPER, PROCESS or similar
+		1053: ErrorConnectionLost, //server shutdown in progress
+		2006: ErrorConnectionLost, //server has gone away
+		2013: ErrorConnectionLost, //lost connection during query
+		1054: ErrorUnsupported,    //unknown column
+		1109: ErrorUnsupported,    //unknown table in information_schema
+		1146: ErrorUnsupported,    //table doesn't exist
+		1193: ErrorUnsupported,    //unknown system variable
+	}
+	//errors that went through a plain string keep the driver's format
+	errorNumberRe = regexp.MustCompile(`^Error (\d+)`)
+)
+
+//sorts err into an ErrorClass by its MySQL error number
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorFatal
+	}
+	if err == mysql.ErrInvalidConn || err == driver.ErrBadConn || err == io.EOF {
+		return ErrorConnectionLost
+	}
+	var number uint16
+	var me *mysql.MySQLError
+	if errors.As(err, &me) {
+		number = me.Number
+	} else if m := errorNumberRe.FindStringSubmatch(err.Error()); m != nil {
+		n, _ := strconv.ParseUint(m[1], 10, 16)
+		number = uint16(n)
+	}
+	if class, ok := errorClasses[number]; ok {
+		return class
+	}
+	return ErrorFatal
+}
+
+//replaces accounts, hosts and IP addresses in line with a short hash of
+// each. the same value always gets the same hash, so lines about one
+// client can still be matched up
+func Redact(line string) string {
+	line = redactAccountRe.ReplaceAllStringFunc(line, func(m string) string {
+		parts := redactAccountRe.FindStringSubmatch(m)
+		return "'" + redactedName(parts[1]) + "'@'" + redactedName(parts[2]) + "'"
+	})
+	line = redactAddressRe.ReplaceAllStringFunc(line, func(m string) string {
+		parts := redactAddressRe.FindStringSubmatch(m)
+		return parts[1] + "(" + redactedName(parts[2]) + ")"
+	})
+	line = redactLookupRe.ReplaceAllStringFunc(line, func(m string) string {
+		return "lookup " + redactedName(redactLookupRe.FindStringSubmatch(m)[1])
+	})
+	line = redactDialRe.ReplaceAllStringFunc(line, func(m string) string {
+		parts := redactDialRe.FindStringSubmatch(m)
+		return "dial " + parts[1] + " " + redactedName(parts[2]) + ":" + parts[3]
+	})
+	line = redactIPv4Re.ReplaceAllStringFunc(line, redactedName)
+	return redactIPv6Re.ReplaceAllStringFunc(line, redactedName)
+}
+
+func redactedName(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "redacted-" + hex.EncodeToString(sum[:4])
+}
+
+//returns the name of the nearest Get* method on the call stack.
+// used to attribute errors to the metrics collector that hit them
+func GetterName() string {
+	pc := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pc[:runtime.Callers(2, pc)])
+	for {
+		frame, more := frames.Next()
+		for _, part := range strings.Split(frame.Function, ".") {
+			if strings.HasPrefix(part, "Get") {
+				return part
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	return "unknown"
+}
+
+// GetterErrors - the errors a collector's getters hit, by getter name as
+// GetterName finds it. The zero value is ready to use
+type GetterErrors struct {
+	lock  sync.Mutex
+	errs  map[string]error //errors hit by each getter since Reset
+	total uint64           //errors recorded in every collection so far
+}
+
+// Clears the errors recorded since the last Reset, at the start of a collection
+func (g *GetterErrors) Reset() {
+	g.lock.Lock()
+	g.errs = make(map[string]error)
+	g.lock.Unlock()
+}
+
+// Records err against the getter on the call stack and returns the getter's name
+func (g *GetterErrors) Record(err error) string {
+	name := GetterName()
+	g.lock.Lock()
+	if g.errs == nil {
+		g.errs = make(map[string]error)
+	}
+	g.errs[name] = err
+	g.total++
+	g.lock.Unlock()
+	return name
+}
+
+// Returns the errors recorded since the last Reset, by getter name
+func (g *GetterErrors) Last() map[string]error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	errs := make(map[string]error, len(g.errs))
+	for name, err := range g.errs {
+		errs[name] = err
+	}
+	return errs
+}
+
+// Returns how many errors have been recorded in every collection so far
+func (g *GetterErrors) Total() uint64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.total
+}
+
+// Returns the errors recorded since the last Reset as one error, see
+// CollectionError
+func (g *GetterErrors) Err() error {
+	return CollectionError(g.Last())
+}
+
+// Combines the errors of a collection, by getter name, into one error
+// naming each failed getter, or nil if every getter succeeded
+func CollectionError(errs map[string]error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = name + ": " + errs[name].Error()
+	}
+	return errors.New("collection failed: " + strings.Join(msgs, "; "))
+}
+
+func (database *mysqlDB) Close() {
+	//nil when the connection settings couldn't be used
+	db := database.pool()
+	if database.borrowed || db == nil {
+		return
+	}
+	db.Close()
+}
+
+//Parse results from "SHOW ENGINE INNODB STATUS" query
+func ParseInnodbStats(blob string) (*InnodbStats, error) {
+	idb := new(InnodbStats)
+	idb.Metrics = make(map[string]string)
+
+	chunks := regexp.MustCompile("\n[-=]{3,80}\n").Split(blob, -1)
+	for i, chunk := range chunks {
+		m := regexp.MustCompile("([/ A-Z])\\s*$").MatchString(chunk)
+		if m {
+			chunk = strings.Trim(chunk, " \n")
+			if m, _ := regexp.MatchString("FILE I/O", chunk); m {
+				idb.parseFileIO(chunks[i+1])
+			} else if chunk == "LOG" {
+				idb.parseLog(chunks[i+1])
+			} else if chunk == "BUFFER POOL AND MEMORY" {
+				idb.parseBufferPoolAndMem(chunks[i+1])
+			} else if chunk == "TRANSACTIONS" {
+				idb.parseTransactions(chunks[i+1])
+			}
+		}
+	}
+	return idb, nil
+}
+
+//parse the File I/O section of the "show engine innodb status;" command
+//stores expressions of the form:     123.456 metric_name
+func (idb *InnodbStats) parseFileIO(blob string) {
+	lines := strings.Split(blob, "\n")
+	for _, line := range lines {
+		//fsyncs waiting on the log and on the buffer pool
+		m := regexp.MustCompile("^Pending flushes \\(fsync\\) log: (\\d+); buffer pool: (\\d+)").FindStringSubmatch(line)
+		if len(m) == 3 {
+			idb.Metrics["pending_fsyncs_log"] = m[1]
+			idb.Metrics["pending_fsyncs_buffer_pool"] = m[2]
+			continue
+		}
+		if strings.Contains(line, ",") {
+			elements := strings.Split(line, ",")
+			for _, element := range elements {
+				element = strings.Trim(element, " \n")
+				m := regexp.MustCompile("^(\\d+(\\.\\d+)?) ([A-Za-z/ ]+)\\s*$").FindStringSubmatch(element)
+				if len(m) == 4 {
+					key := strings.Replace(strings.Replace(m[3], " ", "_", -1), "/", "_per_", -1)
+					idb.Metrics[key] = m[1]
+				}
+			}
+		}
+	}
+}
+
+//parse the log section of the "show engine innodb status;" command
+func (idb *InnodbStats) parseLog(blob string) {
+	lines := strings.Split(blob, "\n")
+	for _, line := range lines {
+		line := strings.Trim(line, " \n")
+		if regexp.MustCompile("^(.+?)\\s+(\\d+)\\s*$").MatchString(line) {
+			elements := strings.Split(line, " ")
+			c := len(elements)
+			val := elements[c-1]
+			key := strings.Trim(strings.ToLower(strings.Join(elements[:c-1], "_")), "_")
+			idb.Metrics[key] = val
+		} else {
+			elements := strings.Split(line, ",")
+			for _, element := range elements {
+				element = strings.Trim(element, " \n\t\r\f")
+				if regexp.MustCompile("(\\d+) ([A-Za-z/ ,']+)\\s*$").MatchString(element) {
+					element = strings.Replace(strings.Replace(element, "i/o's", "io", -1), "/second", "_per_sec", -1)
+					words := strings.Split(element, " ")
+					key := strings.Trim(strings.ToLower(strings.Join(words[1:], "_")), "_")
+					idb.Metrics[key] = words[0]
+				}
+			}
+		}
+	}
+}
+
+func (idb *InnodbStats) parseBufferPoolAndMem(blob string) {
+	lines := strings.Split(blob, "\n")
+	matches := []string{"Page hash", "Dictionary cache", "File system", "Lock system", "Recovery system",
+		"Dictionary memory allocated", "Buffer pool size", "Free buffers", "Database pages", "Old database pages",
+		"Modified db pages", "Pending reads", "Pending writes: LRU", "Pages made young", "Pages read"}
+	for _, line := range lines {
+		line = strings.Split(strings.Trim(line, " \n"), ",")[0]
+		//so many regular expressions. just gonna hard code some of them
+		words := strings.Split(line, " ")
+		if m, _ := regexp.MatchString("Total memory allocated by read views \\d+", line); m {
+			idb.Metrics["total_mem_by_read_views"] = words[len(words)-1]
+		} else if m, _ := regexp.MatchString("Total memory allocated \\d+", line); m {
+			line := strings.Split(line, ";")[0]
+			words := strings.Split(line, " ")
+			idb.Metrics["total_mem"] = words[len(words)-1]
+		} else if m, _ := regexp.MatchString("Adaptive hash index", line); m {
+			idb.Metrics["adaptive_hash"] = words[3]
+		} else if m := regexp.MustCompile("^LRU len: (\\d+)").FindStringSubmatch(line); len(m) == 2 {
+			//the summary comes before the per instance sections, keep the first
+			if _, ok := idb.Metrics["lru_len"]; !ok {
+				idb.Metrics["lru_len"] = m[1]
+			}
+		} else {
+			for _, match := range matches {
+				if m, _ := regexp.MatchString(match, line); m {
+					line = strings.Split(line, ",")[0]
+					key := strings.Trim(strings.ToLower(strings.Replace(strings.Replace(match, " ", "_", -1), ":", "", -1)), " \n\t\f\r")
+					if _, ok := idb.Metrics[key]; ok {
+						continue
+					}
+					key_len := len(strings.Split(key, "_"))
+					idb.Metrics[key] = strings.Trim(strings.Split(strings.Join(words[key_len:], ""), "(")[0], " \n\t\f\r")
+				} else if m, _ := regexp.MatchString("Buffer pool hit rate", line); m {
+					line := strings.Split(line, ",")[0]
+					words := strings.Split(line, " ")
+					num, _ := strconv.ParseFloat(words[4], 64)
+					den, _ := strconv.ParseFloat(words[6], 64)
+					idb.Metrics["buffer_pool_hit_rate"] = strconv.FormatFloat(num/den, 'f', -1, 64)
+					idb.Metrics["cache_hit_pct"] = strconv.FormatFloat((num/den)*100.0, 'f', -1, 64)
+				}
+			}
+		}
 
 	}
+	//modified db pages is the length of the flush list
+	if v, ok := idb.Metrics["modified_db_pages"]; ok {
+		idb.Metrics["flush_list_len"] = v
+	}
 }
 
 func (idb *InnodbStats) parseTransactions(blob string) {
@@ -19,9 +19,35 @@
 package tools
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/codahale/tmpmysqld"
+	"github.com/go-sql-driver/mysql"
 )
 
 var (
@@ -35,7 +61,7 @@ const (
 )
 
 //initialize test mysql instance and populate with data
-func initDB(t testing.TB) mysqlDB {
+func initDB(t testing.TB) *mysqlDB {
 	server, err := tmpmysql.NewMySQLServer("inspect_mysql_test")
 	if err != nil {
 		t.Fatal(err)
@@ -76,7 +102,7 @@ func initDB(t testing.TB) mysqlDB {
 			t.Fatal(err)
 		}
 	}
-	return *test
+	return test
 }
 
 //tests string manipulation of making dsn string
@@ -118,13 +144,1788 @@ func TestMakeDsn3(t *testing.T) {
 	}
 }
 
+func TestMakeDsnTimeouts(t *testing.T) {
+	dsn := map[string]string{
+		"user":         "brian",
+		"host":         "tcp(db1:3306)",
+		"dbname":       "mysqldb",
+		"timeout":      "5s",
+		"readTimeout":  "30s",
+		"writeTimeout": "1m0s",
+	}
+	expected := "brian@tcp(db1:3306)/mysqldb?timeout=5s&readTimeout=30s&writeTimeout=1m0s"
+	result := makeDsn(dsn)
+	if result != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + result)
+	}
+}
+
+func TestMakeDsnCharset(t *testing.T) {
+	dsn := map[string]string{
+		"user":      "brian",
+		"host":      "tcp(127.0.0.1:3306)",
+		"dbname":    "mysqldb",
+		"charset":   "utf8mb4",
+		"collation": "utf8mb4_general_ci",
+	}
+	expected := "brian@tcp(127.0.0.1:3306)/mysqldb?timeout=30s&charset=utf8mb4&collation=utf8mb4_general_ci"
+	result := makeDsn(dsn)
+	if result != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + result)
+	}
+
+	//empty options are left out
+	dsn["charset"] = ""
+	dsn["collation"] = ""
+	expected = "brian@tcp(127.0.0.1:3306)/mysqldb?timeout=30s"
+	result = makeDsn(dsn)
+	if result != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + result)
+	}
+}
+
+func TestMakeDsnDefaultDB(t *testing.T) {
+	dsn := map[string]string{
+		"user":   "brian",
+		"host":   "tcp(127.0.0.1:3306)",
+		"dbname": Options{DefaultDB: "shop"}.defaultDB(),
+	}
+	expected := "brian@tcp(127.0.0.1:3306)/shop?timeout=30s"
+	if result := makeDsn(dsn); result != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + result)
+	}
+
+	dsn["dbname"] = Options{}.defaultDB()
+	expected = "brian@tcp(127.0.0.1:3306)/information_schema?timeout=30s"
+	if result := makeDsn(dsn); result != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + result)
+	}
+}
+
+func TestSessionInit(t *testing.T) {
+	params, err := sessionParams("SET SESSION transaction_isolation='READ-UNCOMMITTED'; " +
+		"set lock_wait_timeout = 1;SET @@session.sql_mode='ANSI,TRADITIONAL';")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn := makeDsn(map[string]string{
+		"user":    "brian",
+		"host":    "tcp(127.0.0.1:3306)",
+		"dbname":  "mysqldb",
+		"session": params,
+	})
+	expected := "brian@tcp(127.0.0.1:3306)/mysqldb?timeout=30s" +
+		"&transaction_isolation=%27READ-UNCOMMITTED%27&lock_wait_timeout=1&sql_mode=%27ANSI%2CTRADITIONAL%27"
+	if dsn != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + dsn)
+	}
+
+	for _, bad := range []string{
+		"SELECT 1",
+		"SET GLOBAL read_only=1",
+		"SET SESSION a=1, b=2",
+		"SET SESSION lock_wait_timeout",
+	} {
+		if _, err := sessionParams(bad); err == nil {
+			t.Error("expected an error for: " + bad)
+		}
+	}
+}
+
+//stands in for a collector, whose Get* methods make the queries
+type tagCollector struct {
+	db *mysqlDB
+}
+
+func (c tagCollector) GetSlaveStats() string {
+	return c.db.tagQuery("SHOW SLAVE STATUS;")
+}
+
+func TestQueryTag(t *testing.T) {
+	c := tagCollector{&mysqlDB{queryTag: "inspect-mysql"}}
+	expected := "/* inspect-mysql:GetSlaveStats */ SHOW SLAVE STATUS;"
+	if result := c.GetSlaveStats(); result != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + result)
+	}
+
+	//outside a getter only the tag is added
+	expected = "/* inspect-mysql */ SELECT 1"
+	if result := c.db.tagQuery("SELECT 1"); result != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + result)
+	}
+
+	c.db.queryTag = ""
+	expected = "SHOW SLAVE STATUS;"
+	if result := c.GetSlaveStats(); result != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + result)
+	}
+}
+
+func TestCounterRates(t *testing.T) {
+	var r CounterRates
+	start := time.Unix(1400000000, 0)
+	r.Update("Queries", 1000, start)
+	if _, ok := r.Rate("Queries"); ok {
+		t.Error("expected no rate after one value")
+	}
+	r.Update("Queries", 1600, start.Add(30*time.Second))
+	if rate, _ := r.Rate("Queries"); rate != 20 {
+		t.Error("expected a rate of 20, got " + strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+	//server restarted
+	r.Update("Queries", 50, start.Add(60*time.Second))
+	if rate, _ := r.Rate("Queries"); rate != 0 {
+		t.Error("expected a rate of 0 after a reset, got " + strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+	r.Update("Queries", 150, start.Add(70*time.Second))
+	if rate, _ := r.Rate("Queries"); rate != 10 {
+		t.Error("expected a rate of 10, got " + strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+}
+
+func TestCounterRatesRestore(t *testing.T) {
+	var r CounterRates
+	start := time.Unix(1400000000, 0)
+	r.Update("Queries", 1000, start)
+	var next CounterRates
+	next.Restore(r.Samples())
+	next.Update("Queries", 1300, start.Add(30*time.Second))
+	if rate, ok := next.Rate("Queries"); !ok || rate != 10 {
+		t.Error("expected a rate of 10 from the restored value, got " + strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+	//values updated since aren't replaced
+	next.Restore(r.Samples())
+	next.Update("Queries", 1600, start.Add(60*time.Second))
+	if rate, _ := next.Rate("Queries"); rate != 10 {
+		t.Error("expected a rate of 10, got " + strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+}
+
+func TestHistory(t *testing.T) {
+	h := NewHistory(3)
+	start := time.Unix(1400000000, 0)
+	for i := 0; i < 5; i++ {
+		values := map[string]float64{"mysqlstat.Queries": float64(100 * i)}
+		if i == 3 {
+			//a getter failed and left the metric out
+			values = map[string]float64{}
+		}
+		h.Add(start.Add(time.Duration(i)*time.Second), values)
+	}
+	//the first two snapshots were evicted
+	points := h.Values("mysqlstat.Queries")
+	if len(points) != 2 || points[0].Value != 200 || points[1].Value != 400 ||
+		!points[0].Time.Equal(start.Add(2*time.Second)) {
+		t.Error("unexpected history: " + fmt.Sprint(points))
+	}
+	if points := h.Values("mysqlstat.Missing"); len(points) != 0 {
+		t.Error("expected no history for an unknown metric")
+	}
+}
+
+func TestWindow(t *testing.T) {
+	w := NewWindow(20, 0)
+	if !math.IsNaN(w.Percentile(95)) || !math.IsNaN(w.Max()) {
+		t.Error("expected no stats for an empty window")
+	}
+	start := time.Unix(1400000000, 0)
+	//a lag spike as the relay log catches up, then the first 5 samples
+	// leave the window
+	samples := []float64{500, 400, 300, 200, 100, 0, 0, 1, 2, 0, 0, 3, 0, 0, 1, 0, 0, 2, 0, 0, 1, 4, 0, 0, 30}
+	for i, v := range samples {
+		w.Add(start.Add(time.Duration(i)*time.Second), v)
+	}
+	if p95 := w.Percentile(95); p95 != 4 {
+		t.Error("expected a p95 of 4, got " + strconv.FormatFloat(p95, 'f', -1, 64))
+	}
+	if max := w.Max(); max != 30 {
+		t.Error("expected a max of 30, got " + strconv.FormatFloat(max, 'f', -1, 64))
+	}
+
+	//samples older than the age are dropped as well
+	w = NewWindow(100, 10*time.Second)
+	for i, v := range samples {
+		w.Add(start.Add(time.Duration(i)*time.Second), v)
+	}
+	if max := w.Max(); max != 30 {
+		t.Error("expected a max of 30, got " + strconv.FormatFloat(max, 'f', -1, 64))
+	}
+	w.Add(start.Add(60*time.Second), 5)
+	if p95, max := w.Percentile(95), w.Max(); p95 != 5 || max != 5 {
+		t.Error("expected only the last sample, got " + fmt.Sprint(p95, max))
+	}
+}
+
+func TestSnapshotValues(t *testing.T) {
+	values, err := SnapshotValues(func(j *JSONWriter) {
+		j.Counter("mysqlstat.Queries", 1000, 3.5)
+		j.Gauge("mysqlstat.Uptime", 60)
+		j.Gauge("mysqlstat.Unset", math.NaN())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values["mysqlstat.Queries"] != 1000 || values["mysqlstat.Uptime"] != 60 {
+		t.Error("unexpected snapshot: " + fmt.Sprint(values))
+	}
+}
+
+func TestWriteNDJSON(t *testing.T) {
+	var buf bytes.Buffer
+	at := time.Date(2014, 5, 13, 15, 4, 5, 0, time.UTC)
+	labels := map[string]string{"env": "prod", "dc": "east \"1\""}
+	err := WriteNDJSON(&buf, at, labels, func(j *JSONWriter) {
+		j.Counter("mysqlstat.Queries", 1000, 3.5)
+		j.Gauge("mysqlstat.Uptime", 60.5)
+		j.Gauge("mysqlstat.Unset", math.NaN())
+		j.Gauge("tablestat.db1.DBSize", 2048)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatal("expected a line for each of 3 metrics, got: " + buf.String())
+	}
+	for _, line := range lines {
+		var rec struct {
+			Name   string            `json:"name"`
+			Value  float64           `json:"value"`
+			Type   string            `json:"type"`
+			Ts     string            `json:"ts"`
+			Labels map[string]string `json:"labels"`
+		}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Error("line isn't valid JSON: " + line + ": " + err.Error())
+			continue
+		}
+		if rec.Name == "" || rec.Type == "" || rec.Ts != "2014-05-13T15:04:05Z" || !reflect.DeepEqual(rec.Labels, labels) {
+			t.Error("unexpected line: " + line)
+		}
+	}
+	if lines[0] != `{"name": "mysqlstat.Queries", "value": 1000, "type": "counter", "ts": "2014-05-13T15:04:05Z", `+
+		`"labels": {"dc": "east \"1\"", "env": "prod"}}` {
+		t.Error("unexpected counter line: " + lines[0])
+	}
+
+	//no labels, and no collection yet
+	buf.Reset()
+	WriteNDJSON(&buf, time.Time{}, nil, func(j *JSONWriter) { j.Gauge("mysqlstat.Uptime", 1) })
+	if buf.String() != `{"name": "mysqlstat.Uptime", "value": 1, "type": "gauge", "ts": null}`+"\n" {
+		t.Error("unexpected line: " + buf.String())
+	}
+}
+
+// Test both influx schemes' lines, including tags, integer counters and
+// the words names are split into
+func TestWriteInflux(t *testing.T) {
+	write := func(j *JSONWriter) {
+		j.Gauge("mysqlstat.SlaveSecondsBehindMaster", 3)
+		j.Counter("mysqlstat.SlavePosition", 73, 0)
+		j.Gauge("mysqlstat.InnodbLRUListLength", 1024)
+		j.Gauge("mysqlstat.Uptime", 60.5)
+		j.Gauge("mysqlstat.Unset", math.NaN())
+		j.Counter("mysqlstat.db1.tbl1.RowsRead", 10, 0)
+	}
+	at := time.Unix(1400000000, 0)
+	labels := map[string]string{"env": "prod", "dc": "us east"}
+	for _, c := range []struct {
+		scheme   InfluxScheme
+		expected string
+	}{
+		{InfluxPerMetric, "mysql_db1_tbl1_rows_read,dc=us\\ east,env=prod value=10i 1400000000000000000\n" +
+			"mysql_innodb_lru_list_length,dc=us\\ east,env=prod value=1024 1400000000000000000\n" +
+			"mysql_slave_position,dc=us\\ east,env=prod value=73i 1400000000000000000\n" +
+			"mysql_slave_seconds_behind_master,dc=us\\ east,env=prod value=3 1400000000000000000\n" +
+			"mysql_uptime,dc=us\\ east,env=prod value=60.5 1400000000000000000\n"},
+		{InfluxWide, "mysql,dc=us\\ east,env=prod uptime=60.5 1400000000000000000\n" +
+			"mysql_db1_tbl1_rows,dc=us\\ east,env=prod read=10i 1400000000000000000\n" +
+			"mysql_innodb,dc=us\\ east,env=prod lru_list_length=1024 1400000000000000000\n" +
+			"mysql_slave,dc=us\\ east,env=prod position=73i,seconds_behind_master=3 1400000000000000000\n"},
+	} {
+		var buf bytes.Buffer
+		if err := WriteInflux(&buf, at, c.scheme, labels, write); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != c.expected {
+			t.Error("Incorrect result, expected:\n" + c.expected + "but got:\n" + buf.String())
+		}
+	}
+	var buf bytes.Buffer
+	WriteInflux(&buf, time.Time{}, InfluxPerMetric, nil, func(j *JSONWriter) { j.Gauge("mysqlstat.Uptime", 1) })
+	if buf.String() != "mysql_uptime value=1\n" {
+		t.Error("unexpected line without labels or a collection time: " + buf.String())
+	}
+	if _, err := ParseInfluxScheme("tall"); err == nil {
+		t.Error("expected an error for an unknown scheme")
+	}
+}
+
+// Test that dots are kept and other characters graphite can't take
+// are replaced
+func TestGraphiteName(t *testing.T) {
+	for _, c := range []struct {
+		name, expected string
+	}{
+		{"mysqlstat.Queries", "mysqlstat.Queries"},
+		{"mysql.db-1.", "mysql.db-1"},
+		{".mysql..db1", "mysql.db1"},
+		{"mutex.&buf_pool->LRU_list_mutex", "mutex._buf_pool-_LRU_list_mutex"},
+		{"status.my key", "status.my_key"},
+		{"", ""},
+	} {
+		if n := GraphiteName(c.name); n != c.expected {
+			t.Error("expected " + c.expected + " for " + c.name + ", got " + n)
+		}
+	}
+}
+
+// Test that lines are held until Flush and written sorted by name
+func TestSortedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewSortedWriter(&buf)
+	io.WriteString(w, "b.Value 2\na.Value 1\n")
+	io.WriteString(w, "a.b.Value 3\nc 4 1400000000\n")
+	if buf.Len() != 0 {
+		t.Error("expected nothing written before Flush")
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "a.Value 1\na.b.Value 3\nb.Value 2\nc 4 1400000000\n"
+	if buf.String() != expected {
+		t.Error("Incorrect result, expected:\n" + expected + "but got:\n" + buf.String())
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	write := func(j *JSONWriter) {
+		j.Gauge("mysqlstat.Uptime", 60.5)
+		j.Counter("mysqlstat.Queries", 1000, 3.5)
+		j.Gauge("mysqlstat.&buf_pool->LRU_list_mutex", 2)
+		j.Gauge("mysqlstat.Unset", math.NaN())
+		//clash once cleaned
+		j.Gauge("mysqlstat.db1.t-1.SizeBytes", 16384)
+		j.Gauge("mysqlstat.db1.t_1.SizeBytes", 32768)
+	}
+	names := NewNameSanitizer(NamesPrometheus)
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, names, write); err != nil {
+		t.Fatal(err)
+	}
+	expected := "# TYPE mysqlstat_buf_pool_LRU_list_mutex gauge\n" +
+		"mysqlstat_buf_pool_LRU_list_mutex 2\n" +
+		"# TYPE mysqlstat_Queries counter\n" +
+		"mysqlstat_Queries 1000\n" +
+		"# TYPE mysqlstat_Uptime gauge\n" +
+		"mysqlstat_Uptime 60.5\n" +
+		"# TYPE mysqlstat_db1_t_1_SizeBytes gauge\n" +
+		"mysqlstat_db1_t_1_SizeBytes 16384\n" +
+		"# TYPE mysqlstat_db1_t_1_SizeBytes_2 gauge\n" +
+		"mysqlstat_db1_t_1_SizeBytes_2 32768\n"
+	if buf.String() != expected {
+		t.Error("Incorrect result, expected:\n" + expected + "but got:\n" + buf.String())
+	}
+	var again bytes.Buffer
+	WritePrometheus(&again, names, write)
+	if again.String() != buf.String() {
+		t.Error("expected the same names on every write")
+	}
+	//the metric that took the unsuffixed name goes away, and a bigger
+	// counter than a float64 holds exactly is added
+	var later bytes.Buffer
+	WritePrometheus(&later, names, func(j *JSONWriter) {
+		j.Gauge("mysqlstat.db1.t_1.SizeBytes", 32768)
+		j.Counter("mysqlstat.Bytes_received", 9007199254740993, 0)
+	})
+	expected = "# TYPE mysqlstat_Bytes_received counter\n" +
+		"mysqlstat_Bytes_received 9007199254740993\n" +
+		"# TYPE mysqlstat_db1_t_1_SizeBytes_2 gauge\n" +
+		"mysqlstat_db1_t_1_SizeBytes_2 32768\n"
+	if later.String() != expected {
+		t.Error("Incorrect result, expected:\n" + expected + "but got:\n" + later.String())
+	}
+}
+
+func TestCachedCollect(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+	var calls int32
+	release := make(chan struct{})
+	c := NewCachedCollect(5*time.Second, func() error {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return errors.New("collect failed")
+	})
+	c.now = func() time.Time { return now }
+
+	//scrapes arriving together share one collection
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.Collect()
+		}()
+	}
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err == nil || err.Error() != "collect failed" {
+			t.Error("expected every caller to get the collection's error, got: " + fmt.Sprint(err))
+		}
+	}
+	if calls != 1 {
+		t.Error("expected 1 collection for concurrent calls, got " + fmt.Sprint(calls))
+	}
+
+	//within the ttl the last result is reused
+	now = now.Add(4 * time.Second)
+	c.Collect()
+	if calls != 1 {
+		t.Error("expected no collection within the ttl, got " + fmt.Sprint(calls))
+	}
+	now = now.Add(time.Second)
+	c.Collect()
+	if calls != 2 {
+		t.Error("expected a collection once the ttl passed, got " + fmt.Sprint(calls))
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	same := []string{
+		"SELECT * FROM orders WHERE id = 42 AND status = 'open'",
+		"select *\n  from orders\n where id = 7 and status = \"closed\"",
+		"SELECT * FROM orders /* from the cart page */ WHERE id = 1234 AND status = 'it''s'",
+		"SELECT * FROM orders WHERE id = 9 AND status = 'a\\'b' -- retried",
+	}
+	want := "select * from orders where id = ? and status = ?"
+	for _, query := range same {
+		if got := Fingerprint(query); got != want {
+			t.Error("expected " + strconv.Quote(want) + " for " + strconv.Quote(query) + ", got " + strconv.Quote(got))
+		}
+	}
+	if FingerprintID(Fingerprint(same[0])) != FingerprintID(Fingerprint(same[1])) {
+		t.Error("expected queries with the same fingerprint to share an id")
+	}
+
+	cases := map[string]string{
+		"SELECT name FROM users WHERE id IN (1, 2, 3)":              "select name from users where id in (?+)",
+		"SELECT name FROM users WHERE id IN (4)":                    "select name from users where id in (?+)",
+		"INSERT INTO t1 (a, b) VALUES (1, 'x'), (2, 'y'), (3, 'z')": "insert into t1 (a, b) values (?+)",
+		"SELECT `Col2` FROM t2 WHERE c3 > 1.5e3":                    "select `Col2` from t2 where c3 > ?",
+	}
+	for query, want := range cases {
+		if got := Fingerprint(query); got != want {
+			t.Error("expected " + strconv.Quote(want) + " for " + strconv.Quote(query) + ", got " + strconv.Quote(got))
+		}
+	}
+	if FingerprintID(cases["SELECT name FROM users WHERE id IN (4)"]) == FingerprintID(want) {
+		t.Error("expected different fingerprints to have different ids")
+	}
+}
+
+func TestResultRow(t *testing.T) {
+	var logged []string
+	res := map[string][]string{
+		"count":   []string{"12", "-3"},
+		"pct":     []string{"42.5", ""},
+		"name":    []string{"db1", ""},
+		"garbage": []string{"12abc", "1e400"},
+	}
+	row := NewResultRow(res, 0, func(in interface{}) { logged = append(logged, fmt.Sprint(in)) })
+	if v, ok := row.Int("count"); !ok || v != 12 {
+		t.Error("expected an int of 12, got " + fmt.Sprint(v, ok))
+	}
+	if v, ok := row.Uint("count"); !ok || v != 12 {
+		t.Error("expected a uint of 12, got " + fmt.Sprint(v, ok))
+	}
+	if v, ok := row.Float("pct"); !ok || v != 42.5 {
+		t.Error("expected a float of 42.5, got " + fmt.Sprint(v, ok))
+	}
+	if v, ok := row.String("name"); !ok || v != "db1" {
+		t.Error("expected db1, got " + fmt.Sprint(v, ok))
+	}
+	if len(logged) != 0 {
+		t.Error("unexpected log output: " + fmt.Sprint(logged))
+	}
+
+	//NULL and empty values, missing columns and rows past the end read as
+	// not set, without logging
+	row = NewResultRow(res, 1, func(in interface{}) { logged = append(logged, fmt.Sprint(in)) })
+	if _, ok := row.Float("pct"); ok {
+		t.Error("expected an empty value to be unset")
+	}
+	if _, ok := row.String("name"); ok {
+		t.Error("expected an empty string to be unset")
+	}
+	if _, ok := row.Int("missing"); ok {
+		t.Error("expected a missing column to be unset")
+	}
+	if _, ok := NewResultRow(res, 2, nil).Int("count"); ok {
+		t.Error("expected a missing row to be unset")
+	}
+	if len(logged) != 0 {
+		t.Error("unexpected log output: " + fmt.Sprint(logged))
+	}
+
+	//negative counters and malformed values are logged
+	if _, ok := row.Uint("count"); ok {
+		t.Error("expected a negative uint to fail")
+	}
+	if _, ok := row.Float("garbage"); ok {
+		t.Error("expected an out of range float to fail")
+	}
+	row = NewResultRow(res, 0, func(in interface{}) { logged = append(logged, fmt.Sprint(in)) })
+	if _, ok := row.Int("garbage"); ok {
+		t.Error("expected a malformed int to fail")
+	}
+	expected := []string{`can't parse count: "-3"`, `can't parse garbage: "1e400"`, `can't parse garbage: "12abc"`}
+	if !reflect.DeepEqual(logged, expected) {
+		t.Error("unexpected log output: " + fmt.Sprint(logged))
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	free, total, err := DiskUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	if total != uint64(st.Blocks)*uint64(st.Bsize) || total == 0 || free > total {
+		t.Error("unexpected disk usage: " + fmt.Sprint(free, total))
+	}
+	if _, _, err := DiskUsage(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a path that doesn't exist")
+	}
+}
+
+func TestAggregateSamples(t *testing.T) {
+	var samples []map[string]float64
+	for _, v := range []float64{4, 1, 7, 2, 6} {
+		samples = append(samples, map[string]float64{"mysqlstat.Threads_running": v})
+	}
+	//only collected once
+	samples[2]["mysqlstat.SlaveSecondsBehindMaster"] = 3
+	stats := AggregateSamples(samples)
+	expected := map[string]SampleStats{
+		"mysqlstat.Threads_running":          {Min: 1, Avg: 4, Max: 7, Count: 5},
+		"mysqlstat.SlaveSecondsBehindMaster": {Min: 3, Avg: 3, Max: 3, Count: 1},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Error("unexpected stats: " + fmt.Sprint(stats))
+	}
+	if len(AggregateSamples(nil)) != 0 {
+		t.Error("expected no stats without samples")
+	}
+}
+
+//reads everything sent on the first connection made to l
+func receiveGraphite(l net.Listener) chan string {
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			received <- ""
+			return
+		}
+		data, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		received <- string(data)
+	}()
+	return received
+}
+
+func TestGraphiteSinkBatching(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := receiveGraphite(l)
+
+	g := NewGraphiteSink(l.Addr().String(), time.Hour)
+	g.Write([]byte("mysqlstat.Queries.Value 10 1400000000\n"))
+	g.Write([]byte("mysqlstat.Uptime.Value 20 1400000000\n"))
+	select {
+	case data := <-received:
+		t.Fatal("lines sent before flushing: " + data)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "mysqlstat.Queries.Value 10 1400000000\nmysqlstat.Uptime.Value 20 1400000000\n"
+	if data := <-received; data != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + data)
+	}
+}
+
+func TestGraphiteSinkDropped(t *testing.T) {
+	//find a free port, then leave nothing listening on it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	g := NewGraphiteSink(addr, 0)
+	line := []byte("mysqlstat.Queries.Value 10 1400000000\n")
+	full := bytes.Repeat(line, maxGraphiteBuffer/len(line))
+	if _, err := g.Write(full); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Write(append(line, line...)); err == nil {
+		t.Error("expected an error writing past the buffer")
+	}
+	if g.Dropped() != 2 {
+		t.Error("expected 2 dropped lines, got " + strconv.FormatUint(g.Dropped(), 10))
+	}
+}
+
+// Test that lines dropped with the buffer full are sent once there is
+// room, rather than held back by the change filter as already sent
+func TestGraphiteSinkDroppedUnchanged(t *testing.T) {
+	g := NewGraphiteSink("127.0.0.1:1", 0)
+	line := []byte("mysqlstat.Queries.Value 10 1400000000\n")
+	g.Write(bytes.Repeat(line, maxGraphiteBuffer/len(line)))
+	g.SetChangeFilter(NewChangeFilter(time.Hour))
+	uptime := "mysqlstat.Uptime.Value 20 1400000000\n"
+	if _, err := g.Write([]byte(uptime)); err == nil {
+		t.Fatal("expected an error writing past the buffer")
+	}
+	//as if carbon took what was buffered
+	g.buf.Reset()
+	if _, err := g.Write([]byte(uptime)); err != nil {
+		t.Fatal(err)
+	}
+	if g.buf.String() != uptime {
+		t.Error("expected the dropped line to be buffered, got: " + g.buf.String())
+	}
+}
+
+func TestChangeFilter(t *testing.T) {
+	f := NewChangeFilter(time.Minute)
+	start := time.Unix(1400000000, 0)
+	cycle := func(queries, uptime string) string {
+		return "Queries.Value " + queries + " 1400000000\nUptime.Value " + uptime + " 1400000000\n"
+	}
+	if out := string(f.Filter([]byte(cycle("10", "20")), start)); out != cycle("10", "20") {
+		t.Error("expected every line the first time, got:\n" + out)
+	}
+	//the timestamp changes every collection, the value doesn't
+	out := string(f.Filter([]byte(cycle("10", "30")), start.Add(10*time.Second)))
+	if out != "Uptime.Value 30 1400000000\n" {
+		t.Error("expected only the changed line, got:\n" + out)
+	}
+	out = string(f.Filter([]byte(cycle("10", "30")), start.Add(50*time.Second)))
+	if out != "" {
+		t.Error("expected no lines when nothing changed, got:\n" + out)
+	}
+	//Queries was last sent a minute ago, Uptime 50s ago
+	out = string(f.Filter([]byte(cycle("10", "30")), start.Add(time.Minute)))
+	if out != "Queries.Value 10 1400000000\n" {
+		t.Error("expected the unchanged line again at its heartbeat, got:\n" + out)
+	}
+}
+
+func TestFormatGraphiteTagged(t *testing.T) {
+	lines := "Queries.Value 10 1400000000\nUptime.Value 20\n"
+	labels := map[string]string{"role": "primary", "host": "db1", "dc": "us east;1", "empty": ""}
+	var buf bytes.Buffer
+	if err := FormatGraphiteTagged(&buf, []byte(lines), labels); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Queries.Value;dc=us_east_1;host=db1;role=primary 10 1400000000\n" +
+		"Uptime.Value;dc=us_east_1;host=db1;role=primary 20\n"
+	if buf.String() != expected {
+		t.Error("expected:\n" + expected + "got:\n" + buf.String())
+	}
+	//name;tag=value;... with no spaces in the name
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		parts := strings.Split(strings.Fields(line)[0], ";")
+		for _, tag := range parts[1:] {
+			if kv := strings.SplitN(tag, "=", 2); len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				t.Error("malformed tag " + tag + " in " + line)
+			}
+		}
+	}
+
+	buf.Reset()
+	FormatGraphiteTagged(&buf, []byte(lines), nil)
+	if buf.String() != lines {
+		t.Error("expected lines as they were without labels, got:\n" + buf.String())
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	at := time.Unix(1400000000, 0)
+	values := map[string]float64{"lag": 30, "running": 1, "missing_nan": math.NaN()}
+	cases := []struct {
+		op        string
+		threshold float64
+		fires     bool
+	}{
+		{">", 30, false},
+		{">", 29.5, true},
+		{">=", 30, true},
+		{">=", 31, false},
+		{"<", 30, false},
+		{"<", 31, true},
+		{"<=", 30, true},
+		{"<=", 29, false},
+		{"==", 30, true},
+		{"==", 0, false},
+		{"!=", 0, true},
+		{"!=", 30, false},
+	}
+	for _, c := range cases {
+		a := NewAlerts()
+		if err := a.AddAlertRule("lag", c.op, c.threshold, "warning"); err != nil {
+			t.Fatal(err)
+		}
+		started, _ := a.Evaluate(at, values)
+		if (len(started) == 1) != c.fires || (len(a.Firing()) == 1) != c.fires {
+			t.Error("expected lag 30 "+c.op+" "+FormatValue(c.threshold, 5)+" to fire:", c.fires)
+		}
+	}
+
+	a := NewAlerts()
+	if err := a.AddAlertRule("lag", "=>", 1, "warning"); err == nil {
+		t.Error("expected an unknown operator to be refused")
+	}
+	a.AddAlertRule("lag", ">", 10, "warning")
+	a.AddAlertRule("running", "==", 0, "critical")
+	a.AddAlertRule("missing", ">", 0, "warning")
+	a.AddAlertRule("missing_nan", "!=", 0, "warning")
+	started, resolved := a.Evaluate(at, values)
+	if len(started) != 1 || started[0].Metric != "lag" || started[0].Value != 30 || len(resolved) != 0 {
+		t.Error("expected only the lag alert to start, got", started, resolved)
+	}
+	if s := started[0].String(); s != "warning: lag 30 > 10" {
+		t.Error("unexpected alert description " + s)
+	}
+	//still firing, with the new value and when it started
+	started, _ = a.Evaluate(at.Add(time.Minute), map[string]float64{"lag": 45, "running": 0})
+	firing := a.Firing()
+	if len(started) != 1 || started[0].Metric != "running" || len(firing) != 2 ||
+		firing[0].Value != 45 || !firing[0].Since.Equal(at) {
+		t.Error("expected lag to keep firing since the first evaluation, got", firing)
+	}
+	_, resolved = a.Evaluate(at.Add(2*time.Minute), map[string]float64{"lag": 5, "running": 0})
+	if len(resolved) != 1 || resolved[0].Metric != "lag" || len(a.Firing()) != 1 {
+		t.Error("expected the lag alert to resolve, got", resolved)
+	}
+}
+
+func TestConcurrencyTuner(t *testing.T) {
+	ms := time.Millisecond
+	tuner := NewConcurrencyTuner(1, 8, time.Second, 2)
+	//40 getters of 100ms each, 4s of queries
+	getters := func(latency time.Duration) []time.Duration {
+		latencies := make([]time.Duration, 40)
+		for i := range latencies {
+			latencies[i] = latency
+		}
+		return latencies
+	}
+	if n, changed := tuner.Observe(getters(100*ms), 0); n != 8 || changed {
+		t.Error("expected max connections while measuring, got", n)
+	}
+	if n, changed := tuner.Observe(getters(100*ms), 0); n != 4 || !changed {
+		t.Error("expected 4 connections for 4s of queries within 1s, got", n)
+	}
+	if n, changed := tuner.Observe(getters(100*ms), 0); n != 4 || changed {
+		t.Error("expected no change, got", n)
+	}
+	//time waiting for a connection isn't query time
+	if n, _ := tuner.Observe(getters(200*ms), 4*time.Second); n != 4 {
+		t.Error("expected waiting to be left out, got", n)
+	}
+
+	//a fast target needs few connections
+	fast := NewConcurrencyTuner(1, 8, time.Second, 1)
+	if n, _ := fast.Observe(getters(5*ms), 0); n != 1 {
+		t.Error("expected 1 connection for 200ms of queries, got", n)
+	}
+	//a slow one can't go past max
+	if n, _ := fast.Observe(getters(time.Second), 0); n != 8 {
+		t.Error("expected max connections for 40s of queries, got", n)
+	}
+}
+
+// Test that lines are kept whole when carbon goes away in the middle of
+// a send, so the next connection doesn't start with the rest of a line
+func TestGraphiteSinkShortWrite(t *testing.T) {
+	//a small receive window, so the send blocks before it is done
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4096)
+		})
+	}}
+	l, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.ReadFull(conn, make([]byte, 100))
+		time.Sleep(50 * time.Millisecond)
+		//closing with data unread resets the connection
+		conn.Close()
+	}()
+
+	var lines bytes.Buffer
+	for i := 0; lines.Len() < 3<<20; i++ {
+		fmt.Fprintf(&lines, "mysqlstat.Queries.Value %d 1400000000\n", i)
+	}
+	sent := lines.String()
+	g := NewGraphiteSink(l.Addr().String(), 0)
+	g.minBackoff = time.Millisecond
+	g.Write(lines.Bytes())
+	if err := g.Flush(); err == nil {
+		t.Skip("carbon took all " + strconv.Itoa(len(sent)) + " bytes before the connection was reset")
+	}
+	left := g.buf.String()
+	if left == "" || !strings.HasSuffix(sent, left) || sent[len(sent)-len(left)-1] != '\n' {
+		t.Fatal("expected whole lines to be left, got " + strconv.Itoa(len(left)) + " bytes starting " +
+			strconv.Quote(left[:min(len(left), 40)]))
+	}
+
+	received := receiveGraphite(l)
+	time.Sleep(5 * time.Millisecond)
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-received; data != left {
+		t.Error("expected the lines left to be sent on the next connection, got " + strconv.Itoa(len(data)) + " bytes")
+	}
+}
+
+func TestGraphiteSinkReconnect(t *testing.T) {
+	//find a free port, then leave nothing listening on it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	g := NewGraphiteSink(addr, 0)
+	g.minBackoff = 20 * time.Millisecond
+	g.Write([]byte("mysqlstat.Queries.Value 10\n"))
+	if err := g.Flush(); err == nil {
+		t.Fatal("expected flushing to fail with carbon down")
+	}
+	//still backing off
+	if err := g.Flush(); err == nil || !strings.Contains(err.Error(), "waiting to reconnect") {
+		t.Error("expected to wait before reconnecting")
+	}
+	if g.backoff != 20*time.Millisecond {
+		t.Error("unexpected backoff: " + g.backoff.String())
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("could not listen on " + addr + " again: " + err.Error())
+	}
+	defer l.Close()
+	received := receiveGraphite(l)
+	time.Sleep(30 * time.Millisecond)
+	g.Write([]byte("mysqlstat.Queries.Value 11\n"))
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "mysqlstat.Queries.Value 10\nmysqlstat.Queries.Value 11\n"
+	if data := <-received; data != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + data)
+	}
+	if g.backoff != 0 {
+		t.Error("expected backoff to be reset after reconnecting")
+	}
+}
+
+//a MetricsBus server recording the metrics pushed to it. its first
+// failures calls fail with status UNAVAILABLE
+type metricsBus struct {
+	failures int
+
+	lock    sync.Mutex
+	conns   int
+	metrics []pushedMetric
+}
+
+type pushedMetric struct {
+	timestamp uint64
+	name      string
+	kind      uint64
+	value     float64
+	labels    map[string]string
+	count     uint64
+}
+
+func (b *metricsBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	w.Header().Set("Content-Type", "application/grpc")
+	status := "0"
+	if r.ProtoMajor != 2 || r.URL.Path != "/inspectmysql.MetricsBus/Push" ||
+		r.Header.Get("Content-Type") != "application/grpc" || err != nil || len(body) < 5 {
+		//UNIMPLEMENTED
+		status = "12"
+	} else if b.failures > 0 {
+		b.failures--
+		status = "14"
+	} else {
+		for req := body[5:]; len(req) > 0; {
+			var m []byte
+			_, m, req = protoField(req)
+			b.metrics = append(b.metrics, decodePushedMetric(m))
+		}
+		w.Write([]byte{0, 0, 0, 0, 0})
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", status)
+}
+
+//reads the field at the start of msg, returning its number, the value
+// of a length delimited field or the bytes of any other, and the rest
+func protoField(msg []byte) (uint64, []byte, []byte) {
+	key, k := binary.Uvarint(msg)
+	msg = msg[k:]
+	switch key & 7 {
+	case 0:
+		_, k = binary.Uvarint(msg)
+		return key >> 3, msg[:k], msg[k:]
+	case 1:
+		return key >> 3, msg[:8], msg[8:]
+	}
+	l, k := binary.Uvarint(msg)
+	return key >> 3, msg[k : k+int(l)], msg[k+int(l):]
+}
+
+func decodePushedMetric(msg []byte) pushedMetric {
+	m := pushedMetric{labels: map[string]string{}}
+	for len(msg) > 0 {
+		var field uint64
+		var v []byte
+		field, v, msg = protoField(msg)
+		n, _ := binary.Uvarint(v)
+		switch field {
+		case 1:
+			m.timestamp = n
+		case 2:
+			m.name = string(v)
+		case 3:
+			m.kind = n
+		case 4:
+			m.value = math.Float64frombits(binary.LittleEndian.Uint64(v))
+		case 5:
+			_, key, rest := protoField(v)
+			_, value, _ := protoField(rest)
+			m.labels[string(key)] = string(value)
+		case 6:
+			m.count = n
+		}
+	}
+	return m
+}
+
+func TestGRPCPush(t *testing.T) {
+	bus := &metricsBus{failures: 1}
+	srv := httptest.NewUnstartedServer(bus)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			bus.lock.Lock()
+			bus.conns++
+			bus.lock.Unlock()
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	p := NewGRPCPush(srv.Listener.Addr().String())
+	p.minBackoff = 20 * time.Millisecond
+	at := time.Unix(1400000000, 500000000)
+	labels := map[string]string{"dc": "east", "role": "master"}
+	write := func(j *JSONWriter) {
+		j.Counter("mysqlstat.Queries", 1<<60+1, 3.5)
+		j.Gauge("mysqlstat.Uptime", 60.5)
+		j.Gauge("mysqlstat.Unset", math.NaN())
+	}
+	if err := p.Push(at, labels, write); err == nil || !strings.Contains(err.Error(), "status 14") {
+		t.Fatal("expected the first push to fail with UNAVAILABLE, got", err)
+	}
+	//still backing off
+	if err := p.Push(at, labels, write); err == nil || !strings.Contains(err.Error(), "waiting to reconnect") {
+		t.Error("expected to wait before reconnecting")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := p.Push(at, labels, write); err != nil {
+		t.Fatal(err)
+	}
+	if p.backoff != 0 {
+		t.Error("expected backoff to be reset after reconnecting")
+	}
+	expected := []pushedMetric{
+		{1400000000500, "mysqlstat.Queries", 1, float64(1<<60 + 1), labels, 1<<60 + 1},
+		{1400000000500, "mysqlstat.Uptime", 0, 60.5, labels, 0},
+	}
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	if !reflect.DeepEqual(bus.metrics, expected) {
+		t.Error("unexpected metrics: " + fmt.Sprint(bus.metrics))
+	}
+	if bus.conns != 2 {
+		t.Error("expected a new connection after the failed push, got connections:", bus.conns)
+	}
+}
+
+//a driver whose connections are slow to answer a ping
+type slowDriver struct{}
+type slowConn struct{}
+
+func (slowDriver) Open(name string) (driver.Conn, error) { return slowConn{}, nil }
+
+func (slowConn) Prepare(query string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (slowConn) Close() error                              { return nil }
+func (slowConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+func (slowConn) Ping(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(300 * time.Millisecond):
+		return nil
+	}
+}
+
+func init() { sql.Register("slowmysql", slowDriver{}) }
+
+func TestPing(t *testing.T) {
+	db, err := sql.Open("slowmysql", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := &mysqlDB{db: db}
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = database.Ping(ctx)
+	if err != context.DeadlineExceeded {
+		t.Error("expected the ping to time out, got:", err)
+	}
+	if time.Since(start) > 200*time.Millisecond {
+		t.Error("ping didn't stop when the context was done")
+	}
+
+	if err := database.Ping(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+//a driver whose connections hang on queries with SLEEP in them until
+// they are abandoned, and record the queries they are told to kill
+type hangDriver struct{}
+type hangConn struct{}
+type hangRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+var (
+	hangLock   sync.Mutex
+	hangKilled []string
+)
+
+func (hangDriver) Open(name string) (driver.Conn, error) { return hangConn{}, nil }
+
+func (hangConn) Prepare(query string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (hangConn) Close() error                              { return nil }
+func (hangConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+func (hangConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if query == "SELECT CONNECTION_ID();" {
+		return &hangRows{[]string{"id"}, [][]driver.Value{{"42"}}}, nil
+	}
+	if strings.Contains(query, "SLEEP") {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return &hangRows{[]string{"Value"}, [][]driver.Value{{"1"}}}, nil
+}
+
+func (hangConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	hangLock.Lock()
+	hangKilled = append(hangKilled, query)
+	hangLock.Unlock()
+	return driver.ResultNoRows, nil
+}
+
+func (r *hangRows) Columns() []string { return r.columns }
+func (r *hangRows) Close() error      { return nil }
+func (r *hangRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func init() { sql.Register("hangmysql", hangDriver{}) }
+
+// Test a query running past the timeout is given up on, killed on the
+// server and its connection returned to the pool
+func TestQueryTimeout(t *testing.T) {
+	db, err := sql.Open("hangmysql", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := &mysqlDB{db: db}
+	defer database.Close()
+	database.SetMaxConnections(1)
+	database.SetQueryTimeout(30 * time.Millisecond)
+
+	start := time.Now()
+	_, err = database.QueryReturnColumnDict("SELECT SLEEP(600);")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected the query to time out, got:", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("the query didn't stop at the timeout")
+	}
+	hangLock.Lock()
+	killed := append([]string(nil), hangKilled...)
+	hangLock.Unlock()
+	if len(killed) != 1 || killed[0] != "KILL QUERY 42" {
+		t.Errorf("expected the query killed on its connection, got %q", killed)
+	}
+	if inUse := db.Stats().InUse; inUse != 0 {
+		t.Error("expected the connection back in the pool, in use:", inUse)
+	}
+
+	//other queries still run on the one connection allowed
+	res, err := database.QueryReturnColumnDict("SELECT 1 AS Value;")
+	if err != nil || len(res["Value"]) != 1 || res["Value"][0] != "1" {
+		t.Error("expected the next query to run, got:", res, err)
+	}
+}
+
+//a driver whose connections are lost on the first lostAfter queries
+type lostDriver struct{}
+type lostConn struct{}
+
+var (
+	lostLock    sync.Mutex
+	lostQueries int
+)
+
+const lostAfter = 2
+
+func (lostDriver) Open(name string) (driver.Conn, error) { return lostConn{}, nil }
+
+func (lostConn) Prepare(query string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (lostConn) Close() error                              { return nil }
+func (lostConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+func (lostConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	lostLock.Lock()
+	lostQueries++
+	lost := lostQueries <= lostAfter
+	lostLock.Unlock()
+	if lost {
+		return nil, &mysql.MySQLError{Number: 2013, Message: "Lost connection to MySQL server during query"}
+	}
+	return &hangRows{[]string{"Value"}, [][]driver.Value{{"1"}}}, nil
+}
+
+func init() { sql.Register("lostmysql", lostDriver{}) }
+
+// Test a query that lost its connection is retried on the same pool, so
+// queries other getters have running on it aren't cut off
+func TestReconnectSamePool(t *testing.T) {
+	db, err := sql.Open("lostmysql", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := &mysqlDB{db: db, dsnString: "lost"}
+	defer database.Close()
+	res, err := database.QueryReturnColumnDict("SELECT 1 AS Value;")
+	if err != nil || len(res["Value"]) != 1 {
+		t.Error("expected the query to be retried, got:", res, err)
+	}
+	if database.pool() != db {
+		t.Error("expected the pool to be kept")
+	}
+	if err := db.Ping(); err != nil {
+		t.Error("expected the pool to stay open, got:", err)
+	}
+}
+
+//a driver whose queries all fail
+type failDriver struct{}
+type failConn struct{}
+
+func (failDriver) Open(name string) (driver.Conn, error) { return failConn{}, nil }
+
+func (failConn) Prepare(query string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (failConn) Close() error                              { return nil }
+func (failConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+func (failConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return nil, &mysql.MySQLError{Number: 1227, Message: "Access denied; you need the PROCESS privilege"}
+}
+
+func init() { sql.Register("failmysql", failDriver{}) }
+
+// Test a failed query is an error, not an empty result
+func TestQueryMapFirstColumnToRowError(t *testing.T) {
+	db, err := sql.Open("failmysql", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := &mysqlDB{db: db}
+	defer database.Close()
+	res, err := database.QueryMapFirstColumnToRow("SHOW GLOBAL STATUS;")
+	if err == nil || !strings.Contains(err.Error(), "1227") {
+		t.Error("expected the query's error, got:", res, err)
+	}
+}
+
+func TestNewFromDB(t *testing.T) {
+	db, err := sql.Open("slowmysql", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	database := NewFromDB(db)
+	if err := database.Ping(context.Background()); err != nil {
+		t.Error(err)
+	}
+	database.Close()
+	//still open for the caller
+	if err := db.Ping(); err != nil {
+		t.Error("expected the caller's db to stay open, got:", err)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	config, err := Options{}.tlsConfig()
+	if config != nil || err != nil {
+		t.Error("expected no TLS settings by default")
+	}
+	config, err = Options{TLSMinVersion: "1.3"}.tlsConfig()
+	if err != nil || config.MinVersion != tls.VersionTLS13 {
+		t.Error("expected a minimum of TLS 1.3, got:", config, err)
+	}
+	//ciphers alone still refuse 1.0 and 1.1
+	config, err = Options{TLSCiphers: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, " +
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}.tlsConfig()
+	if err != nil || config.MinVersion != tls.VersionTLS12 || len(config.CipherSuites) != 2 ||
+		config.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Error("unexpected TLS settings:", config, err)
+	}
+	for _, opts := range []Options{
+		{TLSMinVersion: "1.0"},
+		{TLSMinVersion: "1.1"},
+		{TLSCiphers: "TLS_RSA_WITH_RC4_128_SHA"},
+	} {
+		if _, err := opts.tlsConfig(); err == nil {
+			t.Error("expected an error for", opts.TLSMinVersion+opts.TLSCiphers)
+		}
+	}
+
+	dsn := makeDsn(map[string]string{"user": "root", "host": "tcp(db1:3306)", "dbname": "information_schema",
+		"tls": tlsConfigName})
+	if !strings.Contains(dsn, "&tls="+tlsConfigName) {
+		t.Error("expected the dsn to name the TLS settings, got: " + dsn)
+	}
+}
+
+func TestTarget(t *testing.T) {
+	tests := []struct {
+		user, host, expected string
+	}{
+		{"monitor", "tcp(db1.example.com:3306)", "monitor@tcp(db1.example.com:3306)"},
+		{"", "unix(/var/lib/mysql/mysql.sock)", "root@unix(/var/lib/mysql/mysql.sock)"},
+		{"monitor", "", "monitor@localhost"},
+		//a dsn pasted as the host
+		{"monitor", "monitor:s3cret@tcp(db1:3306)", "monitor@tcp(db1:3306)"},
+	}
+	for _, test := range tests {
+		if result := TargetName(test.user, test.host); result != test.expected {
+			t.Error("Incorrect result, expected: " + test.expected + " but got: " + result)
+		}
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected Target
+		address  string
+	}{
+		{"", Target{Host: "127.0.0.1", Port: 3306}, "tcp(127.0.0.1:3306)"},
+		{"db1.example.com", Target{Host: "db1.example.com", Port: 3306}, "tcp(db1.example.com:3306)"},
+		{"db1:3307", Target{Host: "db1", Port: 3307}, "tcp(db1:3307)"},
+		{":3307", Target{Host: "127.0.0.1", Port: 3307}, "tcp(127.0.0.1:3307)"},
+		{"monitor@db1:3307/app", Target{Host: "db1", Port: 3307, User: "monitor", DB: "app"}, "tcp(db1:3307)"},
+		{"tcp(db1:3306)", Target{Host: "db1", Port: 3306}, "tcp(db1:3306)"},
+		{"monitor@tcp(10.0.0.5:3306)/app", Target{Host: "10.0.0.5", Port: 3306, User: "monitor", DB: "app"}, "tcp(10.0.0.5:3306)"},
+		{"[::1]:3307", Target{Host: "::1", Port: 3307}, "tcp([::1]:3307)"},
+		{"[::1]", Target{Host: "::1", Port: 3306}, "tcp([::1]:3306)"},
+		{"::1", Target{Host: "::1", Port: 3306}, "tcp([::1]:3306)"},
+		{"/var/run/mysqld/mysqld.sock", Target{Socket: "/var/run/mysqld/mysqld.sock"}, "unix(/var/run/mysqld/mysqld.sock)"},
+		{"root@unix(/tmp/mysql.sock)/app", Target{Socket: "/tmp/mysql.sock", User: "root", DB: "app"}, "unix(/tmp/mysql.sock)"},
+		//a dsn pasted as the target keeps its password out
+		{"monitor:s3cret@tcp(db1:3306)/", Target{Host: "db1", Port: 3306, User: "monitor"}, "tcp(db1:3306)"},
+	}
+	for _, test := range tests {
+		result, err := ParseTarget(test.in)
+		if err != nil {
+			t.Error(test.in + ": " + err.Error())
+			continue
+		}
+		if result != test.expected {
+			t.Errorf("%q: expected %+v but got %+v", test.in, test.expected, result)
+		}
+		if address := result.Address(); address != test.address {
+			t.Error(test.in + ": expected address " + test.address + " but got " + address)
+		}
+	}
+	for _, in := range []string{"db1:port", "db1:0", "db1:70000", "tcp(db1:3306", "unix()", "tcp(db1:3306)app"} {
+		if _, err := ParseTarget(in); err == nil {
+			t.Error("expected an error parsing " + strconv.Quote(in))
+		}
+	}
+}
+
+func TestNormalizeDSN(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"/", "tcp(127.0.0.1:3306)/information_schema"},
+		{"monitor:@tcp(db1.example.com)/", "monitor:@tcp(db1.example.com:3306)/information_schema"},
+		{"monitor:s3cret@tcp(db1:3307)/app?timeout=5s", "monitor:s3cret@tcp(db1:3307)/app?timeout=5s"},
+		{"monitor@tcp/app", "monitor@tcp(127.0.0.1:3306)/app"},
+		{"root@unix(/var/run/mysqld/mysqld.sock)/", "root@unix(/var/run/mysqld/mysqld.sock)/information_schema"},
+		//the password may have an @ or a /
+		{"monitor:p@ss/word@tcp([::1])/?charset=utf8mb4", "monitor:p@ss/word@tcp([::1]:3306)/information_schema?charset=utf8mb4"},
+	}
+	for _, test := range tests {
+		result, err := normalizeDSN(test.in)
+		if err != nil {
+			t.Error(test.in + ": " + err.Error())
+			continue
+		}
+		if result != test.expected {
+			t.Error(test.in + ": expected " + test.expected + " but got " + result)
+		}
+	}
+	for _, in := range []string{"db1:3306", "monitor@db1:3306/app", "tcp(db1:3306", "unix()/app",
+		"tcp(db1:port)/", "monitor:s3cret@tcp(db1)/app?timeout=%zz"} {
+		_, err := normalizeDSN(in)
+		if !errors.Is(err, ErrInvalidDSN) {
+			t.Errorf("%q: expected an invalid dsn error, got %v", in, err)
+			continue
+		}
+		if strings.Contains(err.Error(), "s3cret") {
+			t.Error("expected the password left out of " + err.Error())
+		}
+	}
+}
+
+// Test a malformed dsn fails differently from a server that refuses the
+// connection
+func TestNewDSN(t *testing.T) {
+	if _, err := NewDSN("monitor@db1:3306"); !errors.Is(err, ErrInvalidDSN) {
+		t.Errorf("expected an invalid dsn error, got %v", err)
+	}
+	_, err := NewDSN("monitor@tcp(127.0.0.1:1)/")
+	if err == nil || errors.Is(err, ErrInvalidDSN) {
+		t.Errorf("expected a connection error, got %v", err)
+	}
+	if name := DSNTargetName("monitor:s3cret@tcp(db1:3306)/app"); name != "monitor@tcp(db1:3306)" {
+		t.Error("expected the dsn named without its password, got " + name)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err   error
+		class ErrorClass
+	}{
+		{&mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}, ErrorTransient},
+		{&mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}, ErrorTransient},
+		{&mysql.MySQLError{Number: 1142, Message: "SELECT command denied to user 'monitor'@'localhost' for table 'user'"}, ErrorPrivilege},
+		{&mysql.MySQLError{Number: 1227, Message: "Access denied; you need the PROCESS privilege"}, ErrorPrivilege},
+		{&mysql.MySQLError{Number: 2013, Message: "Lost connection to MySQL server during query"}, ErrorConnectionLost},
+		{mysql.ErrInvalidConn, ErrorConnectionLost},
+		{driver.ErrBadConn, ErrorConnectionLost},
+		{&mysql.MySQLError{Number: 1146, Message: "Table 'performance_schema.error_log' doesn't exist"}, ErrorUnsupported},
+		{&mysql.MySQLError{Number: 1064, Message: "You have an error in your SQL syntax"}, ErrorFatal},
+		//errors passed on as strings are classified by their number
+		{errors.New("Error 1109: Unknown table 'QUERY_RESPONSE_TIME' in information_schema"), ErrorUnsupported},
+		{fmt.Errorf("GetAccounts: %w", &mysql.MySQLError{Number: 1045, Message: "Access denied"}), ErrorPrivilege},
+		{errors.New("something else"), ErrorFatal},
+	}
+	for _, test := range tests {
+		if class := ClassifyError(test.err); class != test.class {
+			t.Error("expected class " + strconv.Itoa(int(test.class)) + " for " + test.err.Error() +
+				", got " + strconv.Itoa(int(class)))
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	line := "Error 1045: Access denied for user 'monitor'@'10.1.2.3' (using password: YES)"
+
+	database := &mysqlDB{}
+	database.Log(line)
+	if !strings.Contains(buf.String(), "'monitor'@'10.1.2.3'") {
+		t.Error("expected the line unchanged without redaction, got: " + buf.String())
+	}
+
+	buf.Reset()
+	database.redact = true
+	database.Log(line)
+	if strings.Contains(buf.String(), "10.1.2.3") || strings.Contains(buf.String(), "monitor") ||
+		!strings.Contains(buf.String(), "Access denied for user 'redacted-") {
+		t.Error("expected the account to be masked, got: " + buf.String())
+	}
+
+	tests := []struct {
+		line, hidden string
+	}{
+		{"dial tcp 192.168.0.10:3306: connection refused", "192.168.0.10"},
+		{"connecting to tcp(db1.example.com:3306)", "db1.example.com"},
+		{"client fe80::1ff:fe23:4567:890a disconnected", "fe80::1ff:fe23:4567:890a"},
+		{"client ::1 disconnected", "::1"},
+		{"dial tcp: lookup db1.internal: no such host", "db1.internal"},
+		{"dial tcp: lookup db1.internal on 10.0.0.2:53: server misbehaving", "db1.internal"},
+		{"dial tcp db1:3306: i/o timeout", "db1:"},
+	}
+	for _, test := range tests {
+		if result := Redact(test.line); strings.Contains(result, test.hidden) ||
+			!strings.Contains(result, "redacted-") {
+			t.Error("expected " + test.hidden + " to be masked, got: " + result)
+		}
+	}
+	//the same value hashes the same way, and times are left alone
+	if Redact("10.1.2.3") != Redact("10.1.2.3") || Redact("10.1.2.3") == Redact("10.1.2.4") {
+		t.Error("expected stable, distinct hashes")
+	}
+	if result := Redact("took 12:34:56"); result != "took 12:34:56" {
+		t.Error("expected times to be left alone, got: " + result)
+	}
+}
+
+//tests converting sizes and times to the units set for output
+func TestUnits(t *testing.T) {
+	for _, c := range []struct {
+		bytes, time string
+		v           float64
+		unit        string
+		expected    float64
+	}{
+		{"MB", "", 3 << 20, UnitBytes, 3},
+		{"GB", "", 512 << 20, UnitBytes, 0.5},
+		{"KB", "", 2048, UnitBytes, 2},
+		{"", "", 2048, UnitBytes, 2048},
+		{"", "ms", 1.5, UnitSeconds, 1500},
+		{"", "s", 250, UnitMilliseconds, 0.25},
+		{"", "s", 90, UnitSeconds, 90},
+		{"MB", "ms", 42, "", 42},
+	} {
+		u, err := ParseUnits(c.bytes, c.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := u.Convert(c.v, c.unit); got != c.expected {
+			t.Error("converting " + FormatValue(c.v, 5) + " " + c.unit + " to " + c.bytes + c.time +
+				": expected " + FormatValue(c.expected, 5) + " but got " + FormatValue(got, 5))
+		}
+	}
+	if _, err := ParseUnits("TB", ""); err == nil {
+		t.Error("expected an error for an unknown byte unit")
+	}
+	if _, err := ParseUnits("", "min"); err == nil {
+		t.Error("expected an error for an unknown time unit")
+	}
+}
+
+//tests formatting of metric values for output
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		val       float64
+		precision int
+		expected  string
+	}{
+		{1111, 5, "1111"},
+		{0, 5, "0"},
+		{-1, 5, "-1"},
+		{134201344, 0, "134201344"},
+		{0.5, 5, "0.50000"},
+		{0.123456789, 8, "0.12345679"},
+		{31.003152, 2, "31.00"},
+		{2.5, 0, "2"},
+	}
+	for _, test := range tests {
+		result := FormatValue(test.val, test.precision)
+		if result != test.expected {
+			t.Error("Incorrect result, expected: " + test.expected + " but got: " + result)
+		}
+	}
+}
+
+//the streamed list holds the same records as encoding them all at once,
+// as the metric context's EncodeJSON did before output was streamed
+func TestJSONWriterBuffered(t *testing.T) {
+	type record struct {
+		Type  string   `json:"type"`
+		Name  string   `json:"name"`
+		Value float64  `json:"value"`
+		Rate  *float64 `json:"rate,omitempty"`
+	}
+	var buffered []record
+	var buf bytes.Buffer
+	j := NewJSONWriter(&buf)
+	for i := 0; i < 500; i++ {
+		name := "mysqlstat.m" + strconv.Itoa(i)
+		switch i % 3 {
+		case 0:
+			rate := float64(i) / 7
+			j.Counter(name, uint64(i*1000), rate)
+			buffered = append(buffered, record{"counter", name, float64(i * 1000), &rate})
+		case 1:
+			j.Gauge(name, float64(i)/3)
+			buffered = append(buffered, record{Type: "gauge", Name: name, Value: float64(i) / 3})
+		default:
+			//not collected, so in neither
+			j.Gauge(name, math.NaN())
+		}
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(buffered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode := func(b []byte) []map[string]interface{} {
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		var records []map[string]interface{}
+		if err := d.Decode(&records); err != nil {
+			t.Fatal("output is not valid JSON: " + err.Error())
+		}
+		for _, rec := range records {
+			for k, v := range rec {
+				if n, ok := v.(json.Number); ok {
+					f, _ := n.Float64()
+					rec[k] = f
+				}
+			}
+		}
+		return records
+	}
+	if streamed, want := decode(buf.Bytes()), decode(encoded); !reflect.DeepEqual(streamed, want) {
+		t.Errorf("streamed records differ from the buffered ones:\n%v\n%v", streamed, want)
+	}
+}
+
+func TestJSONWriter(t *testing.T) {
+	var buf bytes.Buffer
+	j := NewJSONWriter(&buf)
+	j.Counter("mysqlstat.Queries", 9342251, 31.003152)
+	j.Counter("mysqlstat.Questions", 10, math.NaN())
+	j.Gauge("mysqlstat.a\"quoted\".name", -1)
+	j.Gauge("mysqlstat.Unset", math.NaN())
+	if err := j.Close(); err != nil {
+		t.Error(err)
+	}
+	var result []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatal("output is not valid JSON: " + err.Error())
+	}
+	expected := []map[string]interface{}{
+		{"type": "counter", "name": "mysqlstat.Queries", "value": float64(9342251), "rate": 31.003152},
+		{"type": "counter", "name": "mysqlstat.Questions", "value": float64(10), "rate": float64(0)},
+		{"type": "gauge", "name": "mysqlstat.a\"quoted\".name", "value": float64(-1)},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Error("Incorrect result, got: " + buf.String())
+	}
+
+	buf.Reset()
+	if err := NewJSONWriter(&buf).Close(); err != nil || buf.String() != "[]\n" {
+		t.Error("expected empty list, got: " + buf.String())
+	}
+
+	//the first record of a name is kept
+	buf.Reset()
+	j = NewJSONWriter(&buf)
+	j.Gauge("mysqlstat.Uptime", 60)
+	j.Counter("mysqlstat.Uptime", 1, 0)
+	j.Close()
+	if strings.Count(buf.String(), "mysqlstat.Uptime") != 1 || !strings.Contains(buf.String(), "60") ||
+		!reflect.DeepEqual(j.Duplicates(), []string{"mysqlstat.Uptime"}) {
+		t.Error("expected the duplicate to be dropped, got: " + buf.String())
+	}
+}
+
+//after the connection is lost and reopened by queryDb,
+// the new pool keeps the dsn and pool settings of the old one
+func TestReconnect(t *testing.T) {
+	dsn := makeDsn(map[string]string{"user": "root", "host": "tcp(127.0.0.1:1)"})
+	database := &mysqlDB{dsnString: dsn}
+	if err := database.connect(); err != nil {
+		t.Fatal(err)
+	}
+	database.SetMaxConnections(3)
+	old := database.db
+	old.Close()
+
+	if _, _, err := database.queryDb("SELECT 1"); err == nil {
+		t.Error("expected query against unreachable server to fail")
+	}
+	if database.db == old {
+		t.Error("expected connection pool to be reopened")
+	}
+	if database.dsnString != dsn || !strings.Contains(database.dsnString, "timeout=30s") {
+		t.Error("dsn not preserved, got: " + database.dsnString)
+	}
+	if database.db.Stats().MaxOpenConnections != 3 {
+		t.Error("max connections not preserved after reconnect")
+	}
+	database.Close()
+}
+
+func TestPoolStats(t *testing.T) {
+	dsn := makeDsn(map[string]string{"user": "root", "host": "tcp(127.0.0.1:1)"})
+	database := &mysqlDB{dsnString: dsn}
+	if err := database.connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	database.SetMaxConnections(2)
+	stats := database.Stats()
+	if stats.MaxOpenConnections != 2 || stats.InUse != 0 || stats.WaitCount != 0 {
+		t.Error("unexpected stats for an unused pool: " + fmt.Sprint(stats))
+	}
+}
+
+//records an error as a getter would
+func (g *GetterErrors) GetSomething(err error) string {
+	return g.Record(err)
+}
+
+func TestGetterErrors(t *testing.T) {
+	var g GetterErrors
+	if g.Err() != nil || g.Total() != 0 {
+		t.Error("expected no errors before any are recorded")
+	}
+	if name := g.GetSomething(errors.New("boom")); name != "GetSomething" {
+		t.Error("expected the error recorded against GetSomething, got " + name)
+	}
+	g.Record(errors.New("lost"))
+	expected := "collection failed: GetSomething: boom; unknown: lost"
+	if g.Err() == nil || g.Err().Error() != expected {
+		t.Error("Incorrect result, expected: " + expected + " but got: " + fmt.Sprint(g.Err()))
+	}
+	//the total outlives the collection
+	g.Reset()
+	if len(g.Last()) != 0 || g.Err() != nil || g.Total() != 2 {
+		t.Error("unexpected errors after Reset: " + fmt.Sprint(g.Last(), g.Total()))
+	}
+}
+
+func TestPingError(t *testing.T) {
+	unknown := &mysql.MySQLError{Number: 1049, Message: "Unknown database 'shop'"}
+	err := pingError(fmt.Errorf("ping: %w", unknown), "shop")
+	if !strings.HasPrefix(err.Error(), "default database shop does not exist: ") {
+		t.Error("expected the missing database to be named, got: " + err.Error())
+	}
+	//a port that happens to be 1049 isn't a missing database
+	refused := errors.New("dial tcp 10.0.0.5:1049: connect: connection refused")
+	if err := pingError(refused, "shop"); err != refused {
+		t.Error("expected the error to be returned as it is, got: " + err.Error())
+	}
+}
+
+func TestNameSanitizerRules(t *testing.T) {
+	tests := []struct {
+		policy   NamePolicy
+		parts    []string
+		expected string
+	}{
+		{NamesRaw, []string{"db1", "my table.v2"}, "db1.my table.v2"},
+		{NamesGraphite, []string{"db1", "my table.v2"}, "db1.my_table_v2"},
+		{NamesGraphite, []string{"shop-eu", "orders/2026"}, "shop-eu.orders_2026"},
+		{NamesPrometheus, []string{"shop-eu", "orders.2026"}, "shop_eu_orders_2026"},
+		{NamesPrometheus, []string{"2026db", "t:1"}, "_2026db_t:1"},
+		{NamesPrometheus, []string{"db1", "t-&-1"}, "db1_t_1"},
+	}
+	for _, test := range tests {
+		result := NewNameSanitizer(test.policy).Path(test.parts...)
+		if result != test.expected {
+			t.Error("Incorrect result, expected: " + test.expected + " but got: " + result)
+		}
+	}
+}
+
+func TestNameSanitizerCollisions(t *testing.T) {
+	n := NewNameSanitizer(NamesGraphite)
+	first := n.Path("db1", "a.b")
+	second := n.Path("db1", "a_b")
+	third := n.Path("db1", "a-b")
+	fourth := n.Path("db1", "a b")
+	if first != "db1.a_b" || second != "db1.a_b_2" || third != "db1.a-b" || fourth != "db1.a_b_3" {
+		t.Error("unexpected names: " + first + ", " + second + ", " + third + ", " + fourth)
+	}
+	//the same source keeps its name
+	if n.Path("db1", "a_b") != second || n.Path("db1", "a.b") != first {
+		t.Error("names changed between calls")
+	}
+	//tables in different databases don't collide
+	if n.Path("db2", "a_b") != "db2.a_b" {
+		t.Error("unexpected suffix for table in another database")
+	}
+}
+
 //test that the correct data is returned,
 // as well as test that the ordering is preserved
 func TestMakeQuery1(t *testing.T) {
 	testdb := initDB(t)
 	defer testdb.db.Close()
 
-	cols, data, err := testdb.makeQuery("SELECT name FROM people;")
+	cols, data, err := testdb.makeQuery(testdb.db, "SELECT name FROM people;")
 	if err != nil {
 		t.Error(err)
 	}
@@ -142,7 +1943,7 @@ func TestMakeQuery2(t *testing.T) {
 	testdb := initDB(t)
 	defer testdb.db.Close()
 
-	cols, data, err := testdb.makeQuery("SELECT name, age FROM people;")
+	cols, data, err := testdb.makeQuery(testdb.db, "SELECT name, age FROM people;")
 	if err != nil {
 		t.Error(err)
 	}
@@ -287,17 +2088,20 @@ I/O thread 0 state: waiting for i/o request (insert buffer thread)
 I/O thread 9 state: waiting for i/o request (write thread)
 Pending normal aio reads: 0 [0, 0, 0, 0] , aio writes: 0 [0, 0, 0, 0] ,
  ibuf aio reads: 0, log i/o's: 0, sync i/o's: 0
-Pending flushes (fsync) log: 0; buffer pool: 0
+Pending flushes (fsync) log: 2; buffer pool: 7
 1597 OS file reads, 423166 OS file writes, 367474 OS fsyncs
 0.00 reads/s, 0 avg bytes/read, 1.48 writes/s, 0.89 fsyncs/s`
 	idb.parseFileIO(blob)
 	expectedValues := map[string]string{
-		"OS_file_reads":      "1597",
-		"OS_file_writes":     "423166",
-		"reads_per_s":        "0.00",
-		"avg_bytes_per_read": "0",
-		"writes_per_s":       "1.48",
-		"fsyncs_per_s":       "0.89",
+		"OS_file_reads":              "1597",
+		"OS_file_writes":             "423166",
+		"reads_per_s":                "0.00",
+		"avg_bytes_per_read":         "0",
+		"writes_per_s":               "1.48",
+		"fsyncs_per_s":               "0.89",
+		"OS_fsyncs":                  "367474",
+		"pending_fsyncs_log":         "2",
+		"pending_fsyncs_buffer_pool": "7",
 	}
 	for key, val := range expectedValues {
 		if idb.Metrics[key] != val {
@@ -388,6 +2192,7 @@ I/O sum[42]:cur[0], unzip sum[0]:cur[0]`
 		"database_pages":              "7165",
 		"old_database_pages":          "2624",
 		"modified_db_pages":           "1",
+		"pending_reads":               "2",
 		"pending_writes_lru":          "3",
 		"pages_made_young":            "856",
 		"buffer_pool_hit_rate":        "1",
@@ -446,6 +2251,7 @@ I/O sum[42]:cur[0], unzip sum[0]:cur[0]`
 		"database_pages":              "7165",
 		"old_database_pages":          "2624",
 		"modified_db_pages":           "1",
+		"pending_reads":               "2",
 		"pending_writes_lru":          "3",
 		"pages_made_young":            "856",
 		"buffer_pool_hit_rate":        "0.5",
@@ -458,6 +2264,50 @@ I/O sum[42]:cur[0], unzip sum[0]:cur[0]`
 	}
 }
 
+func TestParseBufferPoolLists(t *testing.T) {
+	idb := new(InnodbStats)
+	idb.Metrics = make(map[string]string)
+	blob := `
+Total large memory allocated 2198863872
+Dictionary memory allocated 1372558
+Buffer pool size   131056
+Free buffers       8192
+Database pages     120418
+Old database pages 44430
+Modified db pages  3120
+Pending reads      0
+Pending writes: LRU 0, flush list 2, single page 0
+Pages made young 4021, not young 0
+0.00 youngs/s, 0.00 non-youngs/s
+Pages read 98211, created 22207, written 310922
+0.00 reads/s, 0.00 creates/s, 12.98 writes/s
+Buffer pool hit rate 999 / 1000, young-making rate 0 / 1000 not 0 / 1000
+Pages read ahead 0.00/s, evicted without access 0.00/s, Random read ahead 0.00/s
+LRU len: 120418, unzip_LRU len: 0
+I/O sum[2040]:cur[8], unzip sum[0]:cur[0]
+----------------------
+INDIVIDUAL BUFFER POOL INFO
+----------------------
+---BUFFER POOL 0
+Buffer pool size   65528
+Free buffers       4096
+Database pages     60209
+Old database pages 22215
+Modified db pages  1560
+LRU len: 60209, unzip_LRU len: 0`
+	idb.parseBufferPoolAndMem(blob)
+	expectedValues := map[string]string{
+		"lru_len":           "120418",
+		"modified_db_pages": "3120",
+		"flush_list_len":    "3120",
+	}
+	for key, val := range expectedValues {
+		if idb.Metrics[key] != val {
+			t.Error(key + " not parsed correctly. Expected: " + val + ", Got: " + idb.Metrics[key])
+		}
+	}
+}
+
 func TestParseTransactions(t *testing.T) {
 	idb := new(InnodbStats)
 	idb.Metrics = make(map[string]string)